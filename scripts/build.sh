@@ -9,16 +9,22 @@ fi
 ref_signer="$PWD/external/c-reference-signer"
 
 mkdir -p "$OUT"/{headers,bin}
-rm -f "$OUT"/libmina_signer.so # Otherwise re-building without clean causes permissions issue
-if [[ "$LIB_MINA_SIGNER" == "" ]]; then
-  # No nix
-  cp -R "$ref_signer" "$OUT"
-  make -C "$OUT/c-reference-signer" clean libmina_signer.so
-  cp "$OUT/c-reference-signer/libmina_signer.so" "$OUT"
+if [[ "$PURE_GO_SIGNER" == "1" ]]; then
+  # Signatures are verified in Go, no C library is needed
+  export CGO_ENABLED=0
+  GO_TAGS="-tags=puregosigner"
 else
-  cp "$LIB_MINA_SIGNER" "$OUT"/libmina_signer.so
+  rm -f "$OUT"/libmina_signer.so # Otherwise re-building without clean causes permissions issue
+  if [[ "$LIB_MINA_SIGNER" == "" ]]; then
+    # No nix
+    cp -R "$ref_signer" "$OUT"
+    make -C "$OUT/c-reference-signer" clean libmina_signer.so
+    cp "$OUT/c-reference-signer/libmina_signer.so" "$OUT"
+  else
+    cp "$LIB_MINA_SIGNER" "$OUT"/libmina_signer.so
+  fi
+  cp "$ref_signer"/*.h "$OUT/headers"
 fi
-cp "$ref_signer"/*.h "$OUT/headers"
 
 case "$1" in
   db-migrate-up)
@@ -31,7 +37,7 @@ case "$1" in
     ;;
   test)
     cd src/delegation_backend
-    LD_LIBRARY_PATH="$OUT" $GO test
+    LD_LIBRARY_PATH="$OUT" $GO test $GO_TAGS
     ;;
   integration-test)
     cd src/integration_tests
@@ -48,8 +54,12 @@ case "$1" in
     ;;
   "")
     cd src/cmd/delegation_backend
-    $GO build -o "$OUT/bin/delegation_backend"
-    echo "to run use cmd: LD_LIBRARY_PATH=result ./result/bin/delegation_backend"
+    $GO build $GO_TAGS -o "$OUT/bin/delegation_backend"
+    if [[ "$PURE_GO_SIGNER" == "1" ]]; then
+      echo "to run use cmd: ./result/bin/delegation_backend"
+    else
+      echo "to run use cmd: LD_LIBRARY_PATH=result ./result/bin/delegation_backend"
+    fi
     ;;
   *)
     echo "unknown command $1"
@@ -4,16 +4,26 @@ import (
 	. "block_producers_uptime/delegation_backend"
 	"context"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	logging "github.com/ipfs/go-log/v2"
-	"google.golang.org/api/option"
-	sheets "google.golang.org/api/sheets/v4"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
+// Part of the service specific to one of the networks it serves
+type network struct {
+	app       *App
+	storage   StorageBackend
+	spool     *Spool
+	queue     *SaveQueue
+	limiter   *RedisRateLimiter
+	refresher *WhitelistRefresher
+}
+
 func main() {
 	// Setup logging
 	logging.SetupLogging(logging.Config{
@@ -29,133 +39,347 @@ func main() {
 	// Context and app initialization
 	ctx := context.Background()
 	appCfg := LoadEnv(log)
-	app := new(App)
-	app.IsReady = false
-	app.Log = log
-	awsctx := AwsContext{}
-	kc := KeyspaceContext{}
-	pctx := PostgreSQLContext{}
-	app.VerifySignatureDisabled = appCfg.VerifySignatureDisabled
-	if app.VerifySignatureDisabled {
+	netCfgs, err := appCfg.NetworkConfigs()
+	if err != nil {
+		log.Fatalf("Error in networks configuration: %v", err)
+	}
+	if appCfg.VerifySignatureDisabled {
 		log.Warnf("Signature verification is disabled, it is not recommended to run the delegation backend in this mode!")
 	}
-	app.NetworkId = NetworkId(appCfg.NetworkName)
 
-	// Storage backend setup
-	if appCfg.Aws != nil {
-		log.Infof("storage backend: AWS S3")
-		awsCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(appCfg.Aws.Region))
-		if err != nil {
-			log.Fatalf("Error loading AWS configuration: %v", err)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate-whitelist":
+			os.Exit(validateWhitelists(ctx, netCfgs, log))
+		default:
+			log.Fatalf("Unknown command %s, the only command supported is validate-whitelist", os.Args[1])
 		}
-		client := s3.NewFromConfig(awsCfg)
-		awsctx = AwsContext{Client: client, BucketName: aws.String(GetAWSBucketName(appCfg)), Prefix: appCfg.NetworkName, Context: ctx, Log: log}
-
 	}
 
-	if appCfg.AwsKeyspaces != nil {
-		log.Infof("storage backend: AWS Keyspaces")
-		session, err := InitializeKeyspaceSession(appCfg.AwsKeyspaces)
+	// Settings shared by every network
+	shared := new(App)
+	shared.Log = log
+	shared.VerifySignatureDisabled = appCfg.VerifySignatureDisabled
+	shared.Metrics = NewMetrics()
+	shared.Now = func() time.Time { return time.Now() }
+	shared.BlockTempDir = appCfg.BlockTempDir
+	maxAge, seenTTL := SetSubmissionMaxAge(log), SetSubmissionSeenTTL(log)
+	if maxAge > 0 || seenTTL > 0 {
+		shared.Replay = NewReplayGuard(maxAge, seenTTL)
+		shared.Metrics.RegisterReplayGuard(shared.Replay)
+		log.Infof("Max age of submissions: %v, duplicates rejected for: %v", maxAge, seenTTL)
+	}
+	if len(appCfg.TrustedProxies) > 0 || appCfg.TrustedProxyHops > 0 {
+		shared.Proxies, err = NewTrustedProxies(appCfg.TrustedProxies, appCfg.TrustedProxyHops, appCfg.TrustedProxyHeader)
 		if err != nil {
-			log.Fatalf("Error initializing Keyspace session: %v", err)
+			log.Fatalf("Error configuring trusted proxies: %v", err)
 		}
-		defer session.Close()
+		log.Infof("Trusted proxies: %v, trusted proxy hops: %d", appCfg.TrustedProxies, appCfg.TrustedProxyHops)
+	}
+	if appCfg.IPRateLimit != nil && appCfg.IPRateLimit.PerMinute > 0 {
+		shared.IPLimiter = NewIPRateLimiter(appCfg.IPRateLimit)
+		shared.Metrics.RegisterIPRateLimiter(shared.IPLimiter)
+		log.Infof("Max requests per address per minute: %d", appCfg.IPRateLimit.PerMinute)
+	}
+	if appCfg.GlobalRateLimit != nil {
+		shared.GlobalLimiter = NewGlobalLimiter(appCfg.GlobalRateLimit)
+		log.Infof("Max requests per second: %d, max concurrent requests: %d", appCfg.GlobalRateLimit.PerSecond, appCfg.GlobalRateLimit.MaxConcurrent)
+	}
+	if !shared.VerifySignatureDisabled {
+		shared.Verifier = NewSignatureVerifier(appCfg.SignatureVerifierWorkers, appCfg.SignatureCacheSize, shared.Metrics)
+	}
 
-		kc = KeyspaceContext{
-			Session:  session,
-			Keyspace: appCfg.AwsKeyspaces.Keyspace,
-			Context:  ctx,
+	// Denylist source and refresh loop, checked even with the whitelist disabled
+	var denylistRefresher *DenylistRefresher
+	denylistSource, err := NewDenylistSource(appCfg, log)
+	if err != nil {
+		log.Fatalf("Error creating denylist source: %v", err)
+	}
+	if denylistSource != nil {
+		shared.Denylist = new(DenylistMVar)
+		shared.DenyAudit = NewDenyAuditLog(DENY_AUDIT_SIZE)
+		denylistRefresher = &DenylistRefresher{
+			Source:   denylistSource,
+			Denylist: shared.Denylist,
+			Interval: DENYLIST_REFRESH_INTERVAL,
 			Log:      log,
 		}
+		if err := denylistRefresher.Refresh(ctx); err != nil {
+			log.Fatalf("Failed to initialize denylist: %v", err)
+		}
+		log.Infof("Denylist is enabled, source: %s", denylistSource.Name())
+		go denylistRefresher.Run(ctx)
+	}
 
+	networks := make([]*network, len(netCfgs))
+	apps := make([]*App, len(netCfgs))
+	for i, netCfg := range netCfgs {
+		networks[i] = setupNetwork(ctx, netCfg, shared, log)
+		apps[i] = networks[i].app
+	}
+	setReady := func(ready bool) {
+		for _, app := range apps {
+			app.IsReady.Store(ready)
+		}
 	}
 
-	if appCfg.LocalFileSystem != nil {
-		log.Infof("storage backend: Local File System")
+	// Admin API and metrics require a client certificate with a client CA
+	requireClientCert := appCfg.TLS != nil && appCfg.TLS.ClientCAFile != ""
+	ops := func(h http.Handler) http.Handler {
+		if requireClientCert {
+			return RequireClientCert(h)
+		}
+		return h
 	}
 
-	if appCfg.PostgreSQL != nil {
-		log.Infof("storage backend: PostgreSQL")
-		db, err := NewPostgreSQL(appCfg.PostgreSQL)
-		if err != nil {
-			log.Fatalf("Error initializing PostgreSQL: %v", err)
+	// HTTP handlers setup
+	http.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = rw.Write([]byte("delegation backend service"))
+	})
+	submitH := shared.Metrics.InstrumentSubmit(NewNetworksH(apps))
+	http.Handle("/v1/", submitH)
+	http.Handle("/v2/", submitH)
+	http.Handle("/metrics", ops(shared.Metrics.Handler()))
+
+	// Health check endpoint
+	http.HandleFunc("/health", HealthHandler(apps[0].IsReady.Load))
+
+	// Admin API, whitelists of networks other than the default one
+	// are managed under their own prefixes
+	if appCfg.AdminToken == "" {
+		log.Warnf("ADMIN_TOKEN is not set, admin API is disabled")
+	} else {
+		for i, n := range networks {
+			adminAPI := &AdminAPI{
+				Token:       appCfg.AdminToken,
+				Refresher:   n.refresher,
+				Overrides:   n.app.WhitelistOverrides,
+				NetworkName: n.app.NetworkName,
+				Log:         log,
+				Now:         shared.Now,
+			}
+			if i == 0 {
+				adminAPI.DenylistRefresher = denylistRefresher
+				adminAPI.DenyAudit = shared.DenyAudit
+				http.Handle(ADMIN_PATH_PREFIX, ops(adminAPI.Handler()))
+			} else {
+				adminAPI.PathPrefix = ADMIN_NETWORKS_PATH_PREFIX + n.app.NetworkName + "/"
+				http.Handle(adminAPI.PathPrefix, ops(adminAPI.Handler()))
+			}
 		}
-		defer db.Close()
+	}
 
-		pctx = PostgreSQLContext{
-			DB:  db,
-			Log: log,
+	// Start server
+	server := newServer(ctx, appCfg, log)
+	serverErr := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			// Certificate is taken from the TLS config
+			serverErr <- server.ListenAndServeTLS("", "")
+		} else {
+			serverErr <- server.ListenAndServe()
 		}
+	}()
+	setReady(true)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-serverErr:
+		log.Fatalf("HTTP server failed: %v", err)
+	case sig := <-signals:
+		log.Infof("Received %v, shutting down", sig)
 	}
 
-	app.Save = func(objs ObjectsToSave) {
-		if appCfg.Aws != nil {
-			awsctx.S3Save(objs)
+	// Make /health fail and reject new submissions, giving the load balancer
+	// some time to notice before the listener is closed
+	setReady(false)
+	time.Sleep(SetShutdownDrainDelay(log))
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, SetShutdownTimeout(log))
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Errorf("Error while waiting for in-flight requests to finish: %v", err)
+	}
+	if shared.Verifier != nil {
+		shared.Verifier.Close()
+	}
+	// Queue workers and spool drainers are stopped before the backends
+	// they save into are closed
+	for _, n := range networks {
+		if n.queue != nil {
+			if err := n.queue.Shutdown(shutdownCtx); err != nil {
+				log.Errorf("Save queue of network %s was not drained: %v", n.app.NetworkName, err)
+			}
 		}
-		if appCfg.AwsKeyspaces != nil {
-			kc.KeyspaceSave(objs)
+		if n.spool != nil {
+			if err := n.spool.Shutdown(shutdownCtx); err != nil {
+				log.Errorf("Error closing spool of network %s: %v", n.app.NetworkName, err)
+			}
 		}
-		if appCfg.PostgreSQL != nil {
-			pctx.PostgreSQLSave(objs)
+		if n.limiter != nil {
+			if err := n.limiter.Close(); err != nil {
+				log.Errorf("Error closing rate limiter of network %s: %v", n.app.NetworkName, err)
+			}
 		}
-		if appCfg.LocalFileSystem != nil {
-			LocalFileSystemSave(objs, appCfg.LocalFileSystem.Path, log)
+		if err := n.storage.Close(); err != nil {
+			log.Errorf("Error closing storage backends of network %s: %v", n.app.NetworkName, err)
 		}
 	}
+	log.Info("Delegation backend stopped")
+}
 
-	if appCfg.Aws == nil && appCfg.LocalFileSystem == nil && appCfg.AwsKeyspaces == nil {
-		log.Fatal("No storage backend configured!")
+// Creates the server listening on the configured address, with TLS
+// and HTTP/2 if configured. HTTP/2 is always supported over TLS.
+func newServer(ctx context.Context, appCfg AppConfig, log *logging.ZapEventLogger) *http.Server {
+	server := &http.Server{Addr: appCfg.ListenAddress}
+	if server.Addr == "" {
+		server.Addr = DELEGATION_BACKEND_LISTEN_TO
 	}
+	if appCfg.TLS == nil {
+		if appCfg.H2C {
+			// HTTP/2 without TLS, for proxies in front of the service speaking it
+			server.Handler = h2c.NewHandler(http.DefaultServeMux, &http2.Server{})
+		}
+		log.Infof("Listening on %s", server.Addr)
+		return server
+	}
+	if appCfg.TLS.CertFile == "" || appCfg.TLS.KeyFile == "" {
+		log.Fatal("Both TLS certificate and key files must be set")
+	}
+	certs, err := NewCertReloader(appCfg.TLS.CertFile, appCfg.TLS.KeyFile, log)
+	if err != nil {
+		log.Fatalf("Error configuring TLS: %v", err)
+	}
+	server.TLSConfig, err = NewServerTLSConfig(appCfg.TLS, certs)
+	if err != nil {
+		log.Fatalf("Error configuring TLS: %v", err)
+	}
+	go certs.Run(ctx, TLS_CERT_POLL_INTERVAL)
+	log.Infof("Listening on %s with TLS, client certificates required by admin API and metrics: %v", server.Addr, appCfg.TLS.ClientCAFile != "")
+	return server
+}
 
-	// App other configurations
-	app.Now = func() time.Time { return time.Now() }
-	requestsPerPkHourly := SetRequestsPerPkHourly(log)
-	app.SubmitCounter = NewAttemptCounter(requestsPerPkHourly)
-	log.Infof("Max requests per pk hourly: %v", requestsPerPkHourly)
+// Creates storage, rate limiter and whitelist of the network,
+// the rest of its App is shared by every network
+func setupNetwork(ctx context.Context, netCfg AppConfig, shared *App, log *logging.ZapEventLogger) *network {
+	app := new(App)
+	app.Log = shared.Log
+	app.VerifySignatureDisabled = shared.VerifySignatureDisabled
+	app.Verifier = shared.Verifier
+	app.Replay = shared.Replay
+	app.Denylist = shared.Denylist
+	app.DenyAudit = shared.DenyAudit
+	app.Metrics = shared.Metrics
+	app.Now = shared.Now
+	app.BlockTempDir = shared.BlockTempDir
+	app.IPLimiter = shared.IPLimiter
+	app.GlobalLimiter = shared.GlobalLimiter
+	app.Proxies = shared.Proxies
+	app.NetworkId = netCfg.SignatureNetworkId()
+	app.NetworkName = netCfg.NetworkName
+	app.DecodeBlocks = netCfg.BlockDecoding
+	n := &network{app: app}
+	log.Infof("Setting up network %s, network id: %v", app.NetworkName, app.NetworkId)
 
-	// HTTP handlers setup
-	http.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
-		_, _ = rw.Write([]byte("delegation backend service"))
-	})
-	http.Handle("/v1/submit", app.NewSubmitH())
+	// Storage backend setup
+	backends, err := NewStorageBackends(ctx, netCfg, log)
+	if err != nil {
+		log.Fatalf("Error initializing storage backends: %v", err)
+	}
+	if len(backends) == 0 {
+		log.Fatal("No storage backend configured!")
+	}
+	backends = InstrumentStorage(backends, app.Metrics, app.NetworkName)
+	writePolicyStr := netCfg.StorageWritePolicy
+	if writePolicyStr == "" {
+		writePolicyStr = DEFAULT_WRITE_POLICY
+	}
+	writePolicy, err := ParseWritePolicy(writePolicyStr)
+	if err != nil {
+		log.Fatalf("Error parsing storage write policy: %v", err)
+	}
+	n.storage, err = NewMultiStorage(backends, writePolicy, log)
+	if err != nil {
+		log.Fatalf("Error configuring storage write policy: %v", err)
+	}
+	app.Storage = n.storage
+	log.Infof("Storage write policy: %v", writePolicy)
 
-	// Health check endpoint
-	http.HandleFunc("/health", HealthHandler(func() bool {
-		return app.IsReady
-	}))
+	if netCfg.Spool != nil {
+		// Submissions are accepted once spooled and then replayed into every backend
+		n.spool, err = NewSpool(netCfg.Spool, backends, log)
+		if err != nil {
+			log.Fatalf("Error opening spool: %v", err)
+		}
+		n.spool.Start()
+		app.Metrics.RegisterSpool(app.NetworkName, n.spool)
+		app.Storage = n.spool
+		log.Infof("Submissions are spooled to %s", netCfg.Spool.Path)
+	} else if netCfg.SaveQueue != nil {
+		// Submissions are accepted once queued and saved in the background
+		n.queue = NewSaveQueue(netCfg.SaveQueue, backends, log)
+		n.queue.TempDir = shared.BlockTempDir
+		app.Storage = n.queue
+	}
 
-	// Sheets service and whitelist loop
-	app.WhitelistDisabled = appCfg.DelegationWhitelistDisabled
-	if app.WhitelistDisabled {
-		log.Infof("Delegation whitelist is disabled")
+	// Rate limiter
+	requestsPerPkHourly := netCfg.RequestsPerPkHourly
+	if requestsPerPkHourly <= 0 {
+		requestsPerPkHourly = SetRequestsPerPkHourly(log)
+	}
+	if netCfg.RateLimiter != nil && netCfg.RateLimiter.RedisURL != "" {
+		limiter, err := NewRedisRateLimiter(netCfg.RateLimiter, app.NetworkName, requestsPerPkHourly)
+		if err != nil {
+			log.Fatalf("Error initializing rate limiter: %v", err)
+		}
+		if err := limiter.Ping(ctx); err != nil {
+			log.Warnf("Rate limiter is not reachable yet: %v", err)
+		}
+		n.limiter = limiter
+		app.SubmitCounter = limiter
+		log.Info("Attempts are counted in Redis, shared by all replicas")
 	} else {
-		sheetsService, err2 := sheets.NewService(ctx, option.WithScopes(sheets.SpreadsheetsReadonlyScope))
-		if err2 != nil {
-			log.Fatalf("Error creating Sheets service: %v", err2)
+		var maxKeys int
+		if netCfg.RateLimiter != nil {
+			maxKeys = netCfg.RateLimiter.MaxKeys
 		}
-		initWl, err := RetrieveWhitelist(sheetsService, log, appCfg, 1)
-		if err != nil {
-			log.Fatalf("Failed to initialize whitelist: %v", err)
-		}
-		wlMvar := new(WhitelistMVar)
-		wlMvar.Replace(&initWl)
-		app.Whitelist = wlMvar
-		log.Infof("Delegation whitelist is enabled")
-		go func() {
-			for {
-				time.Sleep(SetWhitelistRefreshInterval(log))
-				wl, err := RetrieveWhitelist(sheetsService, log, appCfg, 10)
-				if err != nil {
-					log.Errorf("Failed to refresh delegation whitelist, using previous one, error: %v", err)
-				} else {
-					wlMvar.Replace(&wl)
-					log.Infof("Delegation whitelist refreshed, number of BPs: %v", len(wl))
-				}
-			}
-		}()
+		counter := NewAttemptCounter(requestsPerPkHourly, maxKeys)
+		app.Metrics.RegisterAttemptCounter(app.NetworkName, counter)
+		app.SubmitCounter = counter
+		go counter.RunSweeper(ctx, ATTEMPT_COUNTER_SWEEP_INTERVAL)
 	}
+	log.Infof("Max requests per pk hourly: %v", requestsPerPkHourly)
 
-	// Start server
-	app.IsReady = true
-	log.Fatal(http.ListenAndServe(DELEGATION_BACKEND_LISTEN_TO, nil))
+	// Whitelist source and refresh loop
+	app.WhitelistDisabled = netCfg.DelegationWhitelistDisabled
+	if app.WhitelistDisabled {
+		log.Infof("Delegation whitelist is disabled")
+		return n
+	}
+	source, err := NewWhitelistSource(ctx, netCfg, log)
+	if err != nil {
+		log.Fatalf("Error creating whitelist source: %v", err)
+	}
+	wlMvar := new(WhitelistMVar)
+	n.refresher = &WhitelistRefresher{
+		Source:           source,
+		Whitelist:        wlMvar,
+		Interval:         SetWhitelistRefreshInterval(log),
+		MaxShrinkPercent: netCfg.DelegationWhitelistMaxShrinkPercent,
+		Log:              log,
+		Metrics:          app.Metrics,
+		Network:          app.NetworkName,
+	}
+	if n.refresher.Interval <= 0 {
+		log.Fatalf("Delegation whitelist refresh interval must be positive, got %v", n.refresher.Interval)
+	}
+	if err := n.refresher.Refresh(ctx); err != nil {
+		log.Fatalf("Failed to initialize whitelist: %v", err)
+	}
+	app.Whitelist = wlMvar
+	app.WhitelistOverrides = NewWhitelistOverrides()
+	log.Infof("Delegation whitelist is enabled, source: %s", source.Name())
+	go n.refresher.Run(ctx)
+	return n
 }
@@ -0,0 +1,63 @@
+package main
+
+import (
+	. "block_producers_uptime/delegation_backend"
+	"context"
+	"encoding/json"
+	"os"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+// Validates whitelists of every network, returning the highest exit code
+// of validateWhitelist. Networks with the whitelist disabled are skipped.
+func validateWhitelists(ctx context.Context, netCfgs []AppConfig, log *logging.ZapEventLogger) int {
+	res, validated := 0, 0
+	for _, netCfg := range netCfgs {
+		if netCfg.DelegationWhitelistDisabled && len(netCfgs) > 1 {
+			continue
+		}
+		log.Infof("Validating whitelist of network %s", netCfg.NetworkName)
+		res = max(res, validateWhitelist(ctx, netCfg, log))
+		validated++
+	}
+	if validated == 0 {
+		log.Errorf("Delegation whitelist is disabled, nothing to validate")
+		return 2
+	}
+	return res
+}
+
+// Loads the whitelist from the configured source and prints the validation
+// report to stdout. Returns the exit code: 0 if every row is valid,
+// 1 if there are invalid rows and 2 if the whitelist couldn't be loaded.
+func validateWhitelist(ctx context.Context, appCfg AppConfig, log *logging.ZapEventLogger) int {
+	if appCfg.DelegationWhitelistDisabled {
+		log.Errorf("Delegation whitelist is disabled, nothing to validate")
+		return 2
+	}
+	source, err := NewWhitelistSource(ctx, appCfg, log)
+	if err != nil {
+		log.Errorf("Error creating whitelist source: %v", err)
+		return 2
+	}
+	refresher := &WhitelistRefresher{
+		Source:    source,
+		Whitelist: new(WhitelistMVar),
+		Log:       log,
+	}
+	loadErr := refresher.Refresh(ctx)
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(refresher.Report()); err != nil {
+		log.Errorf("Error writing whitelist report: %v", err)
+		return 2
+	}
+	if loadErr != nil {
+		return 2
+	}
+	if len(refresher.Report().Issues) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -76,7 +76,7 @@ func main() {
     app.Log = log
     client := s3.NewFromConfig(awsCfg)
 
-    awsctx := dg.AwsContext{Client: client, BucketName: aws.String(itn.GetBucketName(appCfg)), Prefix: appCfg.NetworkName, Context: ctx, Log: log}
+    awsctx := dg.AwsContext{Client: client, BucketName: aws.String(itn.GetBucketName(appCfg)), Prefix: appCfg.NetworkName, Log: log}
 
     if appCfg.IgnoreIPs {
 		output(fmt.Sprintf("Period start; %v\nPeriod end; %v\n",
@@ -90,10 +90,10 @@ func main() {
 			appCfg.Period.Interval))
     }
 
-    identities := itn.CreateIdentities(appCfg, awsctx, log)
+    identities := itn.CreateIdentities(ctx, appCfg, awsctx, log)
     // Go over identities and calculate uptime
     for _, identity := range identities {
-        identity.GetUptime(appCfg, awsctx, log, syncPeriod)
+        identity.GetUptime(ctx, appCfg, awsctx, log, syncPeriod)
         if appCfg.IgnoreIPs {
             output(fmt.Sprintf("%s; %s\n",
 				identity.PublicKey, *identity.Uptime))
@@ -0,0 +1,375 @@
+package delegation_backend
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+const ADMIN_PATH_PREFIX = "/admin/"
+const ADMIN_NETWORKS_PATH_PREFIX = "/admin/networks/"
+const MAX_OVERRIDE_TTL = 30 * 24 * time.Hour
+const MAX_ADMIN_REQUEST_SIZE = 64 * 1024
+
+// AdminAPI serves endpoints for operators of the service,
+// authenticated with a bearer token:
+//
+//	GET    /admin/whitelist                  current whitelist with its source and load time
+//	GET    /admin/whitelist/report           report of the latest refresh
+//	POST   /admin/whitelist/refresh          refresh immediately (?force=1 skips the shrink guard)
+//	GET    /admin/whitelist/keys/<pk>        whether a key is accepted and why
+//	GET    /admin/whitelist/overrides        overrides in effect
+//	PUT    /admin/whitelist/overrides/<pk>   set an allow or deny override
+//	DELETE /admin/whitelist/overrides/<pk>   remove an override
+//	GET    /admin/denylist                   rules of the current denylist
+//	POST   /admin/denylist/refresh           reload the denylist immediately
+//	GET    /admin/denylist/audit             most recent denied attempts
+//
+// Whitelist endpoints are not found when the whitelist is disabled,
+// denylist ones when the denylist is not configured. With several networks
+// served, whitelist endpoints of every network other than the default one
+// are under ADMIN_NETWORKS_PATH_PREFIX/<network>/.
+type AdminAPI struct {
+	Token             string
+	Refresher         *WhitelistRefresher
+	Overrides         *WhitelistOverrides
+	DenylistRefresher *DenylistRefresher
+	DenyAudit         *DenyAuditLog
+	NetworkName       string
+	PathPrefix        string // ADMIN_PATH_PREFIX if empty
+	Log               *logging.ZapEventLogger
+	Now               nowFunc
+}
+
+type adminOverrideJSON struct {
+	PublicKey string         `json:"public_key"`
+	Action    OverrideAction `json:"action"`
+	Reason    string         `json:"reason,omitempty"`
+	CreatedAt time.Time      `json:"created_at"`
+	ExpiresAt time.Time      `json:"expires_at"`
+}
+
+type adminWhitelistJSON struct {
+	Source    string               `json:"source"`
+	LoadedAt  time.Time            `json:"loaded_at"`
+	Entries   []whitelistEntryJSON `json:"entries"`
+	Overrides []adminOverrideJSON  `json:"overrides"`
+}
+
+type adminKeyJSON struct {
+	PublicKey   string              `json:"public_key"`
+	Whitelisted bool                `json:"whitelisted"` // present in the whitelist loaded from the source
+	Entry       *whitelistEntryJSON `json:"entry,omitempty"`
+	Override    *adminOverrideJSON  `json:"override,omitempty"`
+	Accepted    bool                `json:"accepted"` // submissions of the key are accepted now
+	Reason      string              `json:"reason,omitempty"`
+}
+
+type adminDenylistJSON struct {
+	Source string     `json:"source"`
+	Rules  []DenyRule `json:"rules"`
+}
+
+type adminDenyAuditJSON struct {
+	Total    int             `json:"total"` // denied attempts since the start
+	Attempts []DeniedAttempt `json:"attempts"`
+}
+
+type adminOverrideRequest struct {
+	Action    OverrideAction `json:"action"`
+	Reason    string         `json:"reason"`
+	TTL       string         `json:"ttl"`
+	ExpiresAt *time.Time     `json:"expires_at"`
+}
+
+func (a *AdminAPI) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAdminError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		path := strings.TrimPrefix(r.URL.Path, a.pathPrefix())
+		switch {
+		case a.Refresher == nil && strings.HasPrefix(path, "whitelist"):
+			writeAdminError(w, http.StatusNotFound, "Whitelist is disabled")
+		case a.DenylistRefresher == nil && strings.HasPrefix(path, "denylist"):
+			writeAdminError(w, http.StatusNotFound, "Denylist is not configured")
+		case path == "whitelist":
+			a.allowMethods(w, r, a.listWhitelist, http.MethodGet)
+		case path == "whitelist/report":
+			a.allowMethods(w, r, a.Refresher.ReportHandler().ServeHTTP, http.MethodGet)
+		case path == "whitelist/refresh":
+			a.allowMethods(w, r, a.refresh, http.MethodPost)
+		case strings.HasPrefix(path, "whitelist/keys/"):
+			a.allowMethods(w, r, a.checkKey, http.MethodGet)
+		case path == "whitelist/overrides":
+			a.allowMethods(w, r, a.listOverrides, http.MethodGet)
+		case strings.HasPrefix(path, "whitelist/overrides/"):
+			a.allowMethods(w, r, a.changeOverride, http.MethodPut, http.MethodDelete)
+		case path == "denylist":
+			a.allowMethods(w, r, a.listDenylist, http.MethodGet)
+		case path == "denylist/refresh":
+			a.allowMethods(w, r, a.refreshDenylist, http.MethodPost)
+		case path == "denylist/audit":
+			a.allowMethods(w, r, a.listDeniedAttempts, http.MethodGet)
+		default:
+			writeAdminError(w, http.StatusNotFound, "Not found")
+		}
+	})
+}
+
+// Path the API is served under
+func (a *AdminAPI) pathPrefix() string {
+	if a.PathPrefix == "" {
+		return ADMIN_PATH_PREFIX
+	}
+	return a.PathPrefix
+}
+
+func (a *AdminAPI) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || a.Token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) == 1
+}
+
+func (a *AdminAPI) allowMethods(w http.ResponseWriter, r *http.Request, h http.HandlerFunc, methods ...string) {
+	for _, m := range methods {
+		if r.Method == m {
+			h(w, r)
+			return
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeAdminError(w, http.StatusMethodNotAllowed, "Method not allowed")
+}
+
+func (a *AdminAPI) listWhitelist(w http.ResponseWriter, _ *http.Request) {
+	applied := a.Refresher.LastApplied()
+	wl := a.Refresher.Whitelist.ReadWhitelist()
+	if applied == nil || wl == nil {
+		writeAdminError(w, http.StatusServiceUnavailable, "Whitelist wasn't loaded yet")
+		return
+	}
+	resp := adminWhitelistJSON{
+		Source:    applied.Source,
+		LoadedAt:  applied.LoadedAt,
+		Entries:   make([]whitelistEntryJSON, 0, len(*wl)),
+		Overrides: a.overridesJSON(),
+	}
+	for pk, e := range *wl {
+		resp.Entries = append(resp.Entries, makeWhitelistEntryJSON(pk, e))
+	}
+	writeAdminJSON(w, http.StatusOK, resp)
+}
+
+func (a *AdminAPI) refresh(w http.ResponseWriter, r *http.Request) {
+	var err error
+	if r.URL.Query().Get("force") == "1" {
+		a.Log.Warnf("Forced whitelist refresh requested through admin API")
+		err = a.Refresher.ForceRefresh(r.Context())
+	} else {
+		err = a.Refresher.Refresh(r.Context())
+	}
+	status := http.StatusOK
+	if err != nil {
+		a.Log.Errorf("Whitelist refresh requested through admin API failed: %v", err)
+		status = http.StatusBadGateway
+	}
+	writeAdminJSON(w, status, a.Refresher.Report())
+}
+
+func (a *AdminAPI) checkKey(w http.ResponseWriter, r *http.Request) {
+	pk, ok := a.parseAdminPk(w, r, "whitelist/keys/")
+	if !ok {
+		return
+	}
+	now := a.Now()
+	var wl *Whitelist
+	if a.Refresher.Whitelist != nil {
+		wl = a.Refresher.Whitelist.ReadWhitelist()
+	}
+	resp := adminKeyJSON{PublicKey: pk.String()}
+	if wl != nil {
+		if e, has := (*wl)[pk]; has {
+			resp.Whitelisted = true
+			entry := makeWhitelistEntryJSON(pk, e)
+			resp.Entry = &entry
+		}
+	}
+	entry, registered, override := a.Overrides.Lookup(wl, pk, now)
+	if override != nil {
+		o := makeAdminOverrideJSON(pk, *override)
+		resp.Override = &o
+	}
+	switch {
+	case override != nil && override.Action == OverrideDeny:
+		resp.Reason = "denied by override"
+	case !registered:
+		resp.Reason = "not in the whitelist"
+	case !entry.ValidAt(now):
+		resp.Reason = "outside of validity window"
+	case !entry.AllowsNetwork(a.NetworkName):
+		resp.Reason = "pinned to network " + entry.Network
+	default:
+		resp.Accepted = true
+	}
+	writeAdminJSON(w, http.StatusOK, resp)
+}
+
+func (a *AdminAPI) listOverrides(w http.ResponseWriter, _ *http.Request) {
+	writeAdminJSON(w, http.StatusOK, a.overridesJSON())
+}
+
+func (a *AdminAPI) changeOverride(w http.ResponseWriter, r *http.Request) {
+	pk, ok := a.parseAdminPk(w, r, "whitelist/overrides/")
+	if !ok {
+		return
+	}
+	if r.Method == http.MethodDelete {
+		if !a.Overrides.Remove(pk) {
+			writeAdminError(w, http.StatusNotFound, "No override for the key")
+			return
+		}
+		a.Log.Infof("Whitelist override of %s removed through admin API", pk)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var req adminOverrideRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, MAX_ADMIN_REQUEST_SIZE)).Decode(&req); err != nil {
+		writeAdminError(w, http.StatusBadRequest, "Error decoding request: "+err.Error())
+		return
+	}
+	now := a.Now()
+	override, err := req.toOverride(now)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	a.Overrides.Set(pk, override)
+	a.Log.Infof("Whitelist override of %s set through admin API: %s until %v, reason: %s",
+		pk, override.Action, override.ExpiresAt, override.Reason)
+	writeAdminJSON(w, http.StatusOK, makeAdminOverrideJSON(pk, override))
+}
+
+func (req adminOverrideRequest) toOverride(now time.Time) (WhitelistOverride, error) {
+	if req.Action != OverrideAllow && req.Action != OverrideDeny {
+		return WhitelistOverride{}, fmt.Errorf("action should be either %s or %s", OverrideAllow, OverrideDeny)
+	}
+	var expiresAt time.Time
+	switch {
+	case req.TTL != "" && req.ExpiresAt != nil:
+		return WhitelistOverride{}, fmt.Errorf("only one of ttl and expires_at should be set")
+	case req.TTL != "":
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			return WhitelistOverride{}, fmt.Errorf("ttl should be a positive duration, e.g. 2h30m")
+		}
+		expiresAt = now.Add(ttl)
+	case req.ExpiresAt != nil:
+		expiresAt = *req.ExpiresAt
+		if !expiresAt.After(now) {
+			return WhitelistOverride{}, fmt.Errorf("expires_at should be in the future")
+		}
+	default:
+		return WhitelistOverride{}, fmt.Errorf("overrides are temporary, either ttl or expires_at should be set")
+	}
+	if expiresAt.Sub(now) > MAX_OVERRIDE_TTL {
+		return WhitelistOverride{}, fmt.Errorf("override can't last longer than %v", MAX_OVERRIDE_TTL)
+	}
+	return WhitelistOverride{Action: req.Action, Reason: req.Reason, CreatedAt: now, ExpiresAt: expiresAt}, nil
+}
+
+func (a *AdminAPI) overridesJSON() []adminOverrideJSON {
+	pks, overrides := a.Overrides.List(a.Now())
+	res := make([]adminOverrideJSON, len(pks))
+	for i, pk := range pks {
+		res[i] = makeAdminOverrideJSON(pk, overrides[i])
+	}
+	return res
+}
+
+func (a *AdminAPI) listDenylist(w http.ResponseWriter, _ *http.Request) {
+	dl := a.DenylistRefresher.Denylist.Read()
+	if dl == nil {
+		writeAdminError(w, http.StatusServiceUnavailable, "Denylist wasn't loaded yet")
+		return
+	}
+	resp := adminDenylistJSON{Source: a.DenylistRefresher.Source.Name(), Rules: dl.Rules()}
+	if resp.Rules == nil {
+		resp.Rules = []DenyRule{}
+	}
+	writeAdminJSON(w, http.StatusOK, resp)
+}
+
+func (a *AdminAPI) refreshDenylist(w http.ResponseWriter, r *http.Request) {
+	if err := a.DenylistRefresher.Refresh(r.Context()); err != nil {
+		a.Log.Errorf("Denylist refresh requested through admin API failed: %v", err)
+		writeAdminError(w, http.StatusBadGateway, "Denylist refresh failed: "+err.Error())
+		return
+	}
+	a.listDenylist(w, r)
+}
+
+func (a *AdminAPI) listDeniedAttempts(w http.ResponseWriter, _ *http.Request) {
+	attempts, total := a.DenyAudit.Recent()
+	if attempts == nil {
+		attempts = []DeniedAttempt{}
+	}
+	writeAdminJSON(w, http.StatusOK, adminDenyAuditJSON{Total: total, Attempts: attempts})
+}
+
+func (a *AdminAPI) parseAdminPk(w http.ResponseWriter, r *http.Request, prefix string) (Pk, bool) {
+	var pk Pk
+	pkStr := strings.TrimPrefix(r.URL.Path, a.pathPrefix()+prefix)
+	if err := StringToPk(&pk, pkStr); err != nil {
+		writeAdminError(w, http.StatusBadRequest, "Invalid public key: "+err.Error())
+		return pk, false
+	}
+	return pk, true
+}
+
+func makeWhitelistEntryJSON(pk Pk, e WhitelistEntry) whitelistEntryJSON {
+	res := whitelistEntryJSON{
+		PublicKey:   pk.String(),
+		Label:       e.Label,
+		HourlyLimit: e.HourlyLimit,
+		Network:     e.Network,
+	}
+	if !e.NotBefore.IsZero() {
+		res.NotBefore = e.NotBefore.Format(time.RFC3339)
+	}
+	if !e.NotAfter.IsZero() {
+		res.NotAfter = e.NotAfter.Format(time.RFC3339)
+	}
+	return res
+}
+
+func makeAdminOverrideJSON(pk Pk, o WhitelistOverride) adminOverrideJSON {
+	return adminOverrideJSON{
+		PublicKey: pk.String(),
+		Action:    o.Action,
+		Reason:    o.Reason,
+		CreatedAt: o.CreatedAt,
+		ExpiresAt: o.ExpiresAt,
+	}
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, msg string) {
+	writeAdminJSON(w, status, errorResponse{Msg: msg})
+}
@@ -0,0 +1,267 @@
+package delegation_backend
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+const testAdminToken = "secret"
+
+func testAdminAPI(t *testing.T, wl Whitelist) (*AdminAPI, *staticWhitelistSource, *timeMock) {
+	_, tm := newTestAttemptCounter(1)
+	source := &staticWhitelistSource{wl: wl}
+	refresher := &WhitelistRefresher{
+		Source:    source,
+		Whitelist: new(WhitelistMVar),
+		Log:       logging.Logger("test"),
+	}
+	if err := refresher.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return &AdminAPI{
+		Token:       testAdminToken,
+		Refresher:   refresher,
+		Overrides:   NewWhitelistOverrides(),
+		NetworkName: "testnet",
+		Log:         logging.Logger("test"),
+		Now:         tm.Now,
+	}, source, tm
+}
+
+func (a *AdminAPI) testRequest(method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	rec := httptest.NewRecorder()
+	a.Handler().ServeHTTP(rec, req)
+	return rec
+}
+
+func decodeAdminResponse(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("failed decoding response %s: %v", rec.Body, err)
+	}
+}
+
+func TestAdminUnauthorized(t *testing.T) {
+	api, _, _ := testAdminAPI(t, Whitelist{})
+	for _, header := range []string{"", "Bearer wrong", "Basic " + testAdminToken, testAdminToken} {
+		req := httptest.NewRequest("GET", "/admin/whitelist", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		rec := httptest.NewRecorder()
+		api.Handler().ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("authorization %q: expected 401, got %d", header, rec.Code)
+		}
+	}
+
+	api.Token = ""
+	if rec := api.testRequest("GET", "/admin/whitelist", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 with no token configured, got %d", rec.Code)
+	}
+}
+
+func TestAdminListAndRefresh(t *testing.T) {
+	pk1, pk2 := mkPk(), mkPk()
+	api, source, _ := testAdminAPI(t, Whitelist{pk1: {Label: "operator"}})
+
+	var list adminWhitelistJSON
+	rec := api.testRequest("GET", "/admin/whitelist", "")
+	decodeAdminResponse(t, rec, &list)
+	if rec.Code != http.StatusOK || list.Source != "static" || len(list.Entries) != 1 ||
+		list.Entries[0].PublicKey != pk1.String() || list.Entries[0].Label != "operator" {
+		t.Fatalf("unexpected whitelist: %d %+v", rec.Code, list)
+	}
+
+	source.wl = Whitelist{pk1: {}, pk2: {}}
+	if rec := api.testRequest("GET", "/admin/whitelist/refresh", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", rec.Code)
+	}
+	var report WhitelistReport
+	rec = api.testRequest("POST", "/admin/whitelist/refresh", "")
+	decodeAdminResponse(t, rec, &report)
+	if rec.Code != http.StatusOK || !report.Applied || report.Entries != 2 {
+		t.Fatalf("unexpected refresh response: %d %+v", rec.Code, report)
+	}
+	expectWhitelist(t, *api.Refresher.Whitelist.ReadWhitelist(), pk1, pk2)
+
+	// Forced refresh skips the shrink guard
+	api.Refresher.MaxShrinkPercent = 10
+	source.wl = Whitelist{}
+	if rec := api.testRequest("POST", "/admin/whitelist/refresh", ""); rec.Code != http.StatusBadGateway {
+		t.Fatalf("expected 502, got %d", rec.Code)
+	}
+	if rec := api.testRequest("POST", "/admin/whitelist/refresh?force=1", ""); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	expectWhitelist(t, *api.Refresher.Whitelist.ReadWhitelist())
+}
+
+func TestAdminOverrides(t *testing.T) {
+	pk1, pk2 := mkPk(), mkPk()
+	api, _, tm := testAdminAPI(t, Whitelist{pk1: {NotAfter: time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)}})
+	now := tm.Now()
+
+	checkKey := func(pk Pk) adminKeyJSON {
+		var resp adminKeyJSON
+		rec := api.testRequest("GET", "/admin/whitelist/keys/"+pk.String(), "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("unexpected key check response: %d %s", rec.Code, rec.Body)
+		}
+		decodeAdminResponse(t, rec, &resp)
+		return resp
+	}
+	if resp := checkKey(pk1); !resp.Whitelisted || resp.Accepted || resp.Reason != "outside of validity window" {
+		t.Fatalf("unexpected key check: %+v", resp)
+	}
+	if resp := checkKey(pk2); resp.Whitelisted || resp.Accepted {
+		t.Fatalf("unexpected key check: %+v", resp)
+	}
+	if rec := api.testRequest("GET", "/admin/whitelist/keys/B62qnotakey", ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+
+	for _, body := range []string{
+		`{"action": "allow"}`,
+		`{"action": "maybe", "ttl": "1h"}`,
+		`{"action": "allow", "ttl": "-1h"}`,
+		`{"action": "allow", "ttl": "1000h"}`,
+		`{"action": "allow", "ttl": "1h", "expires_at": "2030-01-01T00:00:00Z"}`,
+	} {
+		if rec := api.testRequest("PUT", "/admin/whitelist/overrides/"+pk2.String(), body); rec.Code != http.StatusBadRequest {
+			t.Fatalf("override %s: expected 400, got %d", body, rec.Code)
+		}
+	}
+
+	if rec := api.testRequest("PUT", "/admin/whitelist/overrides/"+pk1.String(), `{"action": "allow", "ttl": "2h", "reason": "renewal pending"}`); rec.Code != http.StatusOK {
+		t.Fatalf("unexpected override response: %d %s", rec.Code, rec.Body)
+	}
+	expiresAt := now.Add(time.Hour).Format(time.RFC3339)
+	if rec := api.testRequest("PUT", "/admin/whitelist/overrides/"+pk2.String(), `{"action": "deny", "expires_at": "`+expiresAt+`"}`); rec.Code != http.StatusOK {
+		t.Fatalf("unexpected override response: %d %s", rec.Code, rec.Body)
+	}
+	if resp := checkKey(pk1); !resp.Accepted || resp.Override == nil || resp.Override.Reason != "renewal pending" {
+		t.Fatalf("unexpected key check: %+v", resp)
+	}
+	if resp := checkKey(pk2); resp.Accepted || resp.Reason != "denied by override" {
+		t.Fatalf("unexpected key check: %+v", resp)
+	}
+
+	var overrides []adminOverrideJSON
+	decodeAdminResponse(t, api.testRequest("GET", "/admin/whitelist/overrides", ""), &overrides)
+	if len(overrides) != 2 || overrides[0].PublicKey != pk2.String() || overrides[1].PublicKey != pk1.String() {
+		t.Fatalf("unexpected overrides: %+v", overrides)
+	}
+
+	// Deny override expires after an hour, allow one after two
+	tm.Advance(90 * time.Minute)
+	decodeAdminResponse(t, api.testRequest("GET", "/admin/whitelist/overrides", ""), &overrides)
+	if len(overrides) != 1 || overrides[0].PublicKey != pk1.String() {
+		t.Fatalf("unexpected overrides: %+v", overrides)
+	}
+
+	if rec := api.testRequest("DELETE", "/admin/whitelist/overrides/"+pk1.String(), ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rec.Code)
+	}
+	if rec := api.testRequest("DELETE", "/admin/whitelist/overrides/"+pk1.String(), ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", rec.Code)
+	}
+	if resp := checkKey(pk1); resp.Accepted || resp.Override != nil {
+		t.Fatalf("unexpected key check: %+v", resp)
+	}
+}
+
+func TestSubmitWithOverrides(t *testing.T) {
+	body := readTestFile("req-no-snark", t)
+	var req submitRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal("failed decoding test file")
+	}
+	_, sh, tm := testSubmitH(1, Whitelist{})
+	sh.app.VerifySignatureDisabled = true
+	sh.app.WhitelistOverrides = NewWhitelistOverrides()
+	if rep := sh.testRequest(body); rep.Code != 401 {
+		t.Fatalf("expected 401, got %v", rep)
+	}
+	sh.app.WhitelistOverrides.Set(req.Submitter, WhitelistOverride{Action: OverrideAllow, ExpiresAt: tm.Now().Add(time.Hour)})
+	if rep := sh.testRequest(body); rep.Code != 200 {
+		t.Fatalf("expected 200, got %v", rep)
+	}
+
+	sh.app.Whitelist.Replace(&Whitelist{req.Submitter: {}})
+	sh.app.WhitelistOverrides.Set(req.Submitter, WhitelistOverride{Action: OverrideDeny, ExpiresAt: tm.Now().Add(time.Hour)})
+	if rep := sh.testRequest(body); rep.Code != 401 {
+		t.Fatalf("expected 401, got %v", rep)
+	}
+}
+
+func TestAdminDenylist(t *testing.T) {
+	csvPath := filepath.Join(t.TempDir(), "denylist.csv")
+	if err := os.WriteFile(csvPath, []byte("10.0.0.0/8,scanner\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	api := &AdminAPI{
+		Token: testAdminToken,
+		DenylistRefresher: &DenylistRefresher{
+			Source:   &FileDenylistSource{Path: csvPath, Log: logging.Logger("test")},
+			Denylist: new(DenylistMVar),
+			Log:      logging.Logger("test"),
+		},
+		DenyAudit: NewDenyAuditLog(10),
+		Log:       logging.Logger("test"),
+	}
+	// Whitelist endpoints are not found with the whitelist disabled
+	if rec := api.testRequest("GET", "/admin/whitelist", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", rec.Code)
+	}
+	if rec := api.testRequest("GET", "/admin/denylist", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", rec.Code)
+	}
+
+	var list adminDenylistJSON
+	rec := api.testRequest("POST", "/admin/denylist/refresh", "")
+	decodeAdminResponse(t, rec, &list)
+	if rec.Code != http.StatusOK || list.Source != "file" || len(list.Rules) != 1 ||
+		list.Rules[0].Value != "10.0.0.0/8" || list.Rules[0].Reason != "scanner" {
+		t.Fatalf("unexpected denylist: %d %+v", rec.Code, list)
+	}
+
+	api.DenyAudit.Record(DeniedAttempt{RemoteAddr: "10.1.1.1", Rule: list.Rules[0]})
+	var audit adminDenyAuditJSON
+	decodeAdminResponse(t, api.testRequest("GET", "/admin/denylist/audit", ""), &audit)
+	if audit.Total != 1 || len(audit.Attempts) != 1 || audit.Attempts[0].RemoteAddr != "10.1.1.1" {
+		t.Fatalf("unexpected audit: %+v", audit)
+	}
+
+	if err := os.Remove(csvPath); err != nil {
+		t.Fatal(err)
+	}
+	if rec := api.testRequest("POST", "/admin/denylist/refresh", ""); rec.Code != http.StatusBadGateway {
+		t.Fatalf("expected 502, got %d", rec.Code)
+	}
+}
+
+func TestAdminNetworkPathPrefix(t *testing.T) {
+	pk := mkPk()
+	api, _, _ := testAdminAPI(t, Whitelist{pk: {}})
+	api.PathPrefix = ADMIN_NETWORKS_PATH_PREFIX + "devnet/"
+	rec := api.testRequest("GET", "/admin/networks/devnet/whitelist/keys/"+pk.String(), "")
+	var key adminKeyJSON
+	decodeAdminResponse(t, rec, &key)
+	if rec.Code != http.StatusOK || !key.Accepted {
+		t.Fatalf("unexpected response: %v", rec)
+	}
+	if rec := api.testRequest("GET", "/admin/whitelist", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 outside of the prefix, got %v", rec)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"os"
 	"strconv"
+	"strings"
 
 	logging "github.com/ipfs/go-log/v2"
 )
@@ -42,8 +43,9 @@ func LoadEnv(log logging.EventLogger) AppConfig {
 		verifySignatureDisabled := boolEnvChecked("VERIFY_SIGNATURE_DISABLED", log)
 
 		delegationWhitelistDisabled := boolEnvChecked("DELEGATION_WHITELIST_DISABLED", log)
+		whitelistSource := os.Getenv("DELEGATION_WHITELIST_SOURCE")
 		var gsheetId, delegationWhitelistList, delegationWhitelistColumn string
-		if delegationWhitelistDisabled {
+		if delegationWhitelistDisabled || (whitelistSource != "" && whitelistSource != WHITELIST_SOURCE_SHEETS) {
 			// If delegation whitelist is disabled, we don't need to load related environment variables
 			// just loading them from env in case they are set, but they won't be used
 			gsheetId = os.Getenv("CONFIG_GSHEET_ID")
@@ -150,12 +152,120 @@ func LoadEnv(log logging.EventLogger) AppConfig {
 			}
 		}
 
+		config.StorageWritePolicy = os.Getenv("STORAGE_WRITE_POLICY")
+		config.BlockCompression = os.Getenv("BLOCK_COMPRESSION")
+
+		// Whitelist source configurations, Google Sheets is used by default
+		if !delegationWhitelistDisabled && whitelistSource != "" && whitelistSource != WHITELIST_SOURCE_SHEETS {
+			config.WhitelistSource = &WhitelistSourceConfig{Type: whitelistSource}
+			switch whitelistSource {
+			case WHITELIST_SOURCE_FILE:
+				config.WhitelistSource.Path = getEnvChecked("DELEGATION_WHITELIST_FILE", log)
+			case WHITELIST_SOURCE_HTTP:
+				config.WhitelistSource.URL = getEnvChecked("DELEGATION_WHITELIST_URL", log)
+			case WHITELIST_SOURCE_POSTGRESQL:
+				// Connection is taken from POSTGRES_* variables
+				config.WhitelistSource.Table = getEnvChecked("DELEGATION_WHITELIST_TABLE", log)
+				config.WhitelistSource.Column = os.Getenv("DELEGATION_WHITELIST_TABLE_COLUMN")
+			default:
+				log.Fatalf("DELEGATION_WHITELIST_SOURCE should be one of sheets, file, http, postgresql, got: %s", whitelistSource)
+			}
+		}
+
+		// Spool configurations
+		if spoolPath := os.Getenv("SPOOL_PATH"); spoolPath != "" {
+			var segmentSize int64
+			if segmentSizeStr := os.Getenv("SPOOL_SEGMENT_SIZE"); segmentSizeStr != "" {
+				var err error
+				segmentSize, err = strconv.ParseInt(segmentSizeStr, 10, 64)
+				if err != nil {
+					log.Fatalf("Error parsing SPOOL_SEGMENT_SIZE: %v", err)
+				}
+			}
+			config.Spool = &SpoolConfig{
+				Path:        spoolPath,
+				SegmentSize: segmentSize,
+			}
+		}
+
+		// Asynchronous save queue configurations
+		if queueSizeStr := os.Getenv("SAVE_QUEUE_SIZE"); queueSizeStr != "" {
+			queueSize, err := strconv.Atoi(queueSizeStr)
+			if err != nil || queueSize <= 0 {
+				log.Fatalf("SAVE_QUEUE_SIZE should be a positive number, got: %s", queueSizeStr)
+			}
+			config.SaveQueue = &SaveQueueConfig{
+				Size:           queueSize,
+				Workers:        intEnvChecked("SAVE_QUEUE_WORKERS", log),
+				BackendWorkers: make(map[string]int),
+			}
+			for _, backend := range []string{"s3", "keyspaces", "filesystem", "postgresql"} {
+				if workers := intEnvChecked("SAVE_QUEUE_WORKERS_"+strings.ToUpper(backend), log); workers > 0 {
+					config.SaveQueue.BackendWorkers[backend] = workers
+				}
+			}
+		}
+
+		// Denylist configurations, connection of the table is taken from POSTGRES_* variables
+		denylistFile, denylistTable := os.Getenv("DENYLIST_FILE"), os.Getenv("DENYLIST_TABLE")
+		if denylistFile != "" || denylistTable != "" {
+			config.Denylist = &DenylistConfig{Path: denylistFile, Table: denylistTable}
+		}
+
+		// Attempts are counted in memory of every replica unless Redis URL is set
+		redisURL, maxKeys := os.Getenv("RATE_LIMITER_REDIS_URL"), intEnvChecked("RATE_LIMITER_MAX_KEYS", log)
+		if redisURL != "" || maxKeys != 0 {
+			config.RateLimiter = &RateLimiterConfig{
+				RedisURL:  redisURL,
+				KeyPrefix: os.Getenv("RATE_LIMITER_KEY_PREFIX"),
+				MaxKeys:   maxKeys,
+			}
+		}
+
+		if perMinute := intEnvChecked("IP_RATE_LIMIT_PER_MINUTE", log); perMinute > 0 {
+			config.IPRateLimit = &IPRateLimitConfig{
+				PerMinute: perMinute,
+				Burst:     intEnvChecked("IP_RATE_LIMIT_BURST", log),
+				MaxKeys:   intEnvChecked("IP_RATE_LIMIT_MAX_KEYS", log),
+			}
+		}
+		globalLimit := GlobalRateLimitConfig{
+			PerSecond:     intEnvChecked("GLOBAL_RATE_LIMIT_PER_SECOND", log),
+			Burst:         intEnvChecked("GLOBAL_RATE_LIMIT_BURST", log),
+			MaxConcurrent: intEnvChecked("MAX_CONCURRENT_SUBMISSIONS", log),
+		}
+		if globalLimit.PerSecond > 0 || globalLimit.MaxConcurrent > 0 {
+			config.GlobalRateLimit = &globalLimit
+		}
+		// Comma-separated networks in CIDR notation or single addresses
+		if trustedProxies := os.Getenv("TRUSTED_PROXIES"); trustedProxies != "" {
+			config.TrustedProxies = strings.Split(trustedProxies, ",")
+		}
+		config.TrustedProxyHops = intEnvChecked("TRUSTED_PROXY_HOPS", log)
+		config.TrustedProxyHeader = os.Getenv("TRUSTED_PROXY_HEADER")
+
+		config.AdminToken = os.Getenv("ADMIN_TOKEN")
+
+		config.ListenAddress = os.Getenv("LISTEN_ADDRESS")
+		certFile, keyFile, clientCAFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE"), os.Getenv("TLS_CLIENT_CA_FILE")
+		if certFile != "" || keyFile != "" || clientCAFile != "" {
+			config.TLS = &TLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: clientCAFile}
+		}
+		config.H2C = boolEnvChecked("H2C", log)
+
 		config.NetworkName = networkName
 		config.GsheetId = gsheetId
 		config.DelegationWhitelistList = delegationWhitelistList
 		config.DelegationWhitelistColumn = delegationWhitelistColumn
+		config.DelegationWhitelistLastColumn = os.Getenv("DELEGATION_WHITELIST_LAST_COLUMN")
+		config.DelegationWhitelistMaxShrinkPercent = intEnvChecked("DELEGATION_WHITELIST_MAX_SHRINK_PERCENT", log)
 		config.DelegationWhitelistDisabled = delegationWhitelistDisabled
 		config.VerifySignatureDisabled = verifySignatureDisabled
+		config.SignatureVerifierWorkers = intEnvChecked("SIGNATURE_VERIFIER_WORKERS", log)
+		config.SignatureCacheSize = intEnvChecked("SIGNATURE_CACHE_SIZE", log)
+		config.BlockTempDir = os.Getenv("BLOCK_TEMP_DIR")
+		config.BlockDecoding = boolEnvChecked("BLOCK_DECODING", log)
+		config.BlockFormat = os.Getenv("BLOCK_FORMAT")
 	}
 
 	return config
@@ -169,6 +279,19 @@ func getEnvChecked(variable string, log logging.EventLogger) string {
 	return value
 }
 
+// Returns 0 if the variable is not set
+func intEnvChecked(variable string, log logging.EventLogger) int {
+	value := os.Getenv(variable)
+	if value == "" {
+		return 0
+	}
+	res, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("%s, if set, should be a number: %v", variable, err)
+	}
+	return res
+}
+
 func boolEnvChecked(variable string, log logging.EventLogger) bool {
 	value := os.Getenv(variable)
 	switch value {
@@ -220,15 +343,101 @@ type PostgreSQLConfig struct {
 	SSLMode  string `json:"sslmode"`
 }
 
+type SpoolConfig struct {
+	Path        string `json:"path"`
+	SegmentSize int64  `json:"segment_size,omitempty"`
+}
+
+type SaveQueueConfig struct {
+	Size           int            `json:"size"`
+	Workers        int            `json:"workers,omitempty"`
+	BackendWorkers map[string]int `json:"backend_workers,omitempty"`
+}
+
+type WhitelistSourceConfig struct {
+	Type   string `json:"type"`
+	Path   string `json:"path,omitempty"`
+	URL    string `json:"url,omitempty"`
+	Table  string `json:"table,omitempty"`
+	Column string `json:"column,omitempty"`
+	// Connection of the postgresql source, storage connection is used if not set
+	PostgreSQL *PostgreSQLConfig `json:"postgresql,omitempty"`
+}
+
+type RateLimiterConfig struct {
+	// redis://[user:password@]host:port[/db], rediss:// for TLS
+	RedisURL  string `json:"redis_url,omitempty"`
+	KeyPrefix string `json:"key_prefix,omitempty"`
+	// Max number of public keys tracked in memory when Redis isn't used
+	MaxKeys int `json:"max_keys,omitempty"`
+}
+
+// Token bucket of every client address, applied before the body is read
+type IPRateLimitConfig struct {
+	PerMinute int `json:"per_minute"`
+	// Requests made at once, PerMinute by default
+	Burst   int `json:"burst,omitempty"`
+	MaxKeys int `json:"max_keys,omitempty"`
+}
+
+type GlobalRateLimitConfig struct {
+	// Requests per second of the whole service, unlimited if zero
+	PerSecond int `json:"per_second,omitempty"`
+	// Requests made at once, PerSecond by default
+	Burst int `json:"burst,omitempty"`
+	// Requests handled concurrently, unlimited if zero
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+}
+
+type TLSConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// CA of client certificates required by the admin API and metrics
+	ClientCAFile string `json:"client_ca_file,omitempty"`
+}
+
+type DenylistConfig struct {
+	Path  string `json:"path,omitempty"`
+	Table string `json:"table,omitempty"`
+	// Connection of the denylist table, storage connection is used if not set
+	PostgreSQL *PostgreSQLConfig `json:"postgresql,omitempty"`
+}
+
 type AppConfig struct {
-	NetworkName                 string                 `json:"network_name"`
-	GsheetId                    string                 `json:"gsheet_id"`
-	DelegationWhitelistList     string                 `json:"delegation_whitelist_list"`
-	DelegationWhitelistColumn   string                 `json:"delegation_whitelist_column"`
-	DelegationWhitelistDisabled bool                   `json:"delegation_whitelist_disabled,omitempty"`
-	VerifySignatureDisabled     bool                   `json:"verify_signature_disabled,omitempty"`
-	Aws                         *AwsConfig             `json:"aws,omitempty"`
-	AwsKeyspaces                *AwsKeyspacesConfig    `json:"aws_keyspaces,omitempty"`
-	LocalFileSystem             *LocalFileSystemConfig `json:"filesystem,omitempty"`
-	PostgreSQL                  *PostgreSQLConfig      `json:"postgresql,omitempty"`
+	NetworkName                         string                 `json:"network_name"`
+	NetworkId                           *uint8                 `json:"network_id,omitempty"`
+	Networks                            []NetworkConfig        `json:"networks,omitempty"`
+	GsheetId                            string                 `json:"gsheet_id"`
+	DelegationWhitelistList             string                 `json:"delegation_whitelist_list"`
+	DelegationWhitelistColumn           string                 `json:"delegation_whitelist_column"`
+	DelegationWhitelistLastColumn       string                 `json:"delegation_whitelist_last_column,omitempty"`
+	DelegationWhitelistMaxShrinkPercent int                    `json:"delegation_whitelist_max_shrink_percent,omitempty"`
+	DelegationWhitelistDisabled         bool                   `json:"delegation_whitelist_disabled,omitempty"`
+	VerifySignatureDisabled             bool                   `json:"verify_signature_disabled,omitempty"`
+	RequestsPerPkHourly                 int                    `json:"requests_per_pk_hourly,omitempty"`
+	SignatureVerifierWorkers            int                    `json:"signature_verifier_workers,omitempty"`
+	SignatureCacheSize                  int                    `json:"signature_cache_size,omitempty"`
+	BlockTempDir                        string                 `json:"block_temp_dir,omitempty"`
+	BlockDecoding                       bool                   `json:"block_decoding,omitempty"`
+	BlockFormat                         string                 `json:"block_format,omitempty"`
+	Aws                                 *AwsConfig             `json:"aws,omitempty"`
+	AwsKeyspaces                        *AwsKeyspacesConfig    `json:"aws_keyspaces,omitempty"`
+	LocalFileSystem                     *LocalFileSystemConfig `json:"filesystem,omitempty"`
+	PostgreSQL                          *PostgreSQLConfig      `json:"postgresql,omitempty"`
+	StorageWritePolicy                  string                 `json:"storage_write_policy,omitempty"`
+	BlockCompression                    string                 `json:"block_compression,omitempty"`
+	Spool                               *SpoolConfig           `json:"spool,omitempty"`
+	SaveQueue                           *SaveQueueConfig       `json:"save_queue,omitempty"`
+	WhitelistSource                     *WhitelistSourceConfig `json:"whitelist_source,omitempty"`
+	Denylist                            *DenylistConfig        `json:"denylist,omitempty"`
+	RateLimiter                         *RateLimiterConfig     `json:"rate_limiter,omitempty"`
+	IPRateLimit                         *IPRateLimitConfig     `json:"ip_rate_limit,omitempty"`
+	GlobalRateLimit                     *GlobalRateLimitConfig `json:"global_rate_limit,omitempty"`
+	TrustedProxies                      []string               `json:"trusted_proxies,omitempty"`
+	TrustedProxyHops                    int                    `json:"trusted_proxy_hops,omitempty"`
+	TrustedProxyHeader                  string                 `json:"trusted_proxy_header,omitempty"`
+	AdminToken                          string                 `json:"admin_token,omitempty"`
+	ListenAddress                       string                 `json:"listen_address,omitempty"`
+	TLS                                 *TLSConfig             `json:"tls,omitempty"`
+	H2C                                 bool                   `json:"h2c,omitempty"`
 }
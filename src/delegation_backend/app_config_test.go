@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"os"
 	"testing"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
 )
 
 type MockLogger struct {
@@ -325,6 +328,27 @@ func TestLoadEnv(t *testing.T) {
 		os.Clearenv()
 	})
 
+	t.Run("whitelist file source from env", func(t *testing.T) {
+		os.Clearenv()
+		os.Setenv("CONFIG_NETWORK_NAME", "test_network")
+		os.Setenv("CONFIG_FILESYSTEM_PATH", "test_path")
+		os.Setenv("DELEGATION_WHITELIST_SOURCE", "file")
+		os.Setenv("DELEGATION_WHITELIST_FILE", "/tmp/whitelist.csv")
+
+		mockLogger.lastMessage = ""
+		config := LoadEnv(mockLogger)
+		if mockLogger.lastMessage != "" {
+			t.Errorf("Unexpected fatal error: %s", mockLogger.lastMessage)
+		}
+		if config.WhitelistSource == nil || config.WhitelistSource.Type != WHITELIST_SOURCE_FILE ||
+			config.WhitelistSource.Path != "/tmp/whitelist.csv" {
+			t.Error("Failed to load whitelist source configs from environment variables")
+		}
+
+		// Cleanup
+		os.Clearenv()
+	})
+
 	t.Run("delegation whitelist disabled - file", func(t *testing.T) {
 		os.Clearenv()
 		// Create a temporary config file
@@ -350,3 +374,17 @@ func TestLoadEnv(t *testing.T) {
 		}
 	})
 }
+
+func TestSetWhitelistRefreshInterval(t *testing.T) {
+	log := logging.Logger("test")
+	for value, expected := range map[string]time.Duration{
+		"5":       5 * time.Minute,
+		"0":       0, // rejected on startup
+		"invalid": 10 * time.Minute,
+	} {
+		t.Setenv("DELEGATION_WHITELIST_REFRESH_INTERVAL", value)
+		if interval := SetWhitelistRefreshInterval(log); interval != expected {
+			t.Errorf("%q: expected %v, got %v", value, expected, interval)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package delegation_backend
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const minusOneHour time.Duration = -60 * 60 * 1000000000
+
+// Max number of public keys the in-memory rate limiter tracks by default
+const DEFAULT_ATTEMPT_COUNTER_MAX_KEYS = 1000000
+
+// Interval of sweeping keys without attempts in the last hour
+const ATTEMPT_COUNTER_SWEEP_INTERVAL = 5 * time.Minute
+
+type nowFunc = func() time.Time
+
+// Attempts of a public key, limited with GCRA: an attempt is allowed if it
+// doesn't move the theoretical arrival time of the next one more than an
+// hour ahead, each allowed attempt moving it by an hour divided by the limit.
+// That is a token bucket of the limit's size refilled evenly over an hour,
+// kept in a single timestamp. Entries are linked into a list ordered by
+// the time of their latest attempt, allowed or not.
+type attemptWindow struct {
+	pk Pk
+	// Theoretical arrival time in Unix nanoseconds, the key has its whole
+	// limit available from then on
+	tat        int64
+	prev, next *attemptWindow
+}
+
+// AttemptCounter limits attempts of public keys per hour. Up to the limit
+// of attempts may be made at once, after which they are allowed at the rate
+// of the limit per hour. Memory is bounded: every key takes a fixed amount
+// of it, keys without attempts in the last hour are dropped and once maxKeys
+// are tracked the least recently active key is evicted to make room for
+// a new one. Rejected attempts count as activity, so a throttled key that
+// keeps trying isn't evicted in favor of idle ones.
+type AttemptCounter struct {
+	attempts   map[Pk]*attemptWindow
+	maxAttempt int
+	maxKeys    int
+	// Most and least recently active windows
+	head, tail *attemptWindow
+	evictions  uint64
+	mutex      sync.Mutex
+	now        nowFunc
+}
+
+// NewAttemptCounter creates a counter tracking at most maxKeys public keys,
+// DEFAULT_ATTEMPT_COUNTER_MAX_KEYS if it's not positive.
+func NewAttemptCounter(maxAttemptPerHour int, maxKeys int) *AttemptCounter {
+	if maxKeys <= 0 {
+		maxKeys = DEFAULT_ATTEMPT_COUNTER_MAX_KEYS
+	}
+	th := new(AttemptCounter)
+	th.maxAttempt = maxAttemptPerHour
+	th.maxKeys = maxKeys
+	th.attempts = make(map[Pk]*attemptWindow)
+	th.now = func() time.Time { return time.Now() }
+	return th
+}
+
+// Record attempt to access the service
+// Returns `true` if attempt was successfully recorded
+// or `false` if amount of attempts per Pk per hour exceeded.
+func (h *AttemptCounter) RecordAttempt(pk Pk) bool {
+	return h.RecordAttemptWithLimit(pk, h.maxAttempt)
+}
+
+// Same as RecordAttempt, but with a custom limit of attempts per hour.
+func (h *AttemptCounter) RecordAttemptWithLimit(pk Pk, maxAttempt int) bool {
+	passes, _ := h.record(pk, maxAttempt)
+	return passes
+}
+
+// Allow implements RateLimiter, attempts are counted in memory of the process.
+func (h *AttemptCounter) Allow(_ context.Context, pk Pk, maxAttempt int) (bool, time.Duration, error) {
+	if maxAttempt == 0 {
+		maxAttempt = h.maxAttempt
+	}
+	passes, retryAfter := h.record(pk, maxAttempt)
+	return passes, retryAfter, nil
+}
+
+// record records an attempt if it fits into the limit, otherwise returns
+// time until the next attempt fits
+func (h *AttemptCounter) record(pk Pk, maxAttempt int) (bool, time.Duration) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	curTime := h.now().UnixNano()
+	h.sweep(curTime)
+	w := h.attempts[pk]
+	if w == nil {
+		if len(h.attempts) >= h.maxKeys {
+			h.evictions++
+			h.remove(h.tail)
+		}
+		w = &attemptWindow{pk: pk, tat: curTime}
+		h.attempts[pk] = w
+	} else {
+		h.unlink(w)
+	}
+	h.pushFront(w)
+	if maxAttempt <= 0 {
+		return false, -minusOneHour
+	}
+	tat := w.tat
+	if tat < curTime {
+		tat = curTime
+	}
+	tat += int64(-minusOneHour) / int64(maxAttempt)
+	if excess := tat - curTime + int64(minusOneHour); excess > 0 {
+		return false, time.Duration(excess)
+	}
+	w.tat = tat
+	return true, 0
+}
+
+// Sweep drops keys without attempts in the last hour.
+func (h *AttemptCounter) Sweep() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.sweep(h.now().UnixNano())
+}
+
+// RunSweeper sweeps idle keys every interval until ctx is done, so that
+// their memory is released even if no more attempts are made.
+func (h *AttemptCounter) RunSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.Sweep()
+		}
+	}
+}
+
+// Size returns number of public keys attempts are tracked for.
+func (h *AttemptCounter) Size() int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return len(h.attempts)
+}
+
+// Evictions returns number of keys evicted because maxKeys were tracked.
+func (h *AttemptCounter) Evictions() uint64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.evictions
+}
+
+// Windows are ordered by their latest attempt, so idle ones are at the tail.
+// Once its theoretical arrival time passes a key has its whole limit available
+// and is as good as a new one, which is at most an hour after its latest
+// attempt whatever the limit.
+func (h *AttemptCounter) sweep(curTime int64) {
+	for h.tail != nil && h.tail.tat <= curTime {
+		h.remove(h.tail)
+	}
+}
+
+func (h *AttemptCounter) remove(w *attemptWindow) {
+	h.unlink(w)
+	delete(h.attempts, w.pk)
+}
+
+func (h *AttemptCounter) unlink(w *attemptWindow) {
+	if w.prev != nil {
+		w.prev.next = w.next
+	} else {
+		h.head = w.next
+	}
+	if w.next != nil {
+		w.next.prev = w.prev
+	} else {
+		h.tail = w.prev
+	}
+	w.prev, w.next = nil, nil
+}
+
+func (h *AttemptCounter) pushFront(w *attemptWindow) {
+	w.next = h.head
+	if h.head != nil {
+		h.head.prev = w
+	}
+	h.head = w
+	if h.tail == nil {
+		h.tail = w
+	}
+}
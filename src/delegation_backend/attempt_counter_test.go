@@ -0,0 +1,314 @@
+package delegation_backend
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"runtime"
+	"sync"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+const s time.Duration = 1000000000
+const m time.Duration = 60 * s
+const h time.Duration = 60 * m
+
+type timeMock struct {
+	mutex sync.RWMutex
+	time  time.Time
+}
+
+func (t *timeMock) Now() time.Time {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.time
+}
+
+func (t *timeMock) Set1971() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.time = time.Date(1971, 8, 11, 14, 37, 12, 0, time.UTC)
+}
+
+func (t *timeMock) Advance(dur time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.time = t.time.Add(dur)
+}
+
+func newTestAttemptCounter(maxAttemptPerHour int) (*AttemptCounter, *timeMock) {
+	th := NewAttemptCounter(maxAttemptPerHour, 0)
+	tm := new(timeMock)
+	tm.time = time.Now()
+	th.now = func() time.Time { return tm.Now() }
+	return th, tm
+}
+
+func mkPk() Pk {
+	var a Pk
+	rand.Read(a[:])
+	return a
+}
+
+func TestZeroMaxAttempt(t *testing.T) {
+	counter, mock := newTestAttemptCounter(0)
+	pk := mkPk()
+	if counter.RecordAttempt(pk) {
+		t.FailNow()
+	}
+	if counter.RecordAttempt(pk) {
+		t.FailNow()
+	}
+	mock.Advance(h)
+	if counter.RecordAttempt(pk) {
+		t.FailNow()
+	}
+}
+
+type MaxAttempt int
+
+func (MaxAttempt) Generate(r *rand.Rand, size int) reflect.Value {
+	p := MaxAttempt(r.Intn(100) + 1)
+	return reflect.ValueOf(p)
+}
+
+func TestManyAttempts(t *testing.T) {
+	pk := mkPk()
+	f := func(maxAttempt MaxAttempt) bool {
+		counter, timeMock := newTestAttemptCounter(int(maxAttempt))
+		interval := h / time.Duration(maxAttempt)
+		for j := 0; j < 2; j++ {
+			// The whole limit is available at once
+			for i := MaxAttempt(0); i < maxAttempt; i++ {
+				if !counter.RecordAttempt(pk) {
+					return false
+				}
+			}
+			if counter.RecordAttempt(pk) {
+				return false
+			}
+			// And refilled by one attempt per interval
+			timeMock.Advance(interval - s)
+			if counter.RecordAttempt(pk) {
+				return false
+			}
+			timeMock.Advance(s)
+			if !counter.RecordAttempt(pk) {
+				return false
+			}
+			if counter.RecordAttempt(pk) {
+				return false
+			}
+			timeMock.Advance(h)
+		}
+		return true
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTwoPks(t *testing.T) {
+	pk1 := mkPk()
+	pk2 := mkPk()
+	counter, timeMock := newTestAttemptCounter(1)
+	if !counter.RecordAttempt(pk1) {
+		t.FailNow()
+	}
+	if counter.RecordAttempt(pk1) {
+		t.FailNow()
+	}
+	timeMock.Advance(30 * m)
+	if !counter.RecordAttempt(pk2) {
+		t.FailNow()
+	}
+	if counter.RecordAttempt(pk2) {
+		t.FailNow()
+	}
+	timeMock.Advance(30 * m)
+	if counter.RecordAttempt(pk2) {
+		t.FailNow()
+	}
+	if !counter.RecordAttempt(pk1) {
+		t.FailNow()
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	counter, mock := newTestAttemptCounter(2)
+	pk := mkPk()
+	ctx := context.Background()
+	counter.Allow(ctx, pk, 0)
+	mock.Advance(10 * m)
+	counter.Allow(ctx, pk, 0)
+	mock.Advance(5 * m)
+	// An attempt is refilled every 30 minutes since the first one
+	if ok, retryAfter, err := counter.Allow(ctx, pk, 0); ok || err != nil || retryAfter != 15*m {
+		t.Fatalf("unexpected result: %v, %v, %v", ok, retryAfter, err)
+	}
+	mock.Advance(15 * m)
+	if ok, _, _ := counter.Allow(ctx, pk, 0); !ok {
+		t.FailNow()
+	}
+	if ok, retryAfter, _ := counter.Allow(ctx, pk, 0); ok || retryAfter != 30*m {
+		t.Fatalf("unexpected result: %v, %v", ok, retryAfter)
+	}
+	// Limit of a whitelist entry overrides the default one
+	pk2 := mkPk()
+	for i := 0; i < 3; i++ {
+		if ok, _, _ := counter.Allow(ctx, pk2, 3); !ok {
+			t.FailNow()
+		}
+	}
+	if ok, retryAfter, _ := counter.Allow(ctx, pk2, 3); ok || retryAfter != 20*m {
+		t.Fatalf("unexpected result: %v, %v", ok, retryAfter)
+	}
+}
+
+func TestSweepIdleKeys(t *testing.T) {
+	counter, mock := newTestAttemptCounter(2)
+	pk1, pk2 := mkPk(), mkPk()
+	counter.RecordAttempt(pk1)
+	mock.Advance(20 * m)
+	counter.RecordAttempt(pk2)
+	mock.Advance(20 * m)
+	counter.Sweep()
+	if counter.Size() != 1 || counter.attempts[pk1] != nil {
+		t.Fatalf("expected idle key to be swept, %d keys tracked", counter.Size())
+	}
+	// Keys are swept on every attempt as well
+	mock.Advance(20 * m)
+	counter.RecordAttempt(pk1)
+	if counter.Size() != 1 || counter.attempts[pk2] != nil {
+		t.Fatalf("expected idle key to be swept, %d keys tracked", counter.Size())
+	}
+	mock.Advance(h)
+	counter.Sweep()
+	if counter.Size() != 0 || counter.head != nil || counter.tail != nil {
+		t.Fatal("expected all keys to be swept")
+	}
+}
+
+func TestMaxKeys(t *testing.T) {
+	counter, mock := newTestAttemptCounter(1)
+	counter.maxKeys = 2
+	pk1, pk2, pk3 := mkPk(), mkPk(), mkPk()
+	counter.RecordAttempt(pk1)
+	mock.Advance(m)
+	counter.RecordAttempt(pk2)
+	mock.Advance(m)
+	// Rejected attempt makes the key recently active,
+	// so that a throttled key can't get a fresh limit by being evicted
+	if counter.RecordAttempt(pk1) {
+		t.FailNow()
+	}
+	if !counter.RecordAttempt(pk3) {
+		t.FailNow()
+	}
+	if counter.Size() != 2 || counter.Evictions() != 1 || counter.attempts[pk2] != nil {
+		t.Fatalf("expected least recently active key to be evicted, %d keys tracked", counter.Size())
+	}
+	if counter.RecordAttempt(pk1) || counter.RecordAttempt(pk3) {
+		t.Fatal("expected tracked keys to keep their attempts")
+	}
+}
+
+func TestClockGoingBackwards(t *testing.T) {
+	counter, mock := newTestAttemptCounter(2)
+	pk := mkPk()
+	counter.RecordAttempt(pk)
+	mock.Advance(-10 * m)
+	// The key doesn't get its limit back, attempts it made stay
+	// accounted until the clock catches up
+	if ok, retryAfter, _ := counter.Allow(context.Background(), pk, 0); ok || retryAfter != 10*m {
+		t.Fatalf("unexpected result: %v, %v", ok, retryAfter)
+	}
+	mock.Advance(10 * m)
+	if ok, _, _ := counter.Allow(context.Background(), pk, 0); !ok {
+		t.FailNow()
+	}
+}
+
+// Memory of the counter stays bounded by the key limit,
+// however many distinct keys make attempts
+func BenchmarkAttemptCounterDistinctKeys(b *testing.B) {
+	for _, maxKeys := range []int{10000, 100000} {
+		b.Run(fmt.Sprintf("max_keys=%d", maxKeys), func(b *testing.B) {
+			counter := NewAttemptCounter(120, maxKeys)
+			pks := make([]Pk, 1<<16)
+			for i := range pks {
+				pks[i] = mkPk()
+			}
+			var before runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// Distinct keys without keeping millions of them in the benchmark
+				pk := pks[i%len(pks)]
+				pk[0], pk[1], pk[2] = byte(i>>16), byte(i>>24), byte(i>>32)
+				counter.RecordAttempt(pk)
+			}
+			b.StopTimer()
+			var after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+			b.ReportMetric(float64(counter.Size()), "keys")
+			b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/float64(1<<20), "heap-MB")
+		})
+	}
+}
+
+// Memory a key takes doesn't depend on its limit or how many attempts
+// it made, here every key uses up its whole limit
+func BenchmarkAttemptCounterKeysAtLimit(b *testing.B) {
+	counter, _ := newTestAttemptCounter(120)
+	var before runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	b.ResetTimer()
+	var pk Pk
+	for i := 0; i < b.N; i++ {
+		pk[0], pk[1], pk[2], pk[3] = byte(i), byte(i>>8), byte(i>>16), byte(i>>24)
+		for counter.RecordAttempt(pk) {
+		}
+	}
+	b.StopTimer()
+	var after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(counter.Size()), "keys")
+	b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/float64(counter.Size()), "heap-B/key")
+}
+
+func BenchmarkAttemptCounterSameKey(b *testing.B) {
+	counter := NewAttemptCounter(120, 0)
+	pk := mkPk()
+	for i := 0; i < b.N; i++ {
+		counter.RecordAttempt(pk)
+	}
+}
+
+func BenchmarkAttemptCounterIdleKeys(b *testing.B) {
+	counter, mock := newTestAttemptCounter(120)
+	for i := 0; i < b.N; i++ {
+		counter.RecordAttempt(mkPk())
+		// Every key becomes idle after a few dozen others
+		mock.Advance(s)
+	}
+	b.ReportMetric(float64(counter.Size()), "keys")
+}
+
+func BenchmarkAttemptCounterParallel(b *testing.B) {
+	counter := NewAttemptCounter(120, 100000)
+	b.RunParallel(func(pb *testing.PB) {
+		pk := mkPk()
+		for i := 0; pb.Next(); i++ {
+			pk[0], pk[1] = byte(i), byte(i>>8)
+			counter.RecordAttempt(pk)
+		}
+	})
+}
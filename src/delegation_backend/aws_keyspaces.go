@@ -114,7 +114,6 @@ func sigv4Authentication(config *AwsKeyspacesConfig) (sigv4.AwsAuthenticator, er
 type KeyspaceContext struct {
 	Session  *gocql.Session
 	Keyspace string
-	Context  context.Context
 	Log      *logging.ZapEventLogger
 }
 
@@ -128,27 +127,21 @@ func calculateShard(submittedAt time.Time) int {
 	return (3600*hour + 60*minute + second) / 144
 }
 
-// Estimate the size of the raw block in bytes.
-// In Go, len() returns the number of bytes in a slice, which should suffice for a rough estimation.
-func calculateBlockSize(rawBlock []byte) int {
-	return len(rawBlock)
-}
-
 // Insert a submission into the Keyspaces database
-func (kc *KeyspaceContext) insertSubmission(submission *Submission) error {
+func (kc *KeyspaceContext) insertSubmission(ctx context.Context, submission *Submission) error {
 	return ExponentialBackoff(func() error {
-		if submission.RawBlock == nil {
-			kc.Log.Error("KeyspaceSave: Block is missing in the submission, which is not expected, but inserting without raw_block")
-			if err := kc.insertSubmissionWithoutRawBlock(submission); err != nil {
+		if submission.blockSize > int64(MAX_BLOCK_SIZE) {
+			kc.Log.Infof("KeyspaceSave: Block too large (%d bytes), inserting without raw_block", submission.blockSize)
+			if err := kc.insertSubmissionWithoutRawBlock(ctx, submission); err != nil {
 				return err
 			}
-		} else if calculateBlockSize(submission.RawBlock) > MAX_BLOCK_SIZE {
-			kc.Log.Infof("KeyspaceSave: Block too large (%d bytes), inserting without raw_block", calculateBlockSize(submission.RawBlock))
-			if err := kc.insertSubmissionWithoutRawBlock(submission); err != nil {
+		} else if submission.RawBlock == nil {
+			kc.Log.Error("KeyspaceSave: Block is missing in the submission, which is not expected, but inserting without raw_block")
+			if err := kc.insertSubmissionWithoutRawBlock(ctx, submission); err != nil {
 				return err
 			}
 		} else {
-			if err := kc.insertSubmissionWithRawBlock(submission); err != nil {
+			if err := kc.insertSubmissionWithRawBlock(ctx, submission); err != nil {
 				return err
 			}
 
@@ -158,8 +151,8 @@ func (kc *KeyspaceContext) insertSubmission(submission *Submission) error {
 	}, maxRetries, initialBackoff)
 }
 
-func (kc *KeyspaceContext) insertSubmissionWithoutRawBlock(submission *Submission) error {
-	query := "INSERT INTO " + kc.Keyspace + ".submissions (submitted_at_date, shard, submitted_at, submitter, remote_addr, peer_id, snark_work, block_hash, created_at, graphql_control_port, built_with_commit_sha) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+func (kc *KeyspaceContext) insertSubmissionWithoutRawBlock(ctx context.Context, submission *Submission) error {
+	query := "INSERT INTO " + kc.Keyspace + ".submissions (submitted_at_date, shard, submitted_at, submitter, remote_addr, peer_id, snark_work, block_hash, created_at, graphql_control_port, built_with_commit_sha, state_hash, parent, height, slot) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
 	values := []interface{}{
 		submission.SubmittedAtDate,
 		calculateShard(submission.SubmittedAt),
@@ -172,12 +165,16 @@ func (kc *KeyspaceContext) insertSubmissionWithoutRawBlock(submission *Submissio
 		submission.CreatedAt,
 		submission.GraphqlControlPort,
 		submission.BuiltWithCommitSha,
+		submission.StateHash,
+		submission.Parent,
+		submission.Height,
+		submission.Slot,
 	}
-	return kc.Session.Query(query, values...).Exec()
+	return kc.Session.Query(query, values...).WithContext(ctx).Exec()
 }
 
-func (kc *KeyspaceContext) insertSubmissionWithRawBlock(submission *Submission) error {
-	query := "INSERT INTO " + kc.Keyspace + ".submissions (submitted_at_date, shard, submitted_at, submitter, remote_addr, peer_id, snark_work, block_hash, created_at, graphql_control_port, built_with_commit_sha, raw_block) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+func (kc *KeyspaceContext) insertSubmissionWithRawBlock(ctx context.Context, submission *Submission) error {
+	query := "INSERT INTO " + kc.Keyspace + ".submissions (submitted_at_date, shard, submitted_at, submitter, remote_addr, peer_id, snark_work, block_hash, created_at, graphql_control_port, built_with_commit_sha, state_hash, parent, height, slot, raw_block) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
 	values := []interface{}{
 		submission.SubmittedAtDate,
 		calculateShard(submission.SubmittedAt),
@@ -190,22 +187,41 @@ func (kc *KeyspaceContext) insertSubmissionWithRawBlock(submission *Submission)
 		submission.CreatedAt,
 		submission.GraphqlControlPort,
 		submission.BuiltWithCommitSha,
+		submission.StateHash,
+		submission.Parent,
+		submission.Height,
+		submission.Slot,
 		submission.RawBlock,
 	}
-	return kc.Session.Query(query, values...).Exec()
+	return kc.Session.Query(query, values...).WithContext(ctx).Exec()
+}
+
+func (kc *KeyspaceContext) Name() string {
+	return "keyspaces"
 }
 
-// KeyspaceSave saves the provided objects into Amazon Keyspaces.
-func (kc *KeyspaceContext) KeyspaceSave(objs ObjectsToSave) {
+// Save saves the provided objects into Amazon Keyspaces.
+func (kc *KeyspaceContext) Save(ctx context.Context, objs ObjectsToSave) error {
 	submissionToSave, err := objectToSaveToSubmission(objs, kc.Log)
 	if err != nil {
 		kc.Log.Errorf("KeyspaceSave: Error preparing submission for saving: %v", err)
-		return
+		return err
 	}
 	kc.Log.Infof("KeyspaceSave: Saving submission for block: %v, submitter: %v, submitted_at: %v", submissionToSave.BlockHash, submissionToSave.Submitter, submissionToSave.SubmittedAt)
-	if err := kc.insertSubmission(submissionToSave); err != nil {
+	if err := kc.insertSubmission(ctx, submissionToSave); err != nil {
 		kc.Log.Errorf("KeyspaceSave: Error saving submission to Keyspaces: %v", err)
+		return err
 	}
+	return nil
+}
+
+func (kc *KeyspaceContext) HealthCheck(ctx context.Context) error {
+	return kc.Session.Query("SELECT now() FROM system.local").WithContext(ctx).Exec()
+}
+
+func (kc *KeyspaceContext) Close() error {
+	kc.Session.Close()
+	return nil
 }
 
 func createSchemaMigrationsTableIfNotExists(session *gocql.Session, keyspace string) error {
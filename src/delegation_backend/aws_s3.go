@@ -0,0 +1,154 @@
+package delegation_backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	logging "github.com/ipfs/go-log/v2"
+)
+
+type AwsContext struct {
+	Client      *s3.Client
+	BucketName  *string
+	Prefix      string
+	Log         *logging.ZapEventLogger
+	Compression BlockCompression // of blocks at rest
+	TempDir     string           // of blocks being compressed, os.TempDir() if empty
+}
+
+// NewAwsContext creates an S3 client for the bucket described by appCfg.
+func NewAwsContext(ctx context.Context, appCfg AppConfig, log *logging.ZapEventLogger) (*AwsContext, error) {
+	compression, err := ParseBlockCompression(appCfg.BlockCompression)
+	if err != nil {
+		return nil, err
+	}
+	awsCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(appCfg.Aws.Region))
+	if err != nil {
+		return nil, fmt.Errorf("error loading AWS configuration: %w", err)
+	}
+	return &AwsContext{
+		Client:      s3.NewFromConfig(awsCfg),
+		BucketName:  aws.String(GetAWSBucketName(appCfg)),
+		Prefix:      appCfg.NetworkName,
+		Log:         log,
+		Compression: compression,
+		TempDir:     appCfg.BlockTempDir,
+	}, nil
+}
+
+func (ctx *AwsContext) Name() string {
+	return "s3"
+}
+
+// Save uploads the provided objects into the S3 bucket under the network prefix,
+// streaming them from their sources. Blocks that are already present in the
+// bucket are not uploaded again.
+func (ctx *AwsContext) Save(c context.Context, objs ObjectsToSave) error {
+	var failed []string
+	var lastErr error
+	for path, src := range objs {
+		fullKey := aws.String(ctx.Prefix + "/" + ctx.Compression.Path(path))
+		if strings.HasPrefix(path, "blocks/") && ctx.blockExists(c, path) {
+			//block already exists, skipping
+			continue
+		}
+
+		input := &s3.PutObjectInput{
+			Bucket:     ctx.BucketName,
+			Key:        fullKey,
+			ContentMD5: nil,
+		}
+		if strings.HasPrefix(path, "blocks/") && ctx.Compression != BLOCK_COMPRESSION_NONE {
+			// Lets HTTP clients decompress the block transparently
+			input.ContentEncoding = aws.String(string(ctx.Compression))
+		}
+		ctx.Log.Infof("S3Save: saving %s", path)
+		if err := ctx.putObject(c, input, path, src); err != nil {
+			ctx.Log.Warnf("S3Save: Error while saving %s: %v", path, err)
+			failed = append(failed, path)
+			lastErr = err
+		}
+	}
+	if lastErr != nil {
+		return fmt.Errorf("failed to save %s: %w", strings.Join(failed, ", "), lastErr)
+	}
+	return nil
+}
+
+// putObject uploads the object from its source. Size of a compressed block
+// isn't known upfront, so it's compressed into a temporary file first.
+func (ctx *AwsContext) putObject(c context.Context, input *s3.PutObjectInput, path string, src ObjectSource) error {
+	if input.ContentEncoding != nil {
+		f, err := os.CreateTemp(ctx.TempDir, "s3-block-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		if err := ctx.Compression.Encode(f, path, src); err != nil {
+			return fmt.Errorf("error while compressing: %w", err)
+		}
+		size, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		src = io.NewSectionReader(f, 0, size)
+	}
+	input.Body = objectReader(src)
+	input.ContentLength = src.Size()
+	_, err := ctx.Client.PutObject(c, input)
+	return err
+}
+
+// blockExists checks whether the block was saved with any compression
+func (ctx *AwsContext) blockExists(c context.Context, path string) bool {
+	for _, p := range savedPaths(path) {
+		_, err := ctx.Client.HeadObject(c, &s3.HeadObjectInput{
+			Bucket: ctx.BucketName,
+			Key:    aws.String(ctx.Prefix + "/" + p),
+		})
+		if err == nil {
+			return true
+		}
+		if !strings.Contains(err.Error(), "NotFound") {
+			ctx.Log.Warnf("S3Save: Error when checking if block exists, but will continue with block save: %s, error: %v", p, err)
+		}
+	}
+	return false
+}
+
+// ReadBlock reads a block saved with any compression, decompressing it.
+func (ctx *AwsContext) ReadBlock(c context.Context, blockHash string) ([]byte, error) {
+	return readBlock(blockHash, func(path string) ([]byte, bool, error) {
+		obj, err := ctx.Client.GetObject(c, &s3.GetObjectInput{
+			Bucket: ctx.BucketName,
+			Key:    aws.String(ctx.Prefix + "/" + path),
+		})
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, false, nil
+		} else if err != nil {
+			return nil, false, err
+		}
+		defer obj.Body.Close()
+		bs, err := io.ReadAll(obj.Body)
+		return bs, err == nil, err
+	})
+}
+
+func (ctx *AwsContext) HealthCheck(c context.Context) error {
+	_, err := ctx.Client.HeadBucket(c, &s3.HeadBucketInput{Bucket: ctx.BucketName})
+	return err
+}
+
+func (ctx *AwsContext) Close() error {
+	return nil
+}
@@ -0,0 +1,265 @@
+package delegation_backend
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/btcsuite/btcutil/base58"
+)
+
+// Max length of hashes serialized as strings in the protocol state
+const MAX_BLOCK_STRING_LENGTH = 64
+
+// Max number of sub-window densities in the consensus state
+const MAX_SUB_WINDOWS = 64
+
+// Format of blocks decodeBlock decodes, the only one supported:
+// Mina 1.x, as on mainnet before the 2024 hard fork
+const BLOCK_FORMAT_LEGACY = "legacy"
+
+var errUndecodableBlock = errors.New("undecodable block")
+var errUnsupportedBlockFormat = errors.New("block is not in the legacy format")
+
+// BlockInfo holds fields of a block decoded from its protocol state
+type BlockInfo struct {
+	StateHash string // base58check-encoded state hash of the block
+	Parent    string // base58check-encoded state hash of the parent block
+	Height    uint32 // blockchain length
+	Slot      uint32 // global slot since genesis
+}
+
+// decodeBlock decodes the protocol state of a block serialized as in
+// mainnet (Mina 1.x), i.e. bin_prot of External_transition.Stable.V1 in
+// which every versioned type is prefixed with its version, and computes
+// its state hash.
+//
+// The protocol state comes first in a block and is decoded as a whole, the
+// proof and the staged ledger diff following it are not. Blocks of later
+// protocol versions, which aren't versioned, are told apart by their start
+// and fail with errUnsupportedBlockFormat.
+func decodeBlock(r io.Reader) (*BlockInfo, error) {
+	d := &binProtDecoder{r: bufio.NewReaderSize(r, 1024)}
+	var s legacyProtocolState
+
+	if prefix, _ := d.r.Peek(len(legacyBlockPrefix)); !bytes.Equal(prefix, legacyBlockPrefix) {
+		return nil, fmt.Errorf("%w: %w", errUndecodableBlock, errUnsupportedBlockFormat)
+	}
+
+	// External_transition, Protocol_state.Value and its Poly
+	d.versions(3)
+	d.versions(1)
+	s.previousStateHash = d.field()
+	// Protocol_state.Body.Value and its Poly
+	d.versions(2)
+	d.versions(1)
+	s.genesisStateHash = d.field()
+
+	// Blockchain_state.Value and its Poly
+	d.versions(2)
+	// Staged_ledger_hash, its Poly and Non_snark
+	d.versions(3)
+	d.versions(1)
+	s.ledgerHash = d.field()
+	d.versions(1)
+	s.auxHash = d.string()
+	d.versions(1)
+	s.pendingCoinbaseAux = d.string()
+	d.versions(2)
+	s.pendingCoinbaseHash = d.field()
+	d.versions(1)
+	s.snarkedLedgerHash = d.field()
+	d.versions(1)
+	s.genesisLedgerHash = d.field()
+	d.versions(3)
+	s.snarkedNextAvailableToken = d.uint()
+	d.versions(2)
+	s.timestamp = d.uint()
+
+	// Consensus_state.Value and its Poly
+	d.versions(2)
+	s.blockchainLength = d.uint32()
+	s.epochCount = d.uint32()
+	s.minWindowDensity = d.uint32()
+	subWindows := d.uint()
+	if subWindows > MAX_SUB_WINDOWS {
+		d.fail(fmt.Errorf("too many sub-windows: %d", subWindows))
+	}
+	for i := uint64(0); i < subWindows && d.err == nil; i++ {
+		s.subWindowDensities = append(s.subWindowDensities, d.uint32())
+	}
+	d.versions(1)
+	s.lastVrfOutput = d.string()
+	d.versions(2)
+	s.totalCurrency = d.uint()
+	// Global_slot and its Poly
+	d.versions(2)
+	s.currSlot = d.uint32()
+	s.slotsPerEpoch = d.uint32()
+	s.globalSlotSinceGenesis = d.uint32()
+	s.stakingEpochData = d.epochData()
+	s.nextEpochData = d.epochData()
+	s.hasAncestorInSameCheckpointWindow = d.bool()
+	s.blockStakeWinner = d.publicKey()
+	s.blockCreator = d.publicKey()
+	s.coinbaseReceiver = d.publicKey()
+	s.superchargeCoinbase = d.bool()
+
+	// Protocol_constants_checked.Value and its Poly
+	d.versions(2)
+	s.k = d.uint32()
+	s.constSlotsPerEpoch = d.uint32()
+	s.slotsPerSubWindow = d.uint32()
+	s.delta = d.uint32()
+	d.versions(2)
+	s.genesisStateTimestamp = d.uint()
+
+	if d.err != nil {
+		return nil, fmt.Errorf("%w: %w", errUndecodableBlock, d.err)
+	}
+	stateHash, err := s.hash()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errUndecodableBlock, err)
+	}
+	return &BlockInfo{
+		StateHash: encodeStateHash(stateHash),
+		Parent:    encodeStateHash(s.previousStateHash),
+		Height:    s.blockchainLength,
+		Slot:      s.globalSlotSinceGenesis,
+	}, nil
+}
+
+func encodeStateHash(hash [32]byte) string {
+	return base58.CheckEncode(append(BLOCK_HASH_PREFIX[:], hash[:]...), BASE58CHECK_VERSION_BLOCK_HASH)
+}
+
+// Versions a legacy block starts with, up to the parent state hash
+var legacyBlockPrefix = []byte{1, 1, 1, 1}
+
+// Decoder of bin_prot values, once an error occurs it's kept
+// and zero values are returned
+type binProtDecoder struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (d *binProtDecoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+func (d *binProtDecoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	b, err := d.r.ReadByte()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	d.fail(err)
+	return b
+}
+
+func (d *binProtDecoder) bytes(n int) []byte {
+	bs := make([]byte, n)
+	if d.err != nil {
+		return bs
+	}
+	_, err := io.ReadFull(d.r, bs)
+	d.fail(err)
+	return bs
+}
+
+// versions reads n version prefixes of versioned types, all of them being 1
+func (d *binProtDecoder) versions(n int) {
+	for i := 0; i < n; i++ {
+		if v := d.uint(); v != 1 && d.err == nil {
+			d.fail(fmt.Errorf("unexpected version %d", v))
+		}
+	}
+}
+
+// Field elements are serialized as 32 bytes, little-endian
+func (d *binProtDecoder) field() (res [32]byte) {
+	copy(res[:], d.bytes(len(res)))
+	return
+}
+
+// uint reads a non-negative bin_prot integer, which is a single byte for
+// values below 0x80 and otherwise a code of its size followed by the value
+func (d *binProtDecoder) uint() uint64 {
+	code := d.byte()
+	var size int
+	switch {
+	case code < 0x80:
+		return uint64(code)
+	case code == 0xfe:
+		size = 2
+	case code == 0xfd:
+		size = 4
+	case code == 0xfc:
+		size = 8
+	default:
+		d.fail(fmt.Errorf("unexpected integer code %#x", code))
+		return 0
+	}
+	var res uint64
+	for i, b := range d.bytes(size) {
+		res |= uint64(b) << (8 * i)
+	}
+	return res
+}
+
+// Versioned 32-bit unsigned integers are prefixed with two versions
+func (d *binProtDecoder) uint32() uint32 {
+	d.versions(2)
+	v := d.uint()
+	if v > 0xffffffff {
+		d.fail(fmt.Errorf("integer %d exceeds 32 bits", v))
+	}
+	return uint32(v)
+}
+
+func (d *binProtDecoder) string() []byte {
+	n := d.uint()
+	if n > MAX_BLOCK_STRING_LENGTH {
+		d.fail(fmt.Errorf("string of %d bytes is too long", n))
+		return nil
+	}
+	return d.bytes(int(n))
+}
+
+func (d *binProtDecoder) bool() bool {
+	b := d.byte()
+	if b > 1 {
+		d.fail(fmt.Errorf("unexpected boolean %#x", b))
+	}
+	return b == 1
+}
+
+func (d *binProtDecoder) epochData() (res legacyEpochData) {
+	// Epoch_data.Value, its Poly, Epoch_ledger.Value and its Poly
+	d.versions(4)
+	d.versions(1)
+	res.ledgerHash = d.field()
+	d.versions(2)
+	res.totalCurrency = d.uint()
+	d.versions(1)
+	res.seed = d.field()
+	d.versions(1)
+	res.startCheckpoint = d.field()
+	d.versions(1)
+	res.lockCheckpoint = d.field()
+	res.epochLength = d.uint32()
+	return
+}
+
+func (d *binProtDecoder) publicKey() (res legacyPublicKey) {
+	d.versions(2)
+	res.x = d.field()
+	res.isOdd = d.bool()
+	return
+}
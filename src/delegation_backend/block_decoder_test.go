@@ -0,0 +1,106 @@
+package delegation_backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/ipfs/go-log/v2"
+)
+
+func testBlock(n string, t *testing.T) []byte {
+	var req submitRequest
+	body := readTestFile(n, t)
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatalf("failed decoding test file %s", n)
+	}
+	// Payload files hold data of a request only
+	if req.Data.Block == nil {
+		if err := json.Unmarshal(body, &req.Data); err != nil || req.Data.Block == nil {
+			t.Fatalf("failed decoding test file %s", n)
+		}
+	}
+	return req.Data.Block.data
+}
+
+func TestDecodeBlock(t *testing.T) {
+	for f, expected := range map[string]BlockInfo{
+		"req-no-snark": {StateHash: "3NK66LNVEVgexShWSCrLtUfTYmGJ6hbTPjvxk3GxcaZzHMTigyL2",
+			Parent: "3NLtSrwrJamrbyeugyvCvg63VUj5eQmipDPgERw756GVWyrEQsiS", Height: 41849, Slot: 58773},
+		"payload-1": {StateHash: "3NL9Bm7aMppMWcPnDEMje1mYMqvyFGoWwfckjkGj7TCfaLUeNnM9",
+			Parent: "3NLCGe1MBGfRssNZK4PUs5noiGuGHebECfLh1NCfth8jaLBcYRZT", Height: 40429, Slot: 56721},
+		"payload-no-snark": {StateHash: "3NKTgwbyczRG9xJpxX6A5s78WP92fZ8VscV3brbV7coM2FvTDAm8",
+			Parent: "3NKMCUPC2pNPSanpioUSgWzADUMuUku9GVnchoBhkYMsNtibCPHj", Height: 42467, Slot: 59661},
+	} {
+		info, err := decodeBlock(bytes.NewReader(testBlock(f, t)))
+		if err != nil {
+			t.Fatalf("%s: %v", f, err)
+		}
+		if *info != expected {
+			t.Fatalf("%s: unexpected block info %+v", f, info)
+		}
+	}
+
+	block := testBlock("req-no-snark", t)
+	wrongVersion := append([]byte{2}, block[1:]...)
+	// Parent state hash that isn't a field element
+	outOfRange := append([]byte(nil), block...)
+	copy(outOfRange[len(legacyBlockPrefix):], bytes.Repeat([]byte{0xff}, 32))
+	for name, bs := range map[string][]byte{
+		"truncated":      block[:500],
+		"empty":          {},
+		"wrong version":  wrongVersion,
+		"out of range":   outOfRange,
+		"garbage":        bytes.Repeat([]byte{0xab}, 1000),
+		"unversioned":    testBlock("req-v1-with-snark", t),
+		"invalid string": append(append([]byte(nil), block[:109]...), 0xfc, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0),
+	} {
+		if _, err := decodeBlock(bytes.NewReader(bs)); !errors.Is(err, errUndecodableBlock) {
+			t.Fatalf("%s: expected block to be undecodable, got %v", name, err)
+		}
+	}
+	// Blocks of later protocol versions are told apart
+	if _, err := decodeBlock(bytes.NewReader(testBlock("req-v1-with-snark", t))); !errors.Is(err, errUnsupportedBlockFormat) {
+		t.Fatalf("expected unsupported block format, got %v", err)
+	}
+}
+
+func TestSubmitDecodedBlock(t *testing.T) {
+	body := readTestFile("req-no-snark", t)
+	var req submitRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal("failed decoding test file")
+	}
+	storage, sh, _ := testSubmitH(1, Whitelist{req.Submitter: {}})
+	sh.app.DecodeBlocks = true
+	if rep := sh.testRequest(body); rep.Code != 200 {
+		t.Fatalf("unexpected response: %v", rep)
+	}
+	submission, err := objectToSaveToSubmission(objectsOf(*storage), log.Logger("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if submission.StateHash == nil || *submission.StateHash != "3NK66LNVEVgexShWSCrLtUfTYmGJ6hbTPjvxk3GxcaZzHMTigyL2" ||
+		submission.Parent == nil || *submission.Parent != "3NLtSrwrJamrbyeugyvCvg63VUj5eQmipDPgERw756GVWyrEQsiS" ||
+		submission.Height == nil || *submission.Height != 41849 || submission.Slot == nil || *submission.Slot != 58773 {
+		t.Fatalf("unexpected submission saved: %+v", submission)
+	}
+
+	req.Data.Block = mkB64B(bytes.Repeat([]byte{0xab}, 1000))
+	garbage, _ := json.Marshal(req)
+	rep := sh.testRequest(garbage)
+	if rep.Code != 400 {
+		t.Fatalf("expected 400, got %v", rep)
+	}
+	expectErrorCode(rep, ERR_INVALID_BLOCK, t)
+
+	// Blocks are stored as is unless decoding is enabled
+	storage, sh, _ = testSubmitH(1, Whitelist{req.Submitter: {}})
+	if rep := sh.testRequest(body); rep.Code != 200 {
+		t.Fatalf("unexpected response: %v", rep)
+	}
+	if submission, err := objectToSaveToSubmission(objectsOf(*storage), log.Logger("test")); err != nil || submission.Height != nil {
+		t.Fatalf("unexpected submission saved: %+v, %v", submission, err)
+	}
+}
@@ -0,0 +1,105 @@
+package delegation_backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// CanonicalJSON re-encodes a JSON value in the form v2 submissions are
+// signed in: without insignificant whitespace, with members of every object
+// sorted by key bytewise. Strings are escaped as by encoding/json without
+// HTML escaping, numbers are kept as sent. Objects with duplicate keys are
+// rejected, as their meaning is ambiguous.
+func CanonicalJSON(b []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var buf bytes.Buffer
+	if err := writeCanonicalJSON(dec, &buf); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after JSON value")
+	}
+	return buf.Bytes(), nil
+}
+
+func writeCanonicalJSON(dec *json.Decoder, buf *bytes.Buffer) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch v := tok.(type) {
+	case json.Delim:
+		if v == '[' {
+			buf.WriteByte('[')
+			for i := 0; dec.More(); i++ {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+				if err := writeCanonicalJSON(dec, buf); err != nil {
+					return err
+				}
+			}
+			buf.WriteByte(']')
+		} else {
+			members := make(map[string][]byte)
+			keys := make([]string, 0)
+			for dec.More() {
+				keyTok, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				key := keyTok.(string)
+				if _, has := members[key]; has {
+					return fmt.Errorf("duplicate key %q", key)
+				}
+				var member bytes.Buffer
+				if err := writeCanonicalJSON(dec, &member); err != nil {
+					return err
+				}
+				members[key] = member.Bytes()
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			buf.WriteByte('{')
+			for i, key := range keys {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+				writeCanonicalString(buf, key)
+				buf.WriteByte(':')
+				buf.Write(members[key])
+			}
+			buf.WriteByte('}')
+		}
+		// Closing delimiter
+		_, err = dec.Token()
+		return err
+	case string:
+		writeCanonicalString(buf, v)
+	case json.Number:
+		buf.WriteString(v.String())
+	case bool:
+		if v {
+			buf.WriteString("true")
+		} else {
+			buf.WriteString("false")
+		}
+	case nil:
+		buf.WriteString("null")
+	}
+	return nil
+}
+
+func writeCanonicalString(buf *bytes.Buffer, s string) {
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	// Encoding a string can't fail
+	_ = enc.Encode(s)
+	// Encoder terminates every value with a newline
+	buf.Truncate(buf.Len() - 1)
+}
@@ -0,0 +1,28 @@
+package delegation_backend
+
+import (
+	"testing"
+)
+
+func TestCanonicalJSON(t *testing.T) {
+	for in, expected := range map[string]string{
+		` { "b" : [1, 2.50, {"d": null, "c": true}], "a": "x<y>&é\n" } `:     `{"a":"x<y>&é\n","b":[1,2.50,{"c":true,"d":null}]}`,
+		`{"peer_id":"p","created_at":"2021-07-17T22:39:48Z","block":"AQ=="}`: `{"block":"AQ==","created_at":"2021-07-17T22:39:48Z","peer_id":"p"}`,
+		`[]`:             `[]`,
+		`{}`:             `{}`,
+		`"\u00e9\u2028"`: `"é\u2028"`,
+	} {
+		out, err := CanonicalJSON([]byte(in))
+		if err != nil {
+			t.Fatalf("%s: %v", in, err)
+		}
+		if string(out) != expected {
+			t.Fatalf("%s: expected %s, got %s", in, expected, out)
+		}
+	}
+	for _, in := range []string{`{"a":1,"a":2}`, `{"a":1} {}`, `{"a":`, `{"a" 1}`, ``} {
+		if _, err := CanonicalJSON([]byte(in)); err == nil {
+			t.Fatalf("expected error for %q", in)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package delegation_backend
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Headers proxies in front of the service may record addresses in
+const (
+	PROXY_HEADER_X_FORWARDED_FOR = "x-forwarded-for"
+	PROXY_HEADER_FORWARDED       = "forwarded" // RFC 7239
+)
+
+// TrustedProxies resolves the address of the client of a request passed
+// through proxies, each of which appends address of its peer to a header.
+// The header is read right to left, skipping addresses of trusted proxies,
+// as only entries added by them can be trusted.
+type TrustedProxies struct {
+	prefixes []netip.Prefix
+	// Number of proxies trusted whatever their address, e.g. load balancers
+	// with dynamic addresses
+	hops   int
+	header string
+}
+
+// NewTrustedProxies creates a resolver trusting proxies in the networks,
+// given in CIDR notation or as single addresses, and hops nearest proxies.
+func NewTrustedProxies(networks []string, hops int, header string) (*TrustedProxies, error) {
+	p := &TrustedProxies{hops: hops, header: strings.ToLower(header)}
+	switch p.header {
+	case "":
+		p.header = PROXY_HEADER_X_FORWARDED_FOR
+	case PROXY_HEADER_X_FORWARDED_FOR, PROXY_HEADER_FORWARDED:
+	default:
+		return nil, fmt.Errorf("unsupported proxy header %q, expected %s or %s", header, PROXY_HEADER_X_FORWARDED_FOR, PROXY_HEADER_FORWARDED)
+	}
+	for _, n := range networks {
+		n = strings.TrimSpace(n)
+		if n == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(n)
+		if err != nil {
+			addr, errAddr := netip.ParseAddr(n)
+			if errAddr != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", n, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		p.prefixes = append(p.prefixes, prefix.Masked())
+	}
+	return p, nil
+}
+
+// ClientAddr returns address of the client of the request. With no trusted
+// proxies the address of the connection peer is returned.
+func (p *TrustedProxies) ClientAddr(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	client, err := netip.ParseAddr(host)
+	if err != nil {
+		return client, false
+	}
+	if p == nil || !p.trusted(client, 0) {
+		return client, true
+	}
+	var forwarded []string
+	if p.header == PROXY_HEADER_FORWARDED {
+		forwarded = forwardedFor(r.Header.Values("Forwarded"))
+	} else {
+		for _, h := range r.Header.Values("X-Forwarded-For") {
+			forwarded = append(forwarded, strings.Split(h, ",")...)
+		}
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr, ok := parseNodeAddr(forwarded[i])
+		if !ok {
+			// Address recorded by the last trusted proxy can't be used,
+			// the proxy itself is the best guess then
+			break
+		}
+		client = addr
+		if !p.trusted(addr, len(forwarded)-i) {
+			break
+		}
+	}
+	return client, true
+}
+
+// Address hops away from the service is trusted, the connection peer being 0 hops away
+func (p *TrustedProxies) trusted(addr netip.Addr, hops int) bool {
+	if hops < p.hops {
+		return true
+	}
+	addr = addr.Unmap()
+	for _, prefix := range p.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor extracts `for` parameters of elements of Forwarded headers,
+// elements without it are kept as empty strings
+func forwardedFor(headers []string) []string {
+	var res []string
+	for _, h := range headers {
+		for _, element := range splitQuoted(h, ',') {
+			var node string
+			for _, pair := range splitQuoted(element, ';') {
+				k, v, _ := strings.Cut(strings.TrimSpace(pair), "=")
+				if strings.EqualFold(k, "for") {
+					node = strings.Trim(v, `"`)
+				}
+			}
+			res = append(res, node)
+		}
+	}
+	return res
+}
+
+// Splits s by sep outside of quoted strings
+func splitQuoted(s string, sep byte) []string {
+	var res []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			res = append(res, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(res, s[start:])
+}
+
+// parseNodeAddr parses an address optionally followed by a port, IPv6
+// addresses with a port being enclosed in brackets. Obfuscated identifiers
+// and "unknown" of RFC 7239 are not addresses.
+func parseNodeAddr(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")); err == nil {
+		return addr, true
+	}
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort.Addr(), true
+	}
+	return netip.Addr{}, false
+}
+
+// RequestOrigin is the resolved address of the client of a request,
+// along with the headers proxies record addresses in as received.
+type RequestOrigin struct {
+	// Invalid if RemoteAddr of the request isn't an address
+	Addr          netip.Addr
+	RemoteAddr    string
+	XForwardedFor string
+	Forwarded     string
+}
+
+func (p *TrustedProxies) Origin(r *http.Request) RequestOrigin {
+	origin := RequestOrigin{
+		RemoteAddr:    r.RemoteAddr,
+		XForwardedFor: strings.Join(r.Header.Values("X-Forwarded-For"), ", "),
+		Forwarded:     strings.Join(r.Header.Values("Forwarded"), ", "),
+	}
+	if addr, ok := p.ClientAddr(r); ok {
+		origin.Addr = addr.Unmap()
+		origin.RemoteAddr = origin.Addr.String()
+	}
+	return origin
+}
@@ -0,0 +1,122 @@
+package delegation_backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientAddr(t *testing.T) {
+	for _, c := range []struct {
+		proxies   []string
+		hops      int
+		peer      string
+		forwarded string
+		expected  string
+	}{
+		// Header of untrusted peers is ignored
+		{nil, 0, "192.0.2.1:1234", "198.51.100.1", "192.0.2.1"},
+		{[]string{"10.0.0.0/8"}, 0, "192.0.2.1:1234", "198.51.100.1", "192.0.2.1"},
+		{[]string{"10.0.0.0/8"}, 0, "10.0.0.1:1234", "", "10.0.0.1"},
+		{[]string{"10.0.0.0/8"}, 0, "10.0.0.1:1234", "198.51.100.1", "198.51.100.1"},
+		// Entries prepended by the client are skipped
+		{[]string{"10.0.0.0/8"}, 0, "10.0.0.1:1234", "203.0.113.7, 198.51.100.1", "198.51.100.1"},
+		{[]string{"10.0.0.0/8", "192.0.2.5"}, 0, "10.0.0.1:1234", "203.0.113.7, 198.51.100.1, 192.0.2.5, 10.0.0.2", "198.51.100.1"},
+		{[]string{"2001:db8::/32"}, 0, "[2001:db8::1]:1234", "203.0.113.7, [2001:db8::2]:80", "203.0.113.7"},
+		// Every entry is trusted, the leftmost is the client
+		{[]string{"10.0.0.0/8"}, 0, "10.0.0.1:1234", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+		// Invalid entry recorded by a trusted proxy
+		{[]string{"10.0.0.0/8"}, 0, "10.0.0.1:1234", "198.51.100.1, garbage", "10.0.0.1"},
+		{[]string{"10.0.0.0/8"}, 0, "10.0.0.1:1234", "garbage, 198.51.100.1", "198.51.100.1"},
+		// Nearest proxies trusted by count
+		{nil, 1, "192.0.2.1:1234", "198.51.100.1", "198.51.100.1"},
+		{nil, 1, "192.0.2.1:1234", "203.0.113.7, 198.51.100.1", "198.51.100.1"},
+		{nil, 2, "192.0.2.1:1234", "203.0.113.7, 198.51.100.1", "203.0.113.7"},
+		{nil, 2, "192.0.2.1:1234", "198.51.100.1", "198.51.100.1"},
+		{nil, 1, "192.0.2.1:1234", "garbage", "192.0.2.1"},
+	} {
+		p, err := NewTrustedProxies(c.proxies, c.hops, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("POST", v1Submit, nil)
+		r.RemoteAddr = c.peer
+		if c.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+		if addr, ok := p.ClientAddr(r); !ok || addr.String() != c.expected {
+			t.Errorf("%v, %q: expected %s, got %v", c.proxies, c.forwarded, c.expected, addr)
+		}
+	}
+
+	var none *TrustedProxies
+	r := httptest.NewRequest("POST", v1Submit, nil)
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	if addr, ok := none.ClientAddr(r); !ok || addr.String() != "192.0.2.1" {
+		t.Errorf("expected address of the peer without trusted proxies, got %v", addr)
+	}
+}
+
+func TestClientAddrForwarded(t *testing.T) {
+	p, err := NewTrustedProxies([]string{"10.0.0.0/8"}, 0, "Forwarded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		forwarded []string
+		expected  string
+	}{
+		{[]string{"for=198.51.100.1"}, "198.51.100.1"},
+		{[]string{`for=203.0.113.7;proto=https, For="[2001:db8:cafe::17]:4711";by=10.0.0.2`}, "2001:db8:cafe::17"},
+		{[]string{"for=203.0.113.7", "for=198.51.100.1;by=10.0.0.1", "for=10.0.0.2"}, "198.51.100.1"},
+		{[]string{`for="198.51.100.1:80";host="a,b;c"`}, "198.51.100.1"},
+		{[]string{"for=203.0.113.7, for=unknown"}, "10.0.0.1"},
+		{[]string{"for=_hidden"}, "10.0.0.1"},
+		{[]string{"proto=https"}, "10.0.0.1"},
+	} {
+		r := httptest.NewRequest("POST", v1Submit, nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		for _, f := range c.forwarded {
+			r.Header.Add("Forwarded", f)
+		}
+		// Ignored when proxies record addresses in Forwarded
+		r.Header.Set("X-Forwarded-For", "192.0.2.99")
+		if addr, ok := p.ClientAddr(r); !ok || addr.String() != c.expected {
+			t.Errorf("%q: expected %s, got %v", c.forwarded, c.expected, addr)
+		}
+	}
+
+	if _, err := NewTrustedProxies([]string{"10.0.0.0/33"}, 0, ""); err == nil {
+		t.Error("expected invalid network to be rejected")
+	}
+	if _, err := NewTrustedProxies(nil, 1, "X-Real-Ip"); err == nil {
+		t.Error("expected unsupported header to be rejected")
+	}
+}
+
+func TestSubmitOrigin(t *testing.T) {
+	body := readTestFile("req-no-snark", t)
+	var req submitRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal("failed decoding test file")
+	}
+	storage, sh, tm := testSubmitH(1, Whitelist{req.Submitter: {}})
+	sh.app.Proxies, _ = NewTrustedProxies([]string{"192.0.2.0/24"}, 0, "")
+	r := httptest.NewRequest("POST", v1Submit, bytes.NewReader(body))
+	r.Header.Set("X-Forwarded-For", "203.0.113.7, 198.51.100.1")
+	r.Header.Set("Forwarded", "for=203.0.113.8")
+	rec := httptest.NewRecorder()
+	sh.ServeHTTP(rec, r)
+	if rec.Code != 200 {
+		t.Fatalf("unexpected response: %v", rec)
+	}
+	var meta MetaToBeSaved
+	paths := makePaths(tm.Now(), req.GetBlockDataHash(), req.Submitter)
+	if err := json.Unmarshal((*storage)[paths.Meta], &meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.RemoteAddr != "198.51.100.1" || meta.XForwardedFor != "203.0.113.7, 198.51.100.1" || meta.Forwarded != "for=203.0.113.8" {
+		t.Fatalf("unexpected origin saved: %+v", meta)
+	}
+}
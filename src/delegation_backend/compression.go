@@ -0,0 +1,207 @@
+package delegation_backend
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content encodings of submissions and of blocks at rest
+const (
+	ENCODING_GZIP = "gzip"
+	ENCODING_ZSTD = "zstd"
+)
+
+// Max window of zstd streams, bounding memory used to decompress one
+const ZSTD_MAX_WINDOW = 8 << 20
+
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+var errDecompress = errors.New("failed to decompress")
+var errDecompressedTooLarge = errors.New("decompressed data exceeds the limit")
+
+var ErrBlockNotFound = errors.New("block is not found")
+
+// decompressingReader decompresses r of the Content-Encoding, failing with
+// errDecompressedTooLarge once more than limit bytes are decompressed, so
+// that a small compressed payload can't expand without bounds. Errors of
+// the decompression itself are wrapped into errDecompress.
+func decompressingReader(encoding string, r io.Reader, limit int64) (io.ReadCloser, error) {
+	var dec io.ReadCloser
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return io.NopCloser(r), nil
+	case ENCODING_GZIP:
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errDecompress, err)
+		}
+		dec = gz
+	case ENCODING_ZSTD:
+		zr, err := zstd.NewReader(r,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxWindow(ZSTD_MAX_WINDOW),
+			zstd.WithDecoderMaxMemory(uint64(limit)))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errDecompress, err)
+		}
+		dec = zr.IOReadCloser()
+	default:
+		return nil, fmt.Errorf("%w %q", errUnsupportedEncoding, encoding)
+	}
+	return &limitedDecompressor{r: dec, remaining: limit}, nil
+}
+
+type limitedDecompressor struct {
+	r         io.ReadCloser
+	remaining int64
+}
+
+func (l *limitedDecompressor) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, errDecompressedTooLarge
+	}
+	// Read a byte past the limit to tell whether it's exceeded
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	// zstd refuses frames declaring more than the max memory upfront
+	if l.remaining < 0 || errors.Is(err, zstd.ErrWindowSizeExceeded) || errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+		return n, errDecompressedTooLarge
+	}
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("%w: %w", errDecompress, err)
+	}
+	return n, err
+}
+
+func (l *limitedDecompressor) Close() error {
+	return l.r.Close()
+}
+
+// BlockCompression is the compression of blocks/*.dat objects at rest,
+// which are then saved with the suffix of the compression
+type BlockCompression string
+
+const (
+	BLOCK_COMPRESSION_NONE BlockCompression = ""
+	BLOCK_COMPRESSION_GZIP BlockCompression = ENCODING_GZIP
+	BLOCK_COMPRESSION_ZSTD BlockCompression = ENCODING_ZSTD
+)
+
+// Every block compression, the blocks saved with either of them can be read
+var blockCompressions = []BlockCompression{BLOCK_COMPRESSION_NONE, BLOCK_COMPRESSION_GZIP, BLOCK_COMPRESSION_ZSTD}
+
+func ParseBlockCompression(s string) (BlockCompression, error) {
+	switch strings.ToLower(s) {
+	case "", "none":
+		return BLOCK_COMPRESSION_NONE, nil
+	case ENCODING_GZIP:
+		return BLOCK_COMPRESSION_GZIP, nil
+	case ENCODING_ZSTD:
+		return BLOCK_COMPRESSION_ZSTD, nil
+	}
+	return BLOCK_COMPRESSION_NONE, fmt.Errorf("unknown block compression %q, expected none, gzip or zstd", s)
+}
+
+func (c BlockCompression) Suffix() string {
+	switch c {
+	case BLOCK_COMPRESSION_GZIP:
+		return ".gz"
+	case BLOCK_COMPRESSION_ZSTD:
+		return ".zst"
+	}
+	return ""
+}
+
+// Path returns the path an object is saved at, with the suffix of the
+// compression if it's a block
+func (c BlockCompression) Path(path string) string {
+	if strings.HasPrefix(path, "blocks/") {
+		return path + c.Suffix()
+	}
+	return path
+}
+
+// savedPaths returns every path the object may have been saved at:
+// a block under the suffix of any compression, so that a block saved
+// before the compression was changed isn't saved again
+func savedPaths(path string) []string {
+	if !strings.HasPrefix(path, "blocks/") {
+		return []string{path}
+	}
+	res := make([]string, len(blockCompressions))
+	for i, c := range blockCompressions {
+		res[i] = c.Path(path)
+	}
+	return res
+}
+
+// Encode writes an object to w as it's read, compressing it if it's a block
+func (c BlockCompression) Encode(w io.Writer, path string, src ObjectSource) error {
+	r := objectReader(src)
+	if !strings.HasPrefix(path, "blocks/") || c == BLOCK_COMPRESSION_NONE {
+		_, err := io.Copy(w, r)
+		return err
+	}
+	switch c {
+	case BLOCK_COMPRESSION_GZIP:
+		gz := gzip.NewWriter(w)
+		if _, err := io.Copy(gz, r); err != nil {
+			return err
+		}
+		return gz.Close()
+	case BLOCK_COMPRESSION_ZSTD:
+		enc := zstdEncoders.Get().(*zstd.Encoder)
+		defer zstdEncoders.Put(enc)
+		enc.Reset(w)
+		if _, err := io.Copy(enc, r); err != nil {
+			return err
+		}
+		return enc.Close()
+	}
+	return fmt.Errorf("unknown block compression %q", string(c))
+}
+
+// Decode decompresses a block saved with the compression
+func (c BlockCompression) Decode(bs []byte) ([]byte, error) {
+	if c == BLOCK_COMPRESSION_NONE {
+		return bs, nil
+	}
+	r, err := decompressingReader(string(c), bytes.NewReader(bs), MAX_SUBMIT_PAYLOAD_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// Encoders reused across saves, each of them holds its window
+var zstdEncoders = sync.Pool{New: func() interface{} {
+	// Can only fail on invalid options
+	enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	return enc
+}}
+
+// readBlock reads a block saved with any of the compressions, read returns
+// false if there is no object at the path
+func readBlock(blockHash string, read func(path string) ([]byte, bool, error)) ([]byte, error) {
+	path := "blocks/" + blockHash + ".dat"
+	for _, c := range blockCompressions {
+		bs, found, err := read(c.Path(path))
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			return c.Decode(bs)
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrBlockNotFound, blockHash)
+}
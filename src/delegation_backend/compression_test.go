@@ -0,0 +1,151 @@
+package delegation_backend
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/klauspost/compress/zstd"
+)
+
+func compress(encoding string, bs []byte, t *testing.T) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case ENCODING_GZIP:
+		w = gzip.NewWriter(&buf)
+	case ENCODING_ZSTD:
+		var err error
+		if w, err = zstd.NewWriter(&buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := w.Write(bs); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecompressingReader(t *testing.T) {
+	data := bytes.Repeat([]byte("block"), 1000)
+	for _, encoding := range []string{ENCODING_GZIP, ENCODING_ZSTD} {
+		read := func(compressed []byte, limit int64) ([]byte, error) {
+			r, err := decompressingReader(encoding, bytes.NewReader(compressed), limit)
+			if err != nil {
+				return nil, err
+			}
+			defer r.Close()
+			return io.ReadAll(r)
+		}
+		compressed := compress(encoding, data, t)
+		if bs, err := read(compressed, int64(len(data))); err != nil || !bytes.Equal(bs, data) {
+			t.Fatalf("%s: unexpected decompressed data: %v", encoding, err)
+		}
+		// Bomb expanding way past its own size
+		bomb := compress(encoding, make([]byte, 10<<20), t)
+		if _, err := read(bomb, 1<<20); !errors.Is(err, errDecompressedTooLarge) {
+			t.Fatalf("%s: expected the limit to be exceeded, got %v", encoding, err)
+		}
+		if _, err := read(compressed[:len(compressed)/2], 1<<20); !errors.Is(err, errDecompress) {
+			t.Fatalf("%s: expected truncated data to fail, got %v", encoding, err)
+		}
+	}
+	if _, err := decompressingReader("br", bytes.NewReader(data), 1); !errors.Is(err, errUnsupportedEncoding) {
+		t.Fatalf("expected unsupported encoding, got %v", err)
+	}
+}
+
+func TestSubmitCompressed(t *testing.T) {
+	body := readTestFile("req-with-snark", t)
+	var req submitRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal("failed decoding test file")
+	}
+	request := func(sh *SubmitH, encoding string, body []byte) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", v1Submit, bytes.NewReader(body))
+		r.Header.Set("Content-Encoding", encoding)
+		sh.ServeHTTP(rec, r)
+		return rec
+	}
+	for _, encoding := range []string{ENCODING_GZIP, ENCODING_ZSTD} {
+		objs, sh, tm := testSubmitH(1, Whitelist{req.Submitter: {}})
+		if rep := request(sh, encoding, compress(encoding, body, t)); rep.Code != 200 {
+			t.Fatalf("%s: unexpected response: %v", encoding, rep)
+		}
+		paths := makePaths(tm.Now(), req.GetBlockDataHash(), req.Submitter)
+		if !bytes.Equal((*objs)[paths.Block], req.Data.Block.data) {
+			t.Fatalf("%s: saved block differs from the submitted one", encoding)
+		}
+		bomb := compress(encoding, bytes.Repeat([]byte(" "), MAX_SUBMIT_PAYLOAD_SIZE+1), t)
+		if rep := request(sh, encoding, bomb); rep.Code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("%s: expected 413, got %v", encoding, rep)
+		}
+		if rep := request(sh, encoding, body); rep.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400 for uncompressed body, got %v", encoding, rep)
+		}
+	}
+	_, sh, _ := testSubmitH(1, Whitelist{req.Submitter: {}})
+	if rep := request(sh, "br", body); rep.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected 415, got %v", rep)
+	}
+}
+
+func TestBlockCompression(t *testing.T) {
+	if _, err := ParseBlockCompression("lz4"); err == nil {
+		t.Fatal("expected unknown compression to be rejected")
+	}
+	block := bytes.Repeat([]byte("block"), 1000)
+	for _, name := range []string{"none", "gzip", "zstd"} {
+		compression, err := ParseBlockCompression(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir := t.TempDir()
+		fs := &LocalFileSystemContext{Path: dir, Log: logging.Logger("delegation backend test"), Compression: compression}
+		objs := objectsOf(map[string][]byte{"submissions/2021-07-01/a.json": []byte("{}"), "blocks/x.dat": block})
+		if err := fs.Save(context.Background(), objs); err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		if meta, err := os.ReadFile(filepath.Join(dir, "submissions/2021-07-01/a.json")); err != nil || string(meta) != "{}" {
+			t.Fatalf("%s: submission was not saved as is: %v", name, err)
+		}
+		saved, err := os.ReadFile(filepath.Join(dir, "blocks/x.dat"+compression.Suffix()))
+		if err != nil || (compression != BLOCK_COMPRESSION_NONE) == bytes.Equal(saved, block) {
+			t.Fatalf("%s: unexpected block at rest: %v", name, err)
+		}
+
+		// Blocks are read regardless of compression they were saved with
+		reader := &LocalFileSystemContext{Path: dir, Compression: BLOCK_COMPRESSION_ZSTD}
+		if bs, err := reader.ReadBlock(context.Background(), "x"); err != nil || !bytes.Equal(bs, block) {
+			t.Fatalf("%s: unexpected block read: %v", name, err)
+		}
+		if _, err := reader.ReadBlock(context.Background(), "y"); !errors.Is(err, ErrBlockNotFound) {
+			t.Fatalf("%s: expected block not to be found, got %v", name, err)
+		}
+
+		// Block saved with another compression isn't saved again
+		other := &LocalFileSystemContext{Path: dir, Log: logging.Logger("delegation backend test"), Compression: BLOCK_COMPRESSION_GZIP}
+		if compression == BLOCK_COMPRESSION_GZIP {
+			other.Compression = BLOCK_COMPRESSION_NONE
+		}
+		if err := other.Save(context.Background(), objectsOf(map[string][]byte{"blocks/x.dat": block})); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, other.Compression.Path("blocks/x.dat"))); !os.IsNotExist(err) {
+			t.Fatalf("%s: block saved again with %q compression", name, other.Compression)
+		}
+	}
+}
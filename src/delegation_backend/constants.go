@@ -9,11 +9,16 @@ import (
 )
 
 const MAX_SUBMIT_PAYLOAD_SIZE = 50000000 // max payload size in bytes
+const MAX_SUBMIT_METADATA_SIZE = 5000000 // max size in bytes of fields of a payload other than its block
 const DELEGATION_BACKEND_LISTEN_TO = ":8080"
 const TIME_DIFF_DELTA time.Duration = -5 * 60 * 1000000000 // -5m
 const WHITELIST_REFRESH_INTERVAL = 10 * 60 * 1000000000    // 10m
 
 var PK_PREFIX = [...]byte{1, 1}
+
+// Every base58check-encoded public key starts with it
+const PK_STRING_PREFIX = "B62"
+
 var SIG_PREFIX = [...]byte{1}
 var BLOCK_HASH_PREFIX = [...]byte{1}
 var MAX_BLOCK_SIZE = 1000000 // (1MB) max block size in bytes for Cassandra, blocks larger than this size will be stored in S3 only
@@ -35,8 +40,9 @@ func SetWhitelistRefreshInterval(log logging.StandardLogger) time.Duration {
 		if err != nil {
 			log.Warnf("Error parsing DELEGATION_WHITELIST_REFRESH_INTERVAL, falling back to default value: %v, error: %v", defaultValue, err)
 			whitelistRefreshInterval = defaultValue
+		} else {
+			whitelistRefreshInterval = time.Duration(minutes) * time.Minute
 		}
-		whitelistRefreshInterval = time.Duration(minutes) * time.Minute
 	} else {
 		whitelistRefreshInterval = defaultValue
 	}
@@ -62,6 +68,41 @@ func SetRequestsPerPkHourly(log logging.StandardLogger) int {
 	return requestsPerPkHourly
 }
 
+func SetShutdownTimeout(log logging.StandardLogger) time.Duration {
+	return secondsEnvOrDefault("SHUTDOWN_TIMEOUT", 30*time.Second, log)
+}
+
+func SetShutdownDrainDelay(log logging.StandardLogger) time.Duration {
+	return secondsEnvOrDefault("SHUTDOWN_DRAIN_DELAY", 0, log)
+}
+
+// Zero, the default, disables the check of submission age
+func SetSubmissionMaxAge(log logging.StandardLogger) time.Duration {
+	return secondsEnvOrDefault("SUBMISSION_MAX_AGE", 0, log)
+}
+
+// Zero disables detection of duplicate submissions
+func SetSubmissionSeenTTL(log logging.StandardLogger) time.Duration {
+	return secondsEnvOrDefault("SUBMISSION_SEEN_TTL", DEFAULT_SUBMISSION_SEEN_TTL, log)
+}
+
+// Duplicates of a submission are rejected for an hour after it's accepted
+// by default, which covers retries of nodes not getting the response
+const DEFAULT_SUBMISSION_SEEN_TTL = time.Hour
+
+func secondsEnvOrDefault(variable string, defaultValue time.Duration, log logging.StandardLogger) time.Duration {
+	envVarValue, exists := os.LookupEnv(variable)
+	if !exists {
+		return defaultValue
+	}
+	seconds, err := strconv.Atoi(envVarValue)
+	if err != nil || seconds < 0 {
+		log.Warnf("Error parsing %s, falling back to default value: %v, error: %v", variable, defaultValue, err)
+		return defaultValue
+	}
+	return time.Duration(seconds) * time.Second
+}
+
 const PK_LENGTH = 33  // one field element (32B) + 1 bit (encoded as full byte)
 const SIG_LENGTH = 64 // one field element (32B) and one scalar (32B)
 
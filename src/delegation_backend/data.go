@@ -132,11 +132,20 @@ type MetaToBeSaved struct {
 	CreatedAt          string  `json:"created_at"`
 	PeerId             string  `json:"peer_id"`
 	SnarkWork          *Base64 `json:"snark_work,omitempty"`
-	RemoteAddr         string  `json:"remote_addr"`
-	Submitter          Pk      `json:"submitter"`  // is base58check-encoded submitter's public key
-	BlockHash          string  `json:"block_hash"` // is base58check-encoded hash of a block
+	RemoteAddr         string  `json:"remote_addr"`               // is address of the client resolved through trusted proxies
+	XForwardedFor      string  `json:"x_forwarded_for,omitempty"` // is X-Forwarded-For header as received
+	Forwarded          string  `json:"forwarded,omitempty"`       // is Forwarded header as received
+	Submitter          Pk      `json:"submitter"`                 // is base58check-encoded submitter's public key
+	BlockHash          string  `json:"block_hash"`                // is base58check-encoded hash of a block
 	GraphqlControlPort int     `json:"graphql_control_port,omitempty"`
 	BuiltWithCommitSha string  `json:"built_with_commit_sha,omitempty"`
+	NodeVersion        string  `json:"node_version,omitempty"`
+	SyncStatus         string  `json:"sync_status,omitempty"`
+	ProtocolVersion    string  `json:"protocol_version,omitempty"`
+	StateHash          string  `json:"state_hash,omitempty"` // is base58check-encoded state hash of the block
+	Parent             string  `json:"parent,omitempty"`     // is base58check-encoded state hash of the parent block
+	Height             uint32  `json:"height,omitempty"`
+	Slot               uint32  `json:"slot,omitempty"`
 }
 
 type submitRequestData struct {
@@ -159,14 +168,29 @@ func (req submitRequest) GetBlockDataHash() string {
 }
 
 func (req submitRequestData) MakeSignPayload() ([]byte, error) {
+	tail, err := req.makeSignPayloadTail()
+	if err != nil {
+		return nil, err
+	}
+	signPayload := new(BufferOrError)
+	signPayload.WriteString(SIGN_PAYLOAD_PREFIX)
+	signPayload.Write(req.Block.json)
+	signPayload.Write(tail)
+	return signPayload.Buf.Bytes(), signPayload.Err
+}
+
+// Block is the first field of the sign payload, so that it can be hashed
+// as it's read, before the rest of fields are known
+const SIGN_PAYLOAD_PREFIX = "{\"block\":"
+
+// Part of the sign payload following the block
+func (req submitRequestData) makeSignPayloadTail() ([]byte, error) {
 	createdAtStr := req.CreatedAt.UTC().Format(time.RFC3339)
 	createdAtJson, err2 := json.Marshal(createdAtStr)
 	if err2 != nil {
 		return nil, err2
 	}
 	signPayload := new(BufferOrError)
-	signPayload.WriteString("{\"block\":")
-	signPayload.Write(req.Block.json)
 	signPayload.WriteString(",\"created_at\":")
 	signPayload.Write(createdAtJson)
 	signPayload.WriteString(",\"peer_id\":\"")
@@ -190,18 +214,20 @@ func (req submitRequestData) MakeSignPayload() ([]byte, error) {
 }
 
 func (req submitRequest) MakeMetaToBeSaved(remoteAddr string) ([]byte, error) {
-	meta := MetaToBeSaved{
+	return json.Marshal(req.makeMeta(remoteAddr, req.GetBlockDataHash()))
+}
+
+func (req submitRequest) makeMeta(remoteAddr string, blockHash string) MetaToBeSaved {
+	return MetaToBeSaved{
 		CreatedAt:          req.Data.CreatedAt.Format(time.RFC3339),
 		PeerId:             req.Data.PeerId,
 		SnarkWork:          req.Data.SnarkWork,
 		RemoteAddr:         remoteAddr,
-		BlockHash:          req.GetBlockDataHash(),
+		BlockHash:          blockHash,
 		Submitter:          req.Submitter,
 		GraphqlControlPort: req.Data.GraphqlControlPort,
 		BuiltWithCommitSha: req.Data.BuiltWithCommitSha,
 	}
-
-	return json.Marshal(meta)
 }
 
 func (req submitRequest) CheckRequiredFields() bool {
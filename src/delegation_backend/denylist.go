@@ -0,0 +1,450 @@
+package delegation_backend
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+type DenyKind string
+
+const (
+	DenyPublicKey DenyKind = "public_key"
+	DenyPeerId    DenyKind = "peer_id"
+	DenyCIDR      DenyKind = "cidr"
+)
+
+const DENYLIST_REFRESH_INTERVAL = time.Minute
+const DENY_AUDIT_SIZE = 1000
+
+// DenyRule blocks submissions matching Value, which is
+// a public key, a libp2p peer id or an IP range depending on Kind.
+type DenyRule struct {
+	Kind   DenyKind `json:"kind"`
+	Value  string   `json:"value"`
+	Reason string   `json:"reason,omitempty"`
+}
+
+// Denylist blocks submissions by public key of the submitter,
+// peer id of the node or address the submission came from.
+type Denylist struct {
+	pks      map[Pk]DenyRule
+	peerIds  map[string]DenyRule
+	prefixes []netip.Prefix
+	rules    []DenyRule // in the order of the source
+	cidrs    []DenyRule // rules of prefixes, same order
+}
+
+var peerIdRe = regexp.MustCompile(`^[0-9A-Za-z]{32,128}$`)
+
+// ParseDenyRule recognizes kind of the value: a public key,
+// an IP address or CIDR range, or otherwise a peer id.
+func ParseDenyRule(value, reason string) (DenyRule, error) {
+	value = strings.TrimSpace(value)
+	rule := DenyRule{Value: value, Reason: strings.TrimSpace(reason)}
+	var pk Pk
+	switch {
+	case strings.HasPrefix(value, PK_STRING_PREFIX) && StringToPk(&pk, value) == nil:
+		rule.Kind = DenyPublicKey
+	case strings.ContainsAny(value, ".:"):
+		prefix, err := parsePrefix(value)
+		if err != nil {
+			return rule, fmt.Errorf("invalid IP address or range %q", value)
+		}
+		rule.Kind = DenyCIDR
+		rule.Value = prefix.String()
+	case peerIdRe.MatchString(value):
+		rule.Kind = DenyPeerId
+	default:
+		return rule, fmt.Errorf("%q is neither a public key, peer id nor IP range", value)
+	}
+	return rule, nil
+}
+
+// Parses a CIDR range, a single address is taken as a range of one
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+}
+
+func NewDenylist(rules []DenyRule) (*Denylist, error) {
+	dl := &Denylist{
+		pks:     make(map[Pk]DenyRule),
+		peerIds: make(map[string]DenyRule),
+		rules:   rules,
+	}
+	for _, rule := range rules {
+		switch rule.Kind {
+		case DenyPublicKey:
+			var pk Pk
+			if err := StringToPk(&pk, rule.Value); err != nil {
+				return nil, fmt.Errorf("invalid public key %q: %w", rule.Value, err)
+			}
+			dl.pks[pk] = rule
+		case DenyPeerId:
+			dl.peerIds[rule.Value] = rule
+		case DenyCIDR:
+			prefix, err := parsePrefix(rule.Value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid IP range %q: %w", rule.Value, err)
+			}
+			dl.prefixes = append(dl.prefixes, prefix)
+			dl.cidrs = append(dl.cidrs, rule)
+		default:
+			return nil, fmt.Errorf("unknown kind of deny rule %q", rule.Kind)
+		}
+	}
+	return dl, nil
+}
+
+// Match returns the rule denying a submission, checking the public key,
+// peer id and the address of the client, as resolved with trusted proxies.
+// An invalid address matches no range.
+func (dl *Denylist) Match(pk Pk, peerId string, addr netip.Addr) (DenyRule, bool) {
+	if rule, has := dl.pks[pk]; has {
+		return rule, true
+	}
+	if rule, has := dl.peerIds[peerId]; has {
+		return rule, true
+	}
+	for i, prefix := range dl.prefixes {
+		if prefix.Contains(addr.Unmap()) {
+			return dl.cidrs[i], true
+		}
+	}
+	return DenyRule{}, false
+}
+
+func (dl *Denylist) Rules() []DenyRule {
+	return dl.rules
+}
+
+// DenylistMVar holds the current denylist.
+// All methods are safe to call on a nil *DenylistMVar.
+type DenylistMVar struct {
+	denylist atomic.Pointer[Denylist]
+}
+
+// Replace does nothing on a nil *DenylistMVar,
+// submissions aren't checked against a denylist then.
+func (mvar *DenylistMVar) Replace(dl *Denylist) {
+	if mvar == nil {
+		return
+	}
+	mvar.denylist.Store(dl)
+}
+
+func (mvar *DenylistMVar) Read() *Denylist {
+	if mvar == nil {
+		return nil
+	}
+	return mvar.denylist.Load()
+}
+
+func (mvar *DenylistMVar) Match(pk Pk, peerId string, addr netip.Addr) (DenyRule, bool) {
+	dl := mvar.Read()
+	if dl == nil {
+		return DenyRule{}, false
+	}
+	return dl.Match(pk, peerId, addr)
+}
+
+// DeniedAttempt is a submission rejected by the denylist.
+type DeniedAttempt struct {
+	Time       time.Time `json:"time"`
+	Submitter  string    `json:"submitter"`
+	PeerId     string    `json:"peer_id"`
+	RemoteAddr string    `json:"remote_addr"`
+	Rule       DenyRule  `json:"rule"`
+}
+
+// DenyAuditLog keeps the most recent denied attempts.
+// All methods are safe to call on a nil *DenyAuditLog.
+type DenyAuditLog struct {
+	mutex    sync.Mutex
+	attempts []DeniedAttempt // ring buffer
+	next     int
+	total    int
+}
+
+func NewDenyAuditLog(size int) *DenyAuditLog {
+	return &DenyAuditLog{attempts: make([]DeniedAttempt, 0, size)}
+}
+
+func (a *DenyAuditLog) Record(attempt DeniedAttempt) {
+	if a == nil {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.total++
+	if len(a.attempts) < cap(a.attempts) {
+		a.attempts = append(a.attempts, attempt)
+		return
+	}
+	if len(a.attempts) == 0 {
+		return
+	}
+	a.attempts[a.next] = attempt
+	a.next = (a.next + 1) % len(a.attempts)
+}
+
+// Recent returns the kept attempts, newest first, along with
+// the number of attempts recorded since the start.
+func (a *DenyAuditLog) Recent() ([]DeniedAttempt, int) {
+	if a == nil {
+		return nil, 0
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	res := make([]DeniedAttempt, 0, len(a.attempts))
+	for i := 1; i <= len(a.attempts); i++ {
+		res = append(res, a.attempts[(a.next-i+len(a.attempts))%len(a.attempts)])
+	}
+	return res, a.total
+}
+
+// DenylistSource is a place the denylist is loaded from.
+type DenylistSource interface {
+	Name() string
+	Load(ctx context.Context) (*Denylist, error)
+}
+
+// NewDenylistSource creates the denylist source configured in appCfg,
+// nil if the denylist is not configured.
+func NewDenylistSource(appCfg AppConfig, log *logging.ZapEventLogger) (DenylistSource, error) {
+	cfg := appCfg.Denylist
+	if cfg == nil {
+		return nil, nil
+	}
+	switch {
+	case cfg.Path != "" && cfg.Table != "":
+		return nil, errors.New("denylist should be loaded either from a file or a table, not both")
+	case cfg.Path != "":
+		return &FileDenylistSource{Path: cfg.Path, PollInterval: WHITELIST_FILE_POLL_INTERVAL, Log: log}, nil
+	case cfg.Table != "":
+		pgCfg := cfg.PostgreSQL
+		if pgCfg == nil {
+			pgCfg = appCfg.PostgreSQL
+		}
+		if pgCfg == nil {
+			return nil, errors.New("denylist PostgreSQL connection is not configured")
+		}
+		db, err := NewPostgreSQL(pgCfg)
+		if err != nil {
+			return nil, err
+		}
+		source, err := NewPostgreSQLDenylistSource(db, cfg.Table, log)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		return source, nil
+	}
+	return nil, errors.New("denylist file or table is not set")
+}
+
+// FileDenylistSource loads the denylist from a local file. Files with .json
+// extension hold an array of values or {"value", "reason"} objects, any other
+// file is read as CSV with the value in the first column and optional reason
+// in the second one, lines starting with # are skipped. The file is polled
+// for changes every PollInterval and reloaded as soon as it's modified.
+type FileDenylistSource struct {
+	Path         string
+	PollInterval time.Duration
+	Log          logging.StandardLogger
+}
+
+func (s *FileDenylistSource) Name() string {
+	return "file"
+}
+
+func (s *FileDenylistSource) Load(_ context.Context) (*Denylist, error) {
+	file, err := os.Open(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var rules []DenyRule
+	if strings.EqualFold(filepath.Ext(s.Path), ".json") {
+		rules, err = s.readJSON(file)
+	} else {
+		rules, err = s.readCSV(file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading denylist file %s: %w", s.Path, err)
+	}
+	return NewDenylist(rules)
+}
+
+func (s *FileDenylistSource) Changes(ctx context.Context) <-chan struct{} {
+	return watchFile(ctx, s.Path, s.PollInterval, s.Log)
+}
+
+func (s *FileDenylistSource) readJSON(r io.Reader) ([]DenyRule, error) {
+	var items []json.RawMessage
+	if err := json.NewDecoder(io.LimitReader(r, MAX_WHITELIST_DOCUMENT_SIZE)).Decode(&items); err != nil {
+		return nil, err
+	}
+	var rules []DenyRule
+	for i, item := range items {
+		var entry struct {
+			Value  string `json:"value"`
+			Reason string `json:"reason"`
+		}
+		if err := json.Unmarshal(item, &entry.Value); err != nil {
+			if err := json.Unmarshal(item, &entry); err != nil {
+				return nil, fmt.Errorf("item %d: %w", i+1, err)
+			}
+		}
+		rules = s.appendRule(rules, i+1, entry.Value, entry.Reason)
+	}
+	return rules, nil
+}
+
+func (s *FileDenylistSource) readCSV(r io.Reader) ([]DenyRule, error) {
+	reader := csv.NewReader(io.LimitReader(r, MAX_WHITELIST_DOCUMENT_SIZE))
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+	var rules []DenyRule
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rules, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+		reason := ""
+		if len(record) > 1 {
+			reason = record[1]
+		}
+		line, _ := reader.FieldPos(0)
+		rules = s.appendRule(rules, line, record[0], reason)
+	}
+}
+
+// Invalid rows are logged and skipped, so that a typo in one
+// of them doesn't prevent other submitters from being denied
+func (s *FileDenylistSource) appendRule(rules []DenyRule, row int, value, reason string) []DenyRule {
+	rule, err := ParseDenyRule(value, reason)
+	if err != nil {
+		s.Log.Warnf("Denylist row %d is invalid: %v", row, err)
+		return rules
+	}
+	return append(rules, rule)
+}
+
+// PostgreSQLDenylistSource loads the denylist from value
+// and reason columns of a table.
+type PostgreSQLDenylistSource struct {
+	DB    *sql.DB
+	Log   logging.StandardLogger
+	query string
+}
+
+func NewPostgreSQLDenylistSource(db *sql.DB, table string, log logging.StandardLogger) (*PostgreSQLDenylistSource, error) {
+	if !sqlIdentifierRe.MatchString(table) {
+		return nil, fmt.Errorf("invalid denylist table name %q", table)
+	}
+	return &PostgreSQLDenylistSource{
+		DB:    db,
+		Log:   log,
+		query: fmt.Sprintf("SELECT value, reason FROM %s", table),
+	}, nil
+}
+
+func (s *PostgreSQLDenylistSource) Name() string {
+	return "postgresql"
+}
+
+func (s *PostgreSQLDenylistSource) Load(ctx context.Context) (*Denylist, error) {
+	rs, err := s.DB.QueryContext(ctx, s.query)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+	var rules []DenyRule
+	for rs.Next() {
+		var value, reason sql.NullString
+		if err := rs.Scan(&value, &reason); err != nil {
+			return nil, err
+		}
+		rule, err := ParseDenyRule(value.String, reason.String)
+		if err != nil {
+			s.Log.Warnf("Denylist row is invalid: %v", err)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	if err := rs.Err(); err != nil {
+		return nil, err
+	}
+	return NewDenylist(rules)
+}
+
+// DenylistRefresher keeps the denylist up to date with its source,
+// reloading it every Interval and whenever the source reports a change.
+type DenylistRefresher struct {
+	Source   DenylistSource
+	Denylist *DenylistMVar
+	Interval time.Duration
+	Log      logging.StandardLogger
+}
+
+// Refresh loads the denylist from the source and replaces the current one.
+// On error the current denylist is kept.
+func (r *DenylistRefresher) Refresh(ctx context.Context) error {
+	dl, err := r.Source.Load(ctx)
+	if err != nil {
+		return err
+	}
+	r.Denylist.Replace(dl)
+	r.Log.Infof("Denylist refreshed from %s, number of rules: %v", r.Source.Name(), len(dl.Rules()))
+	return nil
+}
+
+// Run refreshes the denylist until ctx is done.
+func (r *DenylistRefresher) Run(ctx context.Context) {
+	var changes <-chan struct{}
+	if w, ok := r.Source.(SourceWatcher); ok {
+		changes = w.Changes(ctx)
+	}
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-changes:
+		}
+		if err := r.Refresh(ctx); err != nil {
+			r.Log.Errorf("Failed to refresh denylist, using previous one, error: %v", err)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package delegation_backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+const testPeerId = "12D3KooWEgwqY6ZYyNmB6tFyu8FpAGVvKzFqBiCTWgrN4ZkJ8N3V"
+
+func TestParseDenyRule(t *testing.T) {
+	pk := mkPk()
+	for _, tc := range []struct {
+		value string
+		kind  DenyKind
+		norm  string
+	}{
+		{pk.String(), DenyPublicKey, pk.String()},
+		{testPeerId, DenyPeerId, testPeerId},
+		{" 10.1.2.3 ", DenyCIDR, "10.1.2.3/32"},
+		{"10.1.2.3/8", DenyCIDR, "10.0.0.0/8"},
+		{"2001:db8::1/32", DenyCIDR, "2001:db8::/32"},
+		{"::ffff:10.1.2.3", DenyCIDR, "10.1.2.3/32"},
+	} {
+		rule, err := ParseDenyRule(tc.value, "spam")
+		if err != nil {
+			t.Fatalf("%s: %v", tc.value, err)
+		}
+		if rule.Kind != tc.kind || rule.Value != tc.norm || rule.Reason != "spam" {
+			t.Fatalf("%s: unexpected rule %+v", tc.value, rule)
+		}
+	}
+	for _, value := range []string{"", "10.1.2.300", "10.0.0.0/33", "peer", "B62qnotakey"} {
+		if _, err := ParseDenyRule(value, ""); err == nil {
+			t.Fatalf("%q: expected error", value)
+		}
+	}
+}
+
+func TestDenylistMatch(t *testing.T) {
+	pk1, pk2 := mkPk(), mkPk()
+	var rules []DenyRule
+	for _, value := range []string{pk1.String(), testPeerId, "192.168.0.0/16", "2001:db8::/32"} {
+		rule, err := ParseDenyRule(value, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, rule)
+	}
+	dl, err := NewDenylist(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := netip.MustParseAddr
+	for _, tc := range []struct {
+		pk     Pk
+		peerId string
+		addr   netip.Addr
+		denied *DenyRule
+	}{
+		{pk1, "other", addr("10.0.0.1"), &rules[0]},
+		{pk2, testPeerId, netip.Addr{}, &rules[1]},
+		{pk2, "other", addr("192.168.10.20"), &rules[2]},
+		{pk2, "other", addr("::ffff:192.168.1.1"), &rules[2]},
+		{pk2, "other", addr("2001:db8:1::5"), &rules[3]},
+		{pk2, "other", addr("2001:db9::1"), nil},
+		{pk2, "other", netip.Addr{}, nil},
+	} {
+		rule, denied := dl.Match(tc.pk, tc.peerId, tc.addr)
+		if denied != (tc.denied != nil) || denied && rule != *tc.denied {
+			t.Fatalf("unexpected match of %s %s %v: %+v %v", tc.pk, tc.peerId, tc.addr, rule, denied)
+		}
+	}
+
+	var mvar *DenylistMVar
+	mvar.Replace(dl)
+	if _, denied := mvar.Match(pk1, testPeerId, netip.Addr{}); denied {
+		t.Fatal("nil denylist shouldn't deny")
+	}
+}
+
+func TestDenyAuditLog(t *testing.T) {
+	audit := NewDenyAuditLog(3)
+	for i := 0; i < 5; i++ {
+		audit.Record(DeniedAttempt{Submitter: string(rune('a' + i))})
+	}
+	attempts, total := audit.Recent()
+	if total != 5 || len(attempts) != 3 ||
+		attempts[0].Submitter != "e" || attempts[1].Submitter != "d" || attempts[2].Submitter != "c" {
+		t.Fatalf("unexpected audit log: %d %+v", total, attempts)
+	}
+}
+
+func TestFileDenylistSource(t *testing.T) {
+	pk := mkPk()
+	dir := t.TempDir()
+	csvPath := filepath.Join(dir, "denylist.csv")
+	content := "# abusers\n" +
+		pk.String() + ",spamming submissions\n" +
+		"not a valid value\n" +
+		"\n" +
+		"203.0.113.0/24\n"
+	if err := os.WriteFile(csvPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	source := &FileDenylistSource{Path: csvPath, Log: logging.Logger("test")}
+	dl, err := source.Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := dl.Rules()
+	if len(rules) != 2 || rules[0].Kind != DenyPublicKey || rules[0].Reason != "spamming submissions" ||
+		rules[1].Kind != DenyCIDR {
+		t.Fatalf("unexpected rules: %+v", rules)
+	}
+
+	jsonPath := filepath.Join(dir, "denylist.json")
+	content = `["` + testPeerId + `", {"value": "198.51.100.7", "reason": "scraper"}]`
+	if err := os.WriteFile(jsonPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	source.Path = jsonPath
+	dl, err = source.Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules = dl.Rules()
+	if len(rules) != 2 || rules[0].Kind != DenyPeerId || rules[1].Value != "198.51.100.7/32" || rules[1].Reason != "scraper" {
+		t.Fatalf("unexpected rules: %+v", rules)
+	}
+}
+
+func TestFileDenylistSourceHotReload(t *testing.T) {
+	pk := mkPk()
+	path := filepath.Join(t.TempDir(), "denylist.csv")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	source := &FileDenylistSource{Path: path, PollInterval: 10 * time.Millisecond, Log: logging.Logger("test")}
+	refresher := &DenylistRefresher{
+		Source:   source,
+		Denylist: new(DenylistMVar),
+		Interval: time.Hour,
+		Log:      logging.Logger("test"),
+	}
+	if err := refresher.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go refresher.Run(ctx)
+
+	// Make sure modification time changes on filesystems with coarse timestamps
+	time.Sleep(20 * time.Millisecond)
+	if err := os.WriteFile(path, []byte(pk.String()+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "denylist reload", func() bool {
+		_, denied := refresher.Denylist.Match(pk, "", netip.Addr{})
+		return denied
+	})
+}
+
+func TestSubmitDenylisted(t *testing.T) {
+	body := readTestFile("req-no-snark", t)
+	var req submitRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal("failed decoding test file")
+	}
+	// Denylist is checked even with the whitelist disabled
+	storage, sh, _ := testSubmitH(1, Whitelist{})
+	sh.app.WhitelistDisabled = true
+	sh.app.Denylist = new(DenylistMVar)
+	sh.app.DenyAudit = NewDenyAuditLog(10)
+
+	deny := func(value string) {
+		rule, err := ParseDenyRule(value, "abuse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dl, err := NewDenylist([]DenyRule{rule})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sh.app.Denylist.Replace(dl)
+	}
+	for _, value := range []string{req.Submitter.String(), req.Data.PeerId, "192.0.2.0/24"} {
+		deny(value)
+		if rep := sh.testRequest(body); rep.Code != http.StatusForbidden {
+			t.Fatalf("%s: expected 403, got %v", value, rep)
+		}
+	}
+	if len(*storage) != 0 {
+		t.Fatal("denied submission was saved")
+	}
+	attempts, total := sh.app.DenyAudit.Recent()
+	if total != 3 || attempts[0].Rule.Value != "192.0.2.0/24" || attempts[0].Rule.Reason != "abuse" ||
+		attempts[2].Submitter != req.Submitter.String() || attempts[1].PeerId != req.Data.PeerId {
+		t.Fatalf("unexpected audit log: %+v", attempts)
+	}
+
+	// Only the client address resolved with trusted proxies is checked,
+	// clients can put anything into X-Forwarded-For
+	deny("203.0.113.0/24")
+	forwarded := func(xff string) int {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", v1Submit, bytes.NewReader(body))
+		r.Header.Set("X-Forwarded-For", xff)
+		sh.ServeHTTP(rec, r)
+		return rec.Code
+	}
+	if code := forwarded("203.0.113.9"); code == http.StatusForbidden {
+		t.Fatal("address forwarded by an untrusted peer was checked")
+	}
+	sh.app.Proxies, _ = NewTrustedProxies([]string{"192.0.2.0/24"}, 0, "")
+	if code := forwarded("203.0.113.9, 198.51.100.1"); code == http.StatusForbidden {
+		t.Fatal("address forwarded by an untrusted proxy was checked")
+	}
+	if code := forwarded("198.51.100.1, 203.0.113.9"); code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", code)
+	}
+}
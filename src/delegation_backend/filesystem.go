@@ -0,0 +1,110 @@
+package delegation_backend
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+type LocalFileSystemContext struct {
+	Path        string
+	Log         logging.StandardLogger
+	Compression BlockCompression // of blocks at rest
+}
+
+func (ctx *LocalFileSystemContext) Name() string {
+	return "filesystem"
+}
+
+// Save writes the provided objects below the configured directory,
+// streaming them from their sources. Files that already exist are left untouched.
+func (ctx *LocalFileSystemContext) Save(_ context.Context, objs ObjectsToSave) error {
+	var lastErr error
+	for path, src := range objs {
+		fullPath := filepath.Join(ctx.Path, ctx.Compression.Path(path))
+
+		// Check if file exists, a block possibly with another compression
+		if existing := ctx.existing(path); existing != "" {
+			ctx.Log.Warnf("LocalFileSystemSave: file already exists: %s", existing)
+			continue // skip to the next object
+		}
+
+		err := os.MkdirAll(filepath.Dir(fullPath), os.ModePerm)
+		if err != nil {
+			ctx.Log.Errorf("LocalFileSystemSave: Error creating directories for %s: %v", fullPath, err)
+			lastErr = err
+			continue // skip to the next object
+		}
+		ctx.Log.Infof("LocalFileSystemSave: saving %s", fullPath)
+		if err := ctx.writeFile(fullPath, path, src); err != nil {
+			ctx.Log.Warnf("Error writing to file %s: %v", fullPath, err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// writeFile writes the object into a temporary file renamed to fullPath
+// once complete, so that a failed write isn't taken for a saved object
+func (ctx *LocalFileSystemContext) writeFile(fullPath, path string, src ObjectSource) error {
+	f, err := os.CreateTemp(filepath.Dir(fullPath), ".saving-*")
+	if err != nil {
+		return err
+	}
+	err = ctx.Compression.Encode(f, path, src)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), fullPath)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
+
+// Path of the object if it was saved, empty string otherwise
+func (ctx *LocalFileSystemContext) existing(path string) string {
+	for _, p := range savedPaths(path) {
+		fullPath := filepath.Join(ctx.Path, p)
+		if _, err := os.Stat(fullPath); !os.IsNotExist(err) {
+			return fullPath
+		}
+	}
+	return ""
+}
+
+// ReadBlock reads a block saved with any compression, decompressing it.
+func (ctx *LocalFileSystemContext) ReadBlock(_ context.Context, blockHash string) ([]byte, error) {
+	return readBlock(blockHash, func(path string) ([]byte, bool, error) {
+		bs, err := os.ReadFile(filepath.Join(ctx.Path, path))
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return bs, err == nil, err
+	})
+}
+
+// HealthCheck makes sure the storage directory exists and is writable.
+func (ctx *LocalFileSystemContext) HealthCheck(_ context.Context) error {
+	if err := os.MkdirAll(ctx.Path, os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(ctx.Path, ".healthcheck-*")
+	if err != nil {
+		return fmt.Errorf("directory %s is not writable: %w", ctx.Path, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func (ctx *LocalFileSystemContext) Close() error {
+	return nil
+}
@@ -0,0 +1,342 @@
+package delegation_backend
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const METRICS_NAMESPACE = "delegation_backend"
+
+// Reasons of rejecting a submission, used as a label of the rejections counter
+const (
+	REJECT_UNSUPPORTED_VERSION      = "unsupported_version"
+	REJECT_UNSUPPORTED_ENCODING     = "unsupported_encoding"
+	REJECT_PAYLOAD_TOO_LARGE        = "payload_too_large"
+	REJECT_DECOMPRESSION_ERROR      = "decompression_error"
+	REJECT_READ_ERROR               = "read_error"
+	REJECT_MALFORMED_JSON           = "malformed_json"
+	REJECT_MISSING_FIELDS           = "missing_fields"
+	REJECT_INVALID_BLOCK            = "invalid_block"
+	REJECT_NOT_WHITELISTED          = "not_whitelisted"
+	REJECT_OUTSIDE_VALIDITY_WINDOW  = "outside_validity_window"
+	REJECT_NETWORK_NOT_ALLOWED      = "network_not_allowed"
+	REJECT_DENIED_BY_OVERRIDE       = "denied_by_override"
+	REJECT_DENYLISTED               = "denylisted"
+	REJECT_CREATED_AT_IN_FUTURE     = "created_at_in_future"
+	REJECT_CREATED_AT_TOO_OLD       = "created_at_too_old"
+	REJECT_INVALID_SIGNATURE        = "invalid_signature"
+	REJECT_VERIFIER_UNAVAILABLE     = "verifier_unavailable"
+	REJECT_DUPLICATE                = "duplicate"
+	REJECT_RATE_LIMITED             = "rate_limited"
+	REJECT_IP_RATE_LIMITED          = "ip_rate_limited"
+	REJECT_GLOBAL_RATE_LIMITED      = "global_rate_limited"
+	REJECT_TOO_MANY_CONCURRENT      = "too_many_concurrent"
+	REJECT_RATE_LIMITER_UNAVAILABLE = "rate_limiter_unavailable"
+	REJECT_NOT_READY                = "not_ready"
+	REJECT_STORAGE_UNAVAILABLE      = "storage_unavailable"
+	REJECT_INTERNAL_ERROR           = "internal_error"
+)
+
+// Metrics holds Prometheus metrics of the submit pipeline.
+// All methods are no-ops on a nil *Metrics.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	submitResponses       *prometheus.CounterVec
+	submitDuration        *prometheus.HistogramVec
+	submitRejections      *prometheus.CounterVec
+	submitVersions        *prometheus.CounterVec
+	signatureVerification prometheus.Histogram
+	signatureQueueWait    prometheus.Histogram
+	signatureCache        *prometheus.CounterVec
+	storageSave           *prometheus.HistogramVec
+	whitelistSize         *prometheus.GaugeVec
+	whitelistRefreshes    *prometheus.CounterVec
+	whitelistInvalidRows  *prometheus.GaugeVec
+
+	mutex                sync.Mutex
+	whitelistRefreshedAt map[string]*atomic.Int64 // unix nanoseconds by network
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry:             prometheus.NewRegistry(),
+		whitelistRefreshedAt: make(map[string]*atomic.Int64),
+	}
+	m.submitResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "submit_responses_total",
+		Help:      "Number of responses to the submit API by HTTP status code.",
+	}, []string{"code"})
+	m.submitDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "submit_duration_seconds",
+		Help:      "Time to handle a submit API request.",
+		Buckets:   prometheus.DefBuckets,
+	}, nil)
+	m.submitRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "submit_rejections_total",
+		Help:      "Number of rejected submissions by reason.",
+	}, []string{"reason"})
+	m.submitVersions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "submit_requests_by_version_total",
+		Help:      "Number of submissions by version of the submit API schema.",
+	}, []string{"version"})
+	m.signatureVerification = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "signature_verification_seconds",
+		Help:      "Time to verify signature of a submission.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 14),
+	})
+	m.signatureQueueWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "signature_queue_wait_seconds",
+		Help:      "Time a signature waited for a free verification worker.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 14),
+	})
+	m.signatureCache = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "signature_cache_lookups_total",
+		Help:      "Number of lookups into the cache of verified signatures by result.",
+	}, []string{"result"})
+	m.storageSave = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "storage_save_seconds",
+		Help:      "Time to save a submission into a storage backend.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"network", "backend", "result"})
+	m.whitelistSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "whitelist_size",
+		Help:      "Number of public keys in the delegation whitelist.",
+	}, []string{"network"})
+	m.whitelistRefreshes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "whitelist_refreshes_total",
+		Help:      "Number of whitelist refresh attempts by result.",
+	}, []string{"network", "result"})
+	m.whitelistInvalidRows = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "whitelist_invalid_rows",
+		Help:      "Number of rows left out of the whitelist on the last load.",
+	}, []string{"network"})
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.submitResponses, m.submitDuration, m.submitRejections, m.submitVersions,
+		m.signatureVerification, m.signatureQueueWait, m.signatureCache, m.storageSave,
+		m.whitelistSize, m.whitelistRefreshes, m.whitelistInvalidRows,
+	)
+	return m
+}
+
+// Handler serves the metrics in Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// InstrumentSubmit counts responses of the submit handler by status code.
+func (m *Metrics) InstrumentSubmit(h http.Handler) http.Handler {
+	if m == nil {
+		return h
+	}
+	return promhttp.InstrumentHandlerDuration(m.submitDuration,
+		promhttp.InstrumentHandlerCounter(m.submitResponses, h))
+}
+
+// RegisterAttemptCounter exposes number of keys tracked and evicted by the rate limiter of the network.
+func (m *Metrics) RegisterAttemptCounter(network string, c *AttemptCounter) {
+	if m == nil {
+		return
+	}
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   METRICS_NAMESPACE,
+		Name:        "attempt_counter_keys",
+		Help:        "Number of public keys tracked by the per-key rate limiter.",
+		ConstLabels: prometheus.Labels{"network": network},
+	}, func() float64 { return float64(c.Size()) }))
+	m.registry.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace:   METRICS_NAMESPACE,
+		Name:        "attempt_counter_evictions_total",
+		Help:        "Number of public keys evicted from the per-key rate limiter to stay within its key limit.",
+		ConstLabels: prometheus.Labels{"network": network},
+	}, func() float64 { return float64(c.Evictions()) }))
+}
+
+// RegisterSpool exposes how far behind the end of the spool
+// every storage backend of the network is.
+func (m *Metrics) RegisterSpool(network string, sp *Spool) {
+	if m == nil {
+		return
+	}
+	for backend := range sp.Backlog() {
+		backend := backend
+		m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   METRICS_NAMESPACE,
+			Name:        "spool_backlog_bytes",
+			Help:        "Bytes of spooled submissions not yet saved into the storage backend.",
+			ConstLabels: prometheus.Labels{"network": network, "backend": backend},
+		}, func() float64 { return float64(sp.Backlog()[backend]) }))
+	}
+}
+
+// RegisterIPRateLimiter exposes number of addresses tracked by the per-IP rate limiter.
+func (m *Metrics) RegisterIPRateLimiter(l *IPRateLimiter) {
+	if m == nil {
+		return
+	}
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "ip_rate_limiter_keys",
+		Help:      "Number of client addresses tracked by the per-IP rate limiter.",
+	}, func() float64 { return float64(l.Size()) }))
+}
+
+// RegisterSignatureVerifier exposes number of signatures waiting for verification.
+func (m *Metrics) RegisterSignatureVerifier(v *SignatureVerifier) {
+	if m == nil {
+		return
+	}
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "signature_queue_depth",
+		Help:      "Number of signatures waiting for a free verification worker.",
+	}, func() float64 { return float64(v.QueueDepth()) }))
+}
+
+// RegisterReplayGuard exposes number of submissions remembered to reject duplicates.
+func (m *Metrics) RegisterReplayGuard(g *ReplayGuard) {
+	if m == nil {
+		return
+	}
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "replay_seen_submissions",
+		Help:      "Number of accepted submissions remembered to reject their duplicates.",
+	}, func() float64 { return float64(g.Size()) }))
+}
+
+func (m *Metrics) RecordRejection(reason string) {
+	if m == nil {
+		return
+	}
+	m.submitRejections.WithLabelValues(reason).Inc()
+}
+
+func (m *Metrics) RecordSubmitVersion(version int) {
+	if m == nil {
+		return
+	}
+	m.submitVersions.WithLabelValues(strconv.Itoa(version)).Inc()
+}
+
+func (m *Metrics) RecordSignatureVerification(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.signatureVerification.Observe(d.Seconds())
+}
+
+func (m *Metrics) RecordSignatureQueueWait(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.signatureQueueWait.Observe(d.Seconds())
+}
+
+func (m *Metrics) RecordSignatureCache(hit bool) {
+	if m == nil {
+		return
+	}
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.signatureCache.WithLabelValues(result).Inc()
+}
+
+func (m *Metrics) RecordWhitelistRefresh(network string, size int, invalidRows int, err error) {
+	if m == nil {
+		return
+	}
+	refreshedAt := m.whitelistRefreshedAtOf(network)
+	m.whitelistInvalidRows.WithLabelValues(network).Set(float64(invalidRows))
+	if err != nil {
+		m.whitelistRefreshes.WithLabelValues(network, "error").Inc()
+		return
+	}
+	m.whitelistRefreshes.WithLabelValues(network, "ok").Inc()
+	m.whitelistSize.WithLabelValues(network).Set(float64(size))
+	refreshedAt.Store(time.Now().UnixNano())
+}
+
+// Time of the last successful whitelist load of the network,
+// its age is exposed from the first refresh attempt on
+func (m *Metrics) whitelistRefreshedAtOf(network string) *atomic.Int64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	refreshedAt, has := m.whitelistRefreshedAt[network]
+	if has {
+		return refreshedAt
+	}
+	refreshedAt = new(atomic.Int64)
+	m.whitelistRefreshedAt[network] = refreshedAt
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   METRICS_NAMESPACE,
+		Name:        "whitelist_last_refresh_age_seconds",
+		Help:        "Seconds since the whitelist was last successfully loaded.",
+		ConstLabels: prometheus.Labels{"network": network},
+	}, func() float64 {
+		t := refreshedAt.Load()
+		if t == 0 {
+			return 0
+		}
+		return time.Since(time.Unix(0, t)).Seconds()
+	}))
+	return refreshedAt
+}
+
+func (m *Metrics) RecordStorageSave(network, backend string, d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	m.storageSave.WithLabelValues(network, backend, result).Observe(d.Seconds())
+}
+
+// instrumentedStorage records latency of every save into the wrapped backend.
+type instrumentedStorage struct {
+	StorageBackend
+	metrics *Metrics
+	network string
+}
+
+// InstrumentStorage wraps every backend of the network so that
+// latency of saves into it is recorded, whoever calls them.
+func InstrumentStorage(backends StorageBackends, m *Metrics, network string) StorageBackends {
+	res := make(StorageBackends, len(backends))
+	for i, b := range backends {
+		res[i] = &instrumentedStorage{StorageBackend: b, metrics: m, network: network}
+	}
+	return res
+}
+
+func (s *instrumentedStorage) Save(ctx context.Context, objs ObjectsToSave) error {
+	start := time.Now()
+	err := s.StorageBackend.Save(ctx, objs)
+	s.metrics.RecordStorageSave(s.network, s.Name(), time.Since(start), err)
+	return err
+}
@@ -0,0 +1,71 @@
+package delegation_backend
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func scrapeMetrics(m *Metrics, t *testing.T) string {
+	rep := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rep, httptest.NewRequest("GET", "/metrics", nil))
+	if rep.Code != 200 {
+		t.Fatalf("unexpected status of /metrics: %d", rep.Code)
+	}
+	return rep.Body.String()
+}
+
+func expectMetric(metrics string, line string, t *testing.T) {
+	if !strings.Contains(metrics, line+"\n") {
+		t.Errorf("metric %q not found in:\n%s", line, metrics)
+	}
+}
+
+func TestSubmitMetrics(t *testing.T) {
+	body := readTestFile("req-no-snark", t)
+	_, sh, _ := testSubmitH(1, Whitelist{})
+	m := NewMetrics()
+	sh.app.Metrics = m
+	m.RegisterAttemptCounter("mainnet", sh.app.SubmitCounter.(*AttemptCounter))
+	h := m.InstrumentSubmit(sh)
+
+	tooLarge := httptest.NewRequest("POST", v1Submit, bytes.NewReader(body))
+	tooLarge.ContentLength = MAX_SUBMIT_PAYLOAD_SIZE + 1
+	h.ServeHTTP(httptest.NewRecorder(), tooLarge)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", v1Submit, bytes.NewReader(body)))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", v1Submit, bytes.NewReader([]byte("{}"))))
+
+	metrics := scrapeMetrics(m, t)
+	expectMetric(metrics, `delegation_backend_submit_responses_total{code="413"} 1`, t)
+	expectMetric(metrics, `delegation_backend_submit_responses_total{code="401"} 1`, t)
+	expectMetric(metrics, `delegation_backend_submit_responses_total{code="400"} 1`, t)
+	expectMetric(metrics, `delegation_backend_submit_rejections_total{reason="payload_too_large"} 1`, t)
+	expectMetric(metrics, `delegation_backend_submit_rejections_total{reason="not_whitelisted"} 1`, t)
+	expectMetric(metrics, `delegation_backend_submit_rejections_total{reason="missing_fields"} 1`, t)
+	expectMetric(metrics, `delegation_backend_attempt_counter_keys{network="mainnet"} 0`, t)
+}
+
+func TestStorageAndWhitelistMetrics(t *testing.T) {
+	m := NewMetrics()
+	ok := &memoryStorage{name: "ok", objs: make(map[string][]byte)}
+	failing := &memoryStorage{name: "failing", objs: make(map[string][]byte), saveErr: errors.New("down")}
+	bs := InstrumentStorage(StorageBackends{ok, failing}, m, "mainnet")
+	_ = bs.Save(context.Background(), objectsOf(map[string][]byte{"blocks/x.dat": []byte("x")}))
+	if bs.Name() != "ok,failing" {
+		t.Errorf("instrumenting changed backend names: %s", bs.Name())
+	}
+	m.RecordWhitelistRefresh("mainnet", 42, 3, nil)
+	m.RecordWhitelistRefresh("mainnet", 0, 0, errors.New("sheets unavailable"))
+	m.RecordWhitelistRefresh("devnet", 7, 0, nil)
+
+	metrics := scrapeMetrics(m, t)
+	expectMetric(metrics, `delegation_backend_storage_save_seconds_count{backend="ok",network="mainnet",result="ok"} 1`, t)
+	expectMetric(metrics, `delegation_backend_storage_save_seconds_count{backend="failing",network="mainnet",result="error"} 1`, t)
+	expectMetric(metrics, `delegation_backend_whitelist_size{network="mainnet"} 42`, t)
+	expectMetric(metrics, `delegation_backend_whitelist_size{network="devnet"} 7`, t)
+	expectMetric(metrics, `delegation_backend_whitelist_refreshes_total{network="mainnet",result="error"} 1`, t)
+	expectMetric(metrics, `delegation_backend_whitelist_invalid_rows{network="mainnet"} 0`, t)
+}
@@ -0,0 +1,223 @@
+package delegation_backend
+
+import (
+	"math/big"
+)
+
+// Pure Go verification of signatures made by the Mina reference signer:
+// Schnorr signatures over the Pallas curve y^2 = x^3 + 5 with the challenge
+// computed by the legacy Poseidon hash of the public key, the x coordinate
+// of the commitment and the signed bytes.
+
+// Order of the Pallas base field
+var pallasP, _ = new(big.Int).SetString("40000000000000000000000000000000224698fc094cf91b992d30ed00000001", 16)
+
+// Order of the Pallas group (scalar field)
+var pallasQ, _ = new(big.Int).SetString("40000000000000000000000000000000224698fc0994a8dd8c46eb2100000001", 16)
+
+var pallasB = big.NewInt(5)
+
+var pallasG = pallasPoint{
+	x: mustParseFp("01"),
+	y: mustParseFp("1b74b5a30a12937c53dfa9f06378ee548f655bd4333d477119cf7a23caed2abb"),
+	z: mustParseFp("01"),
+}
+
+// pallasPoint is a point of the Pallas curve in Jacobian coordinates,
+// (x, y, z) stands for the affine point (x/z^2, y/z^3), z = 0 for infinity.
+type pallasPoint struct {
+	x, y, z fpElement
+}
+
+func (pt *pallasPoint) isInfinity() bool {
+	return pt.z.isZero()
+}
+
+// Returns the affine coordinates, the point should not be infinity
+func (pt *pallasPoint) affine() (x, y *big.Int) {
+	var zInv, zInv2, ax, ay fpElement
+	zInv.inverse(&pt.z)
+	zInv2.square(&zInv)
+	ax.mul(&pt.x, &zInv2)
+	ay.mul(&pt.y, &zInv2)
+	ay.mul(&ay, &zInv)
+	return ax.toBig(), ay.toBig()
+}
+
+// Doubling in Jacobian coordinates for a = 0 (dbl-2009-l)
+func (pt *pallasPoint) double() pallasPoint {
+	if pt.isInfinity() {
+		return *pt
+	}
+	var a, b, c, d, e, f, t fpElement
+	var res pallasPoint
+	a.square(&pt.x)
+	b.square(&pt.y)
+	c.square(&b)
+	// D = 2*((X1+B)^2-A-C)
+	d.add(&pt.x, &b)
+	d.square(&d)
+	d.sub(&d, &a)
+	d.sub(&d, &c)
+	d.double(&d)
+	// E = 3*A
+	e.double(&a)
+	e.add(&e, &a)
+	f.square(&e)
+	// X3 = F-2*D
+	res.x.sub(&f, t.double(&d))
+	// Y3 = E*(D-X3)-8*C
+	t.double(&c)
+	t.double(&t)
+	t.double(&t)
+	res.y.sub(&d, &res.x)
+	res.y.mul(&e, &res.y)
+	res.y.sub(&res.y, &t)
+	// Z3 = 2*Y1*Z1
+	res.z.mul(&pt.y, &pt.z)
+	res.z.double(&res.z)
+	return res
+}
+
+// Addition in Jacobian coordinates (add-2007-bl)
+func (pt *pallasPoint) add(other *pallasPoint) pallasPoint {
+	if pt.isInfinity() {
+		return *other
+	}
+	if other.isInfinity() {
+		return *pt
+	}
+	var z1z1, z2z2, u1, u2, s1, s2, h, r, i, j, v, t fpElement
+	var res pallasPoint
+	z1z1.square(&pt.z)
+	z2z2.square(&other.z)
+	u1.mul(&pt.x, &z2z2)
+	u2.mul(&other.x, &z1z1)
+	s1.mul(&pt.y, &other.z)
+	s1.mul(&s1, &z2z2)
+	s2.mul(&other.y, &pt.z)
+	s2.mul(&s2, &z1z1)
+	h.sub(&u2, &u1)
+	r.sub(&s2, &s1)
+	if h.isZero() {
+		if r.isZero() {
+			return pt.double()
+		}
+		return pallasPoint{}
+	}
+	r.double(&r)
+	// I = (2*H)^2, J = H*I, V = U1*I
+	i.double(&h)
+	i.square(&i)
+	j.mul(&h, &i)
+	v.mul(&u1, &i)
+	// X3 = r^2-J-2*V
+	res.x.square(&r)
+	res.x.sub(&res.x, &j)
+	res.x.sub(&res.x, t.double(&v))
+	// Y3 = r*(V-X3)-2*S1*J
+	res.y.sub(&v, &res.x)
+	res.y.mul(&r, &res.y)
+	t.mul(&s1, &j)
+	res.y.sub(&res.y, t.double(&t))
+	// Z3 = ((Z1+Z2)^2-Z1Z1-Z2Z2)*H
+	res.z.add(&pt.z, &other.z)
+	res.z.square(&res.z)
+	res.z.sub(&res.z, &z1z1)
+	res.z.sub(&res.z, &z2z2)
+	res.z.mul(&res.z, &h)
+	return res
+}
+
+// Computes a*p1 + b*p2 with a single run of doublings
+func pallasDoubleMul(a *big.Int, p1 *pallasPoint, b *big.Int, p2 *pallasPoint) pallasPoint {
+	sum := p1.add(p2)
+	var res pallasPoint
+	for i := max(a.BitLen(), b.BitLen()) - 1; i >= 0; i-- {
+		res = res.double()
+		switch {
+		case a.Bit(i) == 1 && b.Bit(i) == 1:
+			res = res.add(&sum)
+		case a.Bit(i) == 1:
+			res = res.add(p1)
+		case b.Bit(i) == 1:
+			res = res.add(p2)
+		}
+	}
+	return res
+}
+
+// Reads a little-endian integer
+func leBytesToInt(bs []byte) *big.Int {
+	be := make([]byte, len(bs))
+	for i, b := range bs {
+		be[len(bs)-1-i] = b
+	}
+	return new(big.Int).SetBytes(be)
+}
+
+// Restores the point of a public key out of its x coordinate
+// and parity of y, returns false if there is no such point
+func decompressPk(pk *Pk) (pallasPoint, bool) {
+	x := leBytesToInt(pk[:32])
+	isOdd := pk[32]
+	if x.Cmp(pallasP) >= 0 || isOdd > 1 {
+		return pallasPoint{}, false
+	}
+	y2 := new(big.Int).Mul(x, x)
+	y2.Mul(y2, x).Add(y2, pallasB).Mod(y2, pallasP)
+	y := new(big.Int).ModSqrt(y2, pallasP)
+	if y == nil {
+		return pallasPoint{}, false
+	}
+	if y.Bit(0) != uint(isOdd) {
+		y.Sub(pallasP, y)
+	}
+	var res pallasPoint
+	res.x.setBig(x)
+	res.y.setBig(y)
+	res.z.setBig(big.NewInt(1))
+	return res, true
+}
+
+// Challenge of the signature, Poseidon hash of the public key,
+// x coordinate of the commitment and bits of the message
+func signatureChallenge(pk *pallasPoint, rx *big.Int, data []byte, networkId uint8) *big.Int {
+	var rxEl fpElement
+	rxEl.setBig(rx)
+	sponge := poseidonSponge{state: poseidonSignatureIv[networkId]}
+	sponge.absorb(pk.x, pk.y, rxEl)
+	sponge.absorb(packBits(bytesToBits(data))...)
+	// Base field is smaller than the scalar field,
+	// so the hash is taken as a scalar as is
+	e := sponge.squeeze()
+	return e.toBig()
+}
+
+// verifyMinaSig checks the signature the same way verify_message_string
+// of the reference signer does. Network id is 0 for testnet, 1 for mainnet.
+func verifyMinaSig(pk *Pk, sig *Sig, data []byte, networkId uint8) bool {
+	if int(networkId) >= len(poseidonSignatureIv) {
+		return false
+	}
+	pkPoint, ok := decompressPk(pk)
+	if !ok {
+		return false
+	}
+	rx := leBytesToInt(sig[:32])
+	s := leBytesToInt(sig[32:])
+	if rx.Sign() == 0 || rx.Cmp(pallasP) >= 0 || s.Sign() == 0 || s.Cmp(pallasQ) >= 0 {
+		return false
+	}
+	e := signatureChallenge(&pkPoint, rx, data, networkId)
+
+	// R = s*G - e*pk should have even y and x equal to rx
+	negPk := pkPoint
+	negPk.y.neg(&pkPoint.y)
+	r := pallasDoubleMul(s, &pallasG, e, &negPk)
+	if r.isInfinity() {
+		return false
+	}
+	x, y := r.affine()
+	return y.Bit(0) == 0 && x.Cmp(rx) == 0
+}
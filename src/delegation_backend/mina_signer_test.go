@@ -0,0 +1,210 @@
+package delegation_backend
+
+import (
+	"encoding/json"
+	"math/big"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+type sigTestVector struct {
+	pk        Pk
+	sig       Sig
+	data      []byte
+	networkId uint8
+}
+
+// Vectors of signer_test.go, usable with any implementation of verification
+func sigTestVectors(t *testing.T) []sigTestVector {
+	var res []sigTestVector
+	add := func(pkStr, sigStr string, data []byte) {
+		var v sigTestVector
+		if err := StringToPk(&v.pk, pkStr); err != nil {
+			t.Fatal(err)
+		}
+		if err := StringToSig(&v.sig, sigStr); err != nil {
+			t.Fatal(err)
+		}
+		v.data = data
+		v.networkId = 1
+		res = append(res, v)
+	}
+	add(PK1, SIG1, []byte{0, 0})
+	add(PK2, SIG2, []byte{0x80})
+	add(PK3, SIG3, []byte{0xFF})
+	hash4 := blake2b.Sum256(readTestFile("payload-no-snark", t))
+	add(PK4, SIG4, hash4[:])
+	hash5 := blake2b.Sum256(readTestFile("payload-with-snark", t))
+	add(PK5, SIG5, hash5[:])
+	for _, tc := range []struct {
+		name      string
+		networkId uint8
+	}{{"req-with-snark", 1}, {"req-no-snark", 1}, {"req-v1-with-snark", 0}} {
+		var req submitRequest
+		if err := json.Unmarshal(readTestFile(tc.name, t), &req); err != nil {
+			t.Fatal(err)
+		}
+		payload, err := req.Data.MakeSignPayload()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash := blake2b.Sum256(payload)
+		res = append(res, sigTestVector{pk: req.Submitter, sig: req.Sig, data: hash[:], networkId: tc.networkId})
+	}
+	return res
+}
+
+func TestVerifyMinaSig(t *testing.T) {
+	for i, v := range sigTestVectors(t) {
+		if !verifyMinaSig(&v.pk, &v.sig, v.data, v.networkId) {
+			t.Fatalf("vector %d: valid signature rejected", i)
+		}
+		if verifyMinaSig(&v.pk, &v.sig, v.data, 1-v.networkId) {
+			t.Fatalf("vector %d: signature accepted for another network", i)
+		}
+		if verifyMinaSig(&v.pk, &v.sig, v.data, 2) {
+			t.Fatalf("vector %d: signature accepted for unknown network", i)
+		}
+		data := append([]byte{}, v.data...)
+		data[len(data)-1] ^= 1
+		if verifyMinaSig(&v.pk, &v.sig, data, v.networkId) {
+			t.Fatalf("vector %d: signature accepted for modified data", i)
+		}
+		// Length of data is not hashed, trailing zero bits don't change
+		// the hash, but the signed data is always a hash of fixed size
+		if verifyMinaSig(&v.pk, &v.sig, append(v.data, 1), v.networkId) {
+			t.Fatalf("vector %d: signature accepted for extended data", i)
+		}
+		for _, idx := range []int{0, 31, 32, 63} {
+			sig := v.sig
+			sig[idx] ^= 1
+			if verifyMinaSig(&v.pk, &sig, v.data, v.networkId) {
+				t.Fatalf("vector %d: modified signature accepted", i)
+			}
+		}
+		pk := v.pk
+		pk[PK_LENGTH-1] ^= 1
+		if verifyMinaSig(&pk, &v.sig, v.data, v.networkId) {
+			t.Fatalf("vector %d: signature accepted for negated key", i)
+		}
+	}
+}
+
+func TestVerifyMinaSigMalformed(t *testing.T) {
+	v := sigTestVectors(t)[0]
+
+	// Parity byte other than 0 or 1
+	pk := v.pk
+	pk[PK_LENGTH-1] = 2
+	if verifyMinaSig(&pk, &v.sig, v.data, v.networkId) {
+		t.Fatal("key with invalid parity accepted")
+	}
+	// x = 0 is not on the curve as 5 is not a square
+	var zeroPk Pk
+	if _, ok := decompressPk(&zeroPk); ok {
+		t.Fatal("decompressed key not on the curve")
+	}
+	// s + q is the same scalar, but it's not a canonical encoding
+	sig := v.sig
+	s := new(big.Int).Add(leBytesToInt(sig[32:]), pallasQ)
+	if s.BitLen() <= 256 {
+		be := s.FillBytes(make([]byte, 32))
+		for i := range be {
+			sig[32+i] = be[31-i]
+		}
+		if verifyMinaSig(&v.pk, &sig, v.data, v.networkId) {
+			t.Fatal("signature with non-canonical scalar accepted")
+		}
+	}
+	var zeroSig Sig
+	if verifyMinaSig(&v.pk, &zeroSig, v.data, v.networkId) {
+		t.Fatal("zero signature accepted")
+	}
+}
+
+func TestPallasArithmetic(t *testing.T) {
+	affineEq := func(a, b pallasPoint) bool {
+		ax, ay := a.affine()
+		bx, by := b.affine()
+		return ax.Cmp(bx) == 0 && ay.Cmp(by) == 0
+	}
+	gx, gy := pallasG.affine()
+	y2 := new(big.Int).Mul(gy, gy)
+	x3b := new(big.Int).Mul(gx, gx)
+	x3b.Mul(x3b, gx).Add(x3b, pallasB)
+	if new(big.Int).Sub(y2, x3b).Mod(y2.Sub(y2, x3b), pallasP).Sign() != 0 {
+		t.Fatal("generator is not on the curve")
+	}
+	// G has order q
+	zero := new(big.Int)
+	if q := pallasDoubleMul(pallasQ, &pallasG, zero, &pallasG); !q.isInfinity() {
+		t.Fatal("q*G is not infinity")
+	}
+	negG := pallasG
+	negG.y.neg(&pallasG.y)
+	qMinusOne := new(big.Int).Sub(pallasQ, big.NewInt(1))
+	if !affineEq(pallasDoubleMul(qMinusOne, &pallasG, zero, &pallasG), negG) {
+		t.Fatal("(q-1)*G is not -G")
+	}
+	// 3*G + 4*(2*G) = 11*G, with 2*G computed both ways
+	g2 := pallasG.double()
+	if !affineEq(g2, pallasG.add(&pallasG)) {
+		t.Fatal("G+G != 2*G")
+	}
+	a := pallasDoubleMul(big.NewInt(3), &pallasG, big.NewInt(4), &g2)
+	b := pallasDoubleMul(big.NewInt(11), &pallasG, zero, &pallasG)
+	if !affineEq(a, b) {
+		t.Fatal("3*G + 8*G != 11*G")
+	}
+	if sum := g2.add(&negG); !affineEq(sum, pallasG) {
+		t.Fatal("2*G - G != G")
+	}
+	if sum := pallasG.add(&negG); !sum.isInfinity() {
+		t.Fatal("G - G is not infinity")
+	}
+}
+
+func TestPallasField(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	random := func() *big.Int {
+		return new(big.Int).Rand(rnd, pallasP)
+	}
+	pMinusOne := new(big.Int).Sub(pallasP, big.NewInt(1))
+	values := []*big.Int{big.NewInt(0), big.NewInt(1), pMinusOne}
+	for i := 0; i < 50; i++ {
+		values = append(values, random())
+	}
+	for _, a := range values {
+		for _, b := range values[:10] {
+			var x, y, z fpElement
+			x.setBig(a)
+			y.setBig(b)
+			expected := new(big.Int)
+			for _, tc := range []struct {
+				name   string
+				actual *fpElement
+				op     func(*big.Int, *big.Int) *big.Int
+			}{
+				{"add", z.add(&x, &y), expected.Add},
+				{"sub", new(fpElement).sub(&x, &y), expected.Sub},
+				{"mul", new(fpElement).mul(&x, &y), expected.Mul},
+			} {
+				tc.op(a, b)
+				expected.Mod(expected, pallasP)
+				if tc.actual.toBig().Cmp(expected) != 0 {
+					t.Fatalf("%v %s %v: expected %v, got %v", a, tc.name, b, expected, tc.actual.toBig())
+				}
+			}
+		}
+		if a.Sign() != 0 {
+			var x, inv fpElement
+			x.setBig(a)
+			inv.inverse(&x)
+			if x.mul(&x, &inv).toBig().Cmp(big.NewInt(1)) != 0 {
+				t.Fatalf("%v * %v^-1 != 1", a, a)
+			}
+		}
+	}
+}
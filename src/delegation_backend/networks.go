@@ -0,0 +1,218 @@
+package delegation_backend
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Network names are used in URL paths, S3 prefixes and directory names
+var networkNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// NetworkConfig describes one of the networks served by a deployment.
+// Settings left empty are taken from the top level of AppConfig.
+type NetworkConfig struct {
+	Name string `json:"name"`
+	// Network id signatures are verified for, 1 for "mainnet" and 0 otherwise if not set
+	NetworkId                     *uint8                 `json:"network_id,omitempty"`
+	GsheetId                      string                 `json:"gsheet_id,omitempty"`
+	DelegationWhitelistList       string                 `json:"delegation_whitelist_list,omitempty"`
+	DelegationWhitelistColumn     string                 `json:"delegation_whitelist_column,omitempty"`
+	DelegationWhitelistLastColumn string                 `json:"delegation_whitelist_last_column,omitempty"`
+	DelegationWhitelistDisabled   *bool                  `json:"delegation_whitelist_disabled,omitempty"`
+	WhitelistSource               *WhitelistSourceConfig `json:"whitelist_source,omitempty"`
+	RequestsPerPkHourly           int                    `json:"requests_per_pk_hourly,omitempty"`
+	BlockDecoding                 *bool                  `json:"block_decoding,omitempty"`
+	BlockFormat                   string                 `json:"block_format,omitempty"`
+	AwsKeyspace                   string                 `json:"aws_keyspace,omitempty"`
+	FileSystemPath                string                 `json:"filesystem_path,omitempty"`
+	PostgreSQL                    *PostgreSQLConfig      `json:"postgresql,omitempty"`
+}
+
+// SignatureNetworkId returns the network id signatures of submissions
+// to the network are made for.
+func (c AppConfig) SignatureNetworkId() uint8 {
+	if c.NetworkId != nil {
+		return *c.NetworkId
+	}
+	return NetworkId(c.NetworkName)
+}
+
+// NetworkConfigs returns configuration of every network served,
+// the first one being served on /v1/submit as well. Without networks
+// configured it's the configuration itself.
+//
+// S3 objects of a network are put under its name. Unless overridden,
+// filesystem storage and the spool of a network are kept in its
+// subdirectory. Keyspaces and PostgreSQL tables have no network column,
+// so networks are required to use distinct keyspaces and databases,
+// only one of them may use the top level ones.
+func (c AppConfig) NetworkConfigs() ([]AppConfig, error) {
+	if err := c.checkWritePolicy(); err != nil {
+		return nil, err
+	}
+	if len(c.Networks) == 0 {
+		if err := c.checkBlockFormat(); err != nil {
+			return nil, err
+		}
+		return []AppConfig{c}, nil
+	}
+	res := make([]AppConfig, 0, len(c.Networks))
+	seen := make(map[string]bool)
+	keyspaces := make(map[string]string)
+	databases := make(map[string]string)
+	for _, n := range c.Networks {
+		if !networkNameRegexp.MatchString(n.Name) {
+			return nil, fmt.Errorf("invalid network name %q", n.Name)
+		}
+		if seen[n.Name] {
+			return nil, fmt.Errorf("network %s is configured twice", n.Name)
+		}
+		seen[n.Name] = true
+		if n.NetworkId != nil && *n.NetworkId > 1 {
+			return nil, fmt.Errorf("network id of %s should be 0 or 1", n.Name)
+		}
+		netCfg := c.forNetwork(n)
+		if err := netCfg.checkBlockFormat(); err != nil {
+			return nil, err
+		}
+		if netCfg.AwsKeyspaces != nil {
+			keyspace := netCfg.AwsKeyspaces.Keyspace
+			if other, has := keyspaces[keyspace]; has {
+				return nil, fmt.Errorf("networks %s and %s share keyspace %s, set aws_keyspace of the network", other, n.Name, keyspace)
+			}
+			keyspaces[keyspace] = n.Name
+		}
+		if netCfg.PostgreSQL != nil {
+			db := fmt.Sprintf("%s:%d/%s", netCfg.PostgreSQL.Host, netCfg.PostgreSQL.Port, netCfg.PostgreSQL.DBName)
+			if other, has := databases[db]; has {
+				return nil, fmt.Errorf("networks %s and %s share database %s, set postgresql of the network", other, n.Name, db)
+			}
+			databases[db] = n.Name
+		}
+		res = append(res, netCfg)
+	}
+	return res, nil
+}
+
+// Blocks are decoded only for networks declaring the format decodeBlock
+// supports, blocks of any other network would all be rejected
+func (c AppConfig) checkBlockFormat() error {
+	if c.BlockFormat != "" && c.BlockFormat != BLOCK_FORMAT_LEGACY {
+		return fmt.Errorf("unknown block format %q of network %s, expected %s", c.BlockFormat, c.NetworkName, BLOCK_FORMAT_LEGACY)
+	}
+	if c.BlockDecoding && c.BlockFormat != BLOCK_FORMAT_LEGACY {
+		return fmt.Errorf("block decoding of network %s requires block format %s, blocks of later protocol versions can't be decoded", c.NetworkName, BLOCK_FORMAT_LEGACY)
+	}
+	return nil
+}
+
+// The spool and the save queue accept a submission once it's written to disk
+// or queued for every backend, whatever the write policy says, so the policy
+// isn't allowed to be set along with them rather than being silently ignored
+func (c AppConfig) checkWritePolicy() error {
+	if c.StorageWritePolicy == "" {
+		return nil
+	}
+	if c.Spool != nil {
+		return fmt.Errorf("storage write policy %q has no effect with the spool, which saves every submission into every backend, unset one of them", c.StorageWritePolicy)
+	}
+	if c.SaveQueue != nil {
+		return fmt.Errorf("storage write policy %q has no effect with the save queue, which queues every submission for every backend, unset one of them", c.StorageWritePolicy)
+	}
+	return nil
+}
+
+func (c AppConfig) forNetwork(n NetworkConfig) AppConfig {
+	res := c
+	res.Networks = nil
+	res.NetworkName = n.Name
+	res.NetworkId = n.NetworkId
+	if n.GsheetId != "" {
+		res.GsheetId = n.GsheetId
+	}
+	if n.DelegationWhitelistList != "" {
+		res.DelegationWhitelistList = n.DelegationWhitelistList
+	}
+	if n.DelegationWhitelistColumn != "" {
+		res.DelegationWhitelistColumn = n.DelegationWhitelistColumn
+	}
+	if n.DelegationWhitelistLastColumn != "" {
+		res.DelegationWhitelistLastColumn = n.DelegationWhitelistLastColumn
+	}
+	if n.DelegationWhitelistDisabled != nil {
+		res.DelegationWhitelistDisabled = *n.DelegationWhitelistDisabled
+	}
+	if n.WhitelistSource != nil {
+		res.WhitelistSource = n.WhitelistSource
+	}
+	if n.RequestsPerPkHourly != 0 {
+		res.RequestsPerPkHourly = n.RequestsPerPkHourly
+	}
+	if n.BlockDecoding != nil {
+		res.BlockDecoding = *n.BlockDecoding
+	}
+	if n.BlockFormat != "" {
+		res.BlockFormat = n.BlockFormat
+	}
+	if c.AwsKeyspaces != nil && n.AwsKeyspace != "" {
+		keyspaces := *c.AwsKeyspaces
+		keyspaces.Keyspace = n.AwsKeyspace
+		res.AwsKeyspaces = &keyspaces
+	}
+	if n.FileSystemPath != "" {
+		res.LocalFileSystem = &LocalFileSystemConfig{Path: n.FileSystemPath}
+	} else if c.LocalFileSystem != nil {
+		res.LocalFileSystem = &LocalFileSystemConfig{Path: filepath.Join(c.LocalFileSystem.Path, n.Name)}
+	}
+	if n.PostgreSQL != nil {
+		res.PostgreSQL = n.PostgreSQL
+	}
+	if c.Spool != nil {
+		spool := *c.Spool
+		spool.Path = filepath.Join(spool.Path, n.Name)
+		res.Spool = &spool
+	}
+	return res
+}
+
+// NetworksH routes submissions to the handler of the network they are
+// sent for: /v1/<network>/submit, or /v1/submit for the default network,
+// and the same under /v2/.
+type NetworksH struct {
+	networks       map[string]*SubmitH
+	defaultNetwork *SubmitH
+}
+
+// NewNetworksH creates the router out of apps of every network,
+// the first one being the default network.
+func NewNetworksH(apps []*App) *NetworksH {
+	h := &NetworksH{networks: make(map[string]*SubmitH, len(apps))}
+	for _, app := range apps {
+		h.networks[app.NetworkName] = app.NewSubmitH()
+	}
+	if len(apps) > 0 {
+		h.defaultNetwork = h.networks[apps[0].NetworkName]
+	}
+	return h
+}
+
+func (h *NetworksH) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var sh *SubmitH
+	rest, ok := strings.CutPrefix(r.URL.Path, "/v1/")
+	if !ok {
+		rest, ok = strings.CutPrefix(r.URL.Path, "/v2/")
+	}
+	if rest == "submit" {
+		sh = h.defaultNetwork
+	} else if network, ok := strings.CutSuffix(rest, "/submit"); ok {
+		sh = h.networks[network]
+	}
+	if sh == nil {
+		http.NotFound(w, r)
+		return
+	}
+	sh.ServeHTTP(w, r)
+}
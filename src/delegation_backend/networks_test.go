@@ -0,0 +1,134 @@
+package delegation_backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNetworkConfigs(t *testing.T) {
+	var cfg AppConfig
+	err := json.Unmarshal([]byte(`{
+		"network_name": "mainnet",
+		"gsheet_id": "sheet",
+		"delegation_whitelist_list": "mainnet_list",
+		"delegation_whitelist_column": "A",
+		"aws_keyspaces": {"keyspace": "bpu", "cassandra_host": "localhost", "cassandra_port": 9142, "ssl_certificate_path": "cert"},
+		"filesystem": {"path": "/data"},
+		"spool": {"path": "/spool"},
+		"networks": [
+			{"name": "mainnet"},
+			{"name": "devnet", "delegation_whitelist_list": "devnet_list", "aws_keyspace": "bpu_devnet", "requests_per_pk_hourly": 240},
+			{"name": "mainnet-staging", "network_id": 1, "delegation_whitelist_disabled": true, "filesystem_path": "/staging", "aws_keyspace": "bpu_staging"}
+		]
+	}`), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	netCfgs, err := cfg.NetworkConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(netCfgs) != 3 {
+		t.Fatalf("expected 3 networks, got %d", len(netCfgs))
+	}
+	mainnet, devnet, staging := netCfgs[0], netCfgs[1], netCfgs[2]
+	if mainnet.SignatureNetworkId() != 1 || devnet.SignatureNetworkId() != 0 || staging.SignatureNetworkId() != 1 {
+		t.Fatal("unexpected network ids")
+	}
+	if mainnet.DelegationWhitelistList != "mainnet_list" || devnet.DelegationWhitelistList != "devnet_list" ||
+		devnet.GsheetId != "sheet" || !staging.DelegationWhitelistDisabled || mainnet.DelegationWhitelistDisabled {
+		t.Fatal("unexpected whitelist settings")
+	}
+	if mainnet.AwsKeyspaces.Keyspace != "bpu" || devnet.AwsKeyspaces.Keyspace != "bpu_devnet" || cfg.AwsKeyspaces.Keyspace != "bpu" {
+		t.Fatal("unexpected keyspaces")
+	}
+	if mainnet.LocalFileSystem.Path != "/data/mainnet" || staging.LocalFileSystem.Path != "/staging" ||
+		devnet.Spool.Path != "/spool/devnet" || cfg.Spool.Path != "/spool" {
+		t.Fatal("unexpected storage paths")
+	}
+	if devnet.RequestsPerPkHourly != 240 || mainnet.RequestsPerPkHourly != 0 {
+		t.Fatal("unexpected rate limits")
+	}
+
+	cfg.Networks = nil
+	if netCfgs, err = cfg.NetworkConfigs(); err != nil || len(netCfgs) != 1 || netCfgs[0].NetworkName != "mainnet" {
+		t.Fatalf("unexpected configuration of a single network: %v", err)
+	}
+	if _, err := (AppConfig{NetworkName: "mainnet", BlockDecoding: true}).NetworkConfigs(); err == nil {
+		t.Fatal("expected block decoding without block format to be rejected")
+	}
+	if _, err := (AppConfig{NetworkName: "mainnet", BlockDecoding: true, BlockFormat: BLOCK_FORMAT_LEGACY}).NetworkConfigs(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (AppConfig{NetworkName: "mainnet", StorageWritePolicy: "all", Spool: &SpoolConfig{Path: "/spool"}}).NetworkConfigs(); err == nil {
+		t.Fatal("expected write policy along with the spool to be rejected")
+	}
+	if _, err := (AppConfig{NetworkName: "mainnet", StorageWritePolicy: "quorum:2", SaveQueue: &SaveQueueConfig{Size: 10}}).NetworkConfigs(); err == nil {
+		t.Fatal("expected write policy along with the save queue to be rejected")
+	}
+
+	decoding := true
+	for _, networks := range [][]NetworkConfig{
+		{{Name: "mainnet"}, {Name: "mainnet"}},
+		{{Name: "Main net"}},
+		{{Name: ""}},
+		{{Name: "devnet", NetworkId: new(uint8)}, {Name: "other", NetworkId: func() *uint8 { id := uint8(2); return &id }()}},
+		// Submissions of networks sharing a keyspace couldn't be told apart
+		{{Name: "mainnet"}, {Name: "devnet"}},
+		{{Name: "mainnet", AwsKeyspace: "bpu"}, {Name: "devnet"}},
+		// Only legacy blocks can be decoded
+		{{Name: "mainnet", AwsKeyspace: "bpu_mainnet", BlockDecoding: &decoding}},
+		{{Name: "mainnet", AwsKeyspace: "bpu_mainnet", BlockDecoding: &decoding, BlockFormat: "berkeley"}},
+		{{Name: "mainnet", PostgreSQL: &PostgreSQLConfig{Host: "db", DBName: "bpu"}}, {Name: "devnet", AwsKeyspace: "bpu_devnet", PostgreSQL: &PostgreSQLConfig{Host: "db", DBName: "bpu"}}},
+	} {
+		cfg.Networks = networks
+		if _, err := cfg.NetworkConfigs(); err == nil {
+			t.Fatalf("expected error for %+v", networks)
+		}
+	}
+}
+
+func TestNetworksH(t *testing.T) {
+	body := readTestFile("req-no-snark", t)
+	var req submitRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal("failed decoding test file")
+	}
+	mainnetStorage, mainnet, _ := testSubmitH(1, Whitelist{req.Submitter: {}})
+	mainnet.app.NetworkName = "mainnet"
+	devnetStorage, devnet, _ := testSubmitH(1, Whitelist{})
+	devnet.app.NetworkName = "devnet"
+	h := NewNetworksH([]*App{mainnet.app, devnet.app})
+
+	request := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", path, bytes.NewReader(body)))
+		return rec
+	}
+	// Submitter is only whitelisted on mainnet
+	if rep := request("/v1/devnet/submit"); rep.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 from devnet, got %v", rep)
+	}
+	if rep := request("/v1/mainnet/submit"); rep.Code != http.StatusOK {
+		t.Fatalf("unexpected response from mainnet: %v", rep)
+	}
+	if len(*mainnetStorage) == 0 || len(*devnetStorage) != 0 {
+		t.Fatal("submission wasn't saved into storage of its network")
+	}
+	// Mainnet is the default network, with its own rate limit
+	if rep := request("/v1/submit"); rep.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 from the default network, got %v", rep)
+	}
+	// v2 is routed the same way, the v1 body is rejected by its schema
+	if rep := request("/v2/devnet/submit"); rep.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 from v2 of devnet, got %v", rep)
+	}
+	for _, path := range []string{"/v3/submit", "/v2/testnet/submit", "/v1/testnet/submit", "/v1/mainnet", "/v1/mainnet/submit/x", "/v1//submit"} {
+		if rep := request(path); rep.Code != http.StatusNotFound {
+			t.Fatalf("%s: expected 404, got %v", path, rep)
+		}
+	}
+}
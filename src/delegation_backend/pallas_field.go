@@ -0,0 +1,150 @@
+package delegation_backend
+
+import (
+	"encoding/binary"
+	"math/big"
+	"math/bits"
+)
+
+// fpElement is an element of the Pallas base field in Montgomery form,
+// x is stored as x*2^256 mod p in little-endian 64-bit limbs.
+type fpElement [4]uint64
+
+var fpModulus = bigToLimbs(pallasP)
+
+// -p^-1 mod 2^64
+var fpInv = func() uint64 {
+	// Newton iteration for p^-1 mod 2^64, each step doubles correct bits
+	inv := uint64(1)
+	for i := 0; i < 6; i++ {
+		inv *= 2 - fpModulus[0]*inv
+	}
+	return -inv
+}()
+
+// 2^512 mod p, multiplying by it converts to Montgomery form
+var fpR2 = func() fpElement {
+	r2 := new(big.Int).Lsh(big.NewInt(1), 512)
+	return bigToLimbs(r2.Mod(r2, pallasP))
+}()
+
+// Limbs of x, which should be less than 2^256
+func bigToLimbs(x *big.Int) (res fpElement) {
+	var buf [32]byte
+	x.FillBytes(buf[:])
+	for i := range res {
+		res[i] = binary.BigEndian.Uint64(buf[24-8*i:])
+	}
+	return
+}
+
+// Sets z to x mod p
+func (z *fpElement) setBig(x *big.Int) *fpElement {
+	*z = bigToLimbs(new(big.Int).Mod(x, pallasP))
+	return z.mul(z, &fpR2)
+}
+
+func (z *fpElement) toBig() *big.Int {
+	canonical := *z
+	canonical.mul(&canonical, &fpElement{1})
+	var buf [32]byte
+	for i, limb := range canonical {
+		binary.BigEndian.PutUint64(buf[24-8*i:], limb)
+	}
+	return new(big.Int).SetBytes(buf[:])
+}
+
+func (z *fpElement) isZero() bool {
+	return z[0]|z[1]|z[2]|z[3] == 0
+}
+
+// Subtracts p if z >= p, carry is the bit above the 256 bits of z
+func (z *fpElement) reduce(carry uint64) {
+	var d fpElement
+	var borrow uint64
+	d[0], borrow = bits.Sub64(z[0], fpModulus[0], 0)
+	d[1], borrow = bits.Sub64(z[1], fpModulus[1], borrow)
+	d[2], borrow = bits.Sub64(z[2], fpModulus[2], borrow)
+	d[3], borrow = bits.Sub64(z[3], fpModulus[3], borrow)
+	if carry != 0 || borrow == 0 {
+		*z = d
+	}
+}
+
+func (z *fpElement) add(x, y *fpElement) *fpElement {
+	var carry uint64
+	z[0], carry = bits.Add64(x[0], y[0], 0)
+	z[1], carry = bits.Add64(x[1], y[1], carry)
+	z[2], carry = bits.Add64(x[2], y[2], carry)
+	z[3], carry = bits.Add64(x[3], y[3], carry)
+	z.reduce(carry)
+	return z
+}
+
+func (z *fpElement) sub(x, y *fpElement) *fpElement {
+	var borrow uint64
+	z[0], borrow = bits.Sub64(x[0], y[0], 0)
+	z[1], borrow = bits.Sub64(x[1], y[1], borrow)
+	z[2], borrow = bits.Sub64(x[2], y[2], borrow)
+	z[3], borrow = bits.Sub64(x[3], y[3], borrow)
+	if borrow != 0 {
+		var carry uint64
+		z[0], carry = bits.Add64(z[0], fpModulus[0], 0)
+		z[1], carry = bits.Add64(z[1], fpModulus[1], carry)
+		z[2], carry = bits.Add64(z[2], fpModulus[2], carry)
+		z[3], _ = bits.Add64(z[3], fpModulus[3], carry)
+	}
+	return z
+}
+
+func (z *fpElement) neg(x *fpElement) *fpElement {
+	return z.sub(&fpElement{}, x)
+}
+
+func (z *fpElement) double(x *fpElement) *fpElement {
+	return z.add(x, x)
+}
+
+// Montgomery multiplication (CIOS)
+func (z *fpElement) mul(x, y *fpElement) *fpElement {
+	var t [6]uint64
+	for i := 0; i < 4; i++ {
+		var c, hi, lo, cc uint64
+		for j := 0; j < 4; j++ {
+			hi, lo = bits.Mul64(x[j], y[i])
+			lo, cc = bits.Add64(lo, t[j], 0)
+			hi += cc
+			lo, cc = bits.Add64(lo, c, 0)
+			hi += cc
+			t[j], c = lo, hi
+		}
+		t[4], cc = bits.Add64(t[4], c, 0)
+		t[5] = cc
+
+		m := t[0] * fpInv
+		hi, lo = bits.Mul64(m, fpModulus[0])
+		_, cc = bits.Add64(lo, t[0], 0)
+		c = hi + cc
+		for j := 1; j < 4; j++ {
+			hi, lo = bits.Mul64(m, fpModulus[j])
+			lo, cc = bits.Add64(lo, t[j], 0)
+			hi += cc
+			lo, cc = bits.Add64(lo, c, 0)
+			hi += cc
+			t[j-1], c = lo, hi
+		}
+		t[3], cc = bits.Add64(t[4], c, 0)
+		t[4] = t[5] + cc
+	}
+	*z = fpElement{t[0], t[1], t[2], t[3]}
+	z.reduce(t[4])
+	return z
+}
+
+func (z *fpElement) square(x *fpElement) *fpElement {
+	return z.mul(x, x)
+}
+
+func (z *fpElement) inverse(x *fpElement) *fpElement {
+	return z.setBig(new(big.Int).ModInverse(x.toBig(), pallasP))
+}
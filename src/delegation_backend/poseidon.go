@@ -0,0 +1,143 @@
+package delegation_backend
+
+import (
+	"math/big"
+)
+
+const POSEIDON_WIDTH = 3
+const POSEIDON_RATE = 2
+const POSEIDON_LEGACY_FULL_ROUNDS = 63
+
+// Prefixes of signature hashes, sponge state after absorbing
+// the prefix is the initial state for hashing signed messages
+const SIGNATURE_PREFIX_TESTNET = "CodaSignature"
+const SIGNATURE_PREFIX_MAINNET = "MinaSignatureMainnet"
+const HASH_PREFIX_LENGTH = 20
+
+type poseidonState [POSEIDON_WIDTH]fpElement
+
+var poseidonMds = func() (res [POSEIDON_WIDTH][POSEIDON_WIDTH]fpElement) {
+	for i, row := range poseidonLegacyMds {
+		for j, s := range row {
+			res[i][j] = mustParseFp(s)
+		}
+	}
+	return
+}()
+
+var poseidonRoundKeys = func() (res [POSEIDON_LEGACY_FULL_ROUNDS + 1]poseidonState) {
+	for i, row := range poseidonLegacyRoundKeys {
+		for j, s := range row {
+			res[i][j] = mustParseFp(s)
+		}
+	}
+	return
+}()
+
+// Initial sponge states of signature hashes, indexed by network id
+var poseidonSignatureIv = [2]poseidonState{
+	poseidonPrefixState(SIGNATURE_PREFIX_TESTNET),
+	poseidonPrefixState(SIGNATURE_PREFIX_MAINNET),
+}
+
+// Parses a hex field element, panics if it's invalid
+func mustParseFp(s string) (res fpElement) {
+	x, ok := new(big.Int).SetString(s, 16)
+	if !ok || x.Cmp(pallasP) >= 0 {
+		panic("invalid field element " + s)
+	}
+	res.setBig(x)
+	return
+}
+
+// poseidonSponge absorbs elements of the Pallas base field
+// with the legacy Poseidon permutation (x^5 s-box, full rounds only).
+type poseidonSponge struct {
+	state    poseidonState
+	absorbed int
+}
+
+func (s *poseidonSponge) absorb(fields ...fpElement) {
+	for i := range fields {
+		if s.absorbed == POSEIDON_RATE {
+			s.permute()
+			s.absorbed = 0
+		}
+		s.state[s.absorbed].add(&s.state[s.absorbed], &fields[i])
+		s.absorbed++
+	}
+}
+
+func (s *poseidonSponge) squeeze() fpElement {
+	s.permute()
+	return s.state[0]
+}
+
+func (s *poseidonSponge) permute() {
+	s.addRoundKeys(0)
+	var t, m fpElement
+	for r := 1; r <= POSEIDON_LEGACY_FULL_ROUNDS; r++ {
+		for i := range s.state {
+			// x^5
+			x := &s.state[i]
+			t.square(x)
+			t.square(&t)
+			x.mul(x, &t)
+		}
+		var next poseidonState
+		for i := range next {
+			for j := range s.state {
+				next[i].add(&next[i], m.mul(&s.state[j], &poseidonMds[i][j]))
+			}
+		}
+		s.state = next
+		s.addRoundKeys(r)
+	}
+}
+
+func (s *poseidonSponge) addRoundKeys(round int) {
+	for i := range s.state {
+		s.state[i].add(&s.state[i], &poseidonRoundKeys[round][i])
+	}
+}
+
+func poseidonPrefixState(prefix string) poseidonState {
+	padded := []byte(prefix)
+	for len(padded) < HASH_PREFIX_LENGTH {
+		padded = append(padded, '*')
+	}
+	var s poseidonSponge
+	s.absorb(packBits(bytesToBits(padded))...)
+	s.permute()
+	return s.state
+}
+
+// Bits of the bytes, least significant bit of every byte first
+func bytesToBits(bs []byte) []bool {
+	bits := make([]bool, 0, 8*len(bs))
+	for _, b := range bs {
+		for i := 0; i < 8; i++ {
+			bits = append(bits, (b>>i)&1 == 1)
+		}
+	}
+	return bits
+}
+
+// Packs bits into field elements of at most 254 bits each,
+// the first bit of a chunk being the least significant one
+func packBits(bits []bool) []fpElement {
+	const chunkSize = 254
+	var fields []fpElement
+	for start := 0; start < len(bits); start += chunkSize {
+		end := min(start+chunkSize, len(bits))
+		var limbs fpElement
+		for i := start; i < end; i++ {
+			if bits[i] {
+				limbs[(i-start)/64] |= 1 << ((i - start) % 64)
+			}
+		}
+		// Chunk is less than p, so it only needs conversion to Montgomery form
+		fields = append(fields, *limbs.mul(&limbs, &fpR2))
+	}
+	return fields
+}
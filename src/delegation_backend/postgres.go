@@ -1,6 +1,7 @@
 package delegation_backend
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 
@@ -26,15 +27,15 @@ func NewPostgreSQL(cfg *PostgreSQLConfig) (*sql.DB, error) {
 	return db, nil
 }
 
-func (ctx *PostgreSQLContext) insertSubmission(submission *Submission) error {
+func (ctx *PostgreSQLContext) insertSubmission(c context.Context, submission *Submission) error {
 	// if SnarkWork is empty, do not insert it into the database
 	if len(submission.SnarkWork) == 0 {
-		return ctx.insertSubmissionWithoutSnarkWork(submission)
+		return ctx.insertSubmissionWithoutSnarkWork(c, submission)
 	}
-	return ctx.insertSubmissionWithSnarkWork(submission)
+	return ctx.insertSubmissionWithSnarkWork(c, submission)
 }
 
-func (ctx *PostgreSQLContext) insertSubmissionWithoutSnarkWork(submission *Submission) error {
+func (ctx *PostgreSQLContext) insertSubmissionWithoutSnarkWork(c context.Context, submission *Submission) error {
 	query := `INSERT INTO submissions 
 				(submitted_at_date, 
 				 submitted_at, 
@@ -44,16 +45,20 @@ func (ctx *PostgreSQLContext) insertSubmissionWithoutSnarkWork(submission *Submi
 				 remote_addr, 
 				 peer_id, 
 				 graphql_control_port,
-				 built_with_commit_sha)
-			   VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
-	_, err := ctx.DB.Exec(query, submission.SubmittedAtDate, submission.SubmittedAt,
+				 built_with_commit_sha,
+				 state_hash,
+				 parent,
+				 height,
+				 slot)
+			   VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`
+	_, err := ctx.DB.ExecContext(c, query, submission.SubmittedAtDate, submission.SubmittedAt,
 		submission.Submitter, submission.CreatedAt, submission.BlockHash,
 		submission.RemoteAddr, submission.PeerId, submission.GraphqlControlPort,
-		submission.BuiltWithCommitSha)
+		submission.BuiltWithCommitSha, submission.StateHash, submission.Parent, submission.Height, submission.Slot)
 	return err
 }
 
-func (ctx *PostgreSQLContext) insertSubmissionWithSnarkWork(submission *Submission) error {
+func (ctx *PostgreSQLContext) insertSubmissionWithSnarkWork(c context.Context, submission *Submission) error {
 	query := `INSERT INTO submissions 
 				(submitted_at_date, 
 				submitted_at, 
@@ -64,31 +69,48 @@ func (ctx *PostgreSQLContext) insertSubmissionWithSnarkWork(submission *Submissi
 				peer_id, 
 				graphql_control_port,
 				built_with_commit_sha,
-				snark_work) 
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
-	_, err := ctx.DB.Exec(query, submission.SubmittedAtDate, submission.SubmittedAt,
+				snark_work,
+				state_hash,
+				parent,
+				height,
+				slot) 
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`
+	_, err := ctx.DB.ExecContext(c, query, submission.SubmittedAtDate, submission.SubmittedAt,
 		submission.Submitter, submission.CreatedAt, submission.BlockHash,
 		submission.RemoteAddr, submission.PeerId, submission.GraphqlControlPort,
-		submission.BuiltWithCommitSha, submission.SnarkWork)
+		submission.BuiltWithCommitSha, submission.SnarkWork, submission.StateHash, submission.Parent, submission.Height, submission.Slot)
 	return err
 }
 
-func (ctx *PostgreSQLContext) PostgreSQLSave(objs ObjectsToSave) {
+func (ctx *PostgreSQLContext) Name() string {
+	return "postgresql"
+}
+
+func (ctx *PostgreSQLContext) Save(c context.Context, objs ObjectsToSave) error {
 	submissionToSave, err := objectToSaveToSubmission(objs, ctx.Log)
 	if err != nil {
 		ctx.Log.Errorf("PostgreSQLSave: Error preparing submission for saving: %v", err)
-		return
+		return err
 	}
 
-	if err := ctx.insertSubmission(submissionToSave); err != nil {
+	if err := ctx.insertSubmission(c, submissionToSave); err != nil {
 		// if err contains uq_submissions_submitter_date then we can ignore it
 		// because it means that the submission is already in the database
 		if err.Error() == "pq: duplicate key value violates unique constraint \"uq_submissions_submitter_date\"" {
 			ctx.Log.Infof("PostgreSQLSave: Submission for submitter: %v at %v already exists", submissionToSave.Submitter, submissionToSave.SubmittedAt)
-			return
+			return nil
 		}
 		ctx.Log.Errorf("PostgreSQLSave: Error saving submission to PostgreSQL: %v", err)
-	} else {
-		ctx.Log.Infof("PostgreSQLSave: Successfully saved submission for submitter: %v at %v", submissionToSave.Submitter, submissionToSave.SubmittedAt)
+		return err
 	}
+	ctx.Log.Infof("PostgreSQLSave: Successfully saved submission for submitter: %v at %v", submissionToSave.Submitter, submissionToSave.SubmittedAt)
+	return nil
+}
+
+func (ctx *PostgreSQLContext) HealthCheck(c context.Context) error {
+	return ctx.DB.PingContext(c)
+}
+
+func (ctx *PostgreSQLContext) Close() error {
+	return ctx.DB.Close()
 }
@@ -0,0 +1,103 @@
+package delegation_backend
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RateLimiter limits number of submissions of a public key per hour.
+type RateLimiter interface {
+	// Allow records an attempt of pk unless it made maxAttempt attempts
+	// within the last hour, returning false and time until its next attempt
+	// fits into the limit then. Zero maxAttempt stands for the default limit
+	// of the rate limiter.
+	Allow(ctx context.Context, pk Pk, maxAttempt int) (bool, time.Duration, error)
+}
+
+const DEFAULT_RATE_LIMITER_KEY_PREFIX = "delegation_backend:attempts:"
+
+// Sliding window of attempts of a key kept in a sorted set scored by time
+// in milliseconds. Returns -1 if the attempt is recorded, otherwise
+// milliseconds until the next one fits into the limit.
+//
+// KEYS[1] - attempts of the key
+// ARGV - current time, window, max attempts, unique member for the attempt
+var redisSlidingWindow = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local max = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local count = redis.call('ZCARD', KEYS[1])
+if count < max then
+  redis.call('ZADD', KEYS[1], now, ARGV[4])
+  redis.call('PEXPIRE', KEYS[1], window)
+  return -1
+end
+if count == 0 then
+  return window
+end
+local oldest = redis.call('ZRANGE', KEYS[1], count - max, count - max, 'WITHSCORES')
+return tonumber(oldest[2]) + window - now
+`)
+
+// RedisRateLimiter counts attempts in Redis (or a server speaking its
+// protocol), so that the limit is shared by every replica of the service
+// and survives restarts. Time of attempts is taken from the replica, clocks
+// of replicas are expected to be synchronized.
+type RedisRateLimiter struct {
+	client     *redis.Client
+	keyPrefix  string
+	maxAttempt int
+	now        nowFunc
+}
+
+// NewRedisRateLimiter connects to Redis at the URL, attempts of the network
+// are kept under the key prefix followed by the network name.
+func NewRedisRateLimiter(cfg *RateLimiterConfig, network string, maxAttemptPerHour int) (*RedisRateLimiter, error) {
+	opts, err := redis.ParseURL(cfg.RedisURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL of the rate limiter: %w", err)
+	}
+	keyPrefix := cfg.KeyPrefix
+	if keyPrefix == "" {
+		keyPrefix = DEFAULT_RATE_LIMITER_KEY_PREFIX
+	}
+	return &RedisRateLimiter{
+		client:     redis.NewClient(opts),
+		keyPrefix:  keyPrefix + network + ":",
+		maxAttempt: maxAttemptPerHour,
+		now:        time.Now,
+	}, nil
+}
+
+func (l *RedisRateLimiter) Allow(ctx context.Context, pk Pk, maxAttempt int) (bool, time.Duration, error) {
+	if maxAttempt == 0 {
+		maxAttempt = l.maxAttempt
+	}
+	var unique [8]byte
+	_, _ = rand.Read(unique[:])
+	now := l.now().UnixMilli()
+	res, err := redisSlidingWindow.Run(ctx, l.client, []string{l.keyPrefix + pk.String()},
+		now, (-minusOneHour).Milliseconds(), maxAttempt, fmt.Sprintf("%d-%s", now, hex.EncodeToString(unique[:]))).Int64()
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to record attempt in Redis: %w", err)
+	}
+	if res < 0 {
+		return true, 0, nil
+	}
+	return false, time.Duration(res) * time.Millisecond, nil
+}
+
+// Ping checks connection to Redis
+func (l *RedisRateLimiter) Ping(ctx context.Context) error {
+	return l.client.Ping(ctx).Err()
+}
+
+func (l *RedisRateLimiter) Close() error {
+	return l.client.Close()
+}
@@ -0,0 +1,96 @@
+package delegation_backend
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func newTestRedisRateLimiter(srv *miniredis.Miniredis, maxAttempt int, tm *timeMock, t *testing.T) *RedisRateLimiter {
+	l, err := NewRedisRateLimiter(&RateLimiterConfig{RedisURL: "redis://" + srv.Addr()}, "mainnet", maxAttempt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.now = tm.Now
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func TestRedisRateLimiter(t *testing.T) {
+	srv := miniredis.RunT(t)
+	tm := &timeMock{time: time.Now()}
+	ctx := context.Background()
+	// Two replicas sharing the same Redis
+	l1 := newTestRedisRateLimiter(srv, 2, tm, t)
+	l2 := newTestRedisRateLimiter(srv, 2, tm, t)
+	pk := mkPk()
+
+	if ok, _, err := l1.Allow(ctx, pk, 0); !ok || err != nil {
+		t.Fatalf("unexpected rejection: %v", err)
+	}
+	tm.Advance(10 * time.Minute)
+	if ok, _, err := l2.Allow(ctx, pk, 0); !ok || err != nil {
+		t.Fatalf("unexpected rejection: %v", err)
+	}
+	tm.Advance(5 * time.Minute)
+	for _, l := range []*RedisRateLimiter{l1, l2} {
+		if ok, retryAfter, err := l.Allow(ctx, pk, 0); ok || err != nil || retryAfter != 45*time.Minute {
+			t.Fatalf("unexpected result: %v, %v, %v", ok, retryAfter, err)
+		}
+	}
+	// Limit of a whitelist entry overrides the default one
+	if ok, _, _ := l2.Allow(ctx, pk, 3); !ok {
+		t.Fatal("unexpected rejection with a higher limit")
+	}
+	if ok, retryAfter, _ := l1.Allow(ctx, pk, 1); ok || retryAfter != time.Hour {
+		t.Fatalf("unexpected result with a lower limit: %v, %v", ok, retryAfter)
+	}
+	// Other keys are not affected
+	if ok, _, _ := l1.Allow(ctx, mkPk(), 0); !ok {
+		t.Fatal("unexpected rejection of another key")
+	}
+	tm.Advance(time.Hour)
+	if ok, _, _ := l1.Allow(ctx, pk, 0); !ok {
+		t.Fatal("unexpected rejection after attempts expired")
+	}
+	if ttl := srv.TTL("delegation_backend:attempts:mainnet:" + pk.String()); ttl != time.Hour {
+		t.Fatalf("unexpected TTL of the key: %v", ttl)
+	}
+
+	srv.Close()
+	if _, _, err := l1.Allow(ctx, pk, 0); err == nil {
+		t.Fatal("expected an error with Redis down")
+	}
+}
+
+func TestSubmitRateLimiterUnavailable(t *testing.T) {
+	body := readTestFile("req-no-snark", t)
+	var req submitRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal("failed decoding test file")
+	}
+	_, sh, tm := testSubmitH(1, Whitelist{req.Submitter: {}})
+	srv := miniredis.RunT(t)
+	sh.app.SubmitCounter = newTestRedisRateLimiter(srv, 1, tm, t)
+	if rep := sh.testRequest(body); rep.Code != 200 {
+		t.Fatalf("unexpected response: %v", rep)
+	}
+	tm.Advance(20 * time.Minute)
+	rep := sh.testRequest(body)
+	if rep.Code != 429 {
+		t.Fatalf("expected 429, got %v", rep)
+	}
+	if retryAfter := rep.Header().Get("Retry-After"); retryAfter != "2400" {
+		t.Fatalf("unexpected Retry-After: %q", retryAfter)
+	}
+
+	srv.Close()
+	rep = sh.testRequest(body)
+	if rep.Code != 503 {
+		t.Fatalf("expected 503, got %v", rep)
+	}
+	expectErrorCode(rep, ERR_RATE_LIMITER_UNAVAILABLE, t)
+}
@@ -0,0 +1,127 @@
+package delegation_backend
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Submissions are remembered per network, networks share the guard
+// and the same signed payload may be submitted to each of them
+type seenSubmission struct {
+	network   string
+	submitter Pk
+	sig       Sig
+}
+
+type seenExpiry struct {
+	key       seenSubmission
+	expiresAt time.Time
+}
+
+type seenExpiryHeap []seenExpiry
+
+func (h seenExpiryHeap) Len() int {
+	return len(h)
+}
+func (h seenExpiryHeap) Less(i, j int) bool {
+	return h[i].expiresAt.Before(h[j].expiresAt)
+}
+func (h seenExpiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+func (h *seenExpiryHeap) Push(x interface{}) {
+	*h = append(*h, x.(seenExpiry))
+}
+func (h *seenExpiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
+
+// ReplayGuard rejects submissions which are too old or were already
+// accepted, the two checks being configured separately. A submission is
+// remembered for seenTTL after it's accepted, or until its payload becomes
+// stale if that's earlier: a replay of it later is rejected as stale anyway.
+// A zero maxAge disables the age check and a zero seenTTL the detection of
+// duplicates. All methods are no-ops on a nil *ReplayGuard.
+type ReplayGuard struct {
+	maxAge   time.Duration
+	seenTTL  time.Duration
+	mutex    sync.Mutex
+	seen     map[seenSubmission]time.Time // expiration time of every entry
+	expiries seenExpiryHeap
+}
+
+func NewReplayGuard(maxAge time.Duration, seenTTL time.Duration) *ReplayGuard {
+	return &ReplayGuard{
+		maxAge:  maxAge,
+		seenTTL: seenTTL,
+		seen:    make(map[seenSubmission]time.Time),
+	}
+}
+
+// IsStale returns true if a payload created at createdAt is too old
+// to be accepted at now.
+func (g *ReplayGuard) IsStale(createdAt time.Time, now time.Time) bool {
+	if g == nil || g.maxAge <= 0 {
+		return false
+	}
+	return createdAt.Add(g.maxAge).Before(now)
+}
+
+// MarkSeen records the submission, returning false if it was already
+// recorded and is not expired yet.
+func (g *ReplayGuard) MarkSeen(network string, submitter Pk, sig Sig, createdAt time.Time, now time.Time) bool {
+	if g == nil || g.seenTTL <= 0 {
+		return true
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.expire(now)
+	key := seenSubmission{network: network, submitter: submitter, sig: sig}
+	if _, has := g.seen[key]; has {
+		return false
+	}
+	expiresAt := now.Add(g.seenTTL)
+	if staleAt := createdAt.Add(g.maxAge); g.maxAge > 0 && staleAt.Before(expiresAt) {
+		expiresAt = staleAt
+	}
+	g.seen[key] = expiresAt
+	heap.Push(&g.expiries, seenExpiry{key: key, expiresAt: expiresAt})
+	return true
+}
+
+// Forget removes the submission recorded by MarkSeen, so that it can be
+// resubmitted after it wasn't accepted.
+func (g *ReplayGuard) Forget(network string, submitter Pk, sig Sig) {
+	if g == nil {
+		return
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	// The heap entry is dropped once it expires
+	delete(g.seen, seenSubmission{network: network, submitter: submitter, sig: sig})
+}
+
+// Size returns number of remembered submissions.
+func (g *ReplayGuard) Size() int {
+	if g == nil {
+		return 0
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return len(g.seen)
+}
+
+func (g *ReplayGuard) expire(now time.Time) {
+	for len(g.expiries) > 0 && g.expiries[0].expiresAt.Before(now) {
+		e := heap.Pop(&g.expiries).(seenExpiry)
+		// Entry could have been forgotten and recorded again since
+		if expiresAt, has := g.seen[e.key]; has && expiresAt.Equal(e.expiresAt) {
+			delete(g.seen, e.key)
+		}
+	}
+}
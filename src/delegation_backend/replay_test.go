@@ -0,0 +1,120 @@
+package delegation_backend
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestReplayGuard(t *testing.T) {
+	g := NewReplayGuard(10*time.Minute, time.Hour)
+	createdAt := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := createdAt.Add(time.Minute)
+	if g.IsStale(createdAt, now) || g.IsStale(createdAt, createdAt.Add(10*time.Minute)) {
+		t.Fatal("fresh payload considered stale")
+	}
+	if !g.IsStale(createdAt, createdAt.Add(11*time.Minute)) {
+		t.Fatal("old payload is not considered stale")
+	}
+
+	pk := mkPk()
+	var sig1, sig2 Sig
+	sig2[0] = 1
+	if !g.MarkSeen("mainnet", pk, sig1, createdAt, now) || !g.MarkSeen("mainnet", pk, sig2, createdAt.Add(time.Minute), now) {
+		t.Fatal("new submission considered a duplicate")
+	}
+	if g.MarkSeen("mainnet", pk, sig1, createdAt, now) {
+		t.Fatal("duplicate wasn't detected")
+	}
+	g.Forget("mainnet", pk, sig1)
+	if !g.MarkSeen("mainnet", pk, sig1, createdAt, now) {
+		t.Fatal("forgotten submission considered a duplicate")
+	}
+	// Same payload may be submitted to every network
+	if !g.MarkSeen("devnet", pk, sig1, createdAt, now) {
+		t.Fatal("submission to another network considered a duplicate")
+	}
+	g.Forget("devnet", pk, sig1)
+
+	// Entries are dropped once their payloads become stale
+	var sig3 Sig
+	sig3[0] = 2
+	g.MarkSeen("mainnet", pk, sig3, createdAt.Add(10*time.Minute), createdAt.Add(11*time.Minute))
+	if g.Size() != 2 {
+		t.Fatalf("expected only fresh submissions to be remembered, got %d", g.Size())
+	}
+	if g.MarkSeen("mainnet", pk, sig2, createdAt.Add(time.Minute), createdAt.Add(11*time.Minute)) {
+		t.Fatal("duplicate wasn't detected")
+	}
+
+	// Without the age check duplicates are remembered for their own TTL
+	g = NewReplayGuard(0, time.Hour)
+	if g.IsStale(createdAt, createdAt.Add(24*time.Hour)) {
+		t.Fatal("age is checked with zero max age")
+	}
+	if !g.MarkSeen("mainnet", pk, sig1, createdAt, now) || g.MarkSeen("mainnet", pk, sig1, createdAt, now.Add(time.Hour)) {
+		t.Fatal("duplicate wasn't detected within the TTL")
+	}
+	if !g.MarkSeen("mainnet", pk, sig1, createdAt, now.Add(time.Hour+time.Second)) {
+		t.Fatal("submission remembered past the TTL")
+	}
+	// And with zero TTL only age is checked
+	g = NewReplayGuard(10*time.Minute, 0)
+	if !g.MarkSeen("mainnet", pk, sig1, createdAt, now) || !g.MarkSeen("mainnet", pk, sig1, createdAt, now) || g.Size() != 0 {
+		t.Fatal("duplicates detected with zero TTL")
+	}
+
+	var nilGuard *ReplayGuard
+	if nilGuard.IsStale(createdAt, now.Add(time.Hour)) || !nilGuard.MarkSeen("mainnet", pk, sig1, createdAt, now) {
+		t.Fatal("nil guard shouldn't reject submissions")
+	}
+}
+
+func TestSubmitReplay(t *testing.T) {
+	body := readTestFile("req-no-snark", t)
+	var req submitRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal("failed decoding test file")
+	}
+	storage, sh, tm := testSubmitH(1, Whitelist{})
+	sh.app.WhitelistDisabled = true
+	sh.app.Replay = NewReplayGuard(10*time.Minute, DEFAULT_SUBMISSION_SEEN_TTL)
+	tm.Advance(req.Data.CreatedAt.Add(time.Minute).Sub(tm.Now()))
+
+	// Failed save doesn't prevent resubmission
+	working := sh.app.Storage
+	sh.app.Storage = &memoryStorage{saveErr: errors.New("down")}
+	sh.app.SubmitCounter = NewAttemptCounter(10, 0)
+	if rep := sh.testRequest(body); rep.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %v", rep)
+	}
+	sh.app.Storage = working
+	if rep := sh.testRequest(body); rep.Code != 200 {
+		t.Fatalf("unexpected response: %v", rep)
+	}
+	saved := len(*storage)
+
+	if rep := sh.testRequest(body); rep.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %v", rep)
+	}
+	if len(*storage) != saved {
+		t.Fatal("duplicate submission was saved")
+	}
+
+	tm.Advance(10 * time.Minute)
+	if rep := sh.testRequest(body); rep.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a stale submission, got %v", rep)
+	}
+
+	// Duplicates are rejected with the default configuration,
+	// which doesn't check age of submissions
+	sh.app.Replay = NewReplayGuard(0, DEFAULT_SUBMISSION_SEEN_TTL)
+	if rep := sh.testRequest(body); rep.Code != 200 {
+		t.Fatalf("unexpected response: %v", rep)
+	}
+	if rep := sh.testRequest(body); rep.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %v", rep)
+	}
+}
@@ -0,0 +1,25 @@
+package delegation_backend
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+)
+
+const REQUEST_ID_HEADER = "X-Request-Id"
+
+// IDs set by a proxy in front of the service are kept if they look sane
+var requestIdRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestId returns the ID of the request from the X-Request-Id header,
+// or a new random one if the header is missing or invalid
+func requestId(r *http.Request) string {
+	if id := r.Header.Get(REQUEST_ID_HEADER); requestIdRegexp.MatchString(id) {
+		return id
+	}
+	var bs [16]byte
+	// Never fails on supported platforms
+	_, _ = rand.Read(bs[:])
+	return hex.EncodeToString(bs[:])
+}
@@ -0,0 +1,188 @@
+package delegation_backend
+
+import (
+	"container/list"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Max number of addresses the per-IP rate limiter tracks by default
+const DEFAULT_IP_RATE_LIMITER_MAX_KEYS = 100000
+
+// IPv6 clients are limited by their /64 network, as a single host
+// is commonly given the whole of it
+const IPV6_RATE_LIMIT_PREFIX = 64
+
+// Token bucket refilled with rate tokens per second up to burst
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take takes a token if there is one, otherwise returns time until there is
+func (b *tokenBucket) take(now time.Time, rate float64, burst int) (bool, time.Duration) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * rate
+	}
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// Time after which a bucket taken from at `last` is full again
+func (b *tokenBucket) full(rate float64, burst int) time.Time {
+	return b.last.Add(time.Duration((float64(burst) - b.tokens) / rate * float64(time.Second)))
+}
+
+type ipBucket struct {
+	prefix netip.Prefix
+	tokenBucket
+}
+
+// IPRateLimiter limits requests of every client address with a token bucket.
+// Buckets that are full again are dropped, and once maxKeys addresses are
+// tracked the least recently active one is evicted.
+type IPRateLimiter struct {
+	rate    float64 // tokens per second
+	burst   int
+	maxKeys int
+	buckets map[netip.Prefix]*list.Element
+	// Buckets ordered by their latest request, most recent first
+	lru   *list.List
+	mutex sync.Mutex
+}
+
+func NewIPRateLimiter(cfg *IPRateLimitConfig) *IPRateLimiter {
+	burst := cfg.Burst
+	if burst <= 0 {
+		burst = cfg.PerMinute
+	}
+	maxKeys := cfg.MaxKeys
+	if maxKeys <= 0 {
+		maxKeys = DEFAULT_IP_RATE_LIMITER_MAX_KEYS
+	}
+	return &IPRateLimiter{
+		rate:    float64(cfg.PerMinute) / 60,
+		burst:   burst,
+		maxKeys: maxKeys,
+		buckets: make(map[netip.Prefix]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Allow takes a token of the address, returning time until
+// the next one is available if there is none.
+func (l *IPRateLimiter) Allow(addr netip.Addr, now time.Time) (bool, time.Duration) {
+	prefix := rateLimitPrefix(addr)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.sweep(now)
+	e := l.buckets[prefix]
+	if e == nil {
+		if len(l.buckets) >= l.maxKeys {
+			l.remove(l.lru.Back())
+		}
+		e = l.lru.PushFront(&ipBucket{prefix: prefix, tokenBucket: tokenBucket{tokens: float64(l.burst), last: now}})
+		l.buckets[prefix] = e
+	} else {
+		l.lru.MoveToFront(e)
+	}
+	return e.Value.(*ipBucket).take(now, l.rate, l.burst)
+}
+
+// Size returns number of addresses tracked.
+func (l *IPRateLimiter) Size() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return len(l.buckets)
+}
+
+// Buckets that are full again are as good as new ones
+func (l *IPRateLimiter) sweep(now time.Time) {
+	for e := l.lru.Back(); e != nil; e = l.lru.Back() {
+		if b := e.Value.(*ipBucket); b.full(l.rate, l.burst).After(now) {
+			return
+		}
+		l.remove(e)
+	}
+}
+
+func (l *IPRateLimiter) remove(e *list.Element) {
+	l.lru.Remove(e)
+	delete(l.buckets, e.Value.(*ipBucket).prefix)
+}
+
+func rateLimitPrefix(addr netip.Addr) netip.Prefix {
+	addr = addr.Unmap()
+	bits := addr.BitLen()
+	if addr.Is6() {
+		bits = IPV6_RATE_LIMIT_PREFIX
+	}
+	prefix, _ := addr.Prefix(bits)
+	return prefix
+}
+
+// GlobalLimiter caps requests per second and number of requests
+// handled concurrently by the whole service.
+type GlobalLimiter struct {
+	rate   float64 // requests per second, unlimited if zero
+	burst  int
+	bucket tokenBucket
+	mutex  sync.Mutex
+	// Slot of every request in progress, concurrency is unlimited if nil
+	slots chan struct{}
+}
+
+func NewGlobalLimiter(cfg *GlobalRateLimitConfig) *GlobalLimiter {
+	burst := cfg.Burst
+	if burst <= 0 {
+		burst = cfg.PerSecond
+	}
+	l := &GlobalLimiter{
+		rate:   float64(cfg.PerSecond),
+		burst:  burst,
+		bucket: tokenBucket{tokens: float64(burst)},
+	}
+	if cfg.MaxConcurrent > 0 {
+		l.slots = make(chan struct{}, cfg.MaxConcurrent)
+	}
+	return l
+}
+
+// Allow takes a token of the service, returning time until
+// the next one is available if there is none.
+func (l *GlobalLimiter) Allow(now time.Time) (bool, time.Duration) {
+	if l.rate <= 0 {
+		return true, 0
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.bucket.take(now, l.rate, l.burst)
+}
+
+// Acquire takes a slot for a request without waiting for one,
+// the slot is to be released once the request is handled.
+func (l *GlobalLimiter) Acquire() bool {
+	if l.slots == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *GlobalLimiter) Release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
@@ -0,0 +1,143 @@
+package delegation_backend
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestIPRateLimiter(t *testing.T) {
+	l := NewIPRateLimiter(&IPRateLimitConfig{PerMinute: 6, Burst: 2})
+	now := time.Now()
+	addr := netip.MustParseAddr("192.0.2.1")
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow(addr, now); !ok {
+			t.Fatal("unexpected rejection within the burst")
+		}
+	}
+	if ok, retryAfter := l.Allow(addr, now); ok || retryAfter != 10*time.Second {
+		t.Fatalf("unexpected result: %v, %v", ok, retryAfter)
+	}
+	if ok, _ := l.Allow(netip.MustParseAddr("192.0.2.2"), now); !ok {
+		t.Fatal("unexpected rejection of another address")
+	}
+	now = now.Add(10 * time.Second)
+	if ok, _ := l.Allow(addr, now); !ok {
+		t.Fatal("unexpected rejection after a token was added")
+	}
+	if ok, _ := l.Allow(addr, now); ok {
+		t.Fatal("expected rejection with no tokens left")
+	}
+
+	// Addresses of a /64 network share their bucket
+	v6 := NewIPRateLimiter(&IPRateLimitConfig{PerMinute: 1})
+	if ok, _ := v6.Allow(netip.MustParseAddr("2001:db8::1"), now); !ok {
+		t.FailNow()
+	}
+	if ok, _ := v6.Allow(netip.MustParseAddr("2001:db8::2"), now); ok {
+		t.Fatal("expected rejection of an address in the same /64")
+	}
+	if ok, _ := v6.Allow(netip.MustParseAddr("2001:db8:0:1::1"), now); !ok {
+		t.Fatal("unexpected rejection of another /64")
+	}
+}
+
+func TestIPRateLimiterBounded(t *testing.T) {
+	l := NewIPRateLimiter(&IPRateLimitConfig{PerMinute: 60, Burst: 1, MaxKeys: 2})
+	now := time.Now()
+	a1, a2, a3 := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2"), netip.MustParseAddr("192.0.2.3")
+	l.Allow(a1, now)
+	l.Allow(a2, now)
+	l.Allow(a3, now)
+	if l.Size() != 2 {
+		t.Fatalf("expected %d addresses to be tracked, got %d", 2, l.Size())
+	}
+	// Least recently active address was evicted
+	if ok, _ := l.Allow(a1, now); !ok {
+		t.Fatal("expected evicted address to start over")
+	}
+	// Buckets full again are dropped
+	now = now.Add(time.Second)
+	l.Allow(a3, now)
+	if l.Size() != 1 {
+		t.Fatalf("expected full buckets to be dropped, %d addresses tracked", l.Size())
+	}
+}
+
+func TestGlobalLimiter(t *testing.T) {
+	l := NewGlobalLimiter(&GlobalRateLimitConfig{PerSecond: 2, MaxConcurrent: 1})
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow(now); !ok {
+			t.Fatal("unexpected rejection within the burst")
+		}
+	}
+	if ok, retryAfter := l.Allow(now); ok || retryAfter != 500*time.Millisecond {
+		t.Fatalf("unexpected result: %v, %v", ok, retryAfter)
+	}
+	if !l.Acquire() || l.Acquire() {
+		t.Fatal("expected a single slot")
+	}
+	l.Release()
+	if !l.Acquire() {
+		t.Fatal("expected released slot to be available")
+	}
+
+	unlimited := NewGlobalLimiter(&GlobalRateLimitConfig{})
+	for i := 0; i < 10; i++ {
+		if ok, _ := unlimited.Allow(now); !ok || !unlimited.Acquire() {
+			t.Fatal("unexpected rejection without limits")
+		}
+	}
+}
+
+func TestSubmitRequestLimits(t *testing.T) {
+	_, sh, tm := testSubmitH(1, Whitelist{})
+	sh.app.IPLimiter = NewIPRateLimiter(&IPRateLimitConfig{PerMinute: 1})
+	sh.app.Proxies, _ = NewTrustedProxies(nil, 1, "")
+	request := func(forwarded string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", v1Submit, bytes.NewReader([]byte("{}")))
+		r.Header.Set("X-Forwarded-For", forwarded)
+		sh.ServeHTTP(rec, r)
+		return rec
+	}
+	if rep := request("198.51.100.1"); rep.Code != 400 {
+		t.Fatalf("expected 400, got %v", rep)
+	}
+	// Invalid requests are limited as well, before the body is parsed
+	rep := request("198.51.100.1")
+	if rep.Code != 429 || rep.Header().Get("Retry-After") != "60" {
+		t.Fatalf("expected 429, got %v", rep)
+	}
+	expectErrorCode(rep, ERR_IP_RATE_LIMITED, t)
+	if rep := request("198.51.100.2"); rep.Code != 400 {
+		t.Fatalf("expected 400 for another address, got %v", rep)
+	}
+
+	sh.app.GlobalLimiter = NewGlobalLimiter(&GlobalRateLimitConfig{PerSecond: 1, MaxConcurrent: 1})
+	if rep := request("198.51.100.3"); rep.Code != 400 {
+		t.Fatalf("expected 400, got %v", rep)
+	}
+	rep = request("198.51.100.4")
+	if rep.Code != 503 || rep.Header().Get("Retry-After") != "1" {
+		t.Fatalf("expected 503, got %v", rep)
+	}
+	expectErrorCode(rep, ERR_GLOBAL_RATE_LIMITED, t)
+
+	tm.Advance(time.Second)
+	// Slot of a request in progress
+	sh.app.GlobalLimiter.Acquire()
+	rep = request("198.51.100.5")
+	if rep.Code != 503 {
+		t.Fatalf("expected 503, got %v", rep)
+	}
+	expectErrorCode(rep, ERR_TOO_MANY_CONCURRENT_REQUESTS, t)
+	sh.app.GlobalLimiter.Release()
+	tm.Advance(time.Second)
+	if rep := request("198.51.100.6"); rep.Code != 400 {
+		t.Fatalf("expected slot to be released, got %v", rep)
+	}
+}
@@ -0,0 +1,252 @@
+package delegation_backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+const DEFAULT_SAVE_QUEUE_WORKERS = 4
+const SAVE_QUEUE_RETRY_AFTER = 10 * time.Second
+
+// Backoff between attempts to save a queued submission
+const (
+	SAVE_QUEUE_MIN_BACKOFF = 1 * time.Second
+	SAVE_QUEUE_MAX_BACKOFF = 1 * time.Minute
+)
+
+var ErrSaveQueueFull = errors.New("save queue is full")
+var ErrSaveQueueClosed = errors.New("save queue is closed")
+
+type backendQueue struct {
+	backend StorageBackend
+	jobs    chan *queuedSubmission
+}
+
+// queuedSubmission holds objects of a submission in a temporary file
+// until it's saved to every backend, sources passed to Save being
+// only valid until it returns
+type queuedSubmission struct {
+	objs    ObjectsToSave // read from file
+	file    *os.File
+	pending atomic.Int32 // backends the submission is yet to be saved to
+}
+
+// done releases the submission once it was taken
+// care of by the last of the backends
+func (s *queuedSubmission) done() {
+	if s.pending.Add(-1) == 0 {
+		s.release()
+	}
+}
+
+// release removes the temporary file
+func (s *queuedSubmission) release() {
+	s.file.Close()
+	_ = os.Remove(s.file.Name())
+}
+
+// SaveQueue saves submissions asynchronously. Every backend has its own
+// bounded queue served by a pool of workers, so a submission is accepted
+// as soon as it is enqueued for every backend. When any of the queues is full
+// the submission is rejected as a whole, leaving it to the submitter to retry.
+// Failed saves are retried until they succeed, so a backend being down fills
+// its queue rather than losing submissions. Submissions still queued when
+// the service stops are lost though, unlike with the spool. Queued
+// submissions are kept on disk in TempDir rather than in memory.
+type SaveQueue struct {
+	TempDir    string // of queued submissions, os.TempDir() if empty
+	queues     []backendQueue
+	log        *logging.ZapEventLogger
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	ctx        context.Context // cancelled when queued submissions are abandoned
+	cancel     context.CancelFunc
+
+	mutex  sync.Mutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewSaveQueue creates a queue of size submissions per backend and starts
+// workers saving into backends. Number of workers for a backend is taken
+// from cfg.BackendWorkers by backend name, falling back to cfg.Workers.
+func NewSaveQueue(cfg *SaveQueueConfig, backends StorageBackends, log *logging.ZapEventLogger) *SaveQueue {
+	q := &SaveQueue{log: log, minBackoff: SAVE_QUEUE_MIN_BACKOFF, maxBackoff: SAVE_QUEUE_MAX_BACKOFF}
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	for _, b := range backends {
+		workers := cfg.BackendWorkers[b.Name()]
+		if workers <= 0 {
+			workers = cfg.Workers
+		}
+		if workers <= 0 {
+			workers = DEFAULT_SAVE_QUEUE_WORKERS
+		}
+		bq := backendQueue{backend: b, jobs: make(chan *queuedSubmission, cfg.Size)}
+		q.queues = append(q.queues, bq)
+		for i := 0; i < workers; i++ {
+			q.wg.Add(1)
+			go q.work(bq)
+		}
+		log.Infof("Save queue for %s: size %d, workers %d", b.Name(), cfg.Size, workers)
+	}
+	return q
+}
+
+func (q *SaveQueue) work(bq backendQueue) {
+	defer q.wg.Done()
+	for job := range bq.jobs {
+		if !q.saveWithRetry(bq.backend, job.objs) {
+			q.log.Errorf("SaveQueue: submission abandoned without being saved to %s", bq.backend.Name())
+		}
+		job.done()
+	}
+}
+
+// saveWithRetry saves objects to the backend until it succeeds,
+// returns false if the queue was abandoned in the meantime.
+func (q *SaveQueue) saveWithRetry(b StorageBackend, objs ObjectsToSave) bool {
+	backoff := q.minBackoff
+	for q.ctx.Err() == nil {
+		err := b.Save(q.ctx, objs)
+		if err == nil {
+			return true
+		}
+		q.log.Warnf("SaveQueue: failed to save to %s, retrying in %v: %v", b.Name(), backoff, err)
+		select {
+		case <-q.ctx.Done():
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > q.maxBackoff {
+			backoff = q.maxBackoff
+		}
+	}
+	return false
+}
+
+func (q *SaveQueue) Name() string {
+	return "queue"
+}
+
+// Save enqueues the objects for every backend without waiting for them
+// to be saved. Returns ErrSaveQueueFull if any of the queues has no room.
+func (q *SaveQueue) Save(_ context.Context, objs ObjectsToSave) error {
+	// Checked upfront not to copy a submission that would be rejected
+	q.mutex.Lock()
+	err := q.checkRoom()
+	q.mutex.Unlock()
+	if err != nil || len(q.queues) == 0 {
+		return err
+	}
+	job, err := q.copySubmission(objs)
+	if err != nil {
+		return fmt.Errorf("error copying submission to the save queue: %w", err)
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	// Only Save sends to the queues and it holds the mutex,
+	// so capacity checked here can't be taken by anyone else
+	if err := q.checkRoom(); err != nil {
+		job.release()
+		return err
+	}
+	for _, bq := range q.queues {
+		bq.jobs <- job
+	}
+	return nil
+}
+
+func (q *SaveQueue) checkRoom() error {
+	if q.closed {
+		return ErrSaveQueueClosed
+	}
+	for _, bq := range q.queues {
+		if len(bq.jobs) >= cap(bq.jobs) {
+			return ErrSaveQueueFull
+		}
+	}
+	return nil
+}
+
+// copySubmission streams the objects into a temporary file
+// the queued submission is then read from by every backend
+func (q *SaveQueue) copySubmission(objs ObjectsToSave) (*queuedSubmission, error) {
+	f, err := os.CreateTemp(q.TempDir, "queued-*")
+	if err != nil {
+		return nil, err
+	}
+	job := &queuedSubmission{objs: make(ObjectsToSave, len(objs)), file: f}
+	job.pending.Store(int32(len(q.queues)))
+	var offset int64
+	for path, src := range objs {
+		n, err := io.Copy(f, objectReader(src))
+		if err != nil {
+			job.release()
+			return nil, err
+		}
+		job.objs[path] = io.NewSectionReader(f, offset, n)
+		offset += n
+	}
+	return job, nil
+}
+
+func (q *SaveQueue) HealthCheck(_ context.Context) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return ErrSaveQueueClosed
+	}
+	return nil
+}
+
+// Depth returns number of submissions waiting to be saved for every backend.
+func (q *SaveQueue) Depth() map[string]int {
+	res := make(map[string]int, len(q.queues))
+	for _, bq := range q.queues {
+		res[bq.backend.Name()] = len(bq.jobs)
+	}
+	return res
+}
+
+// Shutdown stops accepting submissions and waits for the queued ones to be
+// saved. If ctx is done before that, saves in progress are interrupted and
+// the rest of the submissions abandoned, Shutdown returns ctx.Err() once
+// workers have stopped, so backends can be closed right after it.
+func (q *SaveQueue) Shutdown(ctx context.Context) error {
+	q.mutex.Lock()
+	if !q.closed {
+		q.closed = true
+		for _, bq := range q.queues {
+			close(bq.jobs)
+		}
+	}
+	q.mutex.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		q.cancel()
+		<-drained
+		return ctx.Err()
+	}
+}
+
+// Close waits for every queued submission to be saved.
+func (q *SaveQueue) Close() error {
+	return q.Shutdown(context.Background())
+}
@@ -0,0 +1,167 @@
+package delegation_backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+// blockingStorage saves into the wrapped storage only once unblocked
+type blockingStorage struct {
+	*memoryStorage
+	unblock chan struct{}
+}
+
+func (bs *blockingStorage) Save(ctx context.Context, objs ObjectsToSave) error {
+	select {
+	case <-bs.unblock:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return bs.memoryStorage.Save(ctx, objs)
+}
+
+func TestSaveQueueFull(t *testing.T) {
+	log := logging.Logger("delegation backend test")
+	fast := &memoryStorage{name: "fast", objs: make(map[string][]byte)}
+	slow := &blockingStorage{&memoryStorage{name: "slow", objs: make(map[string][]byte)}, make(chan struct{})}
+	q := NewSaveQueue(&SaveQueueConfig{Size: 2, Workers: 1}, StorageBackends{fast, slow}, log)
+
+	// One submission is taken by the blocked worker, two more fill the queue.
+	// Every submission is enqueued once the previous one is taken from
+	// the fast queue, which could fill up otherwise
+	for i := 0; i < 3; i++ {
+		if err := q.Save(context.Background(), spoolTestObjs(i)); err != nil {
+			t.Fatalf("unexpected error on submission %d: %v", i, err)
+		}
+		slowDepth := i
+		waitFor(t, "workers to pick up submission", func() bool {
+			depth := q.Depth()
+			return depth["fast"] == 0 && depth["slow"] == slowDepth
+		})
+	}
+	waitFor(t, "fast backend", func() bool { return fast.savesCount() == 3 })
+	if err := q.Save(context.Background(), spoolTestObjs(3)); !errors.Is(err, ErrSaveQueueFull) {
+		t.Fatalf("expected full queue, got: %v", err)
+	}
+	// The fast worker is idle, so it would only save what's enqueued
+	if depth := q.Depth(); depth["fast"] != 0 || depth["slow"] != 2 {
+		t.Fatalf("rejected submission was enqueued: %v", depth)
+	}
+
+	close(slow.unblock)
+	if err := q.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if slow.savesCount() != 3 {
+		t.Fatalf("queue not drained on shutdown, saved %d", slow.savesCount())
+	}
+	if err := q.Save(context.Background(), spoolTestObjs(4)); !errors.Is(err, ErrSaveQueueClosed) {
+		t.Fatalf("expected closed queue, got: %v", err)
+	}
+}
+
+func TestSaveQueueShutdownDeadline(t *testing.T) {
+	log := logging.Logger("delegation backend test")
+	slow := &blockingStorage{&memoryStorage{name: "slow", objs: make(map[string][]byte)}, make(chan struct{})}
+	q := NewSaveQueue(&SaveQueueConfig{Size: 1, Workers: 1}, StorageBackends{slow}, log)
+	if err := q.Save(context.Background(), spoolTestObjs(0)); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := q.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline to be exceeded, got: %v", err)
+	}
+	// Workers are stopped, nothing is saved once backends may be closed
+	close(slow.unblock)
+	time.Sleep(20 * time.Millisecond)
+	if slow.savesCount() != 0 {
+		t.Fatal("abandoned submission saved after shutdown")
+	}
+}
+
+func TestSubmitQueueFull(t *testing.T) {
+	body := readTestFile("req-no-snark", t)
+	var req submitRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal("failed decoding test file")
+	}
+	_, sh, _ := testSubmitH(1, Whitelist{req.Submitter: {}})
+	sh.app.VerifySignatureDisabled = true
+	slow := &blockingStorage{&memoryStorage{name: "slow", objs: make(map[string][]byte)}, make(chan struct{})}
+	q := NewSaveQueue(&SaveQueueConfig{Size: 1, Workers: 1}, StorageBackends{slow}, sh.app.Log)
+	defer close(slow.unblock)
+	sh.app.Storage = q
+	_ = q.Save(context.Background(), spoolTestObjs(0))
+	waitFor(t, "worker to pick up submission", func() bool { return q.Depth()["slow"] == 0 })
+	_ = q.Save(context.Background(), spoolTestObjs(1))
+
+	rep := sh.testRequest(body)
+	if rep.Code != 503 || rep.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 503 with Retry-After, got: %v", rep)
+	}
+}
+
+func TestSaveQueueRetriesFailedSave(t *testing.T) {
+	log := logging.Logger("delegation backend test")
+	flaky := &memoryStorage{name: "flaky", objs: make(map[string][]byte), saveErr: errors.New("unavailable")}
+	q := NewSaveQueue(&SaveQueueConfig{Size: 1, Workers: 1}, StorageBackends{flaky}, log)
+	q.minBackoff, q.maxBackoff = time.Millisecond, time.Millisecond
+	if err := q.Save(context.Background(), spoolTestObjs(0)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	flaky.mutex.Lock()
+	flaky.saveErr = nil
+	flaky.mutex.Unlock()
+	if err := q.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if flaky.savesCount() != 1 {
+		t.Fatalf("failed save was not retried, saved %d", flaky.savesCount())
+	}
+}
+
+func TestSaveQueueKeepsSubmissionOnDisk(t *testing.T) {
+	log := logging.Logger("delegation backend test")
+	a := &blockingStorage{&memoryStorage{name: "a", objs: make(map[string][]byte)}, make(chan struct{})}
+	b := &memoryStorage{name: "b", objs: make(map[string][]byte)}
+	q := NewSaveQueue(&SaveQueueConfig{Size: 1, Workers: 1}, StorageBackends{a, b}, log)
+	q.TempDir = t.TempDir()
+
+	// Block is read from a file removed as soon as Save returns
+	block, err := os.CreateTemp(t.TempDir(), "block-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := block.Write([]byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	objs := ObjectsToSave{"blocks/x.dat": io.NewSectionReader(block, 0, 3)}
+	if err := q.Save(context.Background(), objs); err != nil {
+		t.Fatal(err)
+	}
+	block.Close()
+	os.Remove(block.Name())
+
+	close(a.unblock)
+	if err := q.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, ms := range []*memoryStorage{a.memoryStorage, b} {
+		if !bytes.Equal(ms.objs["blocks/x.dat"], []byte{1, 2, 3}) {
+			t.Fatalf("unexpected block saved to %s: %v", ms.name, ms.objs["blocks/x.dat"])
+		}
+	}
+	if entries, err := os.ReadDir(q.TempDir); err != nil || len(entries) != 0 {
+		t.Fatalf("queued submission not removed once saved: %v, %v", entries, err)
+	}
+}
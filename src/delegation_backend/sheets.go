@@ -1,39 +1,191 @@
 package delegation_backend
 
 import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
 	logging "github.com/ipfs/go-log/v2"
 	sheets "google.golang.org/api/sheets/v4"
 )
 
-// Process rows retrieved from Google spreadsheet
+// Names of whitelist columns recognized in the header row
+const (
+	WHITELIST_COLUMN_PUBLIC_KEY   = "public_key"
+	WHITELIST_COLUMN_LABEL        = "label"
+	WHITELIST_COLUMN_NOT_BEFORE   = "not_before"
+	WHITELIST_COLUMN_NOT_AFTER    = "not_after"
+	WHITELIST_COLUMN_HOURLY_LIMIT = "hourly_limit"
+	WHITELIST_COLUMN_NETWORK      = "network"
+)
+
+// WhitelistIssue describes a row of the whitelist source that didn't
+// make it into the whitelist, or did with some of its metadata ignored.
+type WhitelistIssue struct {
+	Row    int    `json:"row"` // 1-based
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+}
+
+// Process rows retrieved from Google spreadsheet (or a whitelist file)
 // and extract public keys from the first column.
-func processRows(rows [][](interface{})) Whitelist {
-	wl := make(Whitelist)
-	for _, row := range rows {
-		if len(row) > 0 {
-			switch v := row[0].(type) {
-			case string:
-				var pk Pk
-				err := StringToPk(&pk, v)
-				if err == nil {
-					wl[pk] = true // we need something to be provided as value
-				}
+// If the first row names any of the known columns, it is taken as a header
+// and entries' metadata is read from the columns named in it. Otherwise
+// it's an ordinary row, so a header with no known column names is reported
+// as an issue like any row that can't be turned into an entry.
+func processRows(rows [][](interface{})) (Whitelist, []WhitelistIssue) {
+	if len(rows) > 0 {
+		columns := parseWhitelistHeader(rows[0])
+		for _, name := range whitelistColumns {
+			if _, has := columns[name]; has {
+				return processEntryRows(rows, 1, columns)
 			}
 		}
 	}
-	return wl
+	return processEntryRows(rows, 0, nil)
+}
+
+var whitelistColumns = []string{
+	WHITELIST_COLUMN_PUBLIC_KEY,
+	WHITELIST_COLUMN_LABEL,
+	WHITELIST_COLUMN_NOT_BEFORE,
+	WHITELIST_COLUMN_NOT_AFTER,
+	WHITELIST_COLUMN_HOURLY_LIMIT,
+	WHITELIST_COLUMN_NETWORK,
+}
+
+// Process rows starting from index start, with metadata columns given
+func processEntryRows(rows [][](interface{}), start int, columns map[string]int) (Whitelist, []WhitelistIssue) {
+	wl := make(Whitelist)
+	var issues []WhitelistIssue
+	firstSeen := make(map[Pk]int)
+	for i := start; i < len(rows); i++ {
+		row := rows[i]
+		if len(row) == 0 {
+			continue
+		}
+		issue := func(reason string) {
+			issues = append(issues, WhitelistIssue{Row: i + 1, Value: fmt.Sprint(row[0]), Reason: reason})
+		}
+		v, ok := row[0].(string)
+		if !ok {
+			issue("public key is not a string")
+			continue
+		}
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		var pk Pk
+		if err := StringToPk(&pk, v); err != nil {
+			issue("invalid public key: " + err.Error())
+			continue
+		}
+		if prev, seen := firstSeen[pk]; seen {
+			issue(fmt.Sprintf("duplicate public key, first seen in row %d", prev))
+			continue
+		}
+		entry, err := parseWhitelistEntry(row, columns)
+		if err != nil {
+			// Broken metadata doesn't lock a valid key out
+			issue(err.Error() + ", key kept with default policy")
+		}
+		firstSeen[pk] = i + 1
+		wl[pk] = entry
+	}
+	return wl, issues
+}
+
+func parseWhitelistHeader(row []interface{}) map[string]int {
+	columns := make(map[string]int)
+	for i, cell := range row {
+		if name, ok := cell.(string); ok {
+			name = strings.ToLower(strings.TrimSpace(name))
+			name = strings.NewReplacer(" ", "_", "-", "_").Replace(name)
+			columns[name] = i
+		}
+	}
+	return columns
+}
+
+// parseWhitelistEntry reads metadata of the entry from the columns.
+// Invalid cells are left at their defaults and reported in the error.
+func parseWhitelistEntry(row []interface{}, columns map[string]int) (WhitelistEntry, error) {
+	var entry WhitelistEntry
+	cell := func(name string) string {
+		i, has := columns[name]
+		if !has || i >= len(row) {
+			return ""
+		}
+		switch v := row[i].(type) {
+		case string:
+			return strings.TrimSpace(v)
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		}
+		return fmt.Sprint(row[i])
+	}
+	var invalid []string
+	entry.Label = cell(WHITELIST_COLUMN_LABEL)
+	entry.Network = cell(WHITELIST_COLUMN_NETWORK)
+	if t, err := parseWhitelistTime(cell(WHITELIST_COLUMN_NOT_BEFORE), false); err != nil {
+		invalid = append(invalid, fmt.Sprintf("invalid %s: %v", WHITELIST_COLUMN_NOT_BEFORE, err))
+	} else {
+		entry.NotBefore = t
+	}
+	if t, err := parseWhitelistTime(cell(WHITELIST_COLUMN_NOT_AFTER), true); err != nil {
+		invalid = append(invalid, fmt.Sprintf("invalid %s: %v", WHITELIST_COLUMN_NOT_AFTER, err))
+	} else {
+		entry.NotAfter = t
+	}
+	if limit := cell(WHITELIST_COLUMN_HOURLY_LIMIT); limit != "" {
+		if n, err := strconv.Atoi(limit); err != nil || n < 0 {
+			invalid = append(invalid, fmt.Sprintf("invalid %s: %q", WHITELIST_COLUMN_HOURLY_LIMIT, limit))
+		} else {
+			entry.HourlyLimit = n
+		}
+	}
+	if len(invalid) > 0 {
+		return entry, errors.New(strings.Join(invalid, "; "))
+	}
+	return entry, nil
+}
+
+// Parses either RFC3339 timestamp or a date. A date as the upper bound
+// of the validity window includes the whole day.
+func parseWhitelistTime(s string, upperBound bool) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.DateOnly, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected RFC3339 timestamp or YYYY-MM-DD date, got %q", s)
+	}
+	if upperBound {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
 }
 
 // Retrieve data from delegation program spreadsheet
 // and extract public keys out of the column containing
 // public keys of program participants.
-func RetrieveWhitelist(service *sheets.Service, log *logging.ZapEventLogger, appCfg AppConfig, retries int) (Whitelist, error) {
+func RetrieveWhitelist(service *sheets.Service, log *logging.ZapEventLogger, appCfg AppConfig, retries int) (Whitelist, []WhitelistIssue, error) {
 	var resp *sheets.ValueRange
 	var err error
 
 	operation := func() error {
 		col := appCfg.DelegationWhitelistColumn
-		readRange := appCfg.DelegationWhitelistList + "!" + col + ":" + col
+		lastCol := appCfg.DelegationWhitelistLastColumn
+		if lastCol == "" {
+			lastCol = col
+		}
+		readRange := appCfg.DelegationWhitelistList + "!" + col + ":" + lastCol
 		spId := appCfg.GsheetId
 		resp, err = service.Spreadsheets.Values.Get(spId, readRange).Do()
 		if err != nil {
@@ -44,8 +196,9 @@ func RetrieveWhitelist(service *sheets.Service, log *logging.ZapEventLogger, app
 	err = ExponentialBackoff(operation, retries, initialBackoff)
 	if err != nil {
 		log.Errorf("Unable to retrieve data from sheet after %v retries: %v", retries, err)
-		return nil, err
+		return nil, nil, err
 	}
 
-	return processRows(resp.Values), nil
+	wl, issues := processRows(resp.Values)
+	return wl, issues, nil
 }
@@ -4,8 +4,10 @@ import (
 	"encoding/hex"
 	"math/rand"
 	"reflect"
+	"strings"
 	"testing"
 	"testing/quick"
+	"time"
 )
 
 func randRow(r *rand.Rand) ([](interface{}), *Pk) {
@@ -58,7 +60,7 @@ func (Rows) Generate(r *rand.Rand, size int) reflect.Value {
 		row, pk := randRow(r)
 		res = append(res, row)
 		if pk != nil {
-			wl[*pk] = true
+			wl[*pk] = WhitelistEntry{}
 		}
 	}
 	return reflect.ValueOf(Rows{res, wl})
@@ -66,11 +68,11 @@ func (Rows) Generate(r *rand.Rand, size int) reflect.Value {
 
 func TestProcessRow(t *testing.T) {
 	f := func(rows Rows) bool {
-		actual := processRows(rows.rows)
-		res := reflect.DeepEqual(map[Pk]unit(rows.expected), map[Pk]unit(actual))
+		actual, _ := processRows(rows.rows)
+		res := reflect.DeepEqual(rows.expected, actual)
 		if !res {
-			t.Logf("expected: %s", rows.expected)
-			t.Logf("actual: %s", actual)
+			t.Logf("expected: %v", rows.expected)
+			t.Logf("actual: %v", actual)
 		}
 		return res
 	}
@@ -78,3 +80,93 @@ func TestProcessRow(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestProcessRowsMetadata(t *testing.T) {
+	pk1, pk2, pk3 := mkPk(), mkPk(), mkPk()
+	rows := [][](interface{}){
+		{"Public key", "Label", "Not before", "Not after", "Hourly limit", "Network"},
+		{pk1.String(), "operator 1", "2024-01-01", "2024-06-30", "20", "mainnet"},
+		{pk2.String(), "operator 2", "2024-01-01T12:00:00Z"},
+		{pk3.String(), "operator 3", "soon", "2024-06-30", "twenty"},
+	}
+	wl, issues := processRows(rows)
+	expected := Whitelist{
+		pk1: {
+			Label:       "operator 1",
+			NotBefore:   time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			NotAfter:    time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC),
+			HourlyLimit: 20,
+			Network:     "mainnet",
+		},
+		pk2: {
+			Label:     "operator 2",
+			NotBefore: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+		},
+		// Invalid cells are ignored, the key is kept
+		pk3: {
+			Label:    "operator 3",
+			NotAfter: time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	if !reflect.DeepEqual(expected, wl) {
+		t.Fatalf("expected %v, got %v", expected, wl)
+	}
+	if len(issues) != 1 || issues[0].Row != 4 || issues[0].Value != pk3.String() ||
+		!strings.Contains(issues[0].Reason, WHITELIST_COLUMN_NOT_BEFORE) || !strings.Contains(issues[0].Reason, WHITELIST_COLUMN_HOURLY_LIMIT) {
+		t.Fatalf("unexpected issues: %v", issues)
+	}
+}
+
+func TestProcessRowsIssues(t *testing.T) {
+	pk1, pk2 := mkPk(), mkPk()
+	typoChar := "x"
+	if pk2.String()[20] == 'x' {
+		typoChar = "y"
+	}
+	typo := pk2.String()[:20] + typoChar + pk2.String()[21:]
+	rows := [][](interface{}){
+		{pk1.String()},
+		{},
+		{""},
+		{typo},
+		{42},
+		{pk1.String()},
+		{pk2.String()},
+	}
+	wl, issues := processRows(rows)
+	expected := Whitelist{pk1: {}, pk2: {}}
+	if !reflect.DeepEqual(expected, wl) {
+		t.Fatalf("expected %v, got %v", expected, wl)
+	}
+	expectedIssues := []struct {
+		row    int
+		value  string
+		reason string
+	}{
+		{4, typo, "invalid public key"},
+		{5, "42", "public key is not a string"},
+		{6, pk1.String(), "duplicate public key, first seen in row 1"},
+	}
+	if len(issues) != len(expectedIssues) {
+		t.Fatalf("expected %d issues, got %v", len(expectedIssues), issues)
+	}
+	for i, e := range expectedIssues {
+		if issues[i].Row != e.row || issues[i].Value != e.value || !strings.HasPrefix(issues[i].Reason, e.reason) {
+			t.Errorf("issue %d: expected %v, got %v", i, e, issues[i])
+		}
+	}
+}
+
+func TestProcessRowsHeader(t *testing.T) {
+	pk := mkPk()
+	// Header is recognized by its column names
+	wl, issues := processRows([][](interface{}){{"Public Key"}, {pk.String()}})
+	if len(wl) != 1 || len(issues) != 0 {
+		t.Fatalf("unexpected result: %v, %v", wl, issues)
+	}
+	// Anything else in the first row is reported
+	wl, issues = processRows([][](interface{}){{"Block producers"}, {pk.String()}})
+	if len(wl) != 1 || len(issues) != 1 || issues[0].Row != 1 || issues[0].Value != "Block producers" {
+		t.Fatalf("expected unknown header to be reported: %v, %v", wl, issues)
+	}
+}
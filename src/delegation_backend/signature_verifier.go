@@ -0,0 +1,201 @@
+package delegation_backend
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const DEFAULT_SIGNATURE_CACHE_SIZE = 10000
+
+// Number of verifications waiting for a worker per worker
+const SIGNATURE_QUEUE_SIZE_PER_WORKER = 16
+
+var ErrVerifierClosed = errors.New("signature verifier is closed")
+
+type verificationKey struct {
+	submitter   Pk
+	sig         Sig
+	payloadHash [32]byte
+	networkId   uint8
+}
+
+type verificationJob struct {
+	key      verificationKey
+	queuedAt time.Time
+	result   chan bool
+}
+
+// SignatureVerifier verifies signatures of submissions on a bounded pool
+// of workers, so that a burst of submissions queues up instead of competing
+// for CPU with the rest of request handling. Successful verifications are
+// remembered in an LRU cache, and a resubmission of the same signed payload
+// is accepted without verifying it again. Failed verifications are not
+// cached, so that invalid signatures can't evict the valid ones.
+type SignatureVerifier struct {
+	jobs    chan verificationJob
+	cache   *verificationCache
+	metrics *Metrics
+	// Verification function, verifySig unless replaced in tests
+	verify func(pk *Pk, sig *Sig, data []byte, networkId uint8) bool
+
+	mutex  sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewSignatureVerifier starts the given number of workers, defaulting to
+// the number of CPUs, with a cache of cacheSize verified signatures.
+// Caching is disabled if cacheSize is negative.
+func NewSignatureVerifier(workers int, cacheSize int, metrics *Metrics) *SignatureVerifier {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if cacheSize == 0 {
+		cacheSize = DEFAULT_SIGNATURE_CACHE_SIZE
+	}
+	v := &SignatureVerifier{
+		jobs:    make(chan verificationJob, workers*SIGNATURE_QUEUE_SIZE_PER_WORKER),
+		cache:   newVerificationCache(cacheSize),
+		metrics: metrics,
+		verify:  verifySig,
+	}
+	for i := 0; i < workers; i++ {
+		v.wg.Add(1)
+		go v.work()
+	}
+	metrics.RegisterSignatureVerifier(v)
+	return v
+}
+
+func (v *SignatureVerifier) work() {
+	defer v.wg.Done()
+	for job := range v.jobs {
+		v.metrics.RecordSignatureQueueWait(time.Since(job.queuedAt))
+		start := time.Now()
+		valid := v.verify(&job.key.submitter, &job.key.sig, job.key.payloadHash[:], job.key.networkId)
+		v.metrics.RecordSignatureVerification(time.Since(start))
+		if valid {
+			v.cache.add(job.key)
+		}
+		job.result <- valid
+	}
+}
+
+// Verify checks the signature of the payload hash, waiting for a free worker
+// unless the same signature was verified recently. Returns an error if ctx is
+// done before the verification completes or the verifier is closed.
+func (v *SignatureVerifier) Verify(ctx context.Context, submitter *Pk, sig *Sig, payloadHash [32]byte, networkId uint8) (bool, error) {
+	key := verificationKey{submitter: *submitter, sig: *sig, payloadHash: payloadHash, networkId: networkId}
+	if v.cache.contains(key) {
+		v.metrics.RecordSignatureCache(true)
+		return true, nil
+	}
+	v.metrics.RecordSignatureCache(false)
+
+	job := verificationJob{key: key, queuedAt: time.Now(), result: make(chan bool, 1)}
+	if err := v.enqueue(ctx, job); err != nil {
+		return false, err
+	}
+	select {
+	case valid := <-job.result:
+		return valid, nil
+	case <-ctx.Done():
+		// Worker writes into the buffered channel and doesn't block
+		return false, ctx.Err()
+	}
+}
+
+func (v *SignatureVerifier) enqueue(ctx context.Context, job verificationJob) error {
+	// Read lock keeps the channel open while sending into it
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+	if v.closed {
+		return ErrVerifierClosed
+	}
+	select {
+	case v.jobs <- job:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// QueueDepth returns number of verifications waiting for a worker.
+func (v *SignatureVerifier) QueueDepth() int {
+	return len(v.jobs)
+}
+
+// Close stops the workers after the queued verifications are done.
+func (v *SignatureVerifier) Close() {
+	v.mutex.Lock()
+	if !v.closed {
+		v.closed = true
+		close(v.jobs)
+	}
+	v.mutex.Unlock()
+	v.wg.Wait()
+}
+
+// verificationCache is an LRU set of successfully verified signatures.
+// All methods are no-ops on a nil *verificationCache.
+type verificationCache struct {
+	mutex    sync.Mutex
+	capacity int
+	order    *list.List // front is the most recently used
+	entries  map[verificationKey]*list.Element
+}
+
+func newVerificationCache(capacity int) *verificationCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &verificationCache{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[verificationKey]*list.Element, capacity),
+	}
+}
+
+func (c *verificationCache) contains(key verificationKey) bool {
+	if c == nil {
+		return false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e, has := c.entries[key]
+	if has {
+		c.order.MoveToFront(e)
+	}
+	return has
+}
+
+func (c *verificationCache) add(key verificationKey) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if e, has := c.entries[key]; has {
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.order.PushFront(key)
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(verificationKey))
+	}
+}
+
+func (c *verificationCache) len() int {
+	if c == nil {
+		return 0
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,144 @@
+package delegation_backend
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Verifier accepting signatures whose first byte is zero, counting calls
+func testSignatureVerifier(workers int, cacheSize int, m *Metrics) (*SignatureVerifier, *atomic.Int32) {
+	var calls atomic.Int32
+	v := NewSignatureVerifier(workers, cacheSize, m)
+	v.verify = func(pk *Pk, sig *Sig, data []byte, networkId uint8) bool {
+		calls.Add(1)
+		return sig[0] == 0
+	}
+	return v, &calls
+}
+
+func TestSignatureVerifierCache(t *testing.T) {
+	m := NewMetrics()
+	v, calls := testSignatureVerifier(2, 2, m)
+	defer v.Close()
+	ctx := context.Background()
+	pk := mkPk()
+	var valid, invalid Sig
+	invalid[0] = 1
+	verify := func(sig *Sig, hash [32]byte, expected bool) {
+		res, err := v.Verify(ctx, &pk, sig, hash, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != expected {
+			t.Fatalf("expected %v for signature %x of %x", expected, sig[0], hash[0])
+		}
+	}
+
+	verify(&valid, [32]byte{1}, true)
+	verify(&valid, [32]byte{1}, true)
+	verify(&invalid, [32]byte{1}, false)
+	verify(&invalid, [32]byte{1}, false)
+	if calls.Load() != 3 {
+		t.Fatalf("expected only the valid signature to be cached, got %d calls", calls.Load())
+	}
+
+	// Least recently used entry is evicted
+	verify(&valid, [32]byte{2}, true)
+	verify(&valid, [32]byte{1}, true)
+	verify(&valid, [32]byte{3}, true)
+	if v.cache.len() != 2 {
+		t.Fatalf("unexpected cache size %d", v.cache.len())
+	}
+	verify(&valid, [32]byte{1}, true)
+	verify(&valid, [32]byte{2}, true)
+	if calls.Load() != 6 {
+		t.Fatalf("unexpected number of verifications: %d", calls.Load())
+	}
+
+	metrics := scrapeMetrics(m, t)
+	expectMetric(metrics, `delegation_backend_signature_cache_lookups_total{result="hit"} 3`, t)
+	expectMetric(metrics, `delegation_backend_signature_cache_lookups_total{result="miss"} 6`, t)
+	expectMetric(metrics, `delegation_backend_signature_verification_seconds_count 6`, t)
+	expectMetric(metrics, `delegation_backend_signature_queue_depth 0`, t)
+}
+
+func TestSignatureVerifierCacheDisabled(t *testing.T) {
+	v, calls := testSignatureVerifier(1, -1, nil)
+	defer v.Close()
+	pk := mkPk()
+	for i := 0; i < 3; i++ {
+		if valid, err := v.Verify(context.Background(), &pk, &Sig{}, [32]byte{}, 0); err != nil || !valid {
+			t.Fatalf("unexpected result: %v %v", valid, err)
+		}
+	}
+	if calls.Load() != 3 {
+		t.Fatalf("expected every signature to be verified, got %d calls", calls.Load())
+	}
+}
+
+func TestSignatureVerifierCancel(t *testing.T) {
+	v := NewSignatureVerifier(1, -1, nil)
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	v.verify = func(pk *Pk, sig *Sig, data []byte, networkId uint8) bool {
+		started <- struct{}{}
+		<-release
+		return true
+	}
+	pk := mkPk()
+	done := make(chan bool)
+	go func() {
+		valid, _ := v.Verify(context.Background(), &pk, &Sig{}, [32]byte{}, 0)
+		done <- valid
+	}()
+	<-started
+
+	// The only worker is busy, so the verification is abandoned
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := v.Verify(ctx, &pk, &Sig{}, [32]byte{1}, 0); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancellation, got %v", err)
+	}
+
+	close(release)
+	if !<-done {
+		t.Fatal("expected signature to be valid")
+	}
+	v.Close()
+	if _, err := v.Verify(context.Background(), &pk, &Sig{}, [32]byte{2}, 0); !errors.Is(err, ErrVerifierClosed) {
+		t.Fatalf("expected closed verifier error, got %v", err)
+	}
+}
+
+func TestSubmitWithSignatureVerifier(t *testing.T) {
+	body := readTestFile("req-no-snark", t)
+	storage, sh, tm := testSubmitH(1, Whitelist{})
+	sh.app.WhitelistDisabled = true
+	var calls atomic.Int32
+	sh.app.Verifier = NewSignatureVerifier(1, 10, nil)
+	defer sh.app.Verifier.Close()
+	sh.app.Verifier.verify = func(pk *Pk, sig *Sig, data []byte, networkId uint8) bool {
+		calls.Add(1)
+		return verifySig(pk, sig, data, networkId)
+	}
+	for i := 0; i < 2; i++ {
+		if rep := sh.testRequest(body); rep.Code != 200 {
+			t.Fatalf("unexpected response: %v", rep)
+		}
+		// Next submission is allowed by the rate limiter in an hour
+		tm.Advance(time.Hour)
+	}
+	if calls.Load() != 1 || len(*storage) == 0 {
+		t.Fatalf("expected resubmission to be verified once, got %d calls", calls.Load())
+	}
+
+	sh.app.Verifier = NewSignatureVerifier(1, -1, nil)
+	sh.app.Verifier.Close()
+	if rep := sh.testRequest(body); rep.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 from a closed verifier, got %v", rep)
+	}
+}
@@ -1,5 +1,10 @@
+//go:build !puregosigner
+
 package delegation_backend
 
+// Verification through the C reference signer, build with -tags puregosigner
+// to use the pure Go implementation of mina_signer.go instead
+
 // TODO think of getting rid of -L flags with relative paths
 
 // #cgo LDFLAGS: -L ../../result
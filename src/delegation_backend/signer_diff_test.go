@@ -0,0 +1,34 @@
+//go:build cgo && !puregosigner
+
+package delegation_backend
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// Compares the pure Go verification with the reference signer
+// on the test vectors and on their random corruptions
+func TestVerifyMinaSigMatchesReference(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for i, v := range sigTestVectors(t) {
+		for j := 0; j < 20; j++ {
+			pk, sig, data := v.pk, v.sig, append([]byte{}, v.data...)
+			switch j % 4 {
+			case 1:
+				data[rnd.Intn(len(data))] ^= byte(1 + rnd.Intn(255))
+			case 2:
+				sig[rnd.Intn(SIG_LENGTH)] ^= byte(1 + rnd.Intn(255))
+			case 3:
+				pk[rnd.Intn(PK_LENGTH-1)] ^= byte(1 + rnd.Intn(255))
+			}
+			for _, networkId := range []uint8{0, 1} {
+				expected := verifySig(&pk, &sig, data, networkId)
+				if actual := verifyMinaSig(&pk, &sig, data, networkId); actual != expected {
+					t.Fatalf("vector %d, case %d, network %d: reference signer says %v, pure Go %v",
+						i, j, networkId, expected, actual)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,7 @@
+//go:build puregosigner
+
+package delegation_backend
+
+func verifySig(pk *Pk, sig *Sig, data []byte, networkId uint8) bool {
+	return verifyMinaSig(pk, sig, data, networkId)
+}
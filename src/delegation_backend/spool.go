@@ -0,0 +1,580 @@
+package delegation_backend
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+const DEFAULT_SPOOL_SEGMENT_SIZE int64 = 64 * 1024 * 1024 // 64MB
+
+const spoolSegmentSuffix = ".seg"
+const spoolOffsetsDir = "offsets"
+const spoolRecordHeaderSize = 8 // payload length (4B) + CRC32 of payload (4B)
+
+// A record holds objects of a single submission, a longer one read from
+// a segment is garbage of a torn write rather than a record
+const spoolMaxRecordSize = 2 * MAX_SUBMIT_PAYLOAD_SIZE
+
+const (
+	spoolMinBackoff = 1 * time.Second
+	spoolMaxBackoff = 1 * time.Minute
+)
+
+var errSpoolCorrupted = errors.New("corrupted spool record")
+
+// spoolPosition points to a record in the spool.
+type spoolPosition struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+}
+
+func (p spoolPosition) Before(other spoolPosition) bool {
+	return p.Segment < other.Segment || (p.Segment == other.Segment && p.Offset < other.Offset)
+}
+
+// Spool is a write-ahead log of submissions kept in append-only segment files.
+// Every submission is first appended to the spool and then replayed into each
+// of the storage backends by a dedicated drainer. Drainers track their own
+// offsets, so a backend that is down does not hold back the others.
+// Segments are removed once every backend has drained them.
+type Spool struct {
+	dir         string
+	segmentSize int64
+	backends    StorageBackends
+	log         *logging.ZapEventLogger
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+
+	mutex     sync.Mutex
+	appended  *sync.Cond
+	writer    *os.File
+	first     uint64        // first segment still present on disk
+	end       spoolPosition // end of the last fully written record
+	positions map[string]spoolPosition
+	closed    bool
+	stopped   chan struct{}   // closed when the spool is closed
+	ctx       context.Context // cancelled to interrupt saves in progress
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// NewSpool opens (or creates) a spool in cfg.Path, recovering
+// from a partially written record left by a crash.
+func NewSpool(cfg *SpoolConfig, backends StorageBackends, log *logging.ZapEventLogger) (*Spool, error) {
+	sp := &Spool{
+		dir:         cfg.Path,
+		segmentSize: cfg.SegmentSize,
+		backends:    backends,
+		log:         log,
+		minBackoff:  spoolMinBackoff,
+		maxBackoff:  spoolMaxBackoff,
+		positions:   make(map[string]spoolPosition),
+		stopped:     make(chan struct{}),
+	}
+	sp.ctx, sp.cancel = context.WithCancel(context.Background())
+	if sp.segmentSize <= 0 {
+		sp.segmentSize = DEFAULT_SPOOL_SEGMENT_SIZE
+	}
+	sp.appended = sync.NewCond(&sp.mutex)
+	if err := os.MkdirAll(filepath.Join(sp.dir, spoolOffsetsDir), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	segments, err := sp.listSegments()
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		segments = []uint64{1}
+	}
+	sp.first = segments[0]
+	last := segments[len(segments)-1]
+	size, err := sp.recoverSegment(last)
+	if err != nil {
+		return nil, err
+	}
+	sp.end = spoolPosition{Segment: last, Offset: size}
+	sp.writer, err = os.OpenFile(sp.segmentPath(last), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, b := range backends {
+		pos, err := sp.loadPosition(b.Name())
+		if err != nil {
+			sp.writer.Close()
+			return nil, err
+		}
+		sp.positions[b.Name()] = pos
+	}
+	return sp, nil
+}
+
+// Start launches a drainer for every storage backend.
+func (sp *Spool) Start() {
+	for _, b := range sp.backends {
+		sp.wg.Add(1)
+		go sp.drain(b)
+	}
+}
+
+func (sp *Spool) Name() string {
+	return "spool"
+}
+
+// Save appends the objects to the spool, streaming them from their sources.
+// Once it returns without an error, the submission survives a restart of
+// the service.
+func (sp *Spool) Save(_ context.Context, objs ObjectsToSave) error {
+	paths := make([]string, 0, len(objs))
+	var size int64
+	for path, src := range objs {
+		paths = append(paths, path)
+		size += 8 + int64(len(path)) + src.Size()
+	}
+	if size > spoolMaxRecordSize {
+		return fmt.Errorf("submission of %d bytes is too large for the spool", size)
+	}
+	// Objects are written in the same order they are checksummed in
+	sort.Strings(paths)
+	// Checksum precedes the payload, so the objects are read twice
+	// rather than the record being held in memory
+	checksum := crc32.NewIEEE()
+	if err := writeSpoolPayload(checksum, paths, objs); err != nil {
+		return fmt.Errorf("error reading submission: %w", err)
+	}
+	var header [spoolRecordHeaderSize]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(size))
+	binary.BigEndian.PutUint32(header[4:8], checksum.Sum32())
+
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	if sp.closed {
+		return errors.New("spool is closed")
+	}
+	if sp.end.Offset > 0 && sp.end.Offset+spoolRecordHeaderSize+size > sp.segmentSize {
+		if err := sp.rotate(); err != nil {
+			return fmt.Errorf("error creating spool segment: %w", err)
+		}
+	}
+	w := bufio.NewWriter(sp.writer)
+	_, err := w.Write(header[:])
+	if err == nil {
+		err = writeSpoolPayload(w, paths, objs)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		// Drop whatever part of the record got written, so that
+		// the next record is appended right after the previous one
+		_ = sp.writer.Truncate(sp.end.Offset)
+		return fmt.Errorf("error writing to spool: %w", err)
+	}
+	if err := sp.writer.Sync(); err != nil {
+		_ = sp.writer.Truncate(sp.end.Offset)
+		return fmt.Errorf("error syncing spool: %w", err)
+	}
+	sp.end.Offset += spoolRecordHeaderSize + size
+	sp.appended.Broadcast()
+	return nil
+}
+
+// HealthCheck checks that the spool is open.
+// Backends themselves are allowed to be down while the spool is healthy.
+func (sp *Spool) HealthCheck(_ context.Context) error {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	if sp.closed {
+		return errors.New("spool is closed")
+	}
+	_, err := sp.writer.Stat()
+	return err
+}
+
+// Shutdown stops drainers and closes the current segment. Saves drainers
+// have in progress are let finish until ctx is done, then they are
+// interrupted and Shutdown returns ctx.Err(). Records not yet drained
+// are replayed after the next start.
+func (sp *Spool) Shutdown(ctx context.Context) error {
+	sp.mutex.Lock()
+	if sp.closed {
+		sp.mutex.Unlock()
+		return nil
+	}
+	sp.closed = true
+	close(sp.stopped)
+	sp.appended.Broadcast()
+	sp.mutex.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		sp.wg.Wait()
+		close(drained)
+	}()
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		sp.cancel()
+		<-drained
+		err = ctx.Err()
+	}
+	sp.cancel()
+	if closeErr := sp.writer.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Close stops drainers once their saves in progress finish.
+func (sp *Spool) Close() error {
+	return sp.Shutdown(context.Background())
+}
+
+// Backlog returns amount of bytes every backend is behind the end of the spool.
+func (sp *Spool) Backlog() map[string]int64 {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	res := make(map[string]int64, len(sp.positions))
+	for name, pos := range sp.positions {
+		if pos.Segment == sp.end.Segment {
+			res[name] = sp.end.Offset - pos.Offset
+		} else {
+			// Segments are rotated when they exceed segmentSize, hence the estimate
+			res[name] = int64(sp.end.Segment-pos.Segment)*sp.segmentSize - pos.Offset + sp.end.Offset
+		}
+	}
+	return res
+}
+
+func (sp *Spool) drain(b StorageBackend) {
+	defer sp.wg.Done()
+	name := b.Name()
+	sp.mutex.Lock()
+	pos := sp.positions[name]
+	sp.mutex.Unlock()
+
+	for {
+		sp.mutex.Lock()
+		for !sp.closed && !pos.Before(sp.end) {
+			sp.appended.Wait()
+		}
+		if sp.closed {
+			sp.mutex.Unlock()
+			return
+		}
+		lastSegment := sp.end.Segment
+		sp.mutex.Unlock()
+
+		objs, next, segment, err := sp.readRecord(pos)
+		if err == io.EOF && pos.Segment < lastSegment {
+			sp.advance(name, spoolPosition{Segment: pos.Segment + 1})
+			pos = spoolPosition{Segment: pos.Segment + 1}
+			continue
+		}
+		if err != nil {
+			if pos.Segment < lastSegment {
+				// Nothing after a broken record can be trusted, skip to the next segment
+				sp.log.Errorf("Spool: skipping rest of segment %d for %s at offset %d: %v", pos.Segment, name, pos.Offset, err)
+				pos = spoolPosition{Segment: pos.Segment + 1}
+				sp.advance(name, pos)
+				continue
+			}
+			sp.log.Errorf("Spool: failed to read segment %d for %s at offset %d: %v", pos.Segment, name, pos.Offset, err)
+			if !sp.sleep(sp.maxBackoff) {
+				return
+			}
+			continue
+		}
+
+		// Objects are read from the segment while they are saved
+		saved := sp.saveWithRetry(b, objs)
+		segment.Close()
+		if !saved {
+			return
+		}
+		pos = next
+		sp.advance(name, pos)
+	}
+}
+
+// saveWithRetry saves objects to the backend until it succeeds,
+// returns false if the spool was closed before a save succeeded.
+func (sp *Spool) saveWithRetry(b StorageBackend, objs ObjectsToSave) bool {
+	backoff := sp.minBackoff
+	for {
+		err := b.Save(sp.ctx, objs)
+		if err == nil {
+			return true
+		}
+		sp.log.Warnf("Spool: failed to save to %s, retrying in %v: %v", b.Name(), backoff, err)
+		if !sp.sleep(backoff) {
+			return false
+		}
+		backoff *= 2
+		if backoff > sp.maxBackoff {
+			backoff = sp.maxBackoff
+		}
+	}
+}
+
+func (sp *Spool) sleep(d time.Duration) bool {
+	select {
+	case <-sp.stopped:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// advance records the position of a backend's drainer
+// and removes segments drained by every backend.
+func (sp *Spool) advance(name string, pos spoolPosition) {
+	if err := sp.storePosition(name, pos); err != nil {
+		sp.log.Errorf("Spool: failed to store offset of %s: %v", name, err)
+	}
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	sp.positions[name] = pos
+	min := sp.end.Segment
+	for _, p := range sp.positions {
+		if p.Segment < min {
+			min = p.Segment
+		}
+	}
+	for ; sp.first < min; sp.first++ {
+		if err := os.Remove(sp.segmentPath(sp.first)); err != nil && !os.IsNotExist(err) {
+			sp.log.Warnf("Spool: failed to remove drained segment %d: %v", sp.first, err)
+		}
+	}
+}
+
+func (sp *Spool) rotate() error {
+	next := sp.end.Segment + 1
+	f, err := os.OpenFile(sp.segmentPath(next), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if err := sp.writer.Close(); err != nil {
+		sp.log.Warnf("Spool: error closing segment %d: %v", sp.end.Segment, err)
+	}
+	sp.writer = f
+	sp.end = spoolPosition{Segment: next}
+	return nil
+}
+
+// readRecord checks the record at the position, returning its objects along
+// with the segment they are read from, which is to be closed once they are saved.
+func (sp *Spool) readRecord(pos spoolPosition) (ObjectsToSave, spoolPosition, *os.File, error) {
+	f, err := os.Open(sp.segmentPath(pos.Segment))
+	if err != nil {
+		return nil, pos, nil, err
+	}
+	size, err := readSpoolRecord(f, pos.Offset)
+	if err != nil {
+		f.Close()
+		return nil, pos, nil, err
+	}
+	objs, err := decodeSpoolRecord(io.NewSectionReader(f, pos.Offset+spoolRecordHeaderSize, size))
+	if err != nil {
+		f.Close()
+		return nil, pos, nil, err
+	}
+	return objs, spoolPosition{Segment: pos.Segment, Offset: pos.Offset + spoolRecordHeaderSize + size}, f, nil
+}
+
+// recoverSegment returns the size of the valid prefix of the segment,
+// truncating a record that was only partially written.
+func (sp *Spool) recoverSegment(segment uint64) (int64, error) {
+	path := sp.segmentPath(segment)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var size int64
+	for {
+		payloadSize, err := readSpoolRecord(f, size)
+		if err != nil {
+			if err != io.EOF {
+				sp.log.Warnf("Spool: truncating segment %d at offset %d: %v", segment, size, err)
+			}
+			break
+		}
+		size += spoolRecordHeaderSize + payloadSize
+	}
+	f.Close()
+	return size, os.Truncate(path, size)
+}
+
+// readSpoolRecord checks the checksum of the record at the offset,
+// streaming its payload, and returns the size of the payload
+func readSpoolRecord(r io.ReaderAt, offset int64) (int64, error) {
+	var header [spoolRecordHeaderSize]byte
+	if n, err := r.ReadAt(header[:], offset); n < len(header) {
+		if n == 0 && err == io.EOF {
+			return 0, io.EOF
+		} else if err == io.EOF {
+			return 0, errSpoolCorrupted
+		}
+		return 0, err
+	}
+	size := int64(binary.BigEndian.Uint32(header[0:4]))
+	if size > spoolMaxRecordSize {
+		return 0, errSpoolCorrupted
+	}
+	checksum := crc32.NewIEEE()
+	if n, err := io.Copy(checksum, io.NewSectionReader(r, offset+spoolRecordHeaderSize, size)); err != nil {
+		return 0, err
+	} else if n != size {
+		return 0, errSpoolCorrupted
+	}
+	if checksum.Sum32() != binary.BigEndian.Uint32(header[4:8]) {
+		return 0, errSpoolCorrupted
+	}
+	return size, nil
+}
+
+// Record payload is a sequence of (path length, path, data length, data)
+func writeSpoolPayload(w io.Writer, paths []string, objs ObjectsToSave) error {
+	var length [4]byte
+	for _, path := range paths {
+		src := objs[path]
+		binary.BigEndian.PutUint32(length[:], uint32(len(path)))
+		if _, err := w.Write(length[:]); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, path); err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint32(length[:], uint32(src.Size()))
+		if _, err := w.Write(length[:]); err != nil {
+			return err
+		}
+		if n, err := io.Copy(w, objectReader(src)); err != nil {
+			return err
+		} else if n != src.Size() {
+			return fmt.Errorf("read %d bytes of %s instead of %d", n, path, src.Size())
+		}
+	}
+	return nil
+}
+
+// decodeSpoolRecord returns objects of the payload, data of every
+// object being read from the payload rather than copied out of it
+func decodeSpoolRecord(payload *io.SectionReader) (ObjectsToSave, error) {
+	objs := make(ObjectsToSave)
+	var offset int64
+	for offset < payload.Size() {
+		pathStart, pathLen, err := spoolField(payload, offset)
+		if err != nil {
+			return nil, err
+		}
+		path := make([]byte, pathLen)
+		if _, err := payload.ReadAt(path, pathStart); err != nil {
+			return nil, err
+		}
+		dataStart, dataLen, err := spoolField(payload, pathStart+pathLen)
+		if err != nil {
+			return nil, err
+		}
+		objs[string(path)] = io.NewSectionReader(payload, dataStart, dataLen)
+		offset = dataStart + dataLen
+	}
+	return objs, nil
+}
+
+// spoolField returns the start and the length of the field at the offset
+func spoolField(payload *io.SectionReader, offset int64) (int64, int64, error) {
+	var length [4]byte
+	if _, err := payload.ReadAt(length[:], offset); err != nil {
+		return 0, 0, errSpoolCorrupted
+	}
+	l := int64(binary.BigEndian.Uint32(length[:]))
+	if payload.Size()-offset-4 < l {
+		return 0, 0, errSpoolCorrupted
+	}
+	return offset + 4, l, nil
+}
+
+func (sp *Spool) segmentPath(segment uint64) string {
+	return filepath.Join(sp.dir, fmt.Sprintf("%020d%s", segment, spoolSegmentSuffix))
+}
+
+func (sp *Spool) listSegments() ([]uint64, error) {
+	entries, err := os.ReadDir(sp.dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, spoolSegmentSuffix) {
+			continue
+		}
+		segment, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSegmentSuffix), 10, 64)
+		if err != nil {
+			sp.log.Warnf("Spool: ignoring unexpected file %s", name)
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+func (sp *Spool) offsetPath(name string) string {
+	return filepath.Join(sp.dir, spoolOffsetsDir, name+".json")
+}
+
+func (sp *Spool) loadPosition(name string) (spoolPosition, error) {
+	var pos spoolPosition
+	bs, err := os.ReadFile(sp.offsetPath(name))
+	if os.IsNotExist(err) {
+		// New backend, everything still in the spool is replayed into it
+		return spoolPosition{Segment: sp.first}, nil
+	} else if err != nil {
+		return pos, err
+	}
+	if err := json.Unmarshal(bs, &pos); err != nil {
+		return pos, fmt.Errorf("error decoding spool offset of %s: %w", name, err)
+	}
+	if pos.Segment < sp.first {
+		pos = spoolPosition{Segment: sp.first}
+	}
+	if sp.end.Before(pos) {
+		sp.log.Warnf("Spool: offset of %s is past the end of the spool, resetting", name)
+		pos = sp.end
+	}
+	return pos, nil
+}
+
+func (sp *Spool) storePosition(name string, pos spoolPosition) error {
+	bs, err := json.Marshal(pos)
+	if err != nil {
+		return err
+	}
+	path := sp.offsetPath(name)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, bs, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,204 @@
+package delegation_backend
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+func openTestSpool(t *testing.T, dir string, segmentSize int64, backends ...StorageBackend) *Spool {
+	sp, err := NewSpool(&SpoolConfig{Path: dir, SegmentSize: segmentSize}, backends, logging.Logger("delegation backend test"))
+	if err != nil {
+		t.Fatalf("failed to open spool: %v", err)
+	}
+	sp.minBackoff = 10 * time.Millisecond
+	sp.maxBackoff = 10 * time.Millisecond
+	return sp
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func spoolTestContents(i int) map[string][]byte {
+	return map[string][]byte{
+		fmt.Sprintf("submissions/2021-07-01/%d.json", i): []byte(fmt.Sprintf("{\"i\":%d}", i)),
+		fmt.Sprintf("blocks/%d.dat", i):                  []byte{byte(i), 0, 1, 2},
+	}
+}
+
+func spoolTestObjs(i int) ObjectsToSave {
+	return objectsOf(spoolTestContents(i))
+}
+
+func TestSpoolRecordEncoding(t *testing.T) {
+	contents := spoolTestContents(7)
+	objs := objectsOf(contents)
+	var payload bytes.Buffer
+	if err := writeSpoolPayload(&payload, []string{"blocks/7.dat", "submissions/2021-07-01/7.json"}, objs); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeSpoolRecord(io.NewSectionReader(bytes.NewReader(payload.Bytes()), 0, int64(payload.Len())))
+	if err != nil || len(decoded) != len(objs) {
+		t.Fatalf("failed to decode record: %v, %v", decoded, err)
+	}
+	for path, bs := range contents {
+		if data, err := readObject(decoded[path]); err != nil || string(data) != string(bs) {
+			t.Errorf("unexpected content of %s", path)
+		}
+	}
+	truncated := []byte{0, 0, 0, 9, 'a'}
+	if _, err := decodeSpoolRecord(io.NewSectionReader(bytes.NewReader(truncated), 0, int64(len(truncated)))); err == nil {
+		t.Error("truncated record decoded")
+	}
+}
+
+func TestSpoolDrainsToEveryBackend(t *testing.T) {
+	a := &memoryStorage{name: "a", objs: make(map[string][]byte)}
+	b := &memoryStorage{name: "b", objs: make(map[string][]byte)}
+	sp := openTestSpool(t, t.TempDir(), 0, a, b)
+	sp.Start()
+	defer sp.Close()
+	for i := 0; i < 10; i++ {
+		if err := sp.Save(context.Background(), spoolTestObjs(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "drain", func() bool { return a.savesCount() == 10 && b.savesCount() == 10 })
+	if string(a.objs["blocks/3.dat"]) != string(spoolTestContents(3)["blocks/3.dat"]) {
+		t.Error("unexpected content drained")
+	}
+}
+
+func TestSpoolSlowBackendDoesNotBlockOthers(t *testing.T) {
+	down := &memoryStorage{name: "down", objs: make(map[string][]byte), saveErr: errors.New("down")}
+	up := &memoryStorage{name: "up", objs: make(map[string][]byte)}
+	dir := t.TempDir()
+	sp := openTestSpool(t, dir, 64, down, up)
+	sp.Start()
+	for i := 0; i < 5; i++ {
+		if err := sp.Save(context.Background(), spoolTestObjs(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "drain of working backend", func() bool { return up.savesCount() == 5 })
+	if down.savesCount() != 0 {
+		t.Fatal("failing backend reported saves")
+	}
+	m := NewMetrics()
+	m.RegisterSpool("mainnet", sp)
+	metrics := scrapeMetrics(m, t)
+	expectMetric(metrics, `delegation_backend_spool_backlog_bytes{backend="up",network="mainnet"} 0`, t)
+	if backlog := sp.Backlog()["down"]; backlog <= 0 {
+		t.Errorf("unexpected backlog of failing backend: %d", backlog)
+	} else {
+		expectMetric(metrics, fmt.Sprintf(`delegation_backend_spool_backlog_bytes{backend="down",network="mainnet"} %d`, backlog), t)
+	}
+	if err := sp.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// After restart the recovered backend gets everything, the other one nothing new
+	down.setSaveErr(nil)
+	sp = openTestSpool(t, dir, 64, down, up)
+	sp.Start()
+	defer sp.Close()
+	waitFor(t, "drain of recovered backend", func() bool { return down.savesCount() == 5 })
+	time.Sleep(50 * time.Millisecond)
+	if up.savesCount() != 5 {
+		t.Errorf("records replayed twice: %d", up.savesCount())
+	}
+	waitFor(t, "removal of drained segments", func() bool {
+		segments, err := sp.listSegments()
+		return err == nil && len(segments) == 1
+	})
+}
+
+func TestSpoolRecoversTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	sp := openTestSpool(t, dir, 0)
+	if err := sp.Save(context.Background(), spoolTestObjs(1)); err != nil {
+		t.Fatal(err)
+	}
+	end := sp.end
+	if err := sp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a crash in the middle of writing a record
+	f, err := os.OpenFile(sp.segmentPath(end.Segment), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.Write([]byte{0, 0, 1, 0, 1, 2, 3})
+	f.Close()
+
+	backend := &memoryStorage{name: "a", objs: make(map[string][]byte)}
+	sp = openTestSpool(t, dir, 0, backend)
+	if sp.end != end {
+		t.Fatalf("torn record not truncated: %v, expected %v", sp.end, end)
+	}
+	sp.Start()
+	defer sp.Close()
+	if err := sp.Save(context.Background(), spoolTestObjs(2)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "drain", func() bool { return backend.savesCount() == 2 })
+}
+
+func TestSpoolRejectsOversizedRecord(t *testing.T) {
+	// Length of a torn header isn't trusted to allocate the payload
+	header := []byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}
+	if _, err := readSpoolRecord(bytes.NewReader(header), 0); err != errSpoolCorrupted {
+		t.Fatalf("expected oversized record to be corrupted, got %v", err)
+	}
+}
+
+func TestSpoolShutdownFinishesSaveInProgress(t *testing.T) {
+	slow := &blockingStorage{&memoryStorage{name: "slow", objs: make(map[string][]byte)}, make(chan struct{})}
+	dir := t.TempDir()
+	sp := openTestSpool(t, dir, 0, slow)
+	sp.Start()
+	if err := sp.Save(context.Background(), spoolTestObjs(0)); err != nil {
+		t.Fatal(err)
+	}
+	// Drainer is blocked saving the record when the spool is shut down
+	time.Sleep(20 * time.Millisecond)
+	time.AfterFunc(20*time.Millisecond, func() { close(slow.unblock) })
+	if err := sp.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if slow.savesCount() != 1 {
+		t.Fatal("save in progress was not let finish")
+	}
+
+	// Save interrupted by the deadline is replayed after the next start
+	stuck := &blockingStorage{&memoryStorage{name: "slow", objs: make(map[string][]byte)}, make(chan struct{})}
+	sp = openTestSpool(t, dir, 0, stuck)
+	sp.Start()
+	if err := sp.Save(context.Background(), spoolTestObjs(1)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := sp.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline to be exceeded, got: %v", err)
+	}
+	sp = openTestSpool(t, dir, 0, slow)
+	sp.Start()
+	defer sp.Close()
+	waitFor(t, "replay", func() bool { return slow.savesCount() == 2 })
+}
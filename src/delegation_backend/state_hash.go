@@ -0,0 +1,204 @@
+package delegation_backend
+
+import (
+	"crypto/sha256"
+	"errors"
+)
+
+// Prefixes of protocol state hashes, sponge state after absorbing
+// the prefix is the initial state for hashing
+const PROTOCOL_STATE_PREFIX = "CodaProtoState"
+const PROTOCOL_STATE_BODY_PREFIX = "CodaProtoStateBody"
+
+// Number of bits of the last VRF output that are hashed
+const VRF_OUTPUT_HASHED_BITS = 253
+
+var poseidonProtocolStateIv = poseidonPrefixState(PROTOCOL_STATE_PREFIX)
+var poseidonProtocolStateBodyIv = poseidonPrefixState(PROTOCOL_STATE_BODY_PREFIX)
+
+var errFieldOutOfRange = errors.New("field element out of range")
+
+// legacyProtocolState holds the protocol state of a block serialized as in
+// mainnet (Mina 1.x), field elements being kept as little-endian bytes
+type legacyProtocolState struct {
+	previousStateHash [32]byte
+	genesisStateHash  [32]byte
+
+	// Blockchain state
+	ledgerHash                [32]byte
+	auxHash                   []byte
+	pendingCoinbaseAux        []byte
+	pendingCoinbaseHash       [32]byte
+	snarkedLedgerHash         [32]byte
+	genesisLedgerHash         [32]byte
+	snarkedNextAvailableToken uint64
+	timestamp                 uint64
+
+	// Consensus state
+	blockchainLength                  uint32
+	epochCount                        uint32
+	minWindowDensity                  uint32
+	subWindowDensities                []uint32
+	lastVrfOutput                     []byte
+	totalCurrency                     uint64
+	currSlot                          uint32
+	slotsPerEpoch                     uint32
+	globalSlotSinceGenesis            uint32
+	stakingEpochData                  legacyEpochData
+	nextEpochData                     legacyEpochData
+	hasAncestorInSameCheckpointWindow bool
+	blockStakeWinner                  legacyPublicKey
+	blockCreator                      legacyPublicKey
+	coinbaseReceiver                  legacyPublicKey
+	superchargeCoinbase               bool
+
+	// Protocol constants
+	k                     uint32
+	constSlotsPerEpoch    uint32
+	slotsPerSubWindow     uint32
+	delta                 uint32
+	genesisStateTimestamp uint64
+}
+
+type legacyEpochData struct {
+	ledgerHash      [32]byte
+	totalCurrency   uint64
+	seed            [32]byte
+	startCheckpoint [32]byte
+	lockCheckpoint  [32]byte
+	epochLength     uint32
+}
+
+type legacyPublicKey struct {
+	x     [32]byte
+	isOdd bool
+}
+
+// hashInput collects field elements and bits to hash the way
+// Random_oracle.Input of Mina 1.x does: fields are hashed first,
+// followed by all the bits packed together
+type hashInput struct {
+	fields []fpElement
+	bits   []bool
+	err    error
+}
+
+func (in *hashInput) field(bs [32]byte) {
+	x := leBytesToInt(bs[:])
+	if x.Cmp(pallasP) >= 0 {
+		in.err = errFieldOutOfRange
+		return
+	}
+	var el fpElement
+	el.setBig(x)
+	in.fields = append(in.fields, el)
+}
+
+// Appends n least significant bits of v, least significant first
+func (in *hashInput) uint(v uint64, n int) {
+	for i := 0; i < n; i++ {
+		in.bits = append(in.bits, (v>>i)&1 == 1)
+	}
+}
+
+func (in *hashInput) bool(b bool) {
+	in.bits = append(in.bits, b)
+}
+
+func (in *hashInput) epochData(e *legacyEpochData) {
+	in.field(e.seed)
+	in.field(e.startCheckpoint)
+	in.field(e.lockCheckpoint)
+	in.uint(uint64(e.epochLength), 32)
+	in.field(e.ledgerHash)
+	in.uint(e.totalCurrency, 64)
+}
+
+func (in *hashInput) publicKey(pk *legacyPublicKey) {
+	in.field(pk.x)
+	in.bool(pk.isOdd)
+}
+
+func (in *hashInput) hash(iv poseidonState) (res [32]byte, err error) {
+	if in.err != nil {
+		return res, in.err
+	}
+	sponge := poseidonSponge{state: iv}
+	sponge.absorb(in.fields...)
+	sponge.absorb(packBits(in.bits)...)
+	h := sponge.squeeze()
+	return fpToLeBytes(&h), nil
+}
+
+func fpToLeBytes(x *fpElement) (res [32]byte) {
+	var be [32]byte
+	x.toBig().FillBytes(be[:])
+	for i, b := range be {
+		res[31-i] = b
+	}
+	return
+}
+
+// bodyHash is the hash of the protocol state body, computed the same way
+// Protocol_state.Body.hash of Mina 1.x does
+func (s *legacyProtocolState) bodyHash() ([32]byte, error) {
+	var in hashInput
+
+	// Blockchain state, staged ledger hash being hashed as bits
+	// of the SHA-256 digest of its non-snark part
+	digest := sha256.New()
+	digest.Write(s.ledgerHash[:])
+	digest.Write(s.auxHash)
+	digest.Write(s.pendingCoinbaseAux)
+	in.bits = append(in.bits, bytesToBits(digest.Sum(nil))...)
+	in.field(s.pendingCoinbaseHash)
+	in.field(s.snarkedLedgerHash)
+	in.field(s.genesisLedgerHash)
+	in.uint(s.snarkedNextAvailableToken, 64)
+	in.uint(s.timestamp, 64)
+
+	// Consensus state
+	in.uint(uint64(s.blockchainLength), 32)
+	in.uint(uint64(s.epochCount), 32)
+	in.uint(uint64(s.minWindowDensity), 32)
+	for _, density := range s.subWindowDensities {
+		in.uint(uint64(density), 32)
+	}
+	vrfBits := bytesToBits(s.lastVrfOutput)
+	in.bits = append(in.bits, vrfBits[:min(len(vrfBits), VRF_OUTPUT_HASHED_BITS)]...)
+	in.uint(s.totalCurrency, 64)
+	in.uint(uint64(s.currSlot), 32)
+	in.uint(uint64(s.slotsPerEpoch), 32)
+	in.uint(uint64(s.globalSlotSinceGenesis), 32)
+	in.bool(s.hasAncestorInSameCheckpointWindow)
+	in.bool(s.superchargeCoinbase)
+	in.epochData(&s.stakingEpochData)
+	in.epochData(&s.nextEpochData)
+	in.publicKey(&s.blockStakeWinner)
+	in.publicKey(&s.blockCreator)
+	in.publicKey(&s.coinbaseReceiver)
+
+	in.field(s.genesisStateHash)
+
+	// Protocol constants
+	in.uint(uint64(s.k), 32)
+	in.uint(uint64(s.constSlotsPerEpoch), 32)
+	in.uint(uint64(s.slotsPerSubWindow), 32)
+	in.uint(uint64(s.delta), 32)
+	in.uint(s.genesisStateTimestamp, 64)
+
+	return in.hash(poseidonProtocolStateBodyIv)
+}
+
+// hash is the state hash of the block, Poseidon hash of the previous
+// state hash and the body hash as in Protocol_state.hash of Mina 1.x
+func (s *legacyProtocolState) hash() ([32]byte, error) {
+	body, err := s.bodyHash()
+	if err != nil {
+		return body, err
+	}
+	var in hashInput
+	in.field(s.previousStateHash)
+	in.field(body)
+	return in.hash(poseidonProtocolStateIv)
+}
@@ -0,0 +1,164 @@
+package delegation_backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+// StorageBackend is a destination submissions are persisted to.
+type StorageBackend interface {
+	// Name identifies the backend in logs and error messages.
+	Name() string
+	// Save persists objects of a single submission.
+	Save(ctx context.Context, objs ObjectsToSave) error
+	// HealthCheck returns an error if the backend is not able to accept writes.
+	HealthCheck(ctx context.Context) error
+	// Close releases resources (sessions, connections) held by the backend.
+	Close() error
+}
+
+// StorageBackendFactory creates a storage backend out of the application
+// configuration. It returns a nil backend if the backend is not configured.
+type StorageBackendFactory func(ctx context.Context, appCfg AppConfig, log *logging.ZapEventLogger) (StorageBackend, error)
+
+type storageBackendEntry struct {
+	name    string
+	factory StorageBackendFactory
+}
+
+var storageBackendsMutex sync.Mutex
+var storageBackendRegistry = []storageBackendEntry{
+	{"s3", newS3Backend},
+	{"keyspaces", newKeyspacesBackend},
+	{"filesystem", newLocalFileSystemBackend},
+	{"postgresql", newPostgreSQLBackend},
+}
+
+// RegisterStorageBackend makes a storage backend available to NewStorageBackends.
+// Backends are created in the order of registration, after the built-in ones.
+func RegisterStorageBackend(name string, factory StorageBackendFactory) {
+	storageBackendsMutex.Lock()
+	defer storageBackendsMutex.Unlock()
+	for _, e := range storageBackendRegistry {
+		if e.name == name {
+			panic("storage backend registered twice: " + name)
+		}
+	}
+	storageBackendRegistry = append(storageBackendRegistry, storageBackendEntry{name, factory})
+}
+
+// NewStorageBackends creates every registered storage backend
+// that is configured in appCfg.
+func NewStorageBackends(ctx context.Context, appCfg AppConfig, log *logging.ZapEventLogger) (StorageBackends, error) {
+	storageBackendsMutex.Lock()
+	registry := append([]storageBackendEntry(nil), storageBackendRegistry...)
+	storageBackendsMutex.Unlock()
+
+	var backends StorageBackends
+	for _, e := range registry {
+		b, err := e.factory(ctx, appCfg, log)
+		if err != nil {
+			_ = backends.Close()
+			return nil, fmt.Errorf("error initializing %s storage backend: %w", e.name, err)
+		}
+		if b != nil {
+			log.Infof("storage backend: %s", b.Name())
+			backends = append(backends, b)
+		}
+	}
+	return backends, nil
+}
+
+func newS3Backend(ctx context.Context, appCfg AppConfig, log *logging.ZapEventLogger) (StorageBackend, error) {
+	if appCfg.Aws == nil {
+		return nil, nil
+	}
+	return NewAwsContext(ctx, appCfg, log)
+}
+
+func newKeyspacesBackend(_ context.Context, appCfg AppConfig, log *logging.ZapEventLogger) (StorageBackend, error) {
+	if appCfg.AwsKeyspaces == nil {
+		return nil, nil
+	}
+	session, err := InitializeKeyspaceSession(appCfg.AwsKeyspaces)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyspaceContext{
+		Session:  session,
+		Keyspace: appCfg.AwsKeyspaces.Keyspace,
+		Log:      log,
+	}, nil
+}
+
+func newLocalFileSystemBackend(_ context.Context, appCfg AppConfig, log *logging.ZapEventLogger) (StorageBackend, error) {
+	if appCfg.LocalFileSystem == nil {
+		return nil, nil
+	}
+	compression, err := ParseBlockCompression(appCfg.BlockCompression)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalFileSystemContext{Path: appCfg.LocalFileSystem.Path, Log: log, Compression: compression}, nil
+}
+
+func newPostgreSQLBackend(_ context.Context, appCfg AppConfig, log *logging.ZapEventLogger) (StorageBackend, error) {
+	if appCfg.PostgreSQL == nil {
+		return nil, nil
+	}
+	db, err := NewPostgreSQL(appCfg.PostgreSQL)
+	if err != nil {
+		return nil, err
+	}
+	return &PostgreSQLContext{DB: db, Log: log}, nil
+}
+
+// StorageBackends saves every submission to all of the contained backends.
+type StorageBackends []StorageBackend
+
+// Has checks whether a backend with the given name is present.
+func (bs StorageBackends) Has(name string) bool {
+	for _, b := range bs {
+		if b.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (bs StorageBackends) Name() string {
+	names := make([]string, len(bs))
+	for i, b := range bs {
+		names[i] = b.Name()
+	}
+	return strings.Join(names, ",")
+}
+
+// Save saves objects to every backend, even if some of them fail.
+// The returned error combines errors of all failed backends.
+func (bs StorageBackends) Save(ctx context.Context, objs ObjectsToSave) error {
+	return bs.forEach(func(b StorageBackend) error { return b.Save(ctx, objs) })
+}
+
+func (bs StorageBackends) HealthCheck(ctx context.Context) error {
+	return bs.forEach(func(b StorageBackend) error { return b.HealthCheck(ctx) })
+}
+
+func (bs StorageBackends) Close() error {
+	return bs.forEach(func(b StorageBackend) error { return b.Close() })
+}
+
+func (bs StorageBackends) forEach(f func(StorageBackend) error) error {
+	var errs []error
+	for _, b := range bs {
+		if err := f(b); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", b.Name(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,153 @@
+package delegation_backend
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+// memoryStorage is a StorageBackend keeping saved objects in a map
+type memoryStorage struct {
+	mutex   sync.Mutex
+	name    string
+	objs    map[string][]byte
+	saveErr error
+	saves   int
+	closed  bool
+}
+
+func (ms *memoryStorage) Name() string {
+	if ms.name == "" {
+		return "memory"
+	}
+	return ms.name
+}
+
+func (ms *memoryStorage) Save(_ context.Context, objs ObjectsToSave) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if ms.saveErr != nil {
+		return ms.saveErr
+	}
+	// Sources are only valid during the save
+	for path, src := range objs {
+		value, err := readObject(src)
+		if err != nil {
+			return err
+		}
+		ms.objs[path] = value
+	}
+	ms.saves++
+	return nil
+}
+
+// objectsOf makes objects to save out of their contents
+func objectsOf(contents map[string][]byte) ObjectsToSave {
+	objs := make(ObjectsToSave, len(contents))
+	for path, bs := range contents {
+		objs[path] = bytes.NewReader(bs)
+	}
+	return objs
+}
+
+func (ms *memoryStorage) HealthCheck(_ context.Context) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	return ms.saveErr
+}
+
+func (ms *memoryStorage) Close() error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.closed = true
+	return nil
+}
+
+func (ms *memoryStorage) setSaveErr(err error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.saveErr = err
+}
+
+func (ms *memoryStorage) savesCount() int {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	return ms.saves
+}
+
+func TestStorageBackendsSaveToAll(t *testing.T) {
+	a := &memoryStorage{name: "a", objs: make(map[string][]byte)}
+	b := &memoryStorage{name: "b", objs: make(map[string][]byte)}
+	bs := StorageBackends{a, b}
+	if err := bs.Save(context.Background(), objectsOf(map[string][]byte{"blocks/x.dat": []byte("x")})); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(a.objs["blocks/x.dat"]) != "x" || string(b.objs["blocks/x.dat"]) != "x" {
+		t.Fatal("object was not saved to every backend")
+	}
+	if bs.Name() != "a,b" {
+		t.Errorf("unexpected name: %s", bs.Name())
+	}
+}
+
+func TestStorageBackendsSaveReportsFailures(t *testing.T) {
+	errDown := errors.New("down")
+	a := &memoryStorage{name: "a", objs: make(map[string][]byte), saveErr: errDown}
+	b := &memoryStorage{name: "b", objs: make(map[string][]byte)}
+	bs := StorageBackends{a, b}
+	err := bs.Save(context.Background(), objectsOf(map[string][]byte{"blocks/x.dat": []byte("x")}))
+	if !errors.Is(err, errDown) {
+		t.Fatalf("expected error of failed backend, got: %v", err)
+	}
+	if string(b.objs["blocks/x.dat"]) != "x" {
+		t.Fatal("failure of one backend prevented saving to another")
+	}
+	if err := bs.Close(); err != nil || !a.closed || !b.closed {
+		t.Fatal("not every backend was closed")
+	}
+}
+
+func TestNewStorageBackendsFromConfig(t *testing.T) {
+	log := logging.Logger("delegation backend test")
+	dir := t.TempDir()
+	bs, err := NewStorageBackends(context.Background(), AppConfig{LocalFileSystem: &LocalFileSystemConfig{Path: dir}}, log)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(bs) != 1 || bs[0].Name() != "filesystem" {
+		t.Fatalf("unexpected backends: %v", bs.Name())
+	}
+	bs, err = NewStorageBackends(context.Background(), AppConfig{}, log)
+	if err != nil || len(bs) != 0 {
+		t.Fatalf("expected no backends, got %v, error: %v", bs.Name(), err)
+	}
+}
+
+func TestLocalFileSystemSave(t *testing.T) {
+	dir := t.TempDir()
+	fs := &LocalFileSystemContext{Path: dir, Log: logging.Logger("delegation backend test")}
+	if err := fs.HealthCheck(context.Background()); err != nil {
+		t.Fatalf("health check failed: %v", err)
+	}
+	contents := map[string][]byte{"submissions/2021-07-01/a.json": []byte("{}"), "blocks/x.dat": []byte("x")}
+	objs := objectsOf(contents)
+	if err := fs.Save(context.Background(), objs); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for path, expected := range contents {
+		actual, err := os.ReadFile(filepath.Join(dir, path))
+		if err != nil || string(actual) != string(expected) {
+			t.Errorf("unexpected content of %s: %s, error: %v", path, actual, err)
+		}
+	}
+	// Saving existing files again is not an error
+	if err := fs.Save(context.Background(), objs); err != nil {
+		t.Fatalf("unexpected error on second save: %v", err)
+	}
+}
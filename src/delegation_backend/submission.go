@@ -20,6 +20,16 @@ type Submission struct {
 	SnarkWork          []byte    `json:"snark_work,omitempty"`
 	GraphqlControlPort int       `json:"graphql_control_port,omitempty"`
 	BuiltWithCommitSha string    `json:"built_with_commit_sha,omitempty"`
+	NodeVersion        string    `json:"node_version,omitempty"`
+	SyncStatus         string    `json:"sync_status,omitempty"`
+	ProtocolVersion    string    `json:"protocol_version,omitempty"`
+	// Decoded from the block, nil unless blocks are decoded
+	StateHash *string `json:"state_hash,omitempty"`
+	Parent    *string `json:"parent,omitempty"`
+	Height    *int    `json:"height,omitempty"`
+	Slot      *int    `json:"slot,omitempty"`
+	// Size of the block, RawBlock is nil if it's larger than MAX_BLOCK_SIZE
+	blockSize int64
 }
 
 type Block struct {
@@ -77,8 +87,13 @@ func parseBlockBytes(data []byte, filePath string) (*Block, error) {
 
 func objectToSaveToSubmission(objs ObjectsToSave, logger Logger) (*Submission, error) {
 	var submissionToSave *Submission = &Submission{}
-	for path, bs := range objs {
+	for path, src := range objs {
 		if strings.HasPrefix(path, "submissions/") {
+			bs, err := readObject(src)
+			if err != nil {
+				logger.Errorf("Error reading submission JSON: %v", err)
+				continue
+			}
 			submission, err := parseSubmissionBytes(bs, path)
 			if err != nil {
 				logger.Errorf("Error parsing submission JSON: %v", err)
@@ -94,8 +109,24 @@ func objectToSaveToSubmission(objs ObjectsToSave, logger Logger) (*Submission, e
 			submissionToSave.SubmittedAtDate = submission.SubmittedAtDate
 			submissionToSave.Submitter = submission.Submitter
 			submissionToSave.BuiltWithCommitSha = submission.BuiltWithCommitSha
+			submissionToSave.NodeVersion = submission.NodeVersion
+			submissionToSave.SyncStatus = submission.SyncStatus
+			submissionToSave.ProtocolVersion = submission.ProtocolVersion
+			submissionToSave.StateHash = submission.StateHash
+			submissionToSave.Parent = submission.Parent
+			submissionToSave.Height = submission.Height
+			submissionToSave.Slot = submission.Slot
 
 		} else if strings.HasPrefix(path, "blocks/") {
+			// Blocks too large to be stored in a row are never read into memory
+			var bs []byte
+			if src.Size() <= int64(MAX_BLOCK_SIZE) {
+				var err error
+				if bs, err = readObject(src); err != nil {
+					logger.Errorf("Error reading block file: %v", err)
+					continue
+				}
+			}
 			block, err := parseBlockBytes(bs, path)
 			if err != nil {
 				logger.Errorf("Error parsing block file: %v", err)
@@ -103,6 +134,7 @@ func objectToSaveToSubmission(objs ObjectsToSave, logger Logger) (*Submission, e
 			}
 			submissionToSave.RawBlock = block.RawBlock
 			submissionToSave.BlockHash = block.BlockHash
+			submissionToSave.blockSize = src.Size()
 		} else {
 			logger.Errorf("Unknown path format: %s", path)
 		}
@@ -4,110 +4,102 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
-	"path/filepath"
+	"net/netip"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	logging "github.com/ipfs/go-log/v2"
-	"golang.org/x/crypto/blake2b"
+	"go.uber.org/zap"
 )
 
 type errorResponse struct {
-	Msg string `json:"error"`
+	Msg       string    `json:"error"`
+	Code      ErrorCode `json:"code,omitempty"`
+	Retryable bool      `json:"retryable,omitempty"`
 }
 
-func writeErrorResponse(app *App, w *http.ResponseWriter, msg string) {
-	app.Log.Debugf("Responding with error: %s", msg)
-	bs, err := json.Marshal(errorResponse{msg})
+func writeErrorResponse(log *zap.SugaredLogger, w *http.ResponseWriter, code ErrorCode, msg string) {
+	writeErrorResponseImpl(log, w, errorResponse{Msg: msg, Code: code})
+}
+
+// Respond with an error after which the submitter is expected to resubmit
+func writeRetryableErrorResponse(log *zap.SugaredLogger, w *http.ResponseWriter, code ErrorCode, msg string) {
+	writeErrorResponseImpl(log, w, errorResponse{Msg: msg, Code: code, Retryable: true})
+}
+
+func writeErrorResponseImpl(log *zap.SugaredLogger, w *http.ResponseWriter, resp errorResponse) {
+	log.Debugf("Responding with error %s: %s", resp.Code, resp.Msg)
+	bs, err := json.Marshal(resp)
 	if err == nil {
 		_, err2 := io.Copy(*w, bytes.NewReader(bs))
 		if err2 != nil {
-			app.Log.Debugf("Failed to respond with error status: %v", err2)
+			log.Debugf("Failed to respond with error status: %v", err2)
 		}
 	} else {
-		app.Log.Fatal("Failed to json-marshal error message")
+		log.Fatal("Failed to json-marshal error message")
 	}
 }
 
-func (ctx *AwsContext) S3Save(objs ObjectsToSave) {
-	for path, bs := range objs {
-		fullKey := aws.String(ctx.Prefix + "/" + path)
-		if strings.HasPrefix(path, "blocks/") {
-			_, err := ctx.Client.HeadObject(ctx.Context, &s3.HeadObjectInput{
-				Bucket: ctx.BucketName,
-				Key:    fullKey,
-			})
-			if err == nil {
-				//block already exists, skipping
-				continue
-			}
-			if !strings.Contains(err.Error(), "NotFound") {
-				ctx.Log.Warnf("S3Save: Error when checking if block exists, but will continue with block save: %s, error: %v", path, err)
-			}
-		}
-
-		ctx.Log.Infof("S3Save: saving %s", path)
-		_, err := ctx.Client.PutObject(ctx.Context, &s3.PutObjectInput{
-			Bucket:     ctx.BucketName,
-			Key:        fullKey,
-			Body:       bytes.NewReader(bs),
-			ContentMD5: nil,
-		})
-		if err != nil {
-			ctx.Log.Warnf("S3Save: Error while saving metadata: %v", err)
-		}
+// setRetryAfter sets the Retry-After header to d rounded up to seconds
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	secs := int((d + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
 	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
 }
 
-func LocalFileSystemSave(objs ObjectsToSave, directory string, log logging.StandardLogger) {
-	for path, bs := range objs {
-		fullPath := filepath.Join(directory, path)
+// ObjectSource is the content of an object to save. Backends read it with
+// ReadAt, so that it can be read by several of them at once and again on
+// every retry without being held in memory, e.g. a block spooled to disk.
+type ObjectSource interface {
+	io.ReaderAt
+	Size() int64
+}
 
-		// Check if file exists
-		if _, err := os.Stat(fullPath); !os.IsNotExist(err) {
-			log.Warnf("LocalFileSystemSave: file already exists: %s", fullPath)
-			continue // skip to the next object
-		}
+// ObjectsToSave are objects of a submission by path. Sources are only valid
+// until Save returns, backends saving them later keep copies of their own.
+type ObjectsToSave map[string]ObjectSource
 
-		err := os.MkdirAll(filepath.Dir(fullPath), os.ModePerm)
-		if err != nil {
-			log.Errorf("LocalFileSystemSave: Error creating directories for %s: %v", fullPath, err)
-			continue // skip to the next object
-		}
-		log.Infof("LocalFileSystemSave: saving %s", fullPath)
-		err = os.WriteFile(fullPath, bs, 0644)
-		if err != nil {
-			log.Warnf("Error writing to file %s: %v", fullPath, err)
-		}
-	}
+// objectReader reads the object from the start
+func objectReader(src ObjectSource) *io.SectionReader {
+	return io.NewSectionReader(src, 0, src.Size())
 }
 
-type ObjectsToSave map[string][]byte
-
-type AwsContext struct {
-	Client     *s3.Client
-	BucketName *string
-	Prefix     string
-	Context    context.Context
-	Log        *logging.ZapEventLogger
+// readObject reads the whole object into memory, which is
+// only meant for metadata and blocks bounded in size
+func readObject(src ObjectSource) ([]byte, error) {
+	return io.ReadAll(objectReader(src))
 }
 
 type App struct {
 	Log                     *logging.ZapEventLogger
-	SubmitCounter           *AttemptCounter
+	SubmitCounter           RateLimiter
+	IPLimiter               *IPRateLimiter  // requests of addresses aren't limited if nil
+	GlobalLimiter           *GlobalLimiter  // requests of the service aren't limited if nil
+	Proxies                 *TrustedProxies // only the connection peer is trusted if nil
 	Whitelist               *WhitelistMVar
+	WhitelistOverrides      *WhitelistOverrides
 	WhitelistDisabled       bool
+	Denylist                *DenylistMVar
+	DenyAudit               *DenyAuditLog
 	VerifySignatureDisabled bool
+	Verifier                *SignatureVerifier // signatures are verified inline if nil
+	Replay                  *ReplayGuard       // neither age nor duplicates are checked if nil
+	BlockTempDir            string             // os.TempDir() if empty
+	DecodeBlocks            bool               // blocks are neither decoded nor checked if false
 	NetworkId               uint8
-	Save                    func(ObjectsToSave)
+	NetworkName             string
+	Storage                 StorageBackend
 	Now                     nowFunc
-	IsReady                 bool
+	Metrics                 *Metrics
+	IsReady                 atomic.Bool // false during startup and shutdown
 }
 
 type SubmitH struct {
@@ -135,104 +127,338 @@ var nilPk Pk
 var nilTime time.Time
 
 func (h *SubmitH) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.ContentLength == -1 {
-		w.WriteHeader(411)
+	// Echoed to the submitter and attached to every log of the request
+	id := requestId(r)
+	w.Header().Set(REQUEST_ID_HEADER, id)
+	log := h.app.Log.With("request_id", id)
+
+	if !h.app.IsReady.Load() {
+		h.app.Metrics.RecordRejection(REJECT_NOT_READY)
+		w.WriteHeader(503)
+		writeRetryableErrorResponse(log, &w, ERR_SERVICE_NOT_READY, "Service is not ready to accept submissions")
+		return
+	}
+	origin := h.app.Proxies.Origin(r)
+	// Cheap limits are applied before the body is read
+	if !h.checkRequestLimits(log, w, origin.RemoteAddr) {
+		return
+	}
+	if h.app.GlobalLimiter != nil {
+		defer h.app.GlobalLimiter.Release()
+	}
+	version, supported := submitVersion(r)
+	if !supported {
+		h.app.Metrics.RecordRejection(REJECT_UNSUPPORTED_VERSION)
+		w.WriteHeader(415)
+		writeErrorResponse(log, &w, ERR_UNSUPPORTED_VERSION, "Unsupported version of the submit API")
 		return
-	} else if r.ContentLength > MAX_SUBMIT_PAYLOAD_SIZE {
+	}
+	if r.ContentLength > MAX_SUBMIT_PAYLOAD_SIZE {
+		h.app.Metrics.RecordRejection(REJECT_PAYLOAD_TOO_LARGE)
 		w.WriteHeader(413)
+		writeErrorResponse(log, &w, ERR_PAYLOAD_TOO_LARGE, "Payload is too large")
 		return
 	}
-	body, err1 := io.ReadAll(io.LimitReader(r.Body, r.ContentLength))
-	if err1 != nil || int64(len(body)) != r.ContentLength {
-		h.app.Log.Debugf("Error while reading /submit request's body: %v", err1)
-		w.WriteHeader(400)
-		writeErrorResponse(h.app, &w, "Error reading the body")
+	// Body may be chunked, its size is then only limited while it's read
+	body := &countingReader{r: http.MaxBytesReader(w, r.Body, MAX_SUBMIT_PAYLOAD_SIZE)}
+	// Compressed body is limited by the same size once decompressed
+	decompressed, err := decompressingReader(r.Header.Get("Content-Encoding"), body, MAX_SUBMIT_PAYLOAD_SIZE)
+	if errors.Is(err, errUnsupportedEncoding) {
+		h.app.Metrics.RecordRejection(REJECT_UNSUPPORTED_ENCODING)
+		w.WriteHeader(415)
+		writeErrorResponse(log, &w, ERR_UNSUPPORTED_ENCODING, "Unsupported Content-Encoding, expected gzip or zstd")
 		return
 	}
-
-	var req submitRequest
-	if err := json.Unmarshal(body, &req); err != nil {
-		h.app.Log.Debugf("Error while unmarshaling JSON of /submit request's body: %v", err)
+	var req *submitPayload
+	if err == nil {
+		req, err = decodeSubmit(decompressed, version, h.app.BlockTempDir)
+		decompressed.Close()
+	}
+	readErr := body.err
+	if readErr == io.EOF && r.ContentLength >= 0 && body.n != r.ContentLength {
+		readErr = fmt.Errorf("read %d bytes of %d", body.n, r.ContentLength)
+	} else if readErr == io.EOF {
+		readErr = nil
+	}
+	if err == nil && readErr != nil {
+		req.Close()
+		err = readErr
+	}
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case err == nil:
+	case errors.As(readErr, &maxBytesErr) || errors.Is(err, errMetadataTooLarge) || errors.Is(err, errDecompressedTooLarge):
+		h.app.Metrics.RecordRejection(REJECT_PAYLOAD_TOO_LARGE)
+		w.WriteHeader(413)
+		writeErrorResponse(log, &w, ERR_PAYLOAD_TOO_LARGE, "Payload is too large")
+		return
+	case readErr != nil:
+		log.Debugf("Error while reading /submit request's body: %v", readErr)
+		h.app.Metrics.RecordRejection(REJECT_READ_ERROR)
+		w.WriteHeader(400)
+		writeErrorResponse(log, &w, ERR_BODY_READ_FAILED, "Error reading the body")
+		return
+	case errors.Is(err, errDecompress):
+		log.Debugf("Error while decompressing /submit request's body: %v", err)
+		h.app.Metrics.RecordRejection(REJECT_DECOMPRESSION_ERROR)
 		w.WriteHeader(400)
-		writeErrorResponse(h.app, &w, "Error decoding payload")
+		writeErrorResponse(log, &w, ERR_DECOMPRESSION_FAILED, "Error decompressing the body")
+		return
+	case errors.Is(err, errBlockSpool):
+		log.Errorf("Error while spooling block: %v", err)
+		h.app.Metrics.RecordRejection(REJECT_INTERNAL_ERROR)
+		w.WriteHeader(500)
+		writeErrorResponse(log, &w, ERR_INTERNAL_ERROR, "Unexpected server error")
+		return
+	case errors.Is(err, errSchemaVersion):
+		log.Debugf("Error while decoding /submit request's body: %v", err)
+		h.app.Metrics.RecordRejection(REJECT_UNSUPPORTED_VERSION)
+		w.WriteHeader(400)
+		writeErrorResponse(log, &w, ERR_UNSUPPORTED_VERSION, "Unsupported schema version")
+		return
+	default:
+		log.Debugf("Error while unmarshaling JSON of /submit request's body: %v", err)
+		h.app.Metrics.RecordRejection(REJECT_MALFORMED_JSON)
+		w.WriteHeader(400)
+		writeErrorResponse(log, &w, ERR_MALFORMED_PAYLOAD, "Error decoding payload")
 		return
 	}
+	defer req.Close()
+
+	h.app.Metrics.RecordSubmitVersion(version)
 
 	if !req.CheckRequiredFields() {
-		h.app.Log.Debug("One of required fields wasn't provided")
+		log.Debug("One of required fields wasn't provided")
+		h.app.Metrics.RecordRejection(REJECT_MISSING_FIELDS)
 		w.WriteHeader(400)
-		writeErrorResponse(h.app, &w, "One of required fields wasn't provided")
+		writeErrorResponse(log, &w, ERR_MISSING_FIELDS, "One of required fields wasn't provided")
 		return
 	}
 
+	var blockInfo *BlockInfo
+	if h.app.DecodeBlocks {
+		blockInfo, err = decodeBlock(req.block.Reader())
+		if err != nil {
+			log.Debugf("Error while decoding the block: %v", err)
+			h.app.Metrics.RecordRejection(REJECT_INVALID_BLOCK)
+			w.WriteHeader(400)
+			if errors.Is(err, errUnsupportedBlockFormat) {
+				writeErrorResponse(log, &w, ERR_INVALID_BLOCK, "Block is not in the format of the network")
+			} else {
+				writeErrorResponse(log, &w, ERR_INVALID_BLOCK, "Block can't be decoded")
+			}
+			return
+		}
+	}
+
+	submittedAt := h.app.Now()
+	if rule, denied := h.app.Denylist.Match(req.Submitter, req.Data.PeerId, origin.Addr); denied {
+		log.Warnw("Submission denied by denylist", "submitter", req.Submitter.String(),
+			"peer_id", req.Data.PeerId, "remote_addr", origin.RemoteAddr,
+			"rule_kind", rule.Kind, "rule_value", rule.Value, "reason", rule.Reason)
+		h.app.DenyAudit.Record(DeniedAttempt{
+			Time:       submittedAt,
+			Submitter:  req.Submitter.String(),
+			PeerId:     req.Data.PeerId,
+			RemoteAddr: origin.RemoteAddr,
+			Rule:       rule,
+		})
+		h.app.Metrics.RecordRejection(REJECT_DENYLISTED)
+		w.WriteHeader(403)
+		writeErrorResponse(log, &w, ERR_SUBMISSION_DENIED, "Submission is denied")
+		return
+	}
+
+	var wlEntry WhitelistEntry
 	if !h.app.WhitelistDisabled {
 		wl := h.app.Whitelist.ReadWhitelist()
-		if (*wl)[req.Submitter] == nil {
+		var registered bool
+		var override *WhitelistOverride
+		wlEntry, registered, override = h.app.WhitelistOverrides.Lookup(wl, req.Submitter, submittedAt)
+		if override != nil && override.Action == OverrideDeny {
+			log.Debugf("Submitter %s is denied by an override: %s", req.Submitter, override.Reason)
+			h.app.Metrics.RecordRejection(REJECT_DENIED_BY_OVERRIDE)
 			w.WriteHeader(401)
 			message := fmt.Sprintf("Submitter is not registered: %s", req.Submitter)
-			writeErrorResponse(h.app, &w, message)
+			writeErrorResponse(log, &w, ERR_SUBMITTER_NOT_WHITELISTED, message)
+			return
+		}
+		if !registered {
+			h.app.Metrics.RecordRejection(REJECT_NOT_WHITELISTED)
+			w.WriteHeader(401)
+			message := fmt.Sprintf("Submitter is not registered: %s", req.Submitter)
+			writeErrorResponse(log, &w, ERR_SUBMITTER_NOT_WHITELISTED, message)
+			return
+		}
+		if !wlEntry.ValidAt(submittedAt) {
+			log.Debugf("Whitelist entry of %s (%s) is not valid at %v", req.Submitter, wlEntry.Label, submittedAt)
+			h.app.Metrics.RecordRejection(REJECT_OUTSIDE_VALIDITY_WINDOW)
+			w.WriteHeader(401)
+			message := fmt.Sprintf("Submitter registration is not valid at this time: %s", req.Submitter)
+			writeErrorResponse(log, &w, ERR_OUTSIDE_VALIDITY_WINDOW, message)
+			return
+		}
+		if !wlEntry.AllowsNetwork(h.app.NetworkName) {
+			h.app.Metrics.RecordRejection(REJECT_NETWORK_NOT_ALLOWED)
+			w.WriteHeader(401)
+			message := fmt.Sprintf("Submitter is not registered for network %s: %s", h.app.NetworkName, req.Submitter)
+			writeErrorResponse(log, &w, ERR_NETWORK_NOT_ALLOWED, message)
 			return
 		}
 	}
 
-	submittedAt := h.app.Now()
 	if req.Data.CreatedAt.Add(TIME_DIFF_DELTA).After(submittedAt) {
-		h.app.Log.Debugf("Field created_at is a timestamp in future: %v", submittedAt)
+		log.Debugf("Field created_at is a timestamp in future: %v", submittedAt)
+		h.app.Metrics.RecordRejection(REJECT_CREATED_AT_IN_FUTURE)
+		w.WriteHeader(400)
+		writeErrorResponse(log, &w, ERR_CREATED_AT_IN_FUTURE, "Field created_at is a timestamp in future")
+		return
+	}
+	if h.app.Replay.IsStale(req.Data.CreatedAt, submittedAt) {
+		log.Debugf("Field created_at is too old: %v", req.Data.CreatedAt)
+		h.app.Metrics.RecordRejection(REJECT_CREATED_AT_TOO_OLD)
 		w.WriteHeader(400)
-		writeErrorResponse(h.app, &w, "Field created_at is a timestamp in future")
+		writeErrorResponse(log, &w, ERR_CREATED_AT_TOO_OLD, "Field created_at is too old")
 		return
 	}
 
 	if !h.app.VerifySignatureDisabled {
-		payload, err := req.Data.MakeSignPayload()
-		if err != nil {
-			h.app.Log.Errorf("Error while making sign payload: %v", err)
-			w.WriteHeader(500)
-			writeErrorResponse(h.app, &w, "Unexpected server error")
-			return
+		hash := req.signHash
+		var sigValid bool
+		if h.app.Verifier != nil {
+			sigValid, err = h.app.Verifier.Verify(r.Context(), &req.Submitter, &req.Sig, hash, h.app.NetworkId)
+			if err != nil {
+				log.Debugf("Signature wasn't verified: %v", err)
+				h.app.Metrics.RecordRejection(REJECT_VERIFIER_UNAVAILABLE)
+				w.WriteHeader(503)
+				writeRetryableErrorResponse(log, &w, ERR_VERIFIER_UNAVAILABLE, "Signature verification is unavailable")
+				return
+			}
+		} else {
+			verificationStart := time.Now()
+			sigValid = verifySig(&req.Submitter, &req.Sig, hash[:], h.app.NetworkId)
+			h.app.Metrics.RecordSignatureVerification(time.Since(verificationStart))
 		}
-
-		hash := blake2b.Sum256(payload)
-		if !verifySig(&req.Submitter, &req.Sig, hash[:], h.app.NetworkId) {
+		if !sigValid {
+			h.app.Metrics.RecordRejection(REJECT_INVALID_SIGNATURE)
 			w.WriteHeader(401)
-			writeErrorResponse(h.app, &w, "Invalid signature")
+			writeErrorResponse(log, &w, ERR_INVALID_SIGNATURE, "Invalid signature")
 			return
 		}
 	}
 
-	passesAttemptLimit := h.app.SubmitCounter.RecordAttempt(req.Submitter)
+	// Duplicates are rejected before they count against the rate limit
+	if !h.app.Replay.MarkSeen(h.app.NetworkName, req.Submitter, req.Sig, req.Data.CreatedAt, submittedAt) {
+		log.Debugf("Duplicate submission of %s", req.Submitter)
+		h.app.Metrics.RecordRejection(REJECT_DUPLICATE)
+		w.WriteHeader(409)
+		writeErrorResponse(log, &w, ERR_DUPLICATE_SUBMISSION, "Submission was already accepted")
+		return
+	}
+
+	// Limit of the whitelist entry if set, the default one otherwise
+	passesAttemptLimit, retryAfter, err := h.app.SubmitCounter.Allow(r.Context(), req.Submitter, wlEntry.HourlyLimit)
+	if err != nil {
+		log.Errorf("Error while recording attempt of %s: %v", req.Submitter, err)
+		h.app.Replay.Forget(h.app.NetworkName, req.Submitter, req.Sig)
+		h.app.Metrics.RecordRejection(REJECT_RATE_LIMITER_UNAVAILABLE)
+		w.WriteHeader(503)
+		writeRetryableErrorResponse(log, &w, ERR_RATE_LIMITER_UNAVAILABLE, "Rate limiter is unavailable")
+		return
+	}
 	if !passesAttemptLimit {
+		h.app.Replay.Forget(h.app.NetworkName, req.Submitter, req.Sig)
+		h.app.Metrics.RecordRejection(REJECT_RATE_LIMITED)
+		setRetryAfter(w, retryAfter)
 		w.WriteHeader(429)
-		writeErrorResponse(h.app, &w, "Too many requests per hour")
+		writeErrorResponse(log, &w, ERR_RATE_LIMITED, "Too many requests per hour")
 		return
 	}
 
-	blockHash := req.GetBlockDataHash()
-	ps := makePaths(submittedAt, blockHash, req.Submitter)
-
-	remoteAddr := r.Header.Get("X-Forwarded-For")
-	if remoteAddr == "" {
-		// If there is no X-Forwarded-For header, use the remote address
-		remoteAddr = r.RemoteAddr
-	}
+	ps := makePaths(submittedAt, req.block.Hash(), req.Submitter)
 
-	metaBytes, err1 := req.MakeMetaToBeSaved(remoteAddr)
-	if err1 != nil {
-		h.app.Log.Errorf("Error while marshaling JSON for metaToBeSaved: %v", err1)
+	metaBytes, err := req.MakeMetaToBeSaved(origin, blockInfo)
+	if err != nil {
+		log.Errorf("Error while preparing submission to be saved: %v", err)
+		h.app.Replay.Forget(h.app.NetworkName, req.Submitter, req.Sig)
+		h.app.Metrics.RecordRejection(REJECT_INTERNAL_ERROR)
 		w.WriteHeader(500)
-		writeErrorResponse(h.app, &w, "Unexpected server error")
+		writeErrorResponse(log, &w, ERR_INTERNAL_ERROR, "Unexpected server error")
 		return
 	}
 
 	toSave := make(ObjectsToSave)
-	toSave[ps.Meta] = metaBytes
-	toSave[ps.Block] = []byte(req.Data.Block.data)
-	h.app.Save(toSave)
+	toSave[ps.Meta] = bytes.NewReader(metaBytes)
+	// Block is streamed from its temporary file, never read into memory
+	toSave[ps.Block] = req.block.Source()
+	// The save must not be aborted if the submitter disconnects
+	if err := h.app.Storage.Save(context.WithoutCancel(r.Context()), toSave); err != nil {
+		log.Errorf("Error while saving submission of %s: %v", req.Submitter, err)
+		h.app.Replay.Forget(h.app.NetworkName, req.Submitter, req.Sig)
+		h.app.Metrics.RecordRejection(REJECT_STORAGE_UNAVAILABLE)
+		if errors.Is(err, ErrSaveQueueFull) {
+			setRetryAfter(w, SAVE_QUEUE_RETRY_AFTER)
+		}
+		w.WriteHeader(503)
+		writeRetryableErrorResponse(log, &w, ERR_STORAGE_UNAVAILABLE, "Submission could not be saved, please retry")
+		return
+	}
 
-	_, err2 := io.Copy(w, bytes.NewReader([]byte("{\"status\":\"ok\"}")))
-	if err2 != nil {
-		h.app.Log.Debugf("Error while responding with ok status to the user: %v", err2)
+	if _, err := io.Copy(w, bytes.NewReader([]byte("{\"status\":\"ok\"}"))); err != nil {
+		log.Debugf("Error while responding with ok status to the user: %v", err)
+	}
+}
+
+// Reader of a request body counting bytes read and keeping the error
+type countingReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if err != nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// checkRequestLimits applies limits of the client address and of the
+// service, taking a slot of the global limiter if the request passes
+func (h *SubmitH) checkRequestLimits(log *zap.SugaredLogger, w http.ResponseWriter, remoteAddr string) bool {
+	now := h.app.Now()
+	if h.app.IPLimiter != nil {
+		// Address of the client is always resolved unless the peer isn't on IP
+		if addr, err := netip.ParseAddr(remoteAddr); err == nil {
+			if allowed, retryAfter := h.app.IPLimiter.Allow(addr, now); !allowed {
+				h.app.Metrics.RecordRejection(REJECT_IP_RATE_LIMITED)
+				setRetryAfter(w, retryAfter)
+				w.WriteHeader(429)
+				writeErrorResponse(log, &w, ERR_IP_RATE_LIMITED, "Too many requests from the address")
+				return false
+			}
+		}
+	}
+	if h.app.GlobalLimiter == nil {
+		return true
+	}
+	if allowed, retryAfter := h.app.GlobalLimiter.Allow(now); !allowed {
+		h.app.Metrics.RecordRejection(REJECT_GLOBAL_RATE_LIMITED)
+		setRetryAfter(w, retryAfter)
+		w.WriteHeader(503)
+		writeRetryableErrorResponse(log, &w, ERR_GLOBAL_RATE_LIMITED, "Service receives too many requests")
+		return false
+	}
+	if !h.app.GlobalLimiter.Acquire() {
+		h.app.Metrics.RecordRejection(REJECT_TOO_MANY_CONCURRENT)
+		setRetryAfter(w, time.Second)
+		w.WriteHeader(503)
+		writeRetryableErrorResponse(log, &w, ERR_TOO_MANY_CONCURRENT_REQUESTS, "Service handles too many requests")
+		return false
 	}
+	return true
 }
 
 func (app *App) NewSubmitH() *SubmitH {
@@ -0,0 +1,565 @@
+package delegation_backend
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcutil/base58"
+	"golang.org/x/crypto/blake2b"
+)
+
+// Size of the read buffer of a submission and of chunks its block is decoded in
+const BLOCK_DECODE_CHUNK_SIZE = 64 * 1024
+
+var errMetadataTooLarge = errors.New("fields other than block exceed MAX_SUBMIT_METADATA_SIZE")
+
+// Failure of the server to spool a block, rather than a fault of the submission
+var errBlockSpool = errors.New("failed to spool block")
+
+// spooledBlock is a decoded block kept in a temporary file.
+// Close is a no-op on a nil *spooledBlock.
+type spooledBlock struct {
+	file *os.File
+	size int64
+	hash [32]byte // blake2b of the decoded block
+}
+
+// Hash returns base58check-encoded hash of the block
+func (b *spooledBlock) Hash() string {
+	return base58.CheckEncode(b.hash[:], BASE58CHECK_VERSION_BLOCK_HASH)
+}
+
+// Source reads the block from its temporary file, until it's closed
+func (b *spooledBlock) Source() ObjectSource {
+	return io.NewSectionReader(b.file, 0, b.size)
+}
+
+// Reader reads the block from its temporary file from the start
+func (b *spooledBlock) Reader() io.Reader {
+	return io.NewSectionReader(b.file, 0, b.size)
+}
+
+// Close removes the temporary file
+func (b *spooledBlock) Close() error {
+	if b == nil {
+		return nil
+	}
+	err := b.file.Close()
+	if err2 := os.Remove(b.file.Name()); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// Raw JSON of a member of an object
+type rawMember struct {
+	key   []byte
+	value []byte
+}
+
+func objectOf(members []rawMember) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, m := range members {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(m.key)
+		buf.WriteByte(':')
+		buf.Write(m.value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes()
+}
+
+// submitDecoder parses a submission without keeping its block in memory:
+// the block is base64-decoded into a temporary file and hashed as it's read,
+// and so is the payload its signature is made over, which starts with the
+// block in every schema version. Other fields, limited by
+// MAX_SUBMIT_METADATA_SIZE in total, are kept and decoded as usual.
+type submitDecoder struct {
+	r        *bufio.Reader
+	version  int
+	tempDir  string
+	metaSize int
+	block    *spooledBlock
+	signHash hash.Hash
+}
+
+// decodeSubmit parses a submission of the schema version from r, spooling
+// its block into tempDir. Close of the result removes the spooled block.
+func decodeSubmit(r io.Reader, version int, tempDir string) (*submitPayload, error) {
+	d := &submitDecoder{
+		r:       bufio.NewReaderSize(r, BLOCK_DECODE_CHUNK_SIZE),
+		version: version,
+		tempDir: tempDir,
+	}
+	res, err := d.decode()
+	if err != nil {
+		_ = d.block.Close()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return res, nil
+}
+
+func (d *submitDecoder) decode() (*submitPayload, error) {
+	var top, data []rawMember
+	hasData := false
+	err := d.readObject(func(key string, rawKey []byte) error {
+		if key == "data" {
+			if hasData {
+				return errors.New("duplicate field data")
+			}
+			hasData = true
+			var err error
+			data, err = d.readData()
+			return err
+		}
+		if strings.EqualFold(key, "data") {
+			return fmt.Errorf("unexpected field %s", key)
+		}
+		value, err := d.capture()
+		top = append(top, rawMember{key: rawKey, value: value})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := d.peek(); err != io.EOF {
+		if err == nil {
+			err = errors.New("unexpected data after JSON value")
+		}
+		return nil, err
+	}
+
+	res := &submitPayload{Version: d.version, block: d.block}
+	var signTail []byte
+	switch d.version {
+	case SUBMIT_API_V1:
+		if err := json.Unmarshal(objectOf(top), &res.submitRequest); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(objectOf(data), &res.Data); err != nil {
+			return nil, err
+		}
+		if signTail, err = res.Data.makeSignPayloadTail(); err != nil {
+			return nil, err
+		}
+	case SUBMIT_API_V2:
+		// Unlike v1, unknown fields are rejected: every field of data is
+		// covered by the signature, so every field kept has to be known
+		var req submitRequestV2
+		if err := decodeStrict(objectOf(top), &req); err != nil {
+			return nil, err
+		}
+		if req.Version != SUBMIT_API_V2 {
+			return nil, fmt.Errorf("%w %d", errSchemaVersion, req.Version)
+		}
+		res.Submitter, res.Sig = req.Submitter, req.Sig
+		var reqData submitRequestDataV2
+		if err := decodeStrict(objectOf(data), &reqData); err != nil {
+			return nil, err
+		}
+		res.Data, res.Extras = reqData.submitRequestData, reqData.submitRequestExtras
+		canonical, err := CanonicalJSON(objectOf(data))
+		if err != nil {
+			return nil, err
+		}
+		// Block is the first of known fields in the canonical order
+		signTail = []byte{'}'}
+		if len(canonical) > 2 {
+			signTail = append([]byte{','}, canonical[1:]...)
+		}
+	default:
+		return nil, errSchemaVersion
+	}
+	if d.block != nil {
+		d.signHash.Write(signTail)
+		copy(res.signHash[:], d.signHash.Sum(nil))
+	}
+	return res, nil
+}
+
+func decodeStrict(b []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// Reads data of the submission, streaming its block
+func (d *submitDecoder) readData() ([]rawMember, error) {
+	c, err := d.peek()
+	if err != nil {
+		return nil, err
+	}
+	if c != '{' {
+		// Rejected as missing required fields if null
+		_, err := d.captureNull()
+		return nil, err
+	}
+	var members []rawMember
+	err = d.readObject(func(key string, rawKey []byte) error {
+		if key == "block" {
+			return d.streamBlock()
+		}
+		if strings.EqualFold(key, "block") {
+			return fmt.Errorf("unexpected field %s", key)
+		}
+		value, err := d.capture()
+		members = append(members, rawMember{key: rawKey, value: value})
+		return err
+	})
+	return members, err
+}
+
+func (d *submitDecoder) captureNull() ([]byte, error) {
+	value, err := d.capture()
+	if err == nil && string(value) != "null" {
+		err = fmt.Errorf("unexpected value %s", value)
+	}
+	return value, err
+}
+
+// streamBlock decodes base64 string of the block into a temporary file,
+// hashing the block and the beginning of the sign payload along
+func (d *submitDecoder) streamBlock() error {
+	if d.block != nil {
+		return errors.New("duplicate field block")
+	}
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+	if c != '"' {
+		// Rejected as missing required fields if null
+		_, err := d.captureNull()
+		return err
+	}
+	_, _ = d.r.ReadByte()
+
+	file, err := os.CreateTemp(d.tempDir, "block-*.dat")
+	if err != nil {
+		return fmt.Errorf("%w: %v", errBlockSpool, err)
+	}
+	d.block = &spooledBlock{file: file}
+	blockHash, _ := blake2b.New256(nil)
+	b64 := newBase64Decoder(io.MultiWriter(file, blockHash))
+	d.signHash, _ = blake2b.New256(nil)
+	// v1 payload contains the block as sent, v2 payload its canonical form
+	signed := bufio.NewWriterSize(d.signHash, BLOCK_DECODE_CHUNK_SIZE)
+	if d.version == SUBMIT_API_V1 {
+		_, _ = signed.WriteString(SIGN_PAYLOAD_PREFIX + `"`)
+	} else {
+		_, _ = signed.WriteString(`{"block":"`)
+	}
+	for {
+		c, err := d.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if d.version == SUBMIT_API_V1 {
+			_ = signed.WriteByte(c)
+		}
+		if c == '"' {
+			break
+		}
+		if c == '\\' {
+			if c, err = d.readEscape(signed); err != nil {
+				return err
+			}
+		} else if c < 0x20 {
+			return errors.New("control character in a string")
+		}
+		if d.version == SUBMIT_API_V2 {
+			switch c {
+			case '\n':
+				_, _ = signed.WriteString(`\n`)
+			case '\r':
+				_, _ = signed.WriteString(`\r`)
+			default:
+				// Other characters which are escaped in the canonical form are not valid base64
+				_ = signed.WriteByte(c)
+			}
+		}
+		if err := b64.WriteByte(c); err != nil {
+			return err
+		}
+	}
+	if d.version == SUBMIT_API_V2 {
+		_ = signed.WriteByte('"')
+	}
+	if err := b64.Close(); err != nil {
+		return err
+	}
+	d.block.size = b64.n
+	copy(d.block.hash[:], blockHash.Sum(nil))
+	return signed.Flush()
+}
+
+// Reads an escape sequence of a string following the backslash,
+// returning the escaped character. Escapes of characters other than
+// ASCII are returned as 0, those are not a part of valid base64.
+func (d *submitDecoder) readEscape(raw *bufio.Writer) (byte, error) {
+	c, err := d.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if d.version == SUBMIT_API_V1 {
+		_ = raw.WriteByte(c)
+	}
+	switch c {
+	case '"', '\\', '/':
+		return c, nil
+	case 'b':
+		return '\b', nil
+	case 'f':
+		return '\f', nil
+	case 'n':
+		return '\n', nil
+	case 'r':
+		return '\r', nil
+	case 't':
+		return '\t', nil
+	case 'u':
+		var hex [4]byte
+		if _, err := io.ReadFull(d.r, hex[:]); err != nil {
+			return 0, err
+		}
+		if d.version == SUBMIT_API_V1 {
+			_, _ = raw.Write(hex[:])
+		}
+		r, err := strconv.ParseUint(string(hex[:]), 16, 16)
+		if err != nil {
+			return 0, fmt.Errorf("invalid escape \\u%s", hex)
+		}
+		if r >= 0x80 {
+			return 0, nil
+		}
+		return byte(r), nil
+	}
+	return 0, fmt.Errorf("invalid escape \\%c", c)
+}
+
+// readObject reads an object calling member for each of its keys,
+// which is expected to read the value
+func (d *submitDecoder) readObject(member func(key string, rawKey []byte) error) error {
+	if err := d.expect('{'); err != nil {
+		return err
+	}
+	if c, err := d.peek(); err != nil {
+		return err
+	} else if c == '}' {
+		_, _ = d.r.ReadByte()
+		return nil
+	}
+	for {
+		if c, err := d.peek(); err != nil {
+			return err
+		} else if c != '"' {
+			return fmt.Errorf("unexpected character %q instead of a key", c)
+		}
+		rawKey, err := d.capture()
+		if err != nil {
+			return err
+		}
+		var key string
+		if err := json.Unmarshal(rawKey, &key); err != nil {
+			return err
+		}
+		if err := d.expect(':'); err != nil {
+			return err
+		}
+		if err := member(key, rawKey); err != nil {
+			return err
+		}
+		if _, err := d.peek(); err != nil {
+			return err
+		}
+		c, _ := d.r.ReadByte()
+		switch c {
+		case ',':
+		case '}':
+			return nil
+		default:
+			return fmt.Errorf("unexpected character %q after a value", c)
+		}
+	}
+}
+
+func (d *submitDecoder) expect(expected byte) error {
+	if _, err := d.peek(); err != nil {
+		return err
+	}
+	if c, _ := d.r.ReadByte(); c != expected {
+		return fmt.Errorf("unexpected character %q instead of %q", c, expected)
+	}
+	return nil
+}
+
+// peek skips whitespace returning the next character without reading it
+func (d *submitDecoder) peek() (byte, error) {
+	for {
+		c, err := d.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if c != ' ' && c != '\t' && c != '\n' && c != '\r' {
+			return c, d.r.UnreadByte()
+		}
+	}
+}
+
+// capture reads a value as raw JSON, which is validated once decoded
+func (d *submitDecoder) capture() ([]byte, error) {
+	c, err := d.peek()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	switch c {
+	case '"':
+		err = d.captureString(&buf)
+	case '{', '[':
+		for depth := 0; err == nil; {
+			if c, err = d.r.ReadByte(); err != nil {
+				break
+			}
+			if c == '"' {
+				_ = d.r.UnreadByte()
+				err = d.captureString(&buf)
+				continue
+			}
+			buf.WriteByte(c)
+			err = d.checkMetaSize(&buf)
+			if c == '{' || c == '[' {
+				depth++
+			} else if c == '}' || c == ']' {
+				if depth--; depth == 0 {
+					break
+				}
+			}
+		}
+	default:
+		// Literal or number, delimited by a structural character or whitespace
+		for err == nil {
+			if c, err = d.r.ReadByte(); err == io.EOF {
+				err = nil
+				break
+			} else if err != nil {
+				break
+			}
+			if strings.IndexByte(" \t\n\r,}]", c) >= 0 {
+				err = d.r.UnreadByte()
+				break
+			}
+			buf.WriteByte(c)
+			err = d.checkMetaSize(&buf)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	d.metaSize += buf.Len()
+	return buf.Bytes(), nil
+}
+
+func (d *submitDecoder) captureString(buf *bytes.Buffer) error {
+	if c, err := d.r.ReadByte(); err != nil {
+		return err
+	} else {
+		buf.WriteByte(c)
+	}
+	escaped := false
+	for {
+		c, err := d.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		buf.WriteByte(c)
+		if err := d.checkMetaSize(buf); err != nil {
+			return err
+		}
+		if escaped {
+			escaped = false
+		} else if c == '\\' {
+			escaped = true
+		} else if c == '"' {
+			return nil
+		}
+	}
+}
+
+func (d *submitDecoder) checkMetaSize(buf *bytes.Buffer) error {
+	if d.metaSize+buf.Len() > MAX_SUBMIT_METADATA_SIZE {
+		return errMetadataTooLarge
+	}
+	return nil
+}
+
+// base64Decoder decodes standard base64 written into it character by
+// character, in chunks of BLOCK_DECODE_CHUNK_SIZE characters
+type base64Decoder struct {
+	w      io.Writer
+	chars  []byte
+	out    []byte
+	n      int64 // number of decoded bytes written
+	padded bool
+}
+
+func newBase64Decoder(w io.Writer) *base64Decoder {
+	return &base64Decoder{
+		w:     w,
+		chars: make([]byte, 0, BLOCK_DECODE_CHUNK_SIZE),
+		out:   make([]byte, base64.StdEncoding.DecodedLen(BLOCK_DECODE_CHUNK_SIZE)),
+	}
+}
+
+func (b *base64Decoder) WriteByte(c byte) error {
+	// Skipped by base64.StdEncoding as well
+	if c == '\r' || c == '\n' {
+		return nil
+	}
+	if b.padded {
+		return errors.New("illegal base64 data after padding")
+	}
+	b.chars = append(b.chars, c)
+	if len(b.chars) == cap(b.chars) {
+		return b.flush()
+	}
+	return nil
+}
+
+// Close decodes the rest of characters
+func (b *base64Decoder) Close() error {
+	if len(b.chars) == 0 {
+		return nil
+	}
+	return b.flush()
+}
+
+func (b *base64Decoder) flush() error {
+	n, err := base64.StdEncoding.Decode(b.out, b.chars)
+	if err != nil {
+		return err
+	}
+	// Padding can only be at the end of a chunk, as chunks are of whole quads
+	b.padded = b.chars[len(b.chars)-1] == '='
+	b.chars = b.chars[:0]
+	if _, err := b.w.Write(b.out[:n]); err != nil {
+		return fmt.Errorf("%w: %v", errBlockSpool, err)
+	}
+	b.n += int64(n)
+	return nil
+}
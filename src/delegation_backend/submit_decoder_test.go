@@ -0,0 +1,128 @@
+package delegation_backend
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+func TestDecodeSubmitV1(t *testing.T) {
+	for _, f := range []string{"req-no-snark", "req-with-snark"} {
+		body := readTestFile(f, t)
+		var expected submitRequest
+		if err := json.Unmarshal(body, &expected); err != nil {
+			t.Fatalf("failed decoding test file %s", f)
+		}
+		payload, err := expected.Data.MakeSignPayload()
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := decodeSubmit(bytes.NewReader(body), SUBMIT_API_V1, t.TempDir())
+		if err != nil {
+			t.Fatalf("%s: %v", f, err)
+		}
+		if req.signHash != blake2b.Sum256(payload) {
+			t.Fatalf("%s: hash of the sign payload differs from the one of MakeSignPayload", f)
+		}
+		if req.block.Hash() != expected.GetBlockDataHash() || req.Submitter != expected.Submitter ||
+			req.Data.PeerId != expected.Data.PeerId || !req.Data.CreatedAt.Equal(expected.Data.CreatedAt) {
+			t.Fatalf("%s: decoded submission differs", f)
+		}
+		block, err := readObject(req.block.Source())
+		if err != nil || !bytes.Equal(block, expected.Data.Block.data) {
+			t.Fatalf("%s: spooled block differs: %v", f, err)
+		}
+		spooled := req.block.file.Name()
+		if err := req.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(spooled); !os.IsNotExist(err) {
+			t.Fatalf("%s: spooled block wasn't removed", f)
+		}
+	}
+}
+
+func TestDecodeSubmitBlock(t *testing.T) {
+	var expected submitRequest
+	if err := json.Unmarshal(readTestFile("req-no-snark", t), &expected); err != nil {
+		t.Fatal("failed decoding test file")
+	}
+	// Spans several chunks, with padding at the end
+	block := make([]byte, 3*BLOCK_DECODE_CHUNK_SIZE+1)
+	_, _ = rand.New(rand.NewSource(0)).Read(block)
+	encoded := base64.StdEncoding.EncodeToString(block)
+	escaped := strings.ReplaceAll(encoded, "/", `\/`)
+	submitter, _ := json.Marshal(expected.Submitter)
+	sig, _ := json.Marshal(expected.Sig)
+	// Block is the last field, and escaped as some encoders do
+	data := `{"peer_id":"p","created_at":"2021-07-17T22:39:48Z","block":"` + escaped + `"}`
+	body := `{"submitter":` + string(submitter) + `,"data":` + data + `,"signature":` + string(sig) + `}`
+
+	req, err := decodeSubmit(strings.NewReader(body), SUBMIT_API_V1, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer req.Close()
+	var inMemory submitRequestData
+	if err := json.Unmarshal([]byte(data), &inMemory); err != nil {
+		t.Fatal(err)
+	}
+	payload, _ := inMemory.MakeSignPayload()
+	if req.signHash != blake2b.Sum256(payload) || req.block.hash != blake2b.Sum256(block) {
+		t.Fatal("unexpected hashes of a large block")
+	}
+	if spooled, err := readObject(req.block.Source()); err != nil || !bytes.Equal(spooled, block) {
+		t.Fatalf("spooled block differs: %v", err)
+	}
+
+	// v2 signs the canonical form of data, with the block unescaped
+	v2Body := `{"version":2,"submitter":` + string(submitter) + `,"signature":` + string(sig) + `,"data":` + data + `}`
+	v2Req, err := decodeSubmit(strings.NewReader(v2Body), SUBMIT_API_V2, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v2Req.Close()
+	canonical, _ := CanonicalJSON([]byte(data))
+	if v2Req.signHash != blake2b.Sum256(canonical) {
+		t.Fatal("hash of v2 sign payload differs from the one of canonical JSON")
+	}
+}
+
+func TestDecodeSubmitErrors(t *testing.T) {
+	tempDir := t.TempDir()
+	for _, body := range []string{
+		`{"data":{"block":"AQ==","block":"AQ=="}}`,
+		`{"data":{"block":"AQ","peer_id":"p"}}`,
+		`{"data":{"block":"AQ==AQ==","peer_id":"p"}}`,
+		`{"data":{"block":"AéQ=","peer_id":"p"}}`,
+		`{"data":{"Block":"AQ=="}}`,
+		`{"data":{"block":1}}`,
+		`{"data":{"block":"AQ=="},"data":{}}`,
+		`{"data":{"block":"AQ=="}} {}`,
+		`{"data":{"block":"AQ=="}`,
+		`{"data":{"block":"AQ==`,
+		`{"submitter" 1}`,
+		`[]`,
+	} {
+		if _, err := decodeSubmit(strings.NewReader(body), SUBMIT_API_V1, tempDir); err == nil {
+			t.Fatalf("expected error for %s", body)
+		}
+	}
+	large := `{"data":{"peer_id":"` + strings.Repeat("p", MAX_SUBMIT_METADATA_SIZE) + `"}}`
+	if _, err := decodeSubmit(strings.NewReader(large), SUBMIT_API_V1, tempDir); !errors.Is(err, errMetadataTooLarge) {
+		t.Fatalf("expected metadata to be too large, got %v", err)
+	}
+	if _, err := decodeSubmit(strings.NewReader(`{"data":{"block":"AQ=="}}`), SUBMIT_API_V1, tempDir+"/missing"); !errors.Is(err, errBlockSpool) {
+		t.Fatalf("expected spool error, got %v", err)
+	}
+	if entries, _ := os.ReadDir(tempDir); len(entries) != 0 {
+		t.Fatal("spooled blocks of rejected submissions weren't removed")
+	}
+}
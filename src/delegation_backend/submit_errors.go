@@ -0,0 +1,34 @@
+package delegation_backend
+
+// ErrorCode identifies the reason a submission is rejected in the `code`
+// field of the error response. Codes are part of the API and must not change,
+// unlike the messages that accompany them.
+type ErrorCode string
+
+const (
+	ERR_SERVICE_NOT_READY            ErrorCode = "SERVICE_NOT_READY"
+	ERR_UNSUPPORTED_VERSION          ErrorCode = "UNSUPPORTED_VERSION"
+	ERR_UNSUPPORTED_ENCODING         ErrorCode = "UNSUPPORTED_ENCODING"
+	ERR_PAYLOAD_TOO_LARGE            ErrorCode = "PAYLOAD_TOO_LARGE"
+	ERR_BODY_READ_FAILED             ErrorCode = "BODY_READ_FAILED"
+	ERR_DECOMPRESSION_FAILED         ErrorCode = "DECOMPRESSION_FAILED"
+	ERR_MALFORMED_PAYLOAD            ErrorCode = "MALFORMED_PAYLOAD"
+	ERR_MISSING_FIELDS               ErrorCode = "MISSING_FIELDS"
+	ERR_INVALID_BLOCK                ErrorCode = "INVALID_BLOCK"
+	ERR_SUBMISSION_DENIED            ErrorCode = "SUBMISSION_DENIED"
+	ERR_SUBMITTER_NOT_WHITELISTED    ErrorCode = "SUBMITTER_NOT_WHITELISTED"
+	ERR_OUTSIDE_VALIDITY_WINDOW      ErrorCode = "OUTSIDE_VALIDITY_WINDOW"
+	ERR_NETWORK_NOT_ALLOWED          ErrorCode = "NETWORK_NOT_ALLOWED"
+	ERR_CREATED_AT_IN_FUTURE         ErrorCode = "CREATED_AT_IN_FUTURE"
+	ERR_CREATED_AT_TOO_OLD           ErrorCode = "CREATED_AT_TOO_OLD"
+	ERR_VERIFIER_UNAVAILABLE         ErrorCode = "VERIFIER_UNAVAILABLE"
+	ERR_INVALID_SIGNATURE            ErrorCode = "INVALID_SIGNATURE"
+	ERR_DUPLICATE_SUBMISSION         ErrorCode = "DUPLICATE_SUBMISSION"
+	ERR_RATE_LIMITED                 ErrorCode = "RATE_LIMITED"
+	ERR_IP_RATE_LIMITED              ErrorCode = "IP_RATE_LIMITED"
+	ERR_GLOBAL_RATE_LIMITED          ErrorCode = "GLOBAL_RATE_LIMITED"
+	ERR_TOO_MANY_CONCURRENT_REQUESTS ErrorCode = "TOO_MANY_CONCURRENT_REQUESTS"
+	ERR_RATE_LIMITER_UNAVAILABLE     ErrorCode = "RATE_LIMITER_UNAVAILABLE"
+	ERR_STORAGE_UNAVAILABLE          ErrorCode = "STORAGE_UNAVAILABLE"
+	ERR_INTERNAL_ERROR               ErrorCode = "INTERNAL_ERROR"
+)
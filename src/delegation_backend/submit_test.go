@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"math/rand"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -46,16 +48,12 @@ func TestSignPayloadGeneration(t *testing.T) {
 	}
 }
 
-func testSubmitH(maxAttempt int, initWl Whitelist) (*ObjectsToSave, *SubmitH, *timeMock) {
-	storage := make(ObjectsToSave)
+func testSubmitH(maxAttempt int, initWl Whitelist) (*map[string][]byte, *SubmitH, *timeMock) {
+	storage := make(map[string][]byte)
 	log := logging.Logger("delegation backend test")
 	app := new(App)
 	app.Log = log
-	app.Save = func(objs ObjectsToSave) {
-		for path, value := range objs {
-			storage[path] = value
-		}
-	}
+	app.Storage = &memoryStorage{objs: storage}
 	counter, tm := newTestAttemptCounter(1)
 	app.SubmitCounter = counter
 	app.Now = tm.Now
@@ -63,6 +61,7 @@ func testSubmitH(maxAttempt int, initWl Whitelist) (*ObjectsToSave, *SubmitH, *t
 	wlMvar.Replace(&initWl)
 	app.Whitelist = wlMvar
 	app.NetworkId = 1
+	app.IsReady.Store(true)
 	return &storage, app.NewSubmitH(), tm
 }
 
@@ -97,16 +96,34 @@ func TestWrongLengthProvided(t *testing.T) {
 	}
 }
 
-func TestNoLengthProvided(t *testing.T) {
+func TestChunkedBody(t *testing.T) {
 	body := readTestFile("req-no-snark", t)
-	_, sh, _ := testSubmitH(1, Whitelist{})
+	var req submitRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal("failed decoding test file")
+	}
+	objs, sh, tm := testSubmitH(1, Whitelist{req.Submitter: {}})
 	rep := httptest.NewRecorder()
-	req := httptest.NewRequest("POST", v1Submit, bytes.NewReader(body))
-	req.ContentLength = -1
-	sh.ServeHTTP(rep, req)
-	if rep.Code != 411 {
-		t.Log(rep)
-		t.FailNow()
+	r := httptest.NewRequest("POST", v1Submit, bytes.NewReader(body))
+	r.ContentLength = -1
+	sh.ServeHTTP(rep, r)
+	if rep.Code != 200 {
+		t.Fatalf("unexpected response: %v", rep)
+	}
+	paths := makePaths(tm.Now(), req.GetBlockDataHash(), req.Submitter)
+	if !bytes.Equal((*objs)[paths.Block], req.Data.Block.data) {
+		t.Fatal("saved block differs from the submitted one")
+	}
+
+	// Size of a chunked body is only known once it's read
+	req.Data.Block = mkB64B(make([]byte, MAX_SUBMIT_PAYLOAD_SIZE))
+	large, _ := json.Marshal(req)
+	rep = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", v1Submit, bytes.NewReader(large))
+	r.ContentLength = -1
+	sh.ServeHTTP(rep, r)
+	if rep.Code != 413 {
+		t.Fatalf("expected 413, got %v", rep)
 	}
 }
 
@@ -140,6 +157,15 @@ func TestUnauthorized(t *testing.T) {
 		t.Log(rep)
 		t.FailNow()
 	}
+	expectErrorCode(rep, ERR_SUBMITTER_NOT_WHITELISTED, t)
+}
+
+func expectErrorCode(rep *httptest.ResponseRecorder, code ErrorCode, t *testing.T) {
+	t.Helper()
+	var resp errorResponse
+	if err := json.Unmarshal(rep.Body.Bytes(), &resp); err != nil || resp.Code != code {
+		t.Fatalf("expected error code %s, got: %s", code, rep.Body)
+	}
 }
 
 func TestPkLimitExceeded(t *testing.T) {
@@ -150,17 +176,23 @@ func TestPkLimitExceeded(t *testing.T) {
 		t.FailNow()
 	}
 	otherSubmitter := mkPk()
-	_, sh, _ := testSubmitH(1, Whitelist{req.Submitter: true, otherSubmitter: true})
+	_, sh, tm := testSubmitH(1, Whitelist{req.Submitter: {}, otherSubmitter: {}})
 	rep := sh.testRequest(body)
 	if rep.Code != 200 {
 		t.Logf("Unexpected failure: %v", rep)
 		t.FailNow()
 	}
+	tm.Advance(20 * time.Minute)
 	rep2 := sh.testRequest(body)
 	if rep2.Code != 429 {
 		t.Log(rep2)
 		t.FailNow()
 	}
+	expectErrorCode(rep2, ERR_RATE_LIMITED, t)
+	// The accepted attempt leaves the hour window in 40 minutes
+	if retryAfter := rep2.Header().Get("Retry-After"); retryAfter != "2400" {
+		t.Fatalf("unexpected Retry-After: %q", retryAfter)
+	}
 	req.Submitter = otherSubmitter
 	body2, err := json.Marshal(req)
 	if err != nil {
@@ -174,6 +206,40 @@ func TestPkLimitExceeded(t *testing.T) {
 	}
 }
 
+func TestWhitelistEntryPolicies(t *testing.T) {
+	body := readTestFile("req-no-snark", t)
+	var req submitRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Log("failed decoding test file")
+		t.FailNow()
+	}
+	_, _, tm := testSubmitH(1, Whitelist{})
+	now := tm.Now()
+	testCases := []struct {
+		name     string
+		entry    WhitelistEntry
+		expected []int
+	}{
+		{"no restrictions", WhitelistEntry{}, []int{200, 429}},
+		{"within window", WhitelistEntry{NotBefore: now.Add(-time.Hour), NotAfter: now.Add(time.Hour)}, []int{200}},
+		{"not yet valid", WhitelistEntry{NotBefore: now.Add(time.Second)}, []int{401}},
+		{"expired", WhitelistEntry{NotAfter: now}, []int{401}},
+		{"pinned network", WhitelistEntry{Network: "testnet"}, []int{200}},
+		{"other network", WhitelistEntry{Network: "mainnet"}, []int{401}},
+		{"custom hourly limit", WhitelistEntry{HourlyLimit: 3}, []int{200, 200, 200, 429}},
+	}
+	for _, tc := range testCases {
+		_, sh, _ := testSubmitH(1, Whitelist{req.Submitter: tc.entry})
+		sh.app.VerifySignatureDisabled = true
+		sh.app.NetworkName = "testnet"
+		for i, code := range tc.expected {
+			if rep := sh.testRequest(body); rep.Code != code {
+				t.Fatalf("%s: request %d: expected %d, got %v", tc.name, i, code, rep)
+			}
+		}
+	}
+}
+
 func TestSuccess(t *testing.T) {
 	testNames := []string{"req-no-snark", "req-with-snark"}
 	for _, f := range testNames {
@@ -183,7 +249,7 @@ func TestSuccess(t *testing.T) {
 			t.Logf("failed decoding test file %s", f)
 			t.FailNow()
 		}
-		objs, sh, tm := testSubmitH(1, Whitelist{req.Submitter: true})
+		objs, sh, tm := testSubmitH(1, Whitelist{req.Submitter: {}})
 		rep := sh.testRequest(body)
 		if rep.Code != 200 {
 			t.Logf("Failed testing %s: %v", f, rep)
@@ -195,7 +261,7 @@ func TestSuccess(t *testing.T) {
 		meta.CreatedAt = req.Data.CreatedAt.Format(time.RFC3339)
 		meta.PeerId = req.Data.PeerId
 		meta.SnarkWork = req.Data.SnarkWork
-		meta.RemoteAddr = "192.0.2.1:1234"
+		meta.RemoteAddr = "192.0.2.1"
 		meta.BlockHash = bhStr
 		meta.Submitter = req.Submitter
 		metaBytes, err2 := json.Marshal(meta)
@@ -207,6 +273,39 @@ func TestSuccess(t *testing.T) {
 	}
 }
 
+func TestStorageUnavailable(t *testing.T) {
+	body := readTestFile("req-no-snark", t)
+	var req submitRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Log("failed decoding test file")
+		t.FailNow()
+	}
+	_, sh, _ := testSubmitH(1, Whitelist{req.Submitter: {}})
+	sh.app.VerifySignatureDisabled = true
+	sh.app.Storage = &memoryStorage{objs: make(map[string][]byte), saveErr: errors.New("down")}
+	rep := sh.testRequest(body)
+	if rep.Code != 503 {
+		t.Log(rep)
+		t.FailNow()
+	}
+	var resp errorResponse
+	if err := json.Unmarshal(rep.Body.Bytes(), &resp); err != nil || !resp.Retryable || resp.Code != ERR_STORAGE_UNAVAILABLE {
+		t.Logf("Unexpected response body: %s", rep.Body)
+		t.FailNow()
+	}
+}
+
+func TestNotReady(t *testing.T) {
+	body := readTestFile("req-no-snark", t)
+	_, sh, _ := testSubmitH(1, Whitelist{})
+	sh.app.IsReady.Store(false)
+	rep := sh.testRequest(body)
+	if rep.Code != 503 {
+		t.Log(rep)
+		t.FailNow()
+	}
+}
+
 func Test40x(t *testing.T) {
 	body := readTestFile("req-with-snark", t)
 	var req submitRequest
@@ -214,7 +313,7 @@ func Test40x(t *testing.T) {
 		t.Log("failed decoding test file")
 		t.FailNow()
 	}
-	_, sh, tm := testSubmitH(1, Whitelist{req.Submitter: true})
+	_, sh, tm := testSubmitH(1, Whitelist{req.Submitter: {}})
 	//2. Malformed JSON
 	if rep := sh.testRequest([]byte("{}")); rep.Code != 400 {
 		t.Logf("Empty json test failed: %v", rep)
@@ -245,14 +344,38 @@ func Test40x(t *testing.T) {
 	req2 = req
 	req2.Sig = badSig
 	body2, err2 = json.Marshal(req2)
-	if rep := sh.testRequest(body2); err2 != nil || rep.Code != 401 {
+	rep := sh.testRequest(body2)
+	if err2 != nil || rep.Code != 401 {
 		t.Log("Bad signature check failed")
 		t.FailNow()
 	}
+	expectErrorCode(rep, ERR_INVALID_SIGNATURE, t)
 	//5. Created_at in the future
 	tm.Set1971()
-	if rep := sh.testRequest(body); rep.Code != 400 {
+	rep = sh.testRequest(body)
+	if rep.Code != 400 {
 		t.Logf("Failed to test created_at in future: %v", rep)
 		t.FailNow()
 	}
+	expectErrorCode(rep, ERR_CREATED_AT_IN_FUTURE, t)
+}
+
+func TestRequestId(t *testing.T) {
+	body := readTestFile("req-no-snark", t)
+	_, sh, _ := testSubmitH(1, Whitelist{})
+	first, second := sh.testRequest(body), sh.testRequest(body)
+	id := first.Header().Get(REQUEST_ID_HEADER)
+	if id == "" || id == second.Header().Get(REQUEST_ID_HEADER) {
+		t.Fatalf("expected distinct request IDs, got %q", id)
+	}
+	// ID set by a proxy is kept, unless it isn't a sane one
+	for header, expected := range map[string]bool{"nginx-1a2b.3": true, "": false, "a b": false, strings.Repeat("a", 65): false} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", v1Submit, bytes.NewReader(body))
+		req.Header.Set(REQUEST_ID_HEADER, header)
+		sh.ServeHTTP(rec, req)
+		if id := rec.Header().Get(REQUEST_ID_HEADER); (id == header) != expected || id == "" {
+			t.Fatalf("unexpected request ID %q for %q", id, header)
+		}
+	}
 }
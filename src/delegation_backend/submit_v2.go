@@ -0,0 +1,96 @@
+package delegation_backend
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Versions of the submit API schema
+const (
+	SUBMIT_API_V1 = 1
+	SUBMIT_API_V2 = 2
+)
+
+// Media type selecting the schema version regardless of the path
+// the submission is sent to, e.g. application/vnd.mina.submit.v2+json
+var submitMediaTypeRegexp = regexp.MustCompile(`^application/vnd\.mina\.submit\.v([0-9]+)\+json$`)
+
+var errSchemaVersion = errors.New("unsupported schema version")
+
+// Fields of the v2 schema absent in v1
+type submitRequestExtras struct {
+	NodeVersion     string `json:"node_version,omitempty"`
+	SyncStatus      string `json:"sync_status,omitempty"`
+	ProtocolVersion string `json:"protocol_version,omitempty"`
+}
+
+type submitRequestDataV2 struct {
+	submitRequestData
+	submitRequestExtras
+}
+
+type submitRequestV2 struct {
+	Version   int `json:"version"`
+	Submitter Pk  `json:"submitter"`
+	Sig       Sig `json:"signature"`
+}
+
+// Submission decoded from a request of any version of the schema,
+// the submit handler is agnostic of the version beyond decoding.
+type submitPayload struct {
+	submitRequest // Data.Block is always nil, the block is spooled instead
+	Extras        submitRequestExtras
+	Version       int
+	block         *spooledBlock
+	signHash      [32]byte // blake2b of the payload the signature is made over
+}
+
+// submitVersion returns the schema version of the request: the one of its
+// Content-Type if it's a versioned media type, otherwise the one of its path.
+// The second value is false if the version is not supported.
+func submitVersion(r *http.Request) (int, bool) {
+	version := SUBMIT_API_V1
+	if strings.HasPrefix(r.URL.Path, "/v2/") {
+		version = SUBMIT_API_V2
+	}
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil {
+		if m := submitMediaTypeRegexp.FindStringSubmatch(mediaType); m != nil {
+			// Versions too large to parse are unsupported anyway
+			version, _ = strconv.Atoi(m[1])
+		}
+	}
+	return version, version == SUBMIT_API_V1 || version == SUBMIT_API_V2
+}
+
+func (p *submitPayload) CheckRequiredFields() bool {
+	return p.block != nil && p.Data.PeerId != "" &&
+		p.Data.CreatedAt != nilTime && p.Submitter != nilPk && p.Sig != nilSig
+}
+
+// MakeMetaToBeSaved makes the submission's metadata, including fields
+// decoded from its block unless block is nil
+func (p *submitPayload) MakeMetaToBeSaved(origin RequestOrigin, block *BlockInfo) ([]byte, error) {
+	meta := p.makeMeta(origin.RemoteAddr, p.block.Hash())
+	meta.XForwardedFor = origin.XForwardedFor
+	meta.Forwarded = origin.Forwarded
+	meta.NodeVersion = p.Extras.NodeVersion
+	meta.SyncStatus = p.Extras.SyncStatus
+	meta.ProtocolVersion = p.Extras.ProtocolVersion
+	if block != nil {
+		meta.StateHash = block.StateHash
+		meta.Parent = block.Parent
+		meta.Height = block.Height
+		meta.Slot = block.Slot
+	}
+	return json.Marshal(meta)
+}
+
+// Close removes the spooled block
+func (p *submitPayload) Close() error {
+	return p.block.Close()
+}
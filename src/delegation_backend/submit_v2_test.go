@@ -0,0 +1,108 @@
+package delegation_backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-log/v2"
+	"golang.org/x/crypto/blake2b"
+)
+
+const v2Submit = "http://127.0.0.1/v2/submit"
+
+const TEST_V2_DATA = `{ "peer_id": "MLF0jAGTpL84LLerLddNs5M10NCHM+BwNeMxK78+", "created_at": "2021-07-17T22:39:48Z",
+	"block": "zLgvHQzxSh8MWlTjXK+cMA==", "node_version": "3.0.0", "sync_status": "SYNCED", "protocol_version": "3.0.0" }`
+const TEST_V2_SIGN_PAYLOAD = `{"block":"zLgvHQzxSh8MWlTjXK+cMA==","created_at":"2021-07-17T22:39:48Z","node_version":"3.0.0","peer_id":"MLF0jAGTpL84LLerLddNs5M10NCHM+BwNeMxK78+","protocol_version":"3.0.0","sync_status":"SYNCED"}`
+
+func testV2Body(version int, data string, t *testing.T) []byte {
+	var req submitRequest
+	if err := json.Unmarshal(readTestFile("req-no-snark", t), &req); err != nil {
+		t.Fatal("failed decoding test file")
+	}
+	submitter, _ := json.Marshal(req.Submitter)
+	sig, _ := json.Marshal(req.Sig)
+	return []byte(fmt.Sprintf(`{"version": %d, "submitter": %s, "signature": %s, "data": %s}`, version, submitter, sig, data))
+}
+
+func testRequestTo(h http.Handler, url string, contentType string, body []byte) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", url, bytes.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestSubmitV2(t *testing.T) {
+	storage, sh, _ := testSubmitH(1, Whitelist{})
+	sh.app.WhitelistDisabled = true
+	sh.app.SubmitCounter = NewAttemptCounter(10, 0)
+	sh.app.Metrics = NewMetrics()
+	var signed [][]byte
+	sh.app.Verifier = NewSignatureVerifier(1, -1, nil)
+	defer sh.app.Verifier.Close()
+	sh.app.Verifier.verify = func(pk *Pk, sig *Sig, data []byte, networkId uint8) bool {
+		signed = append(signed, append([]byte(nil), data...))
+		return true
+	}
+
+	if rep := testRequestTo(sh, v2Submit, "application/json", testV2Body(2, TEST_V2_DATA, t)); rep.Code != 200 {
+		t.Fatalf("unexpected response: %v", rep)
+	}
+	expectedHash := blake2b.Sum256([]byte(TEST_V2_SIGN_PAYLOAD))
+	if len(signed) != 1 || !bytes.Equal(signed[0], expectedHash[:]) {
+		t.Fatal("signature wasn't verified over canonical JSON of data")
+	}
+	submission, err := objectToSaveToSubmission(objectsOf(*storage), log.Logger("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if submission.NodeVersion != "3.0.0" || submission.SyncStatus != "SYNCED" || submission.ProtocolVersion != "3.0.0" ||
+		submission.PeerId != "MLF0jAGTpL84LLerLddNs5M10NCHM+BwNeMxK78+" {
+		t.Fatalf("unexpected submission saved: %+v", submission)
+	}
+
+	// Media type selects the schema regardless of the path
+	if rep := testRequestTo(sh, v1Submit, "application/vnd.mina.submit.v2+json", testV2Body(2, TEST_V2_DATA, t)); rep.Code != 200 {
+		t.Fatalf("unexpected response: %v", rep)
+	}
+	if rep := testRequestTo(sh, v2Submit, "application/vnd.mina.submit.v1+json", readTestFile("req-no-snark", t)); rep.Code != 200 {
+		t.Fatalf("unexpected response: %v", rep)
+	}
+	if rep := testRequestTo(sh, v2Submit, "application/vnd.mina.submit.v3+json", testV2Body(2, TEST_V2_DATA, t)); rep.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected 415, got %v", rep)
+	}
+
+	for _, body := range [][]byte{
+		testV2Body(3, TEST_V2_DATA, t),
+		readTestFile("req-no-snark", t),
+	} {
+		if rep := testRequestTo(sh, v2Submit, "", body); rep.Code != http.StatusBadRequest ||
+			!strings.Contains(rep.Body.String(), "Unsupported schema version") {
+			t.Fatalf("expected unsupported schema version, got %v", rep)
+		}
+	}
+	for _, data := range []string{
+		`{"peer_id": "p", "created_at": "2021-07-17T22:39:48Z", "block": "AQ==", "unknown": 1}`,
+		`{"peer_id": "p", "peer_id": "q", "created_at": "2021-07-17T22:39:48Z", "block": "AQ=="}`,
+	} {
+		if rep := testRequestTo(sh, v2Submit, "", testV2Body(2, data, t)); rep.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400 for %s, got %v", data, rep)
+		}
+	}
+	if rep := testRequestTo(sh, v2Submit, "", testV2Body(2, `{"peer_id": "p"}`, t)); rep.Code != http.StatusBadRequest ||
+		!strings.Contains(rep.Body.String(), "required fields") {
+		t.Fatalf("expected missing fields, got %v", rep)
+	}
+
+	metrics := scrapeMetrics(sh.app.Metrics, t)
+	expectMetric(metrics, `delegation_backend_submit_requests_by_version_total{version="2"} 3`, t)
+	expectMetric(metrics, `delegation_backend_submit_requests_by_version_total{version="1"} 1`, t)
+	expectMetric(metrics, `delegation_backend_submit_rejections_total{reason="unsupported_version"} 3`, t)
+}
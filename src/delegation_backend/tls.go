@@ -0,0 +1,106 @@
+package delegation_backend
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+// Interval of checking certificate files for changes
+const TLS_CERT_POLL_INTERVAL = 30 * time.Second
+
+// CertReloader serves a certificate loaded from files, reloading it
+// whenever they change so that renewed certificates are used without
+// a restart.
+type CertReloader struct {
+	CertFile string
+	KeyFile  string
+	Log      logging.StandardLogger
+	cert     atomic.Pointer[tls.Certificate]
+}
+
+// NewCertReloader loads the certificate, failing if it can't be loaded.
+func NewCertReloader(certFile, keyFile string, log logging.StandardLogger) (*CertReloader, error) {
+	c := &CertReloader{CertFile: certFile, KeyFile: keyFile, Log: log}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload loads the certificate, keeping the previous one if it fails.
+func (c *CertReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return fmt.Errorf("error loading TLS certificate %s: %w", c.CertFile, err)
+	}
+	c.cert.Store(&cert)
+	return nil
+}
+
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
+
+// Run reloads the certificate whenever its files change until ctx is done.
+// Certificate and key are usually replaced one after another, a failed
+// reload in between is retried once the other file changes.
+func (c *CertReloader) Run(ctx context.Context, interval time.Duration) {
+	certChanges := watchFile(ctx, c.CertFile, interval, c.Log)
+	keyChanges := watchFile(ctx, c.KeyFile, interval, c.Log)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-certChanges:
+		case <-keyChanges:
+		}
+		if err := c.Reload(); err != nil {
+			c.Log.Errorf("Failed to reload TLS certificate, using previous one, error: %v", err)
+		} else {
+			c.Log.Infof("Reloaded TLS certificate %s", c.CertFile)
+		}
+	}
+}
+
+// NewServerTLSConfig makes configuration of the server serving certificate
+// of the reloader. With a client CA, client certificates signed by it are
+// verified if presented, for RequireClientCert to check.
+func NewServerTLSConfig(cfg *TLSConfig, certs *CertReloader) (*tls.Config, error) {
+	res := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.GetCertificate,
+	}
+	if cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading client CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA file %s", cfg.ClientCAFile)
+		}
+		res.ClientCAs = pool
+		res.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return res, nil
+}
+
+// RequireClientCert rejects requests made without a verified client
+// certificate, which is only the case with TLS and a client CA configured.
+func RequireClientCert(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			writeAdminError(w, http.StatusForbidden, "Client certificate required")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
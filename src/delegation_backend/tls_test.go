@@ -0,0 +1,174 @@
+package delegation_backend
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+// Certificate for name signed by parent, self-signed CA if parent is nil
+func testCert(name string, parent *tls.Certificate, t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	signer, signerCert := any(key), tmpl
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerCert = parent.PrivateKey, parent.Leaf
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signerCert, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func writeTestCert(cert tls.Certificate, certFile, keyFile string, t *testing.T) {
+	keyDer, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if keyFile == "" {
+		return
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func servedSerial(c *CertReloader) *big.Int {
+	cert, _ := c.GetCertificate(nil)
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	return leaf.SerialNumber
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	log := logging.Logger("test")
+	if _, err := NewCertReloader(certFile, keyFile, log); err == nil {
+		t.Fatal("expected missing certificate to fail")
+	}
+	first := testCert("first", nil, t)
+	writeTestCert(first, certFile, keyFile, t)
+	c, err := NewCertReloader(certFile, keyFile, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if servedSerial(c).Cmp(first.Leaf.SerialNumber) != 0 {
+		t.Fatal("unexpected certificate served")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx, 10*time.Millisecond)
+	// Renewed certificate is picked up
+	time.Sleep(50 * time.Millisecond)
+	second := testCert("second", nil, t)
+	writeTestCert(second, certFile, keyFile, t)
+	for deadline := time.Now().Add(5 * time.Second); servedSerial(c).Cmp(second.Leaf.SerialNumber) != 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("certificate was not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Certificate not matching the key is not used
+	writeTestCert(testCert("third", nil, t), certFile, "", t)
+	if err := c.Reload(); err == nil {
+		t.Fatal("expected mismatched certificate and key to fail")
+	}
+	if servedSerial(c).Cmp(second.Leaf.SerialNumber) != 0 {
+		t.Fatal("expected previous certificate to be kept")
+	}
+}
+
+func TestRequireClientCert(t *testing.T) {
+	dir := t.TempDir()
+	ca := testCert("ca", nil, t)
+	caFile, certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(ca, caFile, "", t)
+	writeTestCert(testCert("server", &ca, t), certFile, keyFile, t)
+	certs, err := NewCertReloader(certFile, keyFile, logging.Logger("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsCfg, err := NewServerTLSConfig(&TLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile}, certs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/admin/", RequireClientCert(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {})
+	server := &http.Server{Handler: mux, TLSConfig: tlsCfg}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeTLS(ln, "", "")
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	get := func(path string, clientCerts []tls.Certificate) *http.Response {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: clientCerts},
+			ForceAttemptHTTP2: true,
+		}}
+		resp, err := client.Get("https://" + ln.Addr().String() + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	if resp := get("/health", nil); resp.StatusCode != 200 || resp.ProtoMajor != 2 {
+		t.Fatalf("unexpected response without client certificate: %v, %s", resp.StatusCode, resp.Proto)
+	}
+	if resp := get("/admin/whitelist", nil); resp.StatusCode != 403 {
+		t.Fatalf("expected 403 without client certificate, got %v", resp.StatusCode)
+	}
+	if resp := get("/admin/whitelist", []tls.Certificate{testCert("client", &ca, t)}); resp.StatusCode != 200 {
+		t.Fatalf("expected client certificate to be accepted, got %v", resp.StatusCode)
+	}
+	// Certificate of another CA isn't accepted, clients don't even send it
+	if resp := get("/admin/whitelist", []tls.Certificate{testCert("other", nil, t)}); resp.StatusCode != 403 {
+		t.Fatalf("expected certificate of another CA to be rejected, got %v", resp.StatusCode)
+	}
+
+	if _, err := NewServerTLSConfig(&TLSConfig{ClientCAFile: keyFile}, certs); err == nil {
+		t.Fatal("expected file without certificates to be rejected as client CA")
+	}
+}
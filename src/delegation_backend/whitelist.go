@@ -1,9 +1,37 @@
 package delegation_backend
 
-import "sync"
+import (
+	"sync"
+	"time"
+)
 
-type unit = interface{}
-type Whitelist map[Pk]unit
+// WhitelistEntry holds metadata and per-key policies of a whitelisted key.
+// Zero values of the fields mean no restriction.
+type WhitelistEntry struct {
+	Label       string    // name of the operator, for logs
+	NotBefore   time.Time // submissions are accepted starting from NotBefore
+	NotAfter    time.Time // submissions are accepted until NotAfter (exclusive)
+	HourlyLimit int       // overrides REQUESTS_PER_PK_HOURLY for the key
+	Network     string    // the only network submissions are accepted for
+}
+
+type Whitelist map[Pk]WhitelistEntry
+
+// ValidAt checks whether t is within the validity window of the entry.
+func (e WhitelistEntry) ValidAt(t time.Time) bool {
+	if !e.NotBefore.IsZero() && t.Before(e.NotBefore) {
+		return false
+	}
+	if !e.NotAfter.IsZero() && !t.Before(e.NotAfter) {
+		return false
+	}
+	return true
+}
+
+// AllowsNetwork checks whether the entry accepts submissions for the network.
+func (e WhitelistEntry) AllowsNetwork(networkName string) bool {
+	return e.Network == "" || e.Network == networkName
+}
 
 type WhitelistMVar struct {
 	whitelistMutex sync.RWMutex
@@ -0,0 +1,113 @@
+package delegation_backend
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type OverrideAction string
+
+const (
+	// Key is accepted whether it's in the whitelist or not
+	OverrideAllow OverrideAction = "allow"
+	// Key is rejected whether it's in the whitelist or not
+	OverrideDeny OverrideAction = "deny"
+)
+
+// WhitelistOverride is a temporary decision about a key
+// taking precedence over the whitelist loaded from its source.
+type WhitelistOverride struct {
+	Action    OverrideAction
+	Reason    string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// WhitelistOverrides holds overrides set through the admin API.
+// Overrides are kept in memory only and are lost on restart.
+// Reading methods (Get, List and Lookup) are safe to call on a nil
+// *WhitelistOverrides, which holds no overrides; Set and Remove need one
+// created with NewWhitelistOverrides.
+type WhitelistOverrides struct {
+	mutex     sync.RWMutex
+	overrides map[Pk]WhitelistOverride
+}
+
+func NewWhitelistOverrides() *WhitelistOverrides {
+	return &WhitelistOverrides{overrides: make(map[Pk]WhitelistOverride)}
+}
+
+func (o *WhitelistOverrides) Set(pk Pk, override WhitelistOverride) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.overrides[pk] = override
+}
+
+// Remove deletes the override of the key, returns false if there was none.
+func (o *WhitelistOverrides) Remove(pk Pk) bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	_, has := o.overrides[pk]
+	delete(o.overrides, pk)
+	return has
+}
+
+// Get returns the override of the key in effect at the given time.
+func (o *WhitelistOverrides) Get(pk Pk, now time.Time) (WhitelistOverride, bool) {
+	if o == nil {
+		return WhitelistOverride{}, false
+	}
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+	override, has := o.overrides[pk]
+	if !has || !now.Before(override.ExpiresAt) {
+		return WhitelistOverride{}, false
+	}
+	return override, true
+}
+
+// List returns overrides in effect at the given time, ordered by expiry,
+// dropping the expired ones.
+func (o *WhitelistOverrides) List(now time.Time) ([]Pk, []WhitelistOverride) {
+	if o == nil {
+		return nil, nil
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	pks := make([]Pk, 0, len(o.overrides))
+	for pk, override := range o.overrides {
+		if !now.Before(override.ExpiresAt) {
+			delete(o.overrides, pk)
+			continue
+		}
+		pks = append(pks, pk)
+	}
+	sort.Slice(pks, func(i, j int) bool {
+		return o.overrides[pks[i]].ExpiresAt.Before(o.overrides[pks[j]].ExpiresAt)
+	})
+	res := make([]WhitelistOverride, len(pks))
+	for i, pk := range pks {
+		res[i] = o.overrides[pk]
+	}
+	return pks, res
+}
+
+// Lookup resolves whether a key is accepted at the given time, taking the
+// overrides into account. An allowed key not present in the whitelist
+// gets an entry without restrictions. Entry of an allowed key present in
+// the whitelist has its validity window and network pin lifted,
+// keeping the label and hourly limit.
+func (o *WhitelistOverrides) Lookup(wl *Whitelist, pk Pk, now time.Time) (entry WhitelistEntry, accepted bool, override *WhitelistOverride) {
+	if wl != nil {
+		entry, accepted = (*wl)[pk]
+	}
+	ov, has := o.Get(pk, now)
+	if !has {
+		return entry, accepted, nil
+	}
+	if ov.Action == OverrideDeny {
+		return entry, false, &ov
+	}
+	return WhitelistEntry{Label: entry.Label, HourlyLimit: entry.HourlyLimit}, true, &ov
+}
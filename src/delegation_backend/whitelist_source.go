@@ -0,0 +1,515 @@
+package delegation_backend
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+	"google.golang.org/api/option"
+	sheets "google.golang.org/api/sheets/v4"
+)
+
+// Types of whitelist sources
+const (
+	WHITELIST_SOURCE_SHEETS     = "sheets"
+	WHITELIST_SOURCE_FILE       = "file"
+	WHITELIST_SOURCE_HTTP       = "http"
+	WHITELIST_SOURCE_POSTGRESQL = "postgresql"
+)
+
+const WHITELIST_FILE_POLL_INTERVAL = 5 * time.Second
+const WHITELIST_HTTP_TIMEOUT = time.Minute
+const MAX_WHITELIST_DOCUMENT_SIZE = 32 * 1024 * 1024 // 32MB
+const DEFAULT_WHITELIST_TABLE_COLUMN = "public_key"
+
+// Attempts to load the whitelist from Google Sheets on startup, when failing
+// to load it is fatal, and on every refresh, when the previous one is kept
+const WHITELIST_SHEETS_INITIAL_RETRIES = 1
+const WHITELIST_SHEETS_REFRESH_RETRIES = 10
+
+// WhitelistSource is a place the delegation whitelist is loaded from.
+type WhitelistSource interface {
+	// Name identifies the source in logs.
+	Name() string
+	// Load retrieves the current whitelist along with
+	// issues found in rows that were left out of it.
+	Load(ctx context.Context) (Whitelist, []WhitelistIssue, error)
+}
+
+// SourceWatcher is implemented by whitelist and denylist sources able
+// to notice their contents have changed, so the list can be reloaded
+// without waiting for the refresh interval.
+type SourceWatcher interface {
+	// Changes returns a channel receiving a value whenever the source
+	// changes. The channel is not closed, watching stops when ctx is done.
+	Changes(ctx context.Context) <-chan struct{}
+}
+
+// NewWhitelistSource creates the whitelist source configured in appCfg.
+// Google Sheets is used when no source is configured explicitly.
+func NewWhitelistSource(ctx context.Context, appCfg AppConfig, log *logging.ZapEventLogger) (WhitelistSource, error) {
+	cfg := appCfg.WhitelistSource
+	if cfg == nil {
+		cfg = &WhitelistSourceConfig{Type: WHITELIST_SOURCE_SHEETS}
+	}
+	switch cfg.Type {
+	case WHITELIST_SOURCE_SHEETS, "":
+		service, err := sheets.NewService(ctx, option.WithScopes(sheets.SpreadsheetsReadonlyScope))
+		if err != nil {
+			return nil, fmt.Errorf("error creating Sheets service: %w", err)
+		}
+		return &SheetsWhitelistSource{
+			Service:        service,
+			AppCfg:         appCfg,
+			Retries:        WHITELIST_SHEETS_INITIAL_RETRIES,
+			RefreshRetries: WHITELIST_SHEETS_REFRESH_RETRIES,
+			Log:            log,
+		}, nil
+	case WHITELIST_SOURCE_FILE:
+		if cfg.Path == "" {
+			return nil, errors.New("whitelist file path is not set")
+		}
+		return &FileWhitelistSource{Path: cfg.Path, PollInterval: WHITELIST_FILE_POLL_INTERVAL, Log: log}, nil
+	case WHITELIST_SOURCE_HTTP:
+		if cfg.URL == "" {
+			return nil, errors.New("whitelist URL is not set")
+		}
+		return &HTTPWhitelistSource{URL: cfg.URL, Client: &http.Client{Timeout: WHITELIST_HTTP_TIMEOUT}}, nil
+	case WHITELIST_SOURCE_POSTGRESQL:
+		pgCfg := cfg.PostgreSQL
+		if pgCfg == nil {
+			pgCfg = appCfg.PostgreSQL
+		}
+		if pgCfg == nil {
+			return nil, errors.New("whitelist PostgreSQL connection is not configured")
+		}
+		column := cfg.Column
+		if column == "" {
+			column = DEFAULT_WHITELIST_TABLE_COLUMN
+		}
+		db, err := NewPostgreSQL(pgCfg)
+		if err != nil {
+			return nil, err
+		}
+		source, err := NewPostgreSQLWhitelistSource(db, cfg.Table, column)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		return source, nil
+	}
+	return nil, fmt.Errorf("unknown whitelist source %q", cfg.Type)
+}
+
+// SheetsWhitelistSource loads the whitelist from a column
+// of the delegation program spreadsheet. Requests are made Retries times
+// until the whitelist is loaded for the first time, RefreshRetries times
+// after that.
+type SheetsWhitelistSource struct {
+	Service        *sheets.Service
+	AppCfg         AppConfig
+	Retries        int
+	RefreshRetries int
+	Log            *logging.ZapEventLogger
+
+	loaded atomic.Bool
+}
+
+func (s *SheetsWhitelistSource) Name() string {
+	return WHITELIST_SOURCE_SHEETS
+}
+
+func (s *SheetsWhitelistSource) Load(_ context.Context) (Whitelist, []WhitelistIssue, error) {
+	retries := s.Retries
+	if s.loaded.Load() {
+		retries = s.RefreshRetries
+	}
+	wl, issues, err := RetrieveWhitelist(s.Service, s.Log, s.AppCfg, retries)
+	if err == nil {
+		s.loaded.Store(true)
+	}
+	return wl, issues, err
+}
+
+// FileWhitelistSource loads the whitelist from a local file. Files with
+// .json extension hold an array of public keys or entry objects, any other
+// file is read as CSV with public keys in the first column and, if there is
+// a header row, entries' metadata in the columns named in it. The file is
+// polled for changes every PollInterval and reloaded as soon as it's modified.
+type FileWhitelistSource struct {
+	Path         string
+	PollInterval time.Duration
+	Log          logging.StandardLogger
+}
+
+func (s *FileWhitelistSource) Name() string {
+	return WHITELIST_SOURCE_FILE
+}
+
+func (s *FileWhitelistSource) Load(_ context.Context) (Whitelist, []WhitelistIssue, error) {
+	file, err := os.Open(s.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	if strings.EqualFold(filepath.Ext(s.Path), ".json") {
+		wl, issues, err := loadJSONWhitelist(file)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading whitelist file %s: %w", s.Path, err)
+		}
+		return wl, issues, nil
+	}
+	rows, err := readCSVWhitelist(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading whitelist file %s: %w", s.Path, err)
+	}
+	wl, issues := processRows(rows)
+	return wl, issues, nil
+}
+
+func (s *FileWhitelistSource) Changes(ctx context.Context) <-chan struct{} {
+	return watchFile(ctx, s.Path, s.PollInterval, s.Log)
+}
+
+// Polls the file every interval, sending to the returned channel whenever
+// its modification time or size changes. Stops when ctx is done.
+func watchFile(ctx context.Context, path string, interval time.Duration, log logging.StandardLogger) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		lastModTime, lastSize := statFile(path)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			modTime, size := statFile(path)
+			if modTime.Equal(lastModTime) && size == lastSize {
+				continue
+			}
+			lastModTime, lastSize = modTime, size
+			log.Infof("File %s changed", path)
+			select {
+			case changes <- struct{}{}:
+			default: // a reload is already pending
+			}
+		}
+	}()
+	return changes
+}
+
+// Returns zero values if the file can't be accessed,
+// so that its reappearance is noticed as a change
+func statFile(path string) (time.Time, int64) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, -1
+	}
+	return info.ModTime(), info.Size()
+}
+
+// HTTPWhitelistSource loads the whitelist from a URL responding with
+// a JSON array of public keys or entry objects (same as a JSON file).
+type HTTPWhitelistSource struct {
+	URL    string
+	Client *http.Client
+}
+
+func (s *HTTPWhitelistSource) Name() string {
+	return WHITELIST_SOURCE_HTTP
+}
+
+func (s *HTTPWhitelistSource) Load(ctx context.Context) (Whitelist, []WhitelistIssue, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("unexpected status fetching whitelist from %s: %s", s.URL, resp.Status)
+	}
+	wl, issues, err := loadJSONWhitelist(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading whitelist from %s: %w", s.URL, err)
+	}
+	return wl, issues, nil
+}
+
+// PostgreSQLWhitelistSource loads the whitelist from a column of a table.
+type PostgreSQLWhitelistSource struct {
+	DB    *sql.DB
+	query string
+}
+
+var sqlIdentifierRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// NewPostgreSQLWhitelistSource checks the table and column names, as they
+// can't be passed as query parameters and end up in the query text.
+func NewPostgreSQLWhitelistSource(db *sql.DB, table, column string) (*PostgreSQLWhitelistSource, error) {
+	if !sqlIdentifierRe.MatchString(table) {
+		return nil, fmt.Errorf("invalid whitelist table name %q", table)
+	}
+	if !sqlIdentifierRe.MatchString(column) || strings.Contains(column, ".") {
+		return nil, fmt.Errorf("invalid whitelist column name %q", column)
+	}
+	return &PostgreSQLWhitelistSource{
+		DB:    db,
+		query: fmt.Sprintf("SELECT %s FROM %s", column, table),
+	}, nil
+}
+
+func (s *PostgreSQLWhitelistSource) Name() string {
+	return WHITELIST_SOURCE_POSTGRESQL
+}
+
+func (s *PostgreSQLWhitelistSource) Load(ctx context.Context) (Whitelist, []WhitelistIssue, error) {
+	rs, err := s.DB.QueryContext(ctx, s.query)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rs.Close()
+	var rows [][]interface{}
+	for rs.Next() {
+		var pk sql.NullString
+		if err := rs.Scan(&pk); err != nil {
+			return nil, nil, err
+		}
+		// Keep NULLs as empty rows, so that row numbers match the result set
+		if pk.Valid {
+			rows = append(rows, []interface{}{pk.String})
+		} else {
+			rows = append(rows, nil)
+		}
+	}
+	if err := rs.Err(); err != nil {
+		return nil, nil, err
+	}
+	wl, issues := processEntryRows(rows, 0, nil)
+	return wl, issues, nil
+}
+
+// Whitelist entry in JSON form, alternatively an entry
+// can be given by the public key string alone
+type whitelistEntryJSON struct {
+	PublicKey   string `json:"public_key"`
+	Label       string `json:"label,omitempty"`
+	NotBefore   string `json:"not_before,omitempty"`
+	NotAfter    string `json:"not_after,omitempty"`
+	HourlyLimit int    `json:"hourly_limit,omitempty"`
+	Network     string `json:"network,omitempty"`
+}
+
+var whitelistJSONColumns = map[string]int{
+	WHITELIST_COLUMN_LABEL:        1,
+	WHITELIST_COLUMN_NOT_BEFORE:   2,
+	WHITELIST_COLUMN_NOT_AFTER:    3,
+	WHITELIST_COLUMN_HOURLY_LIMIT: 4,
+	WHITELIST_COLUMN_NETWORK:      5,
+}
+
+// Loads a JSON array of public keys or entry objects,
+// row numbers of issues are positions in the array
+func loadJSONWhitelist(r io.Reader) (Whitelist, []WhitelistIssue, error) {
+	var items []json.RawMessage
+	if err := json.NewDecoder(io.LimitReader(r, MAX_WHITELIST_DOCUMENT_SIZE)).Decode(&items); err != nil {
+		return nil, nil, err
+	}
+	rows := make([][]interface{}, len(items))
+	for i, item := range items {
+		var e whitelistEntryJSON
+		if err := json.Unmarshal(item, &e.PublicKey); err != nil {
+			if err := json.Unmarshal(item, &e); err != nil {
+				return nil, nil, fmt.Errorf("item %d: %w", i+1, err)
+			}
+		}
+		limit := ""
+		if e.HourlyLimit != 0 {
+			limit = strconv.Itoa(e.HourlyLimit)
+		}
+		rows[i] = []interface{}{e.PublicKey, e.Label, e.NotBefore, e.NotAfter, limit, e.Network}
+	}
+	wl, issues := processEntryRows(rows, 0, whitelistJSONColumns)
+	return wl, issues, nil
+}
+
+// Reads CSV rows, the header row is told apart by processRows
+func readCSVWhitelist(r io.Reader) ([][]interface{}, error) {
+	reader := csv.NewReader(io.LimitReader(r, MAX_WHITELIST_DOCUMENT_SIZE))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	var rows [][]interface{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		row := make([]interface{}, len(record))
+		for i, v := range record {
+			row[i] = strings.TrimSpace(v)
+		}
+		rows = append(rows, row)
+	}
+}
+
+var ErrWhitelistShrink = errors.New("whitelist shrinks too much")
+
+// WhitelistReport is the outcome of the latest whitelist refresh.
+type WhitelistReport struct {
+	Source   string           `json:"source"`
+	LoadedAt time.Time        `json:"loaded_at"`
+	Entries  int              `json:"entries"`
+	Applied  bool             `json:"applied"`         // whether the loaded whitelist replaced the current one
+	Error    string           `json:"error,omitempty"` // why loading failed or the whitelist wasn't applied
+	Issues   []WhitelistIssue `json:"issues"`
+}
+
+// WhitelistRefresher keeps the whitelist up to date with its source,
+// reloading it every Interval and whenever the source reports a change.
+// A loaded whitelist having more than MaxShrinkPercent less entries than
+// the largest one applied since the last forced refresh is not applied,
+// unless MaxShrinkPercent is zero. Measuring against the largest rather than
+// the current whitelist keeps a series of small shrinks from adding up
+// unnoticed, a forced refresh accepts the current size as the new baseline.
+type WhitelistRefresher struct {
+	Source           WhitelistSource
+	Whitelist        *WhitelistMVar
+	Interval         time.Duration
+	MaxShrinkPercent int
+	Log              logging.StandardLogger
+	Metrics          *Metrics
+	Network          string // label of the metrics
+
+	mutex    sync.Mutex // refreshes are done one at a time
+	baseline int        // size of the largest whitelist applied since the last forced refresh
+	report   atomic.Pointer[WhitelistReport]
+	applied  atomic.Pointer[WhitelistReport]
+}
+
+// Refresh loads the whitelist from the source and replaces the current one.
+// On error the current whitelist is kept.
+func (r *WhitelistRefresher) Refresh(ctx context.Context) error {
+	return r.refresh(ctx, false)
+}
+
+// ForceRefresh is Refresh that doesn't check how much the whitelist shrinks.
+func (r *WhitelistRefresher) ForceRefresh(ctx context.Context) error {
+	return r.refresh(ctx, true)
+}
+
+func (r *WhitelistRefresher) refresh(ctx context.Context, force bool) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	wl, issues, err := r.Source.Load(ctx)
+	report := &WhitelistReport{
+		Source:   r.Source.Name(),
+		LoadedAt: time.Now(),
+		Entries:  len(wl),
+		Issues:   issues,
+	}
+	if report.Issues == nil {
+		report.Issues = []WhitelistIssue{}
+	}
+	if err == nil && !force {
+		err = r.checkShrink(wl)
+	}
+	for _, issue := range issues {
+		r.Log.Warnf("Whitelist row %d (%q) is invalid: %s", issue.Row, issue.Value, issue.Reason)
+	}
+	r.Metrics.RecordWhitelistRefresh(r.Network, len(wl), len(issues), err)
+	if err != nil {
+		report.Error = err.Error()
+		r.report.Store(report)
+		return err
+	}
+	r.Whitelist.Replace(&wl)
+	if force || len(wl) > r.baseline {
+		r.baseline = len(wl)
+	}
+	report.Applied = true
+	r.report.Store(report)
+	r.applied.Store(report)
+	r.Log.Infof("Delegation whitelist refreshed from %s, number of BPs: %v, invalid rows: %v", r.Source.Name(), len(wl), len(issues))
+	return nil
+}
+
+func (r *WhitelistRefresher) checkShrink(wl Whitelist) error {
+	if r.MaxShrinkPercent <= 0 || r.baseline == 0 {
+		return nil
+	}
+	removed := r.baseline - len(wl)
+	if removed*100 > r.MaxShrinkPercent*r.baseline {
+		return fmt.Errorf("%w: %d entries loaded, up to %d since the last forced refresh, more than %d%% less",
+			ErrWhitelistShrink, len(wl), r.baseline, r.MaxShrinkPercent)
+	}
+	return nil
+}
+
+// Report returns the outcome of the latest refresh, nil if there was none.
+func (r *WhitelistRefresher) Report() *WhitelistReport {
+	return r.report.Load()
+}
+
+// LastApplied returns the report of the refresh that loaded
+// the current whitelist, nil if there was none.
+func (r *WhitelistRefresher) LastApplied() *WhitelistReport {
+	return r.applied.Load()
+}
+
+// ReportHandler serves the report of the latest refresh as JSON.
+func (r *WhitelistRefresher) ReportHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		report := r.Report()
+		if report == nil {
+			http.Error(w, "Whitelist wasn't loaded yet", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(report)
+	})
+}
+
+// Run refreshes the whitelist until ctx is done.
+// Interval has to be positive.
+func (r *WhitelistRefresher) Run(ctx context.Context) {
+	var changes <-chan struct{}
+	if w, ok := r.Source.(SourceWatcher); ok {
+		changes = w.Changes(ctx)
+	}
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-changes:
+		}
+		if err := r.Refresh(ctx); err != nil {
+			r.Log.Errorf("Failed to refresh delegation whitelist, using previous one, error: %v", err)
+		}
+	}
+}
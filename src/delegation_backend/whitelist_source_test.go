@@ -0,0 +1,286 @@
+package delegation_backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+func expectWhitelist(t *testing.T, wl Whitelist, pks ...Pk) {
+	if len(wl) != len(pks) {
+		t.Fatalf("expected %d keys in whitelist, got %d", len(pks), len(wl))
+	}
+	for _, pk := range pks {
+		if _, has := wl[pk]; !has {
+			t.Fatalf("expected %s in whitelist", pk)
+		}
+	}
+}
+
+func writeJSONWhitelist(t *testing.T, path string, pks ...Pk) {
+	strs := make([]string, len(pks))
+	for i, pk := range pks {
+		strs[i] = pk.String()
+	}
+	bs, err := json.Marshal(strs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, bs, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileWhitelistSourceJSON(t *testing.T) {
+	pk1, pk2 := mkPk(), mkPk()
+	path := filepath.Join(t.TempDir(), "whitelist.json")
+	writeJSONWhitelist(t, path, pk1, pk2)
+	wl, _, err := (&FileWhitelistSource{Path: path}).Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectWhitelist(t, wl, pk1, pk2)
+}
+
+func TestFileWhitelistSourceCSV(t *testing.T) {
+	pk1, pk2 := mkPk(), mkPk()
+	content := "public_key,name\n" +
+		pk1.String() + ",first\n" +
+		"not a key,second\n" +
+		"\n" +
+		" " + pk2.String() + "\n"
+	path := filepath.Join(t.TempDir(), "whitelist.csv")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wl, _, err := (&FileWhitelistSource{Path: path}).Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectWhitelist(t, wl, pk1, pk2)
+}
+
+func TestFileWhitelistSourceMalformed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "whitelist.json")
+	if err := os.WriteFile(path, []byte(`{"keys": []}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := (&FileWhitelistSource{Path: path}).Load(context.Background()); err == nil {
+		t.Fatal("expected error loading malformed whitelist")
+	}
+}
+
+func TestFileWhitelistSourceHotReload(t *testing.T) {
+	pk1, pk2 := mkPk(), mkPk()
+	path := filepath.Join(t.TempDir(), "whitelist.json")
+	writeJSONWhitelist(t, path, pk1)
+	source := &FileWhitelistSource{Path: path, PollInterval: 10 * time.Millisecond, Log: logging.Logger("test")}
+	wlMvar := new(WhitelistMVar)
+	refresher := &WhitelistRefresher{
+		Source:    source,
+		Whitelist: wlMvar,
+		Interval:  time.Hour,
+		Log:       logging.Logger("test"),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := refresher.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expectWhitelist(t, *wlMvar.ReadWhitelist(), pk1)
+	go refresher.Run(ctx)
+
+	// Let the watcher take the initial state before modifying the file
+	time.Sleep(50 * time.Millisecond)
+	writeJSONWhitelist(t, path, pk1, pk2)
+	waitFor(t, "whitelist reload", func() bool {
+		return len(*wlMvar.ReadWhitelist()) == 2
+	})
+	expectWhitelist(t, *wlMvar.ReadWhitelist(), pk1, pk2)
+}
+
+func TestHTTPWhitelistSource(t *testing.T) {
+	pk := mkPk()
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(`["` + pk.String() + `", "garbage"]`))
+	}))
+	defer server.Close()
+	source := &HTTPWhitelistSource{URL: server.URL, Client: server.Client()}
+
+	wl, _, err := source.Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectWhitelist(t, wl, pk)
+
+	status = http.StatusInternalServerError
+	if _, _, err := source.Load(context.Background()); err == nil {
+		t.Fatal("expected error on non-200 response")
+	}
+}
+
+type failingWhitelistSource struct{}
+
+func (failingWhitelistSource) Name() string { return "failing" }
+func (failingWhitelistSource) Load(context.Context) (Whitelist, []WhitelistIssue, error) {
+	return nil, nil, errors.New("unavailable")
+}
+
+func TestWhitelistRefresherKeepsPrevious(t *testing.T) {
+	pk := mkPk()
+	wlMvar := new(WhitelistMVar)
+	wlMvar.Replace(&Whitelist{pk: {}})
+	refresher := &WhitelistRefresher{
+		Source:    failingWhitelistSource{},
+		Whitelist: wlMvar,
+		Log:       logging.Logger("test"),
+	}
+	if err := refresher.Refresh(context.Background()); err == nil {
+		t.Fatal("expected refresh to fail")
+	}
+	expectWhitelist(t, *wlMvar.ReadWhitelist(), pk)
+}
+
+func TestPostgreSQLWhitelistSourceIdentifiers(t *testing.T) {
+	testCases := []struct {
+		table, column string
+		valid         bool
+	}{
+		{"whitelist", "public_key", true},
+		{"delegation.whitelist", "pk", true},
+		{"whitelist; DROP TABLE submissions", "public_key", false},
+		{"whitelist", "public_key FROM other", false},
+		{"whitelist", "t.public_key", false},
+		{"", "public_key", false},
+	}
+	for _, tc := range testCases {
+		source, err := NewPostgreSQLWhitelistSource(nil, tc.table, tc.column)
+		if (err == nil) != tc.valid {
+			t.Errorf("table %q, column %q: expected valid=%v, got error %v", tc.table, tc.column, tc.valid, err)
+		}
+		if err == nil && !strings.HasSuffix(source.query, "FROM "+tc.table) {
+			t.Errorf("unexpected query %q", source.query)
+		}
+	}
+}
+
+func TestFileWhitelistSourceJSONEntries(t *testing.T) {
+	pk1, pk2 := mkPk(), mkPk()
+	content := `["` + pk1.String() + `", {"public_key": "` + pk2.String() + `", "label": "operator", "hourly_limit": 5, "network": "mainnet"}]`
+	path := filepath.Join(t.TempDir(), "whitelist.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wl, _, err := (&FileWhitelistSource{Path: path}).Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectWhitelist(t, wl, pk1, pk2)
+	if e := wl[pk2]; e.Label != "operator" || e.HourlyLimit != 5 || e.Network != "mainnet" {
+		t.Fatalf("unexpected entry metadata: %+v", e)
+	}
+}
+
+type staticWhitelistSource struct {
+	wl     Whitelist
+	issues []WhitelistIssue
+}
+
+func (s *staticWhitelistSource) Name() string { return "static" }
+func (s *staticWhitelistSource) Load(context.Context) (Whitelist, []WhitelistIssue, error) {
+	return s.wl, s.issues, nil
+}
+
+func TestWhitelistRefresherShrinkBaseline(t *testing.T) {
+	var pks []Pk
+	for i := 0; i < 8; i++ {
+		pks = append(pks, mkPk())
+	}
+	source := &staticWhitelistSource{}
+	load := func(n int) {
+		source.wl = make(Whitelist)
+		for _, pk := range pks[:n] {
+			source.wl[pk] = WhitelistEntry{}
+		}
+	}
+	refresher := &WhitelistRefresher{
+		Source:           source,
+		Whitelist:        new(WhitelistMVar),
+		MaxShrinkPercent: 25,
+		Log:              logging.Logger("test"),
+	}
+	load(8)
+	if err := refresher.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	load(6)
+	if err := refresher.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Small shrink of the current whitelist adds up with the previous one
+	load(5)
+	if err := refresher.Refresh(context.Background()); !errors.Is(err, ErrWhitelistShrink) {
+		t.Fatalf("expected shrink error, got %v", err)
+	}
+	// Until a forced refresh accepts the new size
+	if err := refresher.ForceRefresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	load(4)
+	if err := refresher.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	expectWhitelist(t, *refresher.Whitelist.ReadWhitelist(), pks[:4]...)
+}
+
+func TestWhitelistRefresherShrinkGuard(t *testing.T) {
+	pks := []Pk{mkPk(), mkPk(), mkPk(), mkPk()}
+	source := &staticWhitelistSource{wl: Whitelist{pks[0]: {}, pks[1]: {}, pks[2]: {}, pks[3]: {}}}
+	wlMvar := new(WhitelistMVar)
+	refresher := &WhitelistRefresher{
+		Source:           source,
+		Whitelist:        wlMvar,
+		MaxShrinkPercent: 25,
+		Log:              logging.Logger("test"),
+	}
+	if err := refresher.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Losing one of four entries is within the limit
+	source.wl = Whitelist{pks[0]: {}, pks[1]: {}, pks[2]: {}}
+	if err := refresher.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	expectWhitelist(t, *wlMvar.ReadWhitelist(), pks[:3]...)
+
+	// Losing two of three is not
+	source.wl = Whitelist{pks[0]: {}}
+	source.issues = []WhitelistIssue{{Row: 2, Value: "B62qtypo", Reason: "invalid public key"}}
+	if err := refresher.Refresh(context.Background()); !errors.Is(err, ErrWhitelistShrink) {
+		t.Fatalf("expected shrink error, got %v", err)
+	}
+	expectWhitelist(t, *wlMvar.ReadWhitelist(), pks[:3]...)
+
+	rec := httptest.NewRecorder()
+	refresher.ReportHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/admin/whitelist/report", nil))
+	var report WhitelistReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("failed decoding report %s: %v", rec.Body, err)
+	}
+	if report.Applied || report.Entries != 1 || report.Error == "" ||
+		len(report.Issues) != 1 || report.Issues[0].Row != 2 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+}
@@ -0,0 +1,197 @@
+package delegation_backend
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+type WriteMode string
+
+const (
+	// Every backend has to save the submission
+	WriteAll WriteMode = "all"
+	// At least one backend has to save the submission
+	WriteAny WriteMode = "any"
+	// At least Quorum backends have to save the submission
+	WriteQuorum WriteMode = "quorum"
+	// Primary backend has to save the submission, others are best-effort
+	WritePrimary WriteMode = "primary"
+)
+
+const DEFAULT_WRITE_POLICY = "any"
+
+// WritePolicy decides whether a submission is considered saved
+// given outcomes of saving it to each of the storage backends.
+type WritePolicy struct {
+	Mode    WriteMode
+	Quorum  int
+	Primary string // name of the primary backend, first configured backend if empty
+}
+
+// ParseWritePolicy parses a write policy from one of the forms:
+// "all", "any", "quorum:N", "primary" or "primary:<backend name>".
+func ParseWritePolicy(s string) (WritePolicy, error) {
+	mode, arg, hasArg := strings.Cut(strings.TrimSpace(s), ":")
+	switch WriteMode(mode) {
+	case WriteAll, WriteAny:
+		if hasArg {
+			return WritePolicy{}, fmt.Errorf("write policy %s takes no argument", mode)
+		}
+		return WritePolicy{Mode: WriteMode(mode)}, nil
+	case WriteQuorum:
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 {
+			return WritePolicy{}, fmt.Errorf("write policy quorum requires a positive number of backends, got %q", arg)
+		}
+		return WritePolicy{Mode: WriteQuorum, Quorum: n}, nil
+	case WritePrimary:
+		return WritePolicy{Mode: WritePrimary, Primary: arg}, nil
+	}
+	return WritePolicy{}, fmt.Errorf("unknown write policy %q", s)
+}
+
+func (p WritePolicy) String() string {
+	switch p.Mode {
+	case WriteQuorum:
+		return fmt.Sprintf("%s:%d", p.Mode, p.Quorum)
+	case WritePrimary:
+		if p.Primary != "" {
+			return string(p.Mode) + ":" + p.Primary
+		}
+	}
+	return string(p.Mode)
+}
+
+// SaveResult is an outcome of saving a submission to a single backend.
+type SaveResult struct {
+	Backend  string
+	Err      error
+	Duration time.Duration
+}
+
+// Satisfied checks whether results of saving a submission meet the policy.
+// Results are expected in the same order as backends are configured.
+func (p WritePolicy) Satisfied(results []SaveResult) bool {
+	succeeded := 0
+	for _, r := range results {
+		if r.Err == nil {
+			succeeded++
+		}
+	}
+	switch p.Mode {
+	case WriteAll:
+		return succeeded == len(results)
+	case WriteAny:
+		return succeeded > 0
+	case WriteQuorum:
+		return succeeded >= p.Quorum
+	case WritePrimary:
+		for i, r := range results {
+			if r.Backend == p.Primary || (p.Primary == "" && i == 0) {
+				return r.Err == nil
+			}
+		}
+	}
+	return false
+}
+
+// WritePolicyError is returned when a submission was not saved
+// to enough storage backends to satisfy the write policy.
+type WritePolicyError struct {
+	Policy  WritePolicy
+	Results []SaveResult
+}
+
+func (e *WritePolicyError) Error() string {
+	var failures []string
+	for _, r := range e.Results {
+		if r.Err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", r.Backend, r.Err))
+		}
+	}
+	return fmt.Sprintf("write policy %s not satisfied: %s", e.Policy, strings.Join(failures, "; "))
+}
+
+func (e *WritePolicyError) Unwrap() []error {
+	var errs []error
+	for _, r := range e.Results {
+		if r.Err != nil {
+			errs = append(errs, r.Err)
+		}
+	}
+	return errs
+}
+
+// MultiStorage saves submissions to several backends
+// and reports a failure only if the write policy is not met.
+type MultiStorage struct {
+	Backends StorageBackends
+	Policy   WritePolicy
+	Log      *logging.ZapEventLogger
+}
+
+func NewMultiStorage(backends StorageBackends, policy WritePolicy, log *logging.ZapEventLogger) (*MultiStorage, error) {
+	switch policy.Mode {
+	case WriteQuorum:
+		if policy.Quorum > len(backends) {
+			return nil, fmt.Errorf("write policy %s requires more backends than configured (%d)", policy, len(backends))
+		}
+	case WritePrimary:
+		if policy.Primary != "" && !backends.Has(policy.Primary) {
+			return nil, fmt.Errorf("primary storage backend %s is not configured", policy.Primary)
+		}
+	}
+	return &MultiStorage{Backends: backends, Policy: policy, Log: log}, nil
+}
+
+func (ms *MultiStorage) Name() string {
+	return ms.Backends.Name()
+}
+
+// Save saves objects to every backend and logs outcome
+// of all of them in a single line.
+func (ms *MultiStorage) Save(ctx context.Context, objs ObjectsToSave) error {
+	results := make([]SaveResult, len(ms.Backends))
+	for i, b := range ms.Backends {
+		start := time.Now()
+		err := b.Save(ctx, objs)
+		results[i] = SaveResult{Backend: b.Name(), Err: err, Duration: time.Since(start)}
+	}
+	satisfied := ms.Policy.Satisfied(results)
+
+	fields := []interface{}{"policy", ms.Policy.String(), "satisfied", satisfied}
+	for _, r := range results {
+		outcome := "ok"
+		if r.Err != nil {
+			outcome = r.Err.Error()
+		}
+		fields = append(fields, r.Backend, outcome, r.Backend+"_ms", r.Duration.Milliseconds())
+	}
+	if satisfied {
+		ms.Log.Infow("Submission saved", fields...)
+		return nil
+	}
+	ms.Log.Warnw("Submission not saved", fields...)
+	return &WritePolicyError{Policy: ms.Policy, Results: results}
+}
+
+// HealthCheck judges health of backends with the same policy as saves.
+func (ms *MultiStorage) HealthCheck(ctx context.Context) error {
+	results := make([]SaveResult, len(ms.Backends))
+	for i, b := range ms.Backends {
+		results[i] = SaveResult{Backend: b.Name(), Err: b.HealthCheck(ctx)}
+	}
+	if ms.Policy.Satisfied(results) {
+		return nil
+	}
+	return &WritePolicyError{Policy: ms.Policy, Results: results}
+}
+
+func (ms *MultiStorage) Close() error {
+	return ms.Backends.Close()
+}
@@ -0,0 +1,94 @@
+package delegation_backend
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+func TestParseWritePolicy(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected WritePolicy
+		err      bool
+	}{
+		{"all", WritePolicy{Mode: WriteAll}, false},
+		{"any", WritePolicy{Mode: WriteAny}, false},
+		{"quorum:2", WritePolicy{Mode: WriteQuorum, Quorum: 2}, false},
+		{"primary", WritePolicy{Mode: WritePrimary}, false},
+		{"primary:s3", WritePolicy{Mode: WritePrimary, Primary: "s3"}, false},
+		{"quorum", WritePolicy{}, true},
+		{"quorum:0", WritePolicy{}, true},
+		{"all:1", WritePolicy{}, true},
+		{"most", WritePolicy{}, true},
+	}
+	for _, tc := range testCases {
+		actual, err := ParseWritePolicy(tc.input)
+		if (err != nil) != tc.err || actual != tc.expected {
+			t.Errorf("ParseWritePolicy(%q) = %v, %v", tc.input, actual, err)
+		}
+	}
+}
+
+func TestWritePolicySatisfied(t *testing.T) {
+	errDown := errors.New("down")
+	results := []SaveResult{{Backend: "s3", Err: errDown}, {Backend: "keyspaces"}, {Backend: "filesystem"}}
+	testCases := []struct {
+		policy   WritePolicy
+		expected bool
+	}{
+		{WritePolicy{Mode: WriteAll}, false},
+		{WritePolicy{Mode: WriteAny}, true},
+		{WritePolicy{Mode: WriteQuorum, Quorum: 2}, true},
+		{WritePolicy{Mode: WriteQuorum, Quorum: 3}, false},
+		{WritePolicy{Mode: WritePrimary}, false},
+		{WritePolicy{Mode: WritePrimary, Primary: "keyspaces"}, true},
+	}
+	for _, tc := range testCases {
+		if actual := tc.policy.Satisfied(results); actual != tc.expected {
+			t.Errorf("policy %s: expected %v, got %v", tc.policy, tc.expected, actual)
+		}
+	}
+	if (WritePolicy{Mode: WriteAny}).Satisfied([]SaveResult{{Backend: "s3", Err: errDown}}) {
+		t.Error("policy any satisfied when every backend failed")
+	}
+}
+
+func TestMultiStorageSave(t *testing.T) {
+	log := logging.Logger("delegation backend test")
+	errDown := errors.New("down")
+	failing := &memoryStorage{name: "failing", objs: make(map[string][]byte), saveErr: errDown}
+	working := &memoryStorage{name: "working", objs: make(map[string][]byte)}
+	objs := objectsOf(map[string][]byte{"blocks/x.dat": []byte("x")})
+
+	ms, err := NewMultiStorage(StorageBackends{failing, working}, WritePolicy{Mode: WriteAny}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.Save(context.Background(), objs); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ms.Policy = WritePolicy{Mode: WriteAll}
+	err = ms.Save(context.Background(), objs)
+	var policyErr *WritePolicyError
+	if !errors.As(err, &policyErr) || !errors.Is(err, errDown) {
+		t.Fatalf("expected write policy error, got: %v", err)
+	}
+	if len(policyErr.Results) != 2 || policyErr.Results[1].Err != nil {
+		t.Fatalf("unexpected results: %v", policyErr.Results)
+	}
+}
+
+func TestNewMultiStorageValidatesPolicy(t *testing.T) {
+	log := logging.Logger("delegation backend test")
+	bs := StorageBackends{&memoryStorage{name: "a", objs: make(map[string][]byte)}}
+	if _, err := NewMultiStorage(bs, WritePolicy{Mode: WriteQuorum, Quorum: 2}, log); err == nil {
+		t.Error("quorum larger than number of backends accepted")
+	}
+	if _, err := NewMultiStorage(bs, WritePolicy{Mode: WritePrimary, Primary: "b"}, log); err == nil {
+		t.Error("unknown primary backend accepted")
+	}
+}
@@ -126,7 +126,7 @@ func waitUntilS3BucketHasBlocksAndSubmissions(config delegation_backend.AwsConfi
 				// Check the objects
 				for _, object := range objects.Contents {
 					key := *object.Key
-					if strings.HasPrefix(key, folderPrefix+"blocks/") && strings.HasSuffix(key, ".dat") {
+					if strings.HasPrefix(key, folderPrefix+"blocks/") && strings.Contains(key, ".dat") {
 						hasBlocks = true
 					}
 					if strings.HasPrefix(key, folderPrefix+"submissions/"+currentDate+"/") && strings.HasSuffix(key, ".json") {
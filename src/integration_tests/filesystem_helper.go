@@ -89,7 +89,7 @@ func waitUntilLocalStorageHasBlocksAndSubmissions(directory string) error {
 				blocksPath := filepath.Join(directory, "blocks")
 				if items, err := os.ReadDir(blocksPath); err == nil {
 					for _, item := range items {
-						if strings.HasSuffix(item.Name(), ".dat") {
+						if strings.Contains(item.Name(), ".dat") {
 							hasBlocks = true
 							break
 						}
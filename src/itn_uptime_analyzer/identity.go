@@ -1,6 +1,7 @@
 package itn_uptime_analyzer
 
 import (
+    "context"
     "crypto/md5"
     "encoding/hex"
     "encoding/json"
@@ -33,7 +34,7 @@ func IsIdentityInArray(id string, identities []Identity) bool {
 
 // Goes through each submission and adds an identity type to a map
 // Identity is constructed based on the payload that the BP sends which may hold pubkey, ip address and graphqlport
-func CreateIdentities(config AppConfig, ctx dg.AwsContext, log *logging.ZapEventLogger) []Identity {
+func CreateIdentities(c context.Context, config AppConfig, ctx dg.AwsContext, log *logging.ZapEventLogger) []Identity {
 
     day := config.Period.Start.Format("2006-01-02")
 
@@ -52,7 +53,7 @@ func CreateIdentities(config AppConfig, ctx dg.AwsContext, log *logging.ZapEvent
 
     paginator := s3.NewListObjectsV2Paginator(ctx.Client, input)
     for paginator.HasMorePages() {
-        page, err := paginator.NextPage(ctx.Context)
+        page, err := paginator.NextPage(c)
         if err != nil {
             log.Fatalf("Getting next page of paginator (BPU bucket): %v\n", err)
         }
@@ -67,7 +68,7 @@ func CreateIdentities(config AppConfig, ctx dg.AwsContext, log *logging.ZapEvent
 
                 var identity Identity
 
-                objHandle, err := ctx.Client.GetObject(ctx.Context, &s3.GetObjectInput{
+                objHandle, err := ctx.Client.GetObject(c, &s3.GetObjectInput{
                     Bucket: ctx.BucketName,
                     Key:    obj.Key,
                 })
@@ -1,6 +1,7 @@
 package itn_uptime_analyzer
 
 import (
+    "context"
     dg "block_producers_uptime/delegation_backend"
     "encoding/json"
     "io"
@@ -14,7 +15,7 @@ import (
 )
 
 // This function calculates the difference between the time elapsed today and the execution interval, decides if it need to check multiple buckets or not and calculates the uptime
-func (identity Identity) GetUptime(config AppConfig, ctx dg.AwsContext, log *logging.ZapEventLogger, syncPeriod int) {
+func (identity Identity) GetUptime(c context.Context, config AppConfig, ctx dg.AwsContext, log *logging.ZapEventLogger, syncPeriod int) {
 
     day := config.Period.Start.Format("2006-01-02")
     numberOfSubmissionsNeeded := (60 / syncPeriod) * int(config.Period.Interval.Hours())
@@ -40,7 +41,7 @@ func (identity Identity) GetUptime(config AppConfig, ctx dg.AwsContext, log *log
     uptimeToday := 0
 
     for paginatorToday.HasMorePages() {
-        page, err := paginatorToday.NextPage(ctx.Context)
+        page, err := paginatorToday.NextPage(c)
         if err != nil {
             log.Fatalf("Getting next page of paginatorToday (BPU bucket): %v\n", err)
         }
@@ -55,7 +56,7 @@ func (identity Identity) GetUptime(config AppConfig, ctx dg.AwsContext, log *log
             if regex.MatchString(*obj.Key) {
                 if (submissionTime.After(config.Period.Start)) && (submissionTime.Before(config.Period.End)) {
 
-                    objHandle, err := ctx.Client.GetObject(ctx.Context, &s3.GetObjectInput{
+                    objHandle, err := ctx.Client.GetObject(c, &s3.GetObjectInput{
                         Bucket: ctx.BucketName,
                         Key:    obj.Key,
                     })